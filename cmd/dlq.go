@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"payment-gateway/db"
+)
+
+const dlqUsage = `Usage: main dlq <command> [flags]
+
+Commands:
+  list    list dead-letter events
+  show    print one dead-letter event with its payload
+  replay  write dead-letter events back to the outbox so the relay publishes them again
+
+Selectors (list and replay):
+  --since, --until  RFC 3339 time or date (2024-01-02) the event was dead-lettered
+  --txn             transaction ID
+  --id              comma separated dead-letter event IDs (replay only)
+`
+
+// runDLQ runs the dlq subcommand and returns the exit code.
+func runDLQ(repo db.DeadLetterRepository, args []string, out io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, dlqUsage)
+		return 2
+	}
+
+	var err error
+	switch args[0] {
+	case "list":
+		err = dlqList(repo, args[1:], out)
+	case "show":
+		err = dlqShow(repo, args[1:], out)
+	case "replay":
+		err = dlqReplay(repo, args[1:], out)
+	default:
+		fmt.Fprint(os.Stderr, dlqUsage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dlq %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func dlqList(repo db.DeadLetterRepository, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("dlq list", flag.ContinueOnError)
+	selector := addSelectorFlags(flags)
+	all := flags.Bool("all", false, "include events that were already replayed")
+	limit := flags.Int("limit", 100, "maximum number of events to list")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	filter, err := selector.filter()
+	if err != nil {
+		return err
+	}
+	filter.IncludeReplayed = *all
+	filter.Limit = *limit
+
+	events, err := repo.List(context.Background(), filter)
+	if err != nil {
+		return err
+	}
+	return printDeadLetterEvents(out, events)
+}
+
+func printDeadLetterEvents(out io.Writer, events []*db.DeadLetterEvent) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTXN\tEVENT\tTOPIC\tATTEMPTS\tDEAD-LETTERED\tREPLAYED\tLAST ERROR")
+	for _, event := range events {
+		replayed := "-"
+		if event.ReplayedAt != nil {
+			replayed = event.ReplayedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			event.ID,
+			event.AggregateID,
+			event.EventType,
+			event.Topic,
+			event.Attempts,
+			event.DeadLetteredAt.Format(time.RFC3339),
+			replayed,
+			event.LastError,
+		)
+	}
+	return w.Flush()
+}
+
+func dlqShow(repo db.DeadLetterRepository, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("expected exactly one dead-letter event ID")
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid ID %q", args[0])
+	}
+
+	event, err := repo.Get(context.Background(), id)
+	if err != nil {
+		return err
+	}
+	if event == nil {
+		return fmt.Errorf("dead-letter event %d not found", id)
+	}
+
+	fmt.Fprintf(out, "ID:              %d\n", event.ID)
+	fmt.Fprintf(out, "Outbox event:    %d\n", event.OutboxEventID)
+	fmt.Fprintf(out, "Aggregate:       %s %s\n", event.AggregateType, event.AggregateID)
+	fmt.Fprintf(out, "Event type:      %s\n", event.EventType)
+	fmt.Fprintf(out, "Topic:           %s\n", event.Topic)
+	fmt.Fprintf(out, "Data format:     %s\n", event.DataFormat)
+	fmt.Fprintf(out, "Attempts:        %d\n", event.Attempts)
+	fmt.Fprintf(out, "Last error:      %s\n", event.LastError)
+	fmt.Fprintf(out, "Created at:      %s\n", event.CreatedAt.Format(time.RFC3339))
+	fmt.Fprintf(out, "Dead-lettered:   %s\n", event.DeadLetteredAt.Format(time.RFC3339))
+	if event.ReplayedAt != nil {
+		fmt.Fprintf(out, "Replayed at:     %s\n", event.ReplayedAt.Format(time.RFC3339))
+	}
+	fmt.Fprintf(out, "Payload:\n%s\n", event.Payload)
+	return nil
+}
+
+func dlqReplay(repo db.DeadLetterRepository, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("dlq replay", flag.ContinueOnError)
+	selector := addSelectorFlags(flags)
+	ids := flags.String("id", "", "comma separated dead-letter event IDs")
+	dryRun := flags.Bool("dry-run", false, "only list the events that would be replayed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	filter, err := selector.filter()
+	if err != nil {
+		return err
+	}
+	if filter.IDs, err = parseIDs(*ids); err != nil {
+		return err
+	}
+	// Replaying everything by accident would flood the consumers with duplicates.
+	if len(filter.IDs) == 0 && filter.Since.IsZero() && filter.Until.IsZero() && filter.AggregateID == "" {
+		return errors.New("select the events to replay with --id, --since, --until or --txn")
+	}
+
+	if *dryRun {
+		events, err := repo.List(context.Background(), filter)
+		if err != nil {
+			return err
+		}
+		return printDeadLetterEvents(out, events)
+	}
+
+	events, err := repo.Replay(context.Background(), filter)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		fmt.Fprintf(out, "replayed %d (%s of transaction %s)\n", event.ID, event.EventType, event.AggregateID)
+	}
+	fmt.Fprintf(out, "%d event(s) written back to the outbox\n", len(events))
+	return nil
+}
+
+type selectorFlags struct {
+	since string
+	until string
+	txn   string
+}
+
+func addSelectorFlags(flags *flag.FlagSet) *selectorFlags {
+	s := &selectorFlags{}
+	flags.StringVar(&s.since, "since", "", "only events dead-lettered at or after this time")
+	flags.StringVar(&s.until, "until", "", "only events dead-lettered before this time")
+	flags.StringVar(&s.txn, "txn", "", "only events of this transaction ID")
+	return s
+}
+
+func (s *selectorFlags) filter() (db.DeadLetterFilter, error) {
+	var filter db.DeadLetterFilter
+	var err error
+
+	if filter.Since, err = parseTime(s.since); err != nil {
+		return filter, fmt.Errorf("invalid --since: %v", err)
+	}
+	if filter.Until, err = parseTime(s.until); err != nil {
+		return filter, fmt.Errorf("invalid --until: %v", err)
+	}
+	if s.txn != "" {
+		if _, err := strconv.Atoi(s.txn); err != nil {
+			return filter, fmt.Errorf("invalid --txn %q", s.txn)
+		}
+		filter.AggregateID = s.txn
+	}
+	return filter, nil
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+func parseIDs(value string) ([]int64, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var ids []int64
+	for _, part := range strings.Split(value, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --id %q", part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
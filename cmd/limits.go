@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"payment-gateway/db"
+	"payment-gateway/internal/limits"
+	"payment-gateway/internal/models"
+)
+
+const limitsUsage = `Usage: main limits <command> [flags]
+
+Commands:
+  list     list the limit rules
+  set      create a rule, or replace rule --id
+  enable   enable rule --id
+  disable  disable rule --id
+
+Rule flags (set):
+  --kind          min_amount, max_amount, daily_amount or weekly_amount
+  --type          transaction type the rule applies to, deposit or withdraw
+  --currency      ISO 4217 currency of the amount, the rule only applies to transactions in it
+  --amount        limit in minor units of the currency
+  --user, --country, --gateway, --kyc-tier
+                  only apply the rule to this user, country, gateway or KYC tier
+  --action        reject (default) refuses the transaction, review parks it for an operator
+  --description   why the rule exists
+
+Changes apply right away on all instances, the cached rules are dropped.
+`
+
+// runLimits runs the limits subcommand and returns the exit code.
+func runLimits(repo db.LimitRepository, cache limits.RuleCache, args []string, out io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, limitsUsage)
+		return 2
+	}
+
+	var err error
+	switch args[0] {
+	case "list":
+		err = limitsList(repo, args[1:], out)
+	case "set":
+		err = limitsSet(repo, args[1:], out)
+	case "enable", "disable":
+		err = limitsSetEnabled(repo, args[0] == "enable", args[1:], out)
+	default:
+		fmt.Fprint(os.Stderr, limitsUsage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "limits %s: %v\n", args[0], err)
+		return 1
+	}
+
+	if args[0] != "list" {
+		if err := cache.Invalidate(context.Background()); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: could not drop the cached rules, the change applies within %s: %v\n", limits.DefaultCacheTTL, err)
+		}
+	}
+	return 0
+}
+
+func limitsList(repo db.LimitRepository, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("limits list", flag.ContinueOnError)
+	all := flags.Bool("all", false, "include disabled rules")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	rules, err := repo.ListRules(context.Background(), *all)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tKIND\tTYPE\tAMOUNT\tUSER\tCOUNTRY\tGATEWAY\tKYC TIER\tACTION\tENABLED\tDESCRIPTION")
+	for _, rule := range rules {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%t\t%s\n",
+			rule.ID,
+			rule.Kind,
+			rule.TransactionType,
+			models.Money{Minor: rule.Amount, Currency: rule.Currency},
+			scope(rule.UserID),
+			scope(rule.CountryID),
+			scope(rule.GatewayID),
+			tierScope(rule.KYCTier),
+			rule.Action,
+			rule.Enabled,
+			rule.Description,
+		)
+	}
+	return w.Flush()
+}
+
+// scope prints a scope column, 0 applies to everyone.
+func scope(value int) string {
+	if value == 0 {
+		return "*"
+	}
+	return fmt.Sprint(value)
+}
+
+// tierScope prints the KYC tier column, where 0 is the unverified users and nil applies to every tier.
+func tierScope(tier *int) string {
+	if tier == nil {
+		return "*"
+	}
+	return fmt.Sprint(*tier)
+}
+
+func limitsSet(repo db.LimitRepository, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("limits set", flag.ContinueOnError)
+	rule := limits.Rule{Enabled: true}
+	flags.IntVar(&rule.ID, "id", 0, "rule to replace")
+	flags.StringVar(&rule.Kind, "kind", "", "kind of the limit")
+	flags.StringVar(&rule.TransactionType, "type", "", "transaction type")
+	flags.StringVar(&rule.Currency, "currency", "", "currency of the amount")
+	flags.Int64Var(&rule.Amount, "amount", -1, "limit in minor units")
+	flags.IntVar(&rule.UserID, "user", 0, "user ID")
+	flags.IntVar(&rule.CountryID, "country", 0, "country ID")
+	flags.IntVar(&rule.GatewayID, "gateway", 0, "gateway ID")
+	kycTier := flags.Int("kyc-tier", -1, "KYC tier, 0 is unverified users (default every tier)")
+	flags.StringVar(&rule.Action, "action", limits.ActionReject, "reject or review")
+	flags.StringVar(&rule.Description, "description", "", "why the rule exists")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if rule.TransactionType != db.TypeDeposit && rule.TransactionType != db.TypeWithdraw {
+		return fmt.Errorf("--type has to be %s or %s", db.TypeDeposit, db.TypeWithdraw)
+	}
+	if rule.Amount < 0 {
+		return errors.New("--amount is required")
+	}
+	if *kycTier >= 0 {
+		rule.KYCTier = kycTier
+	}
+	if err := repo.SaveRule(context.Background(), &rule); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "saved rule %d: %s %s of %s\n", rule.ID, rule.TransactionType, rule.Kind, models.Money{Minor: rule.Amount, Currency: rule.Currency})
+	return nil
+}
+
+func limitsSetEnabled(repo db.LimitRepository, enabled bool, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("limits enable", flag.ContinueOnError)
+	id := flags.Int("id", 0, "rule ID")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *id == 0 {
+		return errors.New("--id is required")
+	}
+
+	if err := repo.SetRuleEnabled(context.Background(), *id, enabled); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "rule %d enabled: %t\n", *id, enabled)
+	return nil
+}
@@ -1,12 +1,25 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"payment-gateway/db" // swagger docs
 	"payment-gateway/internal/api"
+	"payment-gateway/internal/cache"
+	"payment-gateway/internal/compliance"
 	"payment-gateway/internal/kafka"
+	"payment-gateway/internal/ledger"
+	"payment-gateway/internal/middleware"
+	"payment-gateway/internal/outbox"
+	"payment-gateway/internal/paypal"
+	"payment-gateway/internal/risk"
+	"payment-gateway/internal/routing"
+	"payment-gateway/internal/sanctions"
+	"payment-gateway/internal/services"
+	"syscall"
 
 	"github.com/joho/godotenv"
 )
@@ -18,29 +31,125 @@ func init() {
 	}
 }
 
-func main() {
-
-	// Initialize the database connection
+func databaseURL() string {
 	dbUser := os.Getenv("DB_USER")
 	dbPassword := os.Getenv("DB_PASSWORD")
 	dbName := os.Getenv("DB_NAME")
 	dbHost := os.Getenv("DB_HOST")
 	dbPort := os.Getenv("DB_PORT")
 
-	dbURL := "postgres://" + dbUser + ":" + dbPassword + "@" + dbHost + ":" + dbPort + "/" + dbName + "?sslmode=disable"
+	return "postgres://" + dbUser + ":" + dbPassword + "@" + dbHost + ":" + dbPort + "/" + dbName + "?sslmode=disable"
+}
+
+func main() {
+
+	// Initialize the database connection
+	db.InitializeDB(databaseURL())
+
+	// Operational subcommands only need the database.
+	if len(os.Args) > 1 && os.Args[1] == "dlq" {
+		os.Exit(runDLQ(db.NewDeadLetterRepository(db.Db), os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "limits" {
+		// Without redis the change still applies, once the cached rules expire.
+		if err := cache.InitRedis(); err != nil {
+			log.Printf("Could not connect to redis: %v", err)
+		}
+		os.Exit(runLimits(db.NewLimitRepository(db.Db), cache.NewLimitRuleCache(), os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sanctions" {
+		os.Exit(runSanctions(db.NewSanctionsRepository(db.Db), os.Args[2:], os.Stdout))
+	}
 
-	db.InitializeDB(dbURL)
 	kafka.Init()
 	defer kafka.Close()
 
+	// Redis holds the idempotency keys, so we can't safely take payments without it.
+	if err := cache.InitRedis(); err != nil {
+		log.Fatalf("Could not connect to redis: %v", err)
+	}
+	defer cache.Close()
+
+	if err := middleware.InitUserAuth(middleware.LoadJWTConfig()); err != nil {
+		log.Fatalf("Could not set up user authentication: %v", err)
+	}
+	middleware.InitGatewayAuth(db.NewGatewayRepository(db.Db))
+	// PayPal webhooks are verified by PayPal, with the credentials of our app.
+	middleware.RegisterCallbackVerifier(middleware.SchemePaypal, middleware.NewPaypalVerifier(paypal.NewClient(paypal.LoadConfig())))
+
+	// SIGINT and SIGTERM stop the background workers and let the requests in flight finish.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Users are screened against the sanctions lists kept in the database, refreshed lists are picked up in the background.
+	sanctionsRepo := db.NewSanctionsRepository(db.Db)
+	screener := sanctions.NewScreener(sanctionsRepo, sanctionsRepo)
+	if err := screener.Load(ctx); err != nil {
+		log.Fatalf("Could not load sanctions lists: %v", err)
+	}
+	go screener.Run(ctx)
+
+	// Deposits and withdrawals are refused until the compliance rules are loaded.
+	complianceRules, err := compliance.LoadConfig(os.Getenv("COMPLIANCE_RULES_FILE"))
+	if err != nil {
+		log.Fatalf("Could not load compliance rules: %v", err)
+	}
+	if err := services.InitCompliance(complianceRules, screener); err != nil {
+		log.Fatalf("Could not set up compliance rules: %v", err)
+	}
+
+	// Transactions are scored for fraud risk before they go to the gateway, with the defaults when no file is given.
+	riskConfig, err := risk.LoadConfig(os.Getenv("RISK_CONFIG_FILE"))
+	if err != nil {
+		log.Fatalf("Could not load risk scoring config: %v", err)
+	}
+	if err := services.InitRisk(riskConfig); err != nil {
+		log.Fatalf("Could not set up risk scoring: %v", err)
+	}
+
+	// Every gateway in the database needs a registered adapter, each one reads its own config.
+	if err := services.InitGateways(ctx, db.NewGatewayRepository(db.Db)); err != nil {
+		log.Fatalf("Could not set up gateways: %v", err)
+	}
+
+	// Transactions only go to another gateway than the one asked for when the merchant's fallback policy says so.
+	routingConfig, err := routing.LoadConfig(os.Getenv("ROUTING_CONFIG_FILE"))
+	if err != nil {
+		log.Fatalf("Could not load routing config: %v", err)
+	}
+	if err := services.InitRouting(ctx, routingConfig, db.NewGatewayRepository(db.Db)); err != nil {
+		log.Fatalf("Could not set up routing: %v", err)
+	}
+
+	// Publish the transaction events written to the outbox table.
+	go outbox.NewRelay(db.NewOutboxRepository(db.Db)).Run(ctx)
+	// Give back the holds of withdrawals that never settled.
+	go ledger.NewHoldSweeper(db.NewLedgerStore(db.Db)).Run(ctx)
+
 	// Set up the HTTP server and routes
 	router := api.SetupRouter()
 
+	server := &http.Server{Addr: ":8080", Handler: router}
+	// ListenAndServe returns as soon as the shutdown starts, main waits until it is done.
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		log.Println("Shutting down server...")
+		// A payment in flight can take up to a gateway call, saving the result is bounded on its own.
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), services.GatewayTimeout+services.StoreTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Could not shut down server: %v", err)
+		}
+	}()
+
 	// Start the server on port 8080
 	log.Println("Starting server on port 8080...")
 
-	if err := http.ListenAndServe(":8080", router); err != nil {
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Could not start server: %s\n", err)
 	}
+	<-shutdown
 
 }
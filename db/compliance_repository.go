@@ -0,0 +1,54 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"payment-gateway/internal/compliance"
+)
+
+// ComplianceRepository is what the compliance rules read from the database.
+type ComplianceRepository interface {
+	compliance.ActivityStore
+}
+
+type SQLComplianceRepository struct {
+	db *sql.DB
+}
+
+func NewComplianceRepository(db *sql.DB) ComplianceRepository {
+	return &SQLComplianceRepository{db: db}
+}
+
+func (r *SQLComplianceRepository) CountTransactions(ctx context.Context, userID int, transactionType string, since time.Time) (int, error) {
+	query := `SELECT COUNT(*) FROM transactions
+			  WHERE user_id = $1 AND ($2 = '' OR type = $2) AND created_at >= $3`
+
+	var count int
+	if err := r.db.QueryRowContext(ctx, query, userID, transactionType, since).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count transactions: %v", err)
+	}
+	return count, nil
+}
+
+// InsertComplianceDecision stores the compliance decision a transaction was created after.
+func InsertComplianceDecision(ctx context.Context, q DBTX, decision *compliance.Decision) error {
+	query := `INSERT INTO compliance_decisions (transaction_id, outcome, results, created_at)
+			  VALUES ($1, $2, $3, $4) RETURNING id`
+
+	results, err := json.Marshal(decision.Results)
+	if err != nil {
+		return fmt.Errorf("failed to encode compliance results: %v", err)
+	}
+	if decision.CreatedAt.IsZero() {
+		decision.CreatedAt = time.Now()
+	}
+	err = q.QueryRowContext(ctx, query, decision.TransactionID, decision.Outcome, results, decision.CreatedAt).Scan(&decision.ID)
+	if err != nil {
+		return fmt.Errorf("failed to insert compliance decision: %v", err)
+	}
+	return nil
+}
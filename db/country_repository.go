@@ -0,0 +1,45 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"payment-gateway/internal/models"
+)
+
+type CountryRepository interface {
+	// GetCountry returns the country with the given id, or nil if it doesn't exist.
+	GetCountry(ctx context.Context, countryID int) (*Country, error)
+}
+
+type countryRepository struct {
+	db *sql.DB
+}
+
+func NewCountryRepository(db *sql.DB) CountryRepository {
+	return &countryRepository{db: db}
+}
+
+func (r *countryRepository) GetCountry(ctx context.Context, countryID int) (*Country, error) {
+	query := `SELECT id, name, code, currency, created_at, updated_at FROM countries WHERE id = $1`
+
+	var country Country
+	err := r.db.QueryRowContext(ctx, query, countryID).Scan(
+		&country.ID,
+		&country.Name,
+		&country.Code,
+		&country.Currency,
+		&country.CreatedAt,
+		&country.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, models.NewServiceError(
+			models.ErrorCodeUnknown,
+			"Failed to fetch country",
+		)
+	}
+
+	return &country, nil
+}
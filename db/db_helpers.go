@@ -1,10 +1,13 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
-	"payment-gateway/internal/utils"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/retry"
+	"strings"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -14,16 +17,28 @@ var Db *sql.DB
 
 const TypeDeposit = "deposit"
 const TypeWithdraw = "withdraw"
+const TypeRefund = "refund"
 
+const StatusInitiated = "initiated"
+
+// StatusReview is a transaction parked by the compliance checks or a limit until an operator reviews it.
+const StatusReview = "review"
 const StatusPending = "pending"
+const StatusAuthorized = "authorized"
 const StatusCompleted = "completed"
 const StatusFailed = "failed"
+const StatusRefunded = "refunded"
+const StatusReversed = "reversed"
 
 type User struct {
-	ID        int
-	Username  string
-	Email     string
+	ID       int
+	Username string
+	Email    string
+	// FullName is the legal name of the user, screened against the sanctions lists.
+	FullName  string
 	CountryID int
+	// KYCTier is how far the user got through verification, 0 is unverified.
+	KYCTier   int
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
@@ -32,14 +47,22 @@ type Gateway struct {
 	ID                  int
 	Name                string
 	DataFormatSupported string
-	CreatedAt           time.Time
-	UpdatedAt           time.Time
+	// A disabled gateway takes no new transactions.
+	Enabled bool
+	// Hex sha256 of the api key the gateway sends with its callbacks, only used by the hmac-sha256 scheme.
+	APIKeyHash string
+	// Secret and scheme used to verify the callbacks sent by this gateway.
+	SigningSecret   string
+	SignatureScheme string
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
 }
 
 type Country struct {
 	ID        int
 	Name      string
 	Code      string
+	Currency  string
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
@@ -47,27 +70,42 @@ type Country struct {
 type Transaction struct {
 	ID           int
 	GatewayTxnId string
-	Amount       float64
+	Amount       models.Money
 	Type         string
 	Status       string
 	UserID       int
 	GatewayID    int
 	CountryID    int
-	CreatedAt    time.Time
+	// ParentID is the transaction a refund belongs to, 0 for other types.
+	ParentID int
+	// RequestedGatewayID is the gateway the user asked for when a fallback policy sent the transaction
+	// to GatewayID instead, 0 otherwise. FallbackReason says why.
+	RequestedGatewayID int
+	FallbackReason     string
+	CreatedAt          time.Time
+}
+
+// DBTX is implemented by both *sql.DB and *sql.Tx, so the helpers can run inside a transaction or not.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
 }
 
 // InitializeDB initializes the database connection
 func InitializeDB(dataSourceName string) {
 	var err error
 
-	err = utils.RetryOperation(func() error {
+	// The database may still be starting up next to us.
+	policy := retry.Policy{MaxAttempts: 5, BaseDelay: time.Second, MaxDelay: 8 * time.Second}
+	err = retry.Do(context.Background(), policy, func(ctx context.Context) error {
 		Db, err = sql.Open("postgres", dataSourceName)
 		if err != nil {
 			return err
 		}
 
-		return Db.Ping()
-	}, 5)
+		return Db.PingContext(ctx)
+	})
 
 	if err != nil {
 		log.Fatalf("Could not connect to the database: %v", err)
@@ -77,10 +115,10 @@ func InitializeDB(dataSourceName string) {
 }
 
 func CreateUser(db *sql.DB, user User) error {
-	query := `INSERT INTO users (username, email, country_id, created_at, updated_at) 
-			  VALUES ($1, $2, $3, $4, $5) RETURNING id`
+	query := `INSERT INTO users (username, email, full_name, country_id, created_at, updated_at) 
+			  VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6) RETURNING id`
 
-	err := db.QueryRow(query, user.Username, user.Email, user.CountryID, time.Now(), time.Now()).Scan(&user.ID)
+	err := db.QueryRow(query, user.Username, user.Email, user.FullName, user.CountryID, time.Now(), time.Now()).Scan(&user.ID)
 	if err != nil {
 		return fmt.Errorf("failed to insert user: %v", err)
 	}
@@ -88,7 +126,7 @@ func CreateUser(db *sql.DB, user User) error {
 }
 
 func GetUsers(db *sql.DB) ([]User, error) {
-	rows, err := db.Query(`SELECT id, username, email, country_id, created_at, updated_at FROM users`)
+	rows, err := db.Query(`SELECT id, username, email, COALESCE(full_name, ''), country_id, kyc_tier, created_at, updated_at FROM users`)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch users: %v", err)
 	}
@@ -97,7 +135,7 @@ func GetUsers(db *sql.DB) ([]User, error) {
 	var users []User
 	for rows.Next() {
 		var user User
-		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.CountryID, &user.CreatedAt, &user.UpdatedAt); err != nil {
+		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.FullName, &user.CountryID, &user.KYCTier, &user.CreatedAt, &user.UpdatedAt); err != nil {
 			return nil, fmt.Errorf("failed to scan user: %v", err)
 		}
 		users = append(users, user)
@@ -141,10 +179,10 @@ func GetGateways(db *sql.DB) ([]Gateway, error) {
 }
 
 func CreateCountry(db *sql.DB, country Country) error {
-	query := `INSERT INTO countries (name, code, created_at, updated_at) 
-			  VALUES ($1, $2, $3, $4) RETURNING id`
+	query := `INSERT INTO countries (name, code, currency, created_at, updated_at) 
+			  VALUES ($1, $2, $3, $4, $5) RETURNING id`
 
-	err := db.QueryRow(query, country.Name, country.Code, time.Now(), time.Now()).Scan(&country.ID)
+	err := db.QueryRow(query, country.Name, country.Code, country.Currency, time.Now(), time.Now()).Scan(&country.ID)
 	if err != nil {
 		return fmt.Errorf("failed to insert country: %v", err)
 	}
@@ -152,7 +190,7 @@ func CreateCountry(db *sql.DB, country Country) error {
 }
 
 func GetCountries(db *sql.DB) ([]Country, error) {
-	rows, err := db.Query(`SELECT id, name, code, created_at, updated_at FROM countries`)
+	rows, err := db.Query(`SELECT id, name, code, currency, created_at, updated_at FROM countries`)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch countries: %v", err)
 	}
@@ -161,7 +199,7 @@ func GetCountries(db *sql.DB) ([]Country, error) {
 	var countries []Country
 	for rows.Next() {
 		var country Country
-		if err := rows.Scan(&country.ID, &country.Name, &country.Code, &country.CreatedAt, &country.UpdatedAt); err != nil {
+		if err := rows.Scan(&country.ID, &country.Name, &country.Code, &country.Currency, &country.CreatedAt, &country.UpdatedAt); err != nil {
 			return nil, fmt.Errorf("failed to scan country: %v", err)
 		}
 		countries = append(countries, country)
@@ -172,12 +210,14 @@ func GetCountries(db *sql.DB) ([]Country, error) {
 	return countries, nil
 }
 
-func CreateTransaction(db *sql.DB, transaction *Transaction) (*Transaction, error) {
-	query := `INSERT INTO transactions (amount, type, status, gateway_id, country_id, user_id, created_at, gateway_txn_id) 
-			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
+func CreateTransaction(ctx context.Context, db DBTX, transaction *Transaction) (*Transaction, error) {
+	query := `INSERT INTO transactions (amount, currency, type, status, gateway_id, country_id, user_id, created_at, gateway_txn_id, parent_id,
+			  requested_gateway_id, fallback_reason) 
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, 0), NULLIF($11, 0), NULLIF($12, '')) RETURNING id`
 
-	err := db.QueryRow(query,
-		transaction.Amount,
+	err := db.QueryRowContext(ctx, query,
+		transaction.Amount.Minor,
+		transaction.Amount.Currency,
 		transaction.Type,
 		transaction.Status,
 		transaction.GatewayID,
@@ -185,6 +225,9 @@ func CreateTransaction(db *sql.DB, transaction *Transaction) (*Transaction, erro
 		transaction.UserID,
 		time.Now(),
 		transaction.GatewayTxnId,
+		transaction.ParentID,
+		transaction.RequestedGatewayID,
+		transaction.FallbackReason,
 	).Scan(&transaction.ID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to insert transaction: %v", err)
@@ -192,21 +235,39 @@ func CreateTransaction(db *sql.DB, transaction *Transaction) (*Transaction, erro
 	return transaction, nil
 }
 
-func GetTransactionByGatewayTxnId(db *sql.DB, trxId string) (*Transaction, error) {
-	query := `SELECT id, gateway_txn_id, amount, type, status, user_id, gateway_id, country_id, created_at 
-			  FROM transactions WHERE gateway_txn_id = $1`
+func GetTransactionByGatewayTxnId(ctx context.Context, db DBTX, gatewayID int, trxId string) (*Transaction, error) {
+	query := `SELECT ` + transactionColumns + ` FROM transactions WHERE gateway_id = $1 AND gateway_txn_id = $2`
+
+	return scanTransaction(db.QueryRowContext(ctx, query, gatewayID, trxId))
+}
+
+// GetTransactionByID returns the transaction, or nil when it doesn't exist. With forUpdate the row
+// stays locked until the surrounding database transaction ends.
+func GetTransactionByID(ctx context.Context, db DBTX, id int, forUpdate bool) (*Transaction, error) {
+	query := `SELECT ` + transactionColumns + ` FROM transactions WHERE id = $1`
+	if forUpdate {
+		query += ` FOR UPDATE`
+	}
+
+	return scanTransaction(db.QueryRowContext(ctx, query, id))
+}
 
+func scanTransaction(row *sql.Row) (*Transaction, error) {
 	var transaction Transaction
-	err := db.QueryRow(query, trxId).Scan(
+	err := row.Scan(
 		&transaction.ID,
 		&transaction.GatewayTxnId,
-		&transaction.Amount,
+		&transaction.Amount.Minor,
+		&transaction.Amount.Currency,
 		&transaction.Type,
 		&transaction.Status,
 		&transaction.UserID,
 		&transaction.GatewayID,
 		&transaction.CountryID,
+		&transaction.ParentID,
 		&transaction.CreatedAt,
+		&transaction.RequestedGatewayID,
+		&transaction.FallbackReason,
 	)
 
 	if err == sql.ErrNoRows {
@@ -219,26 +280,32 @@ func GetTransactionByGatewayTxnId(db *sql.DB, trxId string) (*Transaction, error
 	return &transaction, nil
 }
 
-func UpdateTransaction(db *sql.DB, transaction Transaction) error {
+// UpdateTransaction saves the transaction if it is still in status from, and returns ErrStaleTransaction
+// otherwise. Two changes made from the same status, e.g. a callback the gateway delivered twice at
+// once, can't both be saved.
+func UpdateTransaction(ctx context.Context, db DBTX, transaction Transaction, from string) error {
 	query := `UPDATE transactions 
 			  SET status = $1, 
 				  amount = $2,
-				  type = $3,
-				  gateway_id = $4,
-				  country_id = $5,
-				  user_id = $6,
-				  gateway_txn_id = $7
-			  WHERE id = $8`
-
-	result, err := db.Exec(query,
+				  currency = $3,
+				  type = $4,
+				  gateway_id = $5,
+				  country_id = $6,
+				  user_id = $7,
+				  gateway_txn_id = $8
+			  WHERE id = $9 AND status = $10`
+
+	result, err := db.ExecContext(ctx, query,
 		transaction.Status,
-		transaction.Amount,
+		transaction.Amount.Minor,
+		transaction.Amount.Currency,
 		transaction.Type,
 		transaction.GatewayID,
 		transaction.CountryID,
 		transaction.UserID,
 		transaction.GatewayTxnId,
-		transaction.ID)
+		transaction.ID,
+		from)
 
 	if err != nil {
 		return fmt.Errorf("failed to update transaction: %v", err)
@@ -250,26 +317,125 @@ func UpdateTransaction(db *sql.DB, transaction Transaction) error {
 	}
 
 	if rows == 0 {
-		return fmt.Errorf("no transaction found with id: %d", transaction.ID)
+		return fmt.Errorf("%w: transaction %d is no longer %s", ErrStaleTransaction, transaction.ID, from)
 	}
 
 	return nil
 }
 
-func GetTransactions(db *sql.DB) ([]Transaction, error) {
-	rows, err := db.Query(`SELECT id, amount, type, status, user_id, gateway_id, country_id, created_at FROM transactions`)
+// GetRefundedAmount returns the sum of the refunds of a transaction that haven't failed, in minor units.
+func GetRefundedAmount(ctx context.Context, db DBTX, parentID int) (int64, error) {
+	query := `SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE parent_id = $1 AND type = $2 AND status <> $3`
+
+	var refunded int64
+	if err := db.QueryRowContext(ctx, query, parentID, TypeRefund, StatusFailed).Scan(&refunded); err != nil {
+		return 0, fmt.Errorf("failed to sum refunds: %v", err)
+	}
+	return refunded, nil
+}
+
+func GetRefunds(ctx context.Context, db DBTX, parentID int) ([]*Transaction, error) {
+	query := `SELECT ` + transactionColumns + ` FROM transactions WHERE parent_id = $1 AND type = $2 ORDER BY id`
+
+	rows, err := db.QueryContext(ctx, query, parentID, TypeRefund)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch refunds: %v", err)
+	}
+	return scanTransactions(rows)
+}
+
+// TransactionFilter selects the transactions of a user. Zero values don't filter.
+type TransactionFilter struct {
+	UserID    int
+	Status    string
+	Type      string
+	GatewayID int
+	Currency  string
+	// CreatedFrom is inclusive, CreatedTo exclusive.
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	// After continues a listing after the last transaction of the previous page.
+	After *TransactionCursor
+	Limit int
+}
+
+// TransactionCursor is the position of a transaction in a listing, newest first.
+type TransactionCursor struct {
+	CreatedAt time.Time
+	ID        int
+}
+
+// ListTransactions returns the transactions of filter.UserID, newest first. The
+// (user_id, created_at, id) index serves both the filters and the keyset pagination.
+func ListTransactions(ctx context.Context, db DBTX, filter TransactionFilter) ([]*Transaction, error) {
+	conditions := []string{"user_id = $1"}
+	args := []interface{}{filter.UserID}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if filter.Status != "" {
+		conditions = append(conditions, "status = "+arg(filter.Status))
+	}
+	if filter.Type != "" {
+		conditions = append(conditions, "type = "+arg(filter.Type))
+	}
+	if filter.GatewayID != 0 {
+		conditions = append(conditions, "gateway_id = "+arg(filter.GatewayID))
+	}
+	if filter.Currency != "" {
+		conditions = append(conditions, "currency = "+arg(filter.Currency))
+	}
+	if !filter.CreatedFrom.IsZero() {
+		conditions = append(conditions, "created_at >= "+arg(filter.CreatedFrom))
+	}
+	if !filter.CreatedTo.IsZero() {
+		conditions = append(conditions, "created_at < "+arg(filter.CreatedTo))
+	}
+	if filter.After != nil {
+		conditions = append(conditions, fmt.Sprintf("(created_at, id) < (%s, %s)", arg(filter.After.CreatedAt), arg(filter.After.ID)))
+	}
+
+	query := `SELECT ` + transactionColumns + ` FROM transactions
+			  WHERE ` + strings.Join(conditions, " AND ") + `
+			  ORDER BY created_at DESC, id DESC
+			  LIMIT ` + arg(filter.Limit)
+
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch transactions: %v", err)
 	}
+	return scanTransactions(rows)
+}
+
+const transactionColumns = `id, gateway_txn_id, amount, currency, type, status, user_id, gateway_id, country_id, COALESCE(parent_id, 0), created_at,
+	COALESCE(requested_gateway_id, 0), COALESCE(fallback_reason, '')`
+
+func scanTransactions(rows *sql.Rows) ([]*Transaction, error) {
 	defer rows.Close()
 
-	var transactions []Transaction
+	var transactions []*Transaction
 	for rows.Next() {
 		var transaction Transaction
-		if err := rows.Scan(&transaction.ID, &transaction.Amount, &transaction.Type, &transaction.Status, &transaction.UserID, &transaction.GatewayID, &transaction.CountryID, &transaction.CreatedAt); err != nil {
+		if err := rows.Scan(
+			&transaction.ID,
+			&transaction.GatewayTxnId,
+			&transaction.Amount.Minor,
+			&transaction.Amount.Currency,
+			&transaction.Type,
+			&transaction.Status,
+			&transaction.UserID,
+			&transaction.GatewayID,
+			&transaction.CountryID,
+			&transaction.ParentID,
+			&transaction.CreatedAt,
+			&transaction.RequestedGatewayID,
+			&transaction.FallbackReason,
+		); err != nil {
 			return nil, fmt.Errorf("failed to scan transaction: %v", err)
 		}
-		transactions = append(transactions, transaction)
+		transactions = append(transactions, &transaction)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
@@ -307,3 +473,24 @@ func GetSupportedCountriesByGateway(db *sql.DB, gatewayID int) ([]Country, error
 
 	return countries, nil
 }
+
+// RunInTx runs fn inside a database transaction. The transaction is committed when fn
+// returns nil and rolled back otherwise.
+func RunInTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+
+	if err := fn(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			log.Printf("failed to rollback transaction: %v", rbErr)
+		}
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DeadLetterEvent is an outbox event the relay gave up on. It keeps everything needed
+// to publish it again once the broker is back.
+type DeadLetterEvent struct {
+	ID            int64
+	OutboxEventID int64
+	AggregateType string
+	AggregateID   string
+	EventType     string
+	DataFormat    string
+	// Topic the event was meant for, empty when the data format has no topic.
+	Topic          string
+	Payload        []byte
+	Attempts       int
+	LastError      string
+	CreatedAt      time.Time // when the event was written to the outbox
+	DeadLetteredAt time.Time
+	ReplayedAt     *time.Time
+}
+
+// DeadLetterFilter selects dead-letter events. Zero values don't filter.
+type DeadLetterFilter struct {
+	IDs []int64
+	// Since and Until are matched against the time the event was dead-lettered.
+	Since       time.Time
+	Until       time.Time
+	AggregateID string
+	// Replayed events are skipped unless IncludeReplayed is set.
+	IncludeReplayed bool
+	Limit           int
+}
+
+type DeadLetterRepository interface {
+	List(ctx context.Context, filter DeadLetterFilter) ([]*DeadLetterEvent, error)
+	Get(ctx context.Context, id int64) (*DeadLetterEvent, error)
+
+	// Replay writes the selected events back to the outbox and marks them as replayed.
+	// It returns the replayed events.
+	Replay(ctx context.Context, filter DeadLetterFilter) ([]*DeadLetterEvent, error)
+}
+
+type SQLDeadLetterRepository struct {
+	db *sql.DB
+}
+
+func NewDeadLetterRepository(db *sql.DB) DeadLetterRepository {
+	return &SQLDeadLetterRepository{db: db}
+}
+
+const deadLetterColumns = `id, outbox_event_id, aggregate_type, aggregate_id, event_type, data_format,
+	COALESCE(topic, ''), payload, attempts, COALESCE(last_error, ''), created_at, dead_lettered_at, replayed_at`
+
+func (r *SQLDeadLetterRepository) List(ctx context.Context, filter DeadLetterFilter) ([]*DeadLetterEvent, error) {
+	return listDeadLetterEvents(ctx, r.db, filter, false)
+}
+
+func (r *SQLDeadLetterRepository) Get(ctx context.Context, id int64) (*DeadLetterEvent, error) {
+	events, err := listDeadLetterEvents(ctx, r.db, DeadLetterFilter{IDs: []int64{id}, IncludeReplayed: true}, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, nil
+	}
+	return events[0], nil
+}
+
+func (r *SQLDeadLetterRepository) Replay(ctx context.Context, filter DeadLetterFilter) ([]*DeadLetterEvent, error) {
+	var replayed []*DeadLetterEvent
+	err := RunInTx(ctx, r.db, func(tx *sql.Tx) error {
+		// Lock the rows so two operators replaying at the same time don't publish twice.
+		events, err := listDeadLetterEvents(ctx, tx, filter, true)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, event := range events {
+			err := InsertOutboxEvent(ctx, tx, &OutboxEvent{
+				AggregateType: event.AggregateType,
+				AggregateID:   event.AggregateID,
+				EventType:     event.EventType,
+				DataFormat:    event.DataFormat,
+				Payload:       event.Payload,
+			})
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE dead_letter_events SET replayed_at = $1 WHERE id = $2`, now, event.ID); err != nil {
+				return fmt.Errorf("failed to mark dead-letter event %d as replayed: %v", event.ID, err)
+			}
+			event.ReplayedAt = &now
+		}
+		replayed = events
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return replayed, nil
+}
+
+func listDeadLetterEvents(ctx context.Context, q DBTX, filter DeadLetterFilter, forUpdate bool) ([]*DeadLetterEvent, error) {
+	var conditions []string
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if len(filter.IDs) > 0 {
+		placeholders := make([]string, len(filter.IDs))
+		for i, id := range filter.IDs {
+			placeholders[i] = arg(id)
+		}
+		conditions = append(conditions, "id IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "dead_lettered_at >= "+arg(filter.Since))
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "dead_lettered_at < "+arg(filter.Until))
+	}
+	if filter.AggregateID != "" {
+		conditions = append(conditions, "aggregate_id = "+arg(filter.AggregateID))
+	}
+	if !filter.IncludeReplayed {
+		conditions = append(conditions, "replayed_at IS NULL")
+	}
+
+	query := `SELECT ` + deadLetterColumns + ` FROM dead_letter_events`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	query += ` ORDER BY id`
+	if filter.Limit > 0 {
+		query += ` LIMIT ` + arg(filter.Limit)
+	}
+	if forUpdate {
+		query += ` FOR UPDATE`
+	}
+
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch dead-letter events: %v", err)
+	}
+	defer rows.Close()
+
+	var events []*DeadLetterEvent
+	for rows.Next() {
+		var event DeadLetterEvent
+		if err := rows.Scan(
+			&event.ID,
+			&event.OutboxEventID,
+			&event.AggregateType,
+			&event.AggregateID,
+			&event.EventType,
+			&event.DataFormat,
+			&event.Topic,
+			&event.Payload,
+			&event.Attempts,
+			&event.LastError,
+			&event.CreatedAt,
+			&event.DeadLetteredAt,
+			&event.ReplayedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan dead-letter event: %v", err)
+		}
+		events = append(events, &event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
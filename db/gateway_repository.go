@@ -1,13 +1,28 @@
 package db
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"payment-gateway/internal/models"
 )
 
 type GatewayRepository interface {
-	// GetAvailableGateways returns all gateways available for the given country
-	GetAvailableGateways(countryID int) ([]*Gateway, error)
+	// GetAvailableGateways returns all enabled gateways available for the given country
+	GetAvailableGateways(ctx context.Context, countryID int) ([]*Gateway, error)
+
+	// GetGatewayByName returns the gateway with its callback credentials, or nil if there is none.
+	GetGatewayByName(ctx context.Context, name string) (*Gateway, error)
+
+	// GetSupportedCurrencies returns the ISO 4217 currencies the gateway can settle.
+	GetSupportedCurrencies(ctx context.Context, gatewayID int) ([]string, error)
+
+	// ListGateways returns every gateway, in any country.
+	ListGateways(ctx context.Context) ([]*Gateway, error)
+
+	// GetGateway returns the gateway, enabled or not, or nil if there is none.
+	GetGateway(ctx context.Context, gatewayID int) (*Gateway, error)
 }
 
 type gatewayRepository struct {
@@ -18,15 +33,16 @@ func NewGatewayRepository(db *sql.DB) GatewayRepository {
 	return &gatewayRepository{db: db}
 }
 
-func (r *gatewayRepository) GetAvailableGateways(countryID int) ([]*Gateway, error) {
+func (r *gatewayRepository) GetAvailableGateways(ctx context.Context, countryID int) ([]*Gateway, error) {
 	// Get all gateways that support this country
 	query := `
-		SELECT g.id, g.name, g.data_format_supported, g.created_at, g.updated_at
+		SELECT g.id, g.name, g.data_format_supported, g.enabled, g.created_at, g.updated_at
 		FROM gateways g
 		JOIN gateway_countries gc ON g.id = gc.gateway_id
-		WHERE gc.country_id = $1`
+		WHERE gc.country_id = $1 AND g.enabled
+		ORDER BY g.id`
 
-	rows, err := r.db.Query(query, countryID)
+	rows, err := r.db.QueryContext(ctx, query, countryID)
 	if err != nil {
 		return nil, models.NewServiceError(
 			models.ErrorCodeUnknown,
@@ -42,6 +58,7 @@ func (r *gatewayRepository) GetAvailableGateways(countryID int) ([]*Gateway, err
 			&gateway.ID,
 			&gateway.Name,
 			&gateway.DataFormatSupported,
+			&gateway.Enabled,
 			&gateway.CreatedAt,
 			&gateway.UpdatedAt,
 		)
@@ -70,3 +87,130 @@ func (r *gatewayRepository) GetAvailableGateways(countryID int) ([]*Gateway, err
 
 	return gateways, nil
 }
+
+func (r *gatewayRepository) GetGateway(ctx context.Context, gatewayID int) (*Gateway, error) {
+	query := `SELECT id, name, data_format_supported, enabled, created_at, updated_at FROM gateways WHERE id = $1`
+
+	var gateway Gateway
+	err := r.db.QueryRowContext(ctx, query, gatewayID).Scan(
+		&gateway.ID,
+		&gateway.Name,
+		&gateway.DataFormatSupported,
+		&gateway.Enabled,
+		&gateway.CreatedAt,
+		&gateway.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, models.NewServiceError(
+			models.ErrorCodeUnknown,
+			"Failed to fetch gateway",
+		)
+	}
+
+	return &gateway, nil
+}
+
+func (r *gatewayRepository) GetGatewayByName(ctx context.Context, name string) (*Gateway, error) {
+	query := `
+		SELECT id, name, data_format_supported, enabled, COALESCE(api_key_hash, ''), COALESCE(signing_secret, ''), signature_scheme, created_at, updated_at
+		FROM gateways
+		WHERE name = $1`
+
+	var gateway Gateway
+	err := r.db.QueryRowContext(ctx, query, name).Scan(
+		&gateway.ID,
+		&gateway.Name,
+		&gateway.DataFormatSupported,
+		&gateway.Enabled,
+		&gateway.APIKeyHash,
+		&gateway.SigningSecret,
+		&gateway.SignatureScheme,
+		&gateway.CreatedAt,
+		&gateway.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, models.NewServiceError(
+			models.ErrorCodeUnknown,
+			"Failed to fetch gateway",
+		)
+	}
+
+	return &gateway, nil
+}
+
+// HashAPIKey returns the sha256 of an api key as it is stored in api_key_hash. Only the hash of the key
+// is stored, so a leaked table doesn't give away the keys.
+func HashAPIKey(apiKey string) string {
+	hash := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(hash[:])
+}
+
+func (r *gatewayRepository) ListGateways(ctx context.Context) ([]*Gateway, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT id, name, data_format_supported, enabled, created_at, updated_at FROM gateways ORDER BY id`)
+	if err != nil {
+		return nil, models.NewServiceError(
+			models.ErrorCodeUnknown,
+			"Failed to fetch gateways",
+		)
+	}
+	defer rows.Close()
+
+	var gateways []*Gateway
+	for rows.Next() {
+		var gateway Gateway
+		if err := rows.Scan(&gateway.ID, &gateway.Name, &gateway.DataFormatSupported, &gateway.Enabled, &gateway.CreatedAt, &gateway.UpdatedAt); err != nil {
+			return nil, models.NewServiceError(
+				models.ErrorCodeUnknown,
+				"Failed to scan gateway information",
+			)
+		}
+		gateways = append(gateways, &gateway)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, models.NewServiceError(
+			models.ErrorCodeUnknown,
+			"Error iterating through gateways",
+		)
+	}
+
+	return gateways, nil
+}
+
+func (r *gatewayRepository) GetSupportedCurrencies(ctx context.Context, gatewayID int) ([]string, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT currency FROM gateway_currencies WHERE gateway_id = $1 ORDER BY currency`, gatewayID)
+	if err != nil {
+		return nil, models.NewServiceError(
+			models.ErrorCodeUnknown,
+			"Failed to fetch gateway currencies",
+		)
+	}
+	defer rows.Close()
+
+	var currencies []string
+	for rows.Next() {
+		var currency string
+		if err := rows.Scan(&currency); err != nil {
+			return nil, models.NewServiceError(
+				models.ErrorCodeUnknown,
+				"Failed to scan gateway currency",
+			)
+		}
+		currencies = append(currencies, currency)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, models.NewServiceError(
+			models.ErrorCodeUnknown,
+			"Error iterating through gateway currencies",
+		)
+	}
+
+	return currencies, nil
+}
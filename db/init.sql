@@ -5,6 +5,10 @@ BEGIN
             id SERIAL PRIMARY KEY,
             name VARCHAR(255) NOT NULL UNIQUE,
             data_format_supported VARCHAR(50) NOT NULL,  
+            api_key_hash CHAR(64) UNIQUE,              -- sha256 of the key the gateway sends in X-Gateway-API-Key, hmac-sha256 scheme only
+            signing_secret VARCHAR(255),               -- secret used to sign the callbacks
+            signature_scheme VARCHAR(50) NOT NULL DEFAULT 'hmac-sha256',
+            enabled BOOLEAN NOT NULL DEFAULT TRUE,     -- a disabled gateway takes no new transactions
             created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, 
             updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP  
         );
@@ -36,20 +40,70 @@ BEGIN
     END IF;
 END $$;
 
+DO $$ 
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'gateway_currencies') THEN
+        -- Currencies each gateway is able to settle.
+        CREATE TABLE gateway_currencies (
+            gateway_id INT NOT NULL,
+            currency CHAR(3) NOT NULL,
+            PRIMARY KEY (gateway_id, currency)
+        );
+    END IF;
+END $$;
+
 DO $$ 
 BEGIN
     IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'transactions') THEN
         CREATE TABLE transactions (
             id SERIAL PRIMARY KEY,
-            amount DECIMAL(10, 2) NOT NULL,
+            amount BIGINT NOT NULL,  -- minor units of the currency
+            currency CHAR(3) NOT NULL,  -- ISO 4217
             type VARCHAR(50) NOT NULL,
             status VARCHAR(50) NOT NULL,
             created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,  
             gateway_id INT NOT NULL,  
             country_id INT NOT NULL,  
             user_id INT NOT NULL,
-            gateway_txn_id VARCHAR(255) NOT NULL
+            gateway_txn_id VARCHAR(255) NOT NULL,
+            parent_id INT REFERENCES transactions(id),  -- the refunded transaction, only set for refunds
+            requested_gateway_id INT,  -- the gateway asked for, only set when a fallback policy moved the transaction to gateway_id
+            fallback_reason VARCHAR(50)  -- why it was moved: gateway_disabled or gateway_not_available
         );
+        CREATE INDEX transactions_parent_id_idx ON transactions (parent_id) WHERE parent_id IS NOT NULL;
+        -- Listing a user's transactions, newest first, with keyset pagination on (created_at, id).
+        CREATE INDEX transactions_user_created_idx ON transactions (user_id, created_at DESC, id DESC);
+        CREATE INDEX transactions_user_status_created_idx ON transactions (user_id, status, created_at DESC, id DESC);
+        -- Ids of the gateways are only unique within a gateway, transactions not sent yet have none.
+        CREATE UNIQUE INDEX transactions_gateway_txn_id_idx ON transactions (gateway_id, gateway_txn_id) WHERE gateway_txn_id <> '';
+        -- The review queue, oldest first.
+        CREATE INDEX transactions_review_idx ON transactions (created_at, id) WHERE status = 'review';
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'transaction_events') THEN
+        -- Every status change of a transaction, written together with the change itself. Append-only.
+        CREATE TABLE transaction_events (
+            id BIGSERIAL PRIMARY KEY,
+            transaction_id INT NOT NULL REFERENCES transactions(id),
+            from_status VARCHAR(50),  -- NULL for the status the transaction was created with
+            to_status VARCHAR(50) NOT NULL,
+            reason TEXT NOT NULL,
+            source VARCHAR(50) NOT NULL,  -- api, gateway, callback, reconciler, compliance or review
+            payload BYTEA,  -- raw callback body as the gateway sent it
+            payload_format VARCHAR(50),
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE INDEX transaction_events_transaction_idx ON transaction_events (transaction_id, id);
+
+        CREATE FUNCTION reject_transaction_event_change() RETURNS trigger AS $fn$
+        BEGIN
+            RAISE EXCEPTION 'transaction_events is append-only';
+        END;
+        $fn$ LANGUAGE plpgsql;
+
+        CREATE TRIGGER transaction_events_append_only
+            BEFORE UPDATE OR DELETE ON transaction_events
+            FOR EACH ROW EXECUTE FUNCTION reject_transaction_event_change();
     END IF;
 END $$;
 
@@ -61,9 +115,336 @@ BEGIN
             username VARCHAR(255) NOT NULL UNIQUE,
             email VARCHAR(255) NOT NULL UNIQUE,
             password VARCHAR(255) NOT NULL,
+            full_name VARCHAR(255),  -- legal name, screened against the sanctions lists
             country_id INT,
+            kyc_tier SMALLINT NOT NULL DEFAULT 0,  -- 0 is unverified, higher tiers passed more checks
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+    END IF;
+END $$;
+
+
+DO $$ 
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'outbox_events') THEN
+        -- Events waiting to be published to kafka, written in the same transaction as the change they describe.
+        CREATE TABLE outbox_events (
+            id BIGSERIAL PRIMARY KEY,
+            aggregate_type VARCHAR(50) NOT NULL,
+            aggregate_id VARCHAR(255) NOT NULL,  -- kafka key, events of one aggregate are published in order
+            event_type VARCHAR(100) NOT NULL,
+            data_format VARCHAR(50) NOT NULL,
+            payload BYTEA NOT NULL,
+            attempts INT NOT NULL DEFAULT 0,
+            last_error TEXT,
+            next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            sent_at TIMESTAMP
+        );
+        CREATE INDEX outbox_events_unsent_idx ON outbox_events (id) WHERE sent_at IS NULL;
+    END IF;
+    -- Finding the unsent events of an aggregate that come before an event.
+    CREATE INDEX IF NOT EXISTS outbox_events_unsent_aggregate_idx ON outbox_events (aggregate_type, aggregate_id, id) WHERE sent_at IS NULL;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'dead_letter_events') THEN
+        -- Outbox events the relay gave up on, kept until an operator replays them with `main dlq replay`.
+        CREATE TABLE dead_letter_events (
+            id BIGSERIAL PRIMARY KEY,
+            outbox_event_id BIGINT NOT NULL,
+            aggregate_type VARCHAR(50) NOT NULL,
+            aggregate_id VARCHAR(255) NOT NULL,
+            event_type VARCHAR(100) NOT NULL,
+            data_format VARCHAR(50) NOT NULL,
+            topic VARCHAR(255),
+            payload BYTEA NOT NULL,
+            attempts INT NOT NULL,
+            last_error TEXT,
+            created_at TIMESTAMP NOT NULL,
+            dead_lettered_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            replayed_at TIMESTAMP
+        );
+        CREATE INDEX dead_letter_events_dead_lettered_at_idx ON dead_letter_events (dead_lettered_at);
+        CREATE INDEX dead_letter_events_aggregate_idx ON dead_letter_events (aggregate_type, aggregate_id);
+    END IF;
+END $$;
+
+DO $$ 
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'ledger_accounts') THEN
+        -- Double-entry ledger. balance is the sum of the account's postings, kept up to date with every posting.
+        CREATE TABLE ledger_accounts (
+            id BIGSERIAL PRIMARY KEY,
+            name VARCHAR(255) NOT NULL,  -- e.g. user:42:available, user:42:held, gateway:1:clearing
+            currency CHAR(3) NOT NULL,
+            balance BIGINT NOT NULL DEFAULT 0,  -- minor units of the currency
             created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            UNIQUE (name, currency)
+        );
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'journal_entries') THEN
+        CREATE TABLE journal_entries (
+            id BIGSERIAL PRIMARY KEY,
+            transaction_id INT REFERENCES transactions(id),
+            kind VARCHAR(50) NOT NULL,  -- deposit, withdrawal, refund, reversal, hold or hold_release
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE INDEX journal_entries_transaction_idx ON journal_entries (transaction_id);
+
+        CREATE TABLE ledger_postings (
+            id BIGSERIAL PRIMARY KEY,
+            entry_id BIGINT NOT NULL REFERENCES journal_entries(id),
+            account_id BIGINT NOT NULL REFERENCES ledger_accounts(id),
+            amount BIGINT NOT NULL CHECK (amount <> 0)
+        );
+        CREATE INDEX ledger_postings_entry_idx ON ledger_postings (entry_id);
+        CREATE INDEX ledger_postings_account_idx ON ledger_postings (account_id, id);
+
+        -- The postings of an entry have to balance per currency. Checked at commit, once all of them are written.
+        CREATE FUNCTION check_journal_entry_balanced() RETURNS trigger AS $fn$
+        BEGIN
+            IF EXISTS (
+                SELECT 1 FROM ledger_postings p JOIN ledger_accounts a ON a.id = p.account_id
+                WHERE p.entry_id = NEW.entry_id
+                GROUP BY a.currency HAVING SUM(p.amount) <> 0
+            ) THEN
+                RAISE EXCEPTION 'journal entry % does not balance', NEW.entry_id;
+            END IF;
+            RETURN NULL;
+        END;
+        $fn$ LANGUAGE plpgsql;
+
+        CREATE CONSTRAINT TRIGGER ledger_postings_balanced
+            AFTER INSERT ON ledger_postings
+            DEFERRABLE INITIALLY DEFERRED
+            FOR EACH ROW EXECUTE FUNCTION check_journal_entry_balanced();
+
+        CREATE FUNCTION reject_ledger_change() RETURNS trigger AS $fn$
+        BEGIN
+            RAISE EXCEPTION 'the ledger journal is append-only';
+        END;
+        $fn$ LANGUAGE plpgsql;
+
+        CREATE TRIGGER journal_entries_append_only
+            BEFORE UPDATE OR DELETE ON journal_entries
+            FOR EACH ROW EXECUTE FUNCTION reject_ledger_change();
+        CREATE TRIGGER ledger_postings_append_only
+            BEFORE UPDATE OR DELETE ON ledger_postings
+            FOR EACH ROW EXECUTE FUNCTION reject_ledger_change();
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'ledger_holds') THEN
+        -- Money reserved for withdrawals and refunds in flight, one hold per transaction.
+        CREATE TABLE ledger_holds (
+            id BIGSERIAL PRIMARY KEY,
+            transaction_id INT NOT NULL UNIQUE REFERENCES transactions(id),
+            user_id INT NOT NULL,
+            currency CHAR(3) NOT NULL,
+            amount BIGINT NOT NULL CHECK (amount > 0),
+            status VARCHAR(20) NOT NULL,  -- active, captured, released or expired
+            expires_at TIMESTAMP NOT NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
             updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
         );
+        CREATE INDEX ledger_holds_active_expires_idx ON ledger_holds (expires_at) WHERE status = 'active';
     END IF;
 END $$;
+
+DO $$ 
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'limit_rules') THEN
+        -- Transaction limits, managed with `main limits`. NULL scope columns apply to everyone.
+        CREATE TABLE limit_rules (
+            id SERIAL PRIMARY KEY,
+            kind VARCHAR(50) NOT NULL,  -- min_amount, max_amount, daily_amount or weekly_amount
+            transaction_type VARCHAR(50) NOT NULL,  -- deposit or withdraw
+            currency CHAR(3) NOT NULL,
+            amount BIGINT NOT NULL CHECK (amount >= 0),  -- minor units of the currency
+            user_id INT,
+            country_id INT,
+            gateway_id INT,
+            kyc_tier SMALLINT,
+            action VARCHAR(20) NOT NULL DEFAULT 'reject',  -- reject, or review to park the transaction for an operator
+            enabled BOOLEAN NOT NULL DEFAULT TRUE,
+            description TEXT,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+    END IF;
+END $$;
+
+DO $$ 
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'compliance_decisions') THEN
+        -- The compliance decision every deposit and withdrawal was created after. Append-only.
+        CREATE TABLE compliance_decisions (
+            id BIGSERIAL PRIMARY KEY,
+            transaction_id INT NOT NULL REFERENCES transactions(id),
+            outcome VARCHAR(20) NOT NULL,  -- approve, review or reject
+            results JSONB NOT NULL,  -- rule, outcome and reason of every rule that ran, in order
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE INDEX compliance_decisions_transaction_idx ON compliance_decisions (transaction_id, id);
+
+        CREATE FUNCTION reject_compliance_decision_change() RETURNS trigger AS $fn$
+        BEGIN
+            RAISE EXCEPTION 'compliance_decisions is append-only';
+        END;
+        $fn$ LANGUAGE plpgsql;
+
+        CREATE TRIGGER compliance_decisions_append_only
+            BEFORE UPDATE OR DELETE ON compliance_decisions
+            FOR EACH ROW EXECUTE FUNCTION reject_compliance_decision_change();
+    END IF;
+END $$;
+
+DO $$ 
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'review_decisions') THEN
+        -- Operators' decisions on transactions parked for review, the audit trail of the review queue. Append-only.
+        CREATE TABLE review_decisions (
+            id BIGSERIAL PRIMARY KEY,
+            transaction_id INT NOT NULL UNIQUE REFERENCES transactions(id),  -- a transaction is reviewed once
+            reviewer_id INT NOT NULL,  -- user id of the operator, from their token
+            action VARCHAR(20) NOT NULL,  -- approve or reject
+            reason TEXT NOT NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE FUNCTION reject_review_decision_change() RETURNS trigger AS $fn$
+        BEGIN
+            RAISE EXCEPTION 'review_decisions is append-only';
+        END;
+        $fn$ LANGUAGE plpgsql;
+
+        CREATE TRIGGER review_decisions_append_only
+            BEFORE UPDATE OR DELETE ON review_decisions
+            FOR EACH ROW EXECUTE FUNCTION reject_review_decision_change();
+    END IF;
+END $$;
+
+DO $$ 
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'risk_assessments') THEN
+        -- The fraud risk score every deposit and withdrawal was created with. Append-only.
+        CREATE TABLE risk_assessments (
+            id BIGSERIAL PRIMARY KEY,
+            transaction_id INT NOT NULL REFERENCES transactions(id),
+            score NUMERIC(8, 2) NOT NULL,
+            outcome VARCHAR(20) NOT NULL,  -- allow, review or block
+            features JSONB NOT NULL,  -- name, measured value, score and detail of every feature
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE INDEX risk_assessments_transaction_idx ON risk_assessments (transaction_id, id);
+
+        CREATE FUNCTION reject_risk_assessment_change() RETURNS trigger AS $fn$
+        BEGIN
+            RAISE EXCEPTION 'risk_assessments is append-only';
+        END;
+        $fn$ LANGUAGE plpgsql;
+
+        CREATE TRIGGER risk_assessments_append_only
+            BEFORE UPDATE OR DELETE ON risk_assessments
+            FOR EACH ROW EXECUTE FUNCTION reject_risk_assessment_change();
+    END IF;
+END $$;
+
+DO $$ 
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'routing_decisions') THEN
+        -- How the gateway of a transaction without a gateway_id was picked. Append-only.
+        CREATE TABLE routing_decisions (
+            id BIGSERIAL PRIMARY KEY,
+            transaction_id INT NOT NULL REFERENCES transactions(id),
+            country_id INT NOT NULL,
+            gateway_id INT NOT NULL REFERENCES gateways(id),  -- the gateway that was picked
+            weights JSONB NOT NULL,  -- weights of cost, success rate and latency in the country
+            scores JSONB NOT NULL,  -- fee, success rate, p95 latency and scores of every candidate
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE INDEX routing_decisions_transaction_idx ON routing_decisions (transaction_id, id);
+
+        CREATE FUNCTION reject_routing_decision_change() RETURNS trigger AS $fn$
+        BEGIN
+            RAISE EXCEPTION 'routing_decisions is append-only';
+        END;
+        $fn$ LANGUAGE plpgsql;
+
+        CREATE TRIGGER routing_decisions_append_only
+            BEFORE UPDATE OR DELETE ON routing_decisions
+            FOR EACH ROW EXECUTE FUNCTION reject_routing_decision_change();
+    END IF;
+END $$;
+
+DO $$ 
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'sanctions_lists') THEN
+        -- Sanctions lists users are screened against, loaded with `main sanctions refresh`.
+        CREATE TABLE sanctions_lists (
+            name VARCHAR(50) PRIMARY KEY,  -- OFAC SDN or EU consolidated
+            source TEXT NOT NULL,  -- file the list was loaded from
+            entries INT NOT NULL,
+            refreshed_at TIMESTAMP NOT NULL
+        );
+
+        CREATE TABLE sanctions_entries (
+            id BIGSERIAL PRIMARY KEY,
+            list VARCHAR(50) NOT NULL REFERENCES sanctions_lists(name),
+            ref VARCHAR(50) NOT NULL,  -- id of the entry on its list
+            type VARCHAR(20) NOT NULL,  -- individual or entity
+            names TEXT[] NOT NULL,  -- primary name first, then the aliases
+            UNIQUE (list, ref)
+        );
+    END IF;
+END $$;
+
+-- The CREATE TABLE blocks above are skipped for tables that already exist, so columns and indexes
+-- added to a table after it was first created are added here as well. Every statement is a no-op
+-- once it has run, on a new database all of them are.
+DO $$ 
+BEGIN
+    ALTER TABLE gateways ADD COLUMN IF NOT EXISTS api_key_hash CHAR(64) UNIQUE;
+    ALTER TABLE gateways ADD COLUMN IF NOT EXISTS signing_secret VARCHAR(255);
+    ALTER TABLE gateways ADD COLUMN IF NOT EXISTS signature_scheme VARCHAR(50) NOT NULL DEFAULT 'hmac-sha256';
+    ALTER TABLE gateways ADD COLUMN IF NOT EXISTS enabled BOOLEAN NOT NULL DEFAULT TRUE;
+
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS full_name VARCHAR(255);
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS kyc_tier SMALLINT NOT NULL DEFAULT 0;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'transactions' AND column_name = 'currency') THEN
+        -- Transactions were always made in the currency of their country.
+        ALTER TABLE transactions ADD COLUMN currency CHAR(3);
+        UPDATE transactions t SET currency = c.currency FROM countries c WHERE c.id = t.country_id;
+        ALTER TABLE transactions ALTER COLUMN currency SET NOT NULL;
+    END IF;
+
+    IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'transactions' AND column_name = 'amount' AND data_type = 'numeric') THEN
+        -- Amounts used to be stored in major units, they are minor units of the currency now.
+        ALTER TABLE transactions ALTER COLUMN amount TYPE BIGINT USING round(amount * power(10, CASE
+            WHEN currency IN ('BIF', 'CLP', 'DJF', 'GNF', 'ISK', 'JPY', 'KMF', 'KRW', 'PYG', 'RWF', 'UGX', 'UYI', 'VND', 'VUV', 'XAF', 'XOF', 'XPF') THEN 0
+            WHEN currency IN ('BHD', 'IQD', 'JOD', 'KWD', 'LYD', 'OMR', 'TND') THEN 3
+            WHEN currency IN ('CLF', 'UYW') THEN 4
+            ELSE 2
+        END));
+    END IF;
+
+    ALTER TABLE transactions ADD COLUMN IF NOT EXISTS parent_id INT REFERENCES transactions(id);
+    ALTER TABLE transactions ADD COLUMN IF NOT EXISTS requested_gateway_id INT;
+    ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fallback_reason VARCHAR(50);
+    CREATE INDEX IF NOT EXISTS transactions_parent_id_idx ON transactions (parent_id) WHERE parent_id IS NOT NULL;
+    CREATE INDEX IF NOT EXISTS transactions_user_created_idx ON transactions (user_id, created_at DESC, id DESC);
+    CREATE INDEX IF NOT EXISTS transactions_user_status_created_idx ON transactions (user_id, status, created_at DESC, id DESC);
+    IF EXISTS (SELECT 1 FROM pg_indexes WHERE indexname = 'transactions_gateway_txn_id_idx' AND indexdef NOT LIKE '%gateway_id, gateway_txn_id%') THEN
+        -- The index used to be on gateway_txn_id alone, the id of another gateway matched too.
+        DROP INDEX transactions_gateway_txn_id_idx;
+    END IF;
+    CREATE UNIQUE INDEX IF NOT EXISTS transactions_gateway_txn_id_idx ON transactions (gateway_id, gateway_txn_id) WHERE gateway_txn_id <> '';
+    CREATE INDEX IF NOT EXISTS transactions_review_idx ON transactions (created_at, id) WHERE status = 'review';
+
+    -- A transaction is credited, debited or held once, however often its status change is delivered.
+    CREATE UNIQUE INDEX IF NOT EXISTS journal_entries_transaction_kind_idx ON journal_entries (transaction_id, kind);
+
+    ALTER TABLE limit_rules ADD COLUMN IF NOT EXISTS action VARCHAR(20) NOT NULL DEFAULT 'reject';
+END $$;
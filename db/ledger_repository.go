@@ -0,0 +1,232 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"payment-gateway/internal/ledger"
+
+	"github.com/lib/pq"
+)
+
+type SQLLedgerStore struct {
+	db *sql.DB
+}
+
+var NewLedgerStore = func(db *sql.DB) ledger.Store {
+	return &SQLLedgerStore{db: db}
+}
+
+func (s *SQLLedgerStore) Post(ctx context.Context, entry *ledger.Entry) error {
+	return RunInTx(ctx, s.db, func(tx *sql.Tx) error {
+		return InsertJournalEntry(ctx, tx, entry)
+	})
+}
+
+func (s *SQLLedgerStore) Balance(ctx context.Context, account ledger.Account) (int64, error) {
+	var balance int64
+	err := s.db.QueryRowContext(ctx, `SELECT balance FROM ledger_accounts WHERE name = $1 AND currency = $2`,
+		account.Name, account.Currency).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch balance of %s: %v", account.Name, err)
+	}
+	return balance, nil
+}
+
+func (s *SQLLedgerStore) PlaceHold(ctx context.Context, hold *ledger.Hold) error {
+	return RunInTx(ctx, s.db, func(tx *sql.Tx) error {
+		return PlaceHold(ctx, tx, hold)
+	})
+}
+
+func (s *SQLLedgerStore) SettleHold(ctx context.Context, settlement *ledger.Settlement) error {
+	return RunInTx(ctx, s.db, func(tx *sql.Tx) error {
+		return SettleHold(ctx, tx, settlement)
+	})
+}
+
+func (s *SQLLedgerStore) ExpireHolds(ctx context.Context, now time.Time, limit int) ([]*ledger.Hold, error) {
+	var expired []*ledger.Hold
+	err := RunInTx(ctx, s.db, func(tx *sql.Tx) error {
+		// SKIP LOCKED lets sweepers of several instances work on different holds, and skips
+		// holds that are being settled at this very moment.
+		rows, err := tx.QueryContext(ctx, `SELECT `+holdColumns+` FROM ledger_holds
+			WHERE status = $1 AND expires_at < $2
+			ORDER BY expires_at LIMIT $3 FOR UPDATE SKIP LOCKED`, ledger.HoldActive, now, limit)
+		if err != nil {
+			return fmt.Errorf("failed to fetch expired holds: %v", err)
+		}
+		expired, err = scanHolds(rows)
+		if err != nil {
+			return err
+		}
+
+		for _, hold := range expired {
+			if err := InsertJournalEntry(ctx, tx, hold.ExpireEntry()); err != nil {
+				return err
+			}
+			if err := updateHoldStatus(ctx, tx, hold.ID, ledger.HoldExpired); err != nil {
+				return err
+			}
+			hold.Status = ledger.HoldExpired
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
+
+// PlaceHold checks the user's available balance and places the hold, using the given transaction.
+// The available account row stays locked until the transaction ends, so concurrent withdrawals of
+// the same user, on any instance, check the balance one after the other.
+func PlaceHold(ctx context.Context, q DBTX, hold *ledger.Hold) error {
+	available := ledger.UserAvailable(hold.UserID, hold.Currency)
+
+	var balance int64
+	err := q.QueryRowContext(ctx, `SELECT balance FROM ledger_accounts WHERE name = $1 AND currency = $2 FOR UPDATE`,
+		available.Name, available.Currency).Scan(&balance)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to lock balance of %s: %v", available.Name, err)
+	}
+	if balance < hold.Amount {
+		return ledger.ErrInsufficientFunds
+	}
+
+	if err := InsertJournalEntry(ctx, q, hold.PlaceEntry()); err != nil {
+		return err
+	}
+
+	hold.Status = ledger.HoldActive
+	if hold.CreatedAt.IsZero() {
+		hold.CreatedAt = time.Now()
+	}
+	err = q.QueryRowContext(ctx, `INSERT INTO ledger_holds (transaction_id, user_id, currency, amount, status, expires_at, created_at)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+		hold.TransactionID, hold.UserID, hold.Currency, hold.Amount, hold.Status, hold.ExpiresAt, hold.CreatedAt,
+	).Scan(&hold.ID)
+	if err != nil {
+		return fmt.Errorf("failed to insert hold: %v", err)
+	}
+	return nil
+}
+
+// SettleHold captures or releases the hold of a transaction, using the given transaction.
+func SettleHold(ctx context.Context, q DBTX, settlement *ledger.Settlement) error {
+	rows, err := q.QueryContext(ctx, `SELECT `+holdColumns+` FROM ledger_holds WHERE transaction_id = $1 FOR UPDATE`, settlement.TransactionID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch hold: %v", err)
+	}
+	holds, err := scanHolds(rows)
+	if err != nil {
+		return err
+	}
+	if len(holds) == 0 {
+		return nil
+	}
+
+	hold := holds[0]
+	entry, status, err := hold.Settle(settlement)
+	if err != nil {
+		return fmt.Errorf("hold of transaction %d: %w", hold.TransactionID, err)
+	}
+	if entry != nil {
+		if err := InsertJournalEntry(ctx, q, entry); err != nil {
+			return err
+		}
+	}
+	return updateHoldStatus(ctx, q, hold.ID, status)
+}
+
+const holdColumns = `id, transaction_id, user_id, currency, amount, status, expires_at, created_at`
+
+func scanHolds(rows *sql.Rows) ([]*ledger.Hold, error) {
+	defer rows.Close()
+
+	var holds []*ledger.Hold
+	for rows.Next() {
+		var hold ledger.Hold
+		if err := rows.Scan(
+			&hold.ID,
+			&hold.TransactionID,
+			&hold.UserID,
+			&hold.Currency,
+			&hold.Amount,
+			&hold.Status,
+			&hold.ExpiresAt,
+			&hold.CreatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan hold: %v", err)
+		}
+		holds = append(holds, &hold)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return holds, nil
+}
+
+func updateHoldStatus(ctx context.Context, q DBTX, id int64, status string) error {
+	if _, err := q.ExecContext(ctx, `UPDATE ledger_holds SET status = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`, status, id); err != nil {
+		return fmt.Errorf("failed to update hold %d: %v", id, err)
+	}
+	return nil
+}
+
+// InsertJournalEntry writes the entry and its postings and updates the balances of the accounts,
+// using the given connection or transaction. Accounts are created on their first posting.
+func InsertJournalEntry(ctx context.Context, q DBTX, entry *ledger.Entry) error {
+	if err := entry.Validate(); err != nil {
+		return err
+	}
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+
+	err := q.QueryRowContext(ctx, `INSERT INTO journal_entries (transaction_id, kind, created_at) VALUES (NULLIF($1, 0), $2, $3) RETURNING id`,
+		entry.TransactionID, entry.Kind, entry.CreatedAt).Scan(&entry.ID)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return fmt.Errorf("%w: %s of transaction %d", ledger.ErrDuplicateEntry, entry.Kind, entry.TransactionID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to insert journal entry: %v", err)
+	}
+
+	// The account rows stay locked until the transaction ends. Concurrent entries touch them
+	// in the same order, so they wait for each other instead of deadlocking.
+	postings := append([]ledger.Posting(nil), entry.Postings...)
+	sort.Slice(postings, func(i, j int) bool {
+		if postings[i].Account.Currency != postings[j].Account.Currency {
+			return postings[i].Account.Currency < postings[j].Account.Currency
+		}
+		return postings[i].Account.Name < postings[j].Account.Name
+	})
+
+	for _, posting := range postings {
+		var accountID int64
+		err := q.QueryRowContext(ctx, `
+			INSERT INTO ledger_accounts (name, currency, balance) VALUES ($1, $2, $3)
+			ON CONFLICT (name, currency) DO UPDATE SET balance = ledger_accounts.balance + EXCLUDED.balance, updated_at = CURRENT_TIMESTAMP
+			RETURNING id`,
+			posting.Account.Name, posting.Account.Currency, posting.Amount,
+		).Scan(&accountID)
+		if err != nil {
+			return fmt.Errorf("failed to update balance of %s: %v", posting.Account.Name, err)
+		}
+
+		if _, err := q.ExecContext(ctx, `INSERT INTO ledger_postings (entry_id, account_id, amount) VALUES ($1, $2, $3)`,
+			entry.ID, accountID, posting.Amount); err != nil {
+			return fmt.Errorf("failed to insert posting: %v", err)
+		}
+	}
+	return nil
+}
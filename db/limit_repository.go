@@ -0,0 +1,170 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"payment-gateway/internal/limits"
+)
+
+// LimitRepository is the limits.Store, plus what is needed to manage the rules.
+type LimitRepository interface {
+	limits.Store
+
+	// ListRules returns all rules, disabled ones included when includeDisabled is set.
+	ListRules(ctx context.Context, includeDisabled bool) ([]*limits.Rule, error)
+	// SaveRule creates the rule, or updates it when it has an ID.
+	SaveRule(ctx context.Context, rule *limits.Rule) error
+	SetRuleEnabled(ctx context.Context, id int, enabled bool) error
+}
+
+type SQLLimitRepository struct {
+	db *sql.DB
+}
+
+func NewLimitRepository(db *sql.DB) LimitRepository {
+	return &SQLLimitRepository{db: db}
+}
+
+func (r *SQLLimitRepository) Rules(ctx context.Context) ([]*limits.Rule, error) {
+	return r.ListRules(ctx, false)
+}
+
+func (r *SQLLimitRepository) ListRules(ctx context.Context, includeDisabled bool) ([]*limits.Rule, error) {
+	query := `SELECT id, kind, transaction_type, currency, amount, COALESCE(user_id, 0), COALESCE(country_id, 0),
+				  COALESCE(gateway_id, 0), kyc_tier, action, enabled, COALESCE(description, '')
+			  FROM limit_rules`
+	if !includeDisabled {
+		query += ` WHERE enabled`
+	}
+	query += ` ORDER BY id`
+
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch limit rules: %v", err)
+	}
+	defer rows.Close()
+
+	var rules []*limits.Rule
+	for rows.Next() {
+		var rule limits.Rule
+		if err := rows.Scan(
+			&rule.ID,
+			&rule.Kind,
+			&rule.TransactionType,
+			&rule.Currency,
+			&rule.Amount,
+			&rule.UserID,
+			&rule.CountryID,
+			&rule.GatewayID,
+			&rule.KYCTier,
+			&rule.Action,
+			&rule.Enabled,
+			&rule.Description,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan limit rule: %v", err)
+		}
+		rules = append(rules, &rule)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (r *SQLLimitRepository) SaveRule(ctx context.Context, rule *limits.Rule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+
+	args := []interface{}{
+		rule.Kind, rule.TransactionType, rule.Currency, rule.Amount,
+		rule.UserID, rule.CountryID, rule.GatewayID, rule.KYCTier, rule.Enabled, rule.Description, rule.Action,
+	}
+	if rule.ID == 0 {
+		query := `INSERT INTO limit_rules (kind, transaction_type, currency, amount, user_id, country_id, gateway_id, kyc_tier, enabled, description, action)
+				  VALUES ($1, $2, $3, $4, NULLIF($5, 0), NULLIF($6, 0), NULLIF($7, 0), $8, $9, NULLIF($10, ''), $11)
+				  RETURNING id`
+		if err := r.db.QueryRowContext(ctx, query, args...).Scan(&rule.ID); err != nil {
+			return fmt.Errorf("failed to insert limit rule: %v", err)
+		}
+		return nil
+	}
+
+	query := `UPDATE limit_rules SET kind = $1, transaction_type = $2, currency = $3, amount = $4, user_id = NULLIF($5, 0),
+				  country_id = NULLIF($6, 0), gateway_id = NULLIF($7, 0), kyc_tier = $8, enabled = $9,
+				  description = NULLIF($10, ''), action = $11, updated_at = CURRENT_TIMESTAMP
+			  WHERE id = $12`
+	result, err := r.db.ExecContext(ctx, query, append(args, rule.ID)...)
+	if err != nil {
+		return fmt.Errorf("failed to update limit rule: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("limit rule %d not found", rule.ID)
+	}
+	return nil
+}
+
+func (r *SQLLimitRepository) SetRuleEnabled(ctx context.Context, id int, enabled bool) error {
+	result, err := r.db.ExecContext(ctx, `UPDATE limit_rules SET enabled = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`, enabled, id)
+	if err != nil {
+		return fmt.Errorf("failed to update limit rule: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("limit rule %d not found", id)
+	}
+	return nil
+}
+
+func (r *SQLLimitRepository) Usage(ctx context.Context, userID int, transactionType string, currency string, since time.Time) (int64, error) {
+	return GetUsage(ctx, r.db, userID, transactionType, currency, since)
+}
+
+// GetUsage returns the usage of the limits, see limits.Store.
+func GetUsage(ctx context.Context, q DBTX, userID int, transactionType string, currency string, since time.Time) (int64, error) {
+	// Served by the (user_id, created_at, id) index of transactions.
+	query := `SELECT COALESCE(SUM(amount), 0) FROM transactions
+			  WHERE user_id = $1 AND created_at >= $2 AND type = $3 AND currency = $4 AND status NOT IN ($5, $6)`
+
+	var used int64
+	if err := q.QueryRowContext(ctx, query, userID, since, transactionType, currency, StatusFailed, StatusReversed).Scan(&used); err != nil {
+		return 0, fmt.Errorf("failed to compute usage: %v", err)
+	}
+	return used, nil
+}
+
+func (r *SQLLimitRepository) KYCTier(ctx context.Context, userID int) (int, error) {
+	var tier int
+	err := r.db.QueryRowContext(ctx, `SELECT kyc_tier FROM users WHERE id = $1`, userID).Scan(&tier)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch kyc tier: %v", err)
+	}
+	return tier, nil
+}
+
+// Key class of the postgres advisory locks taken on users while their limits are checked again.
+const userLimitsLockClass = 5402
+
+// usageStore is the usage of the limits within a database transaction.
+type usageStore struct {
+	q DBTX
+}
+
+func (s usageStore) Usage(ctx context.Context, userID int, transactionType string, currency string, since time.Time) (int64, error) {
+	return GetUsage(ctx, s.q, userID, transactionType, currency, since)
+}
+
+// RecheckLimits checks the limits of a new transaction again, using the given transaction. The user stays locked
+// until the transaction ends, so transactions of the user created at the same time are checked and inserted one
+// after the other and each one counts the usage of the ones before.
+func RecheckLimits(ctx context.Context, q DBTX, recheck *limits.Recheck) error {
+	if _, err := q.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1::int, $2::int)`, userLimitsLockClass, recheck.Request.UserID); err != nil {
+		return fmt.Errorf("failed to lock limits of user %d: %v", recheck.Request.UserID, err)
+	}
+	return recheck.Check(ctx, usageStore{q: q})
+}
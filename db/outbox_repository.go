@@ -0,0 +1,227 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"payment-gateway/internal/compliance"
+	"payment-gateway/internal/ledger"
+	"payment-gateway/internal/limits"
+	"payment-gateway/internal/risk"
+	"payment-gateway/internal/routing"
+)
+
+// Random key for the postgres advisory lock that makes sure only one relay publishes at a time.
+const outboxRelayLockID = 7318250913
+
+// OutboxEvent is an event waiting to be published to kafka. It is written in the same
+// database transaction as the change it describes, so we never lose an event when the
+// broker is down and never publish an event for a change that was rolled back.
+type OutboxEvent struct {
+	ID            int64
+	AggregateType string
+	// AggregateID is used as the kafka key, events of the same aggregate are published in order.
+	AggregateID   string
+	EventType     string
+	DataFormat    string
+	Payload       []byte
+	Attempts      int
+	LastError     string
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
+	SentAt        *time.Time
+}
+
+// Effects are rows that have to be written in the same database transaction as the transaction row itself.
+type Effects struct {
+	Outbox  []*OutboxEvent
+	History []*TransactionEvent
+	// Journal are the ledger entries of the change, e.g. the credit of a completed deposit.
+	Journal []*ledger.Entry
+	// Holds fail the whole change with ledger.ErrInsufficientFunds when the balance doesn't cover them.
+	Holds       []*ledger.Hold
+	Settlements []*ledger.Settlement
+	// Compliance is the decision of the compliance rules a new transaction was checked against.
+	Compliance *compliance.Decision
+	// Risk is the fraud risk score of a new transaction.
+	Risk *risk.Assessment
+	// Routing is how the gateway of a new transaction was picked, when it didn't ask for one.
+	Routing *routing.Decision
+	// Review is an operator's decision on a transaction in review. Fails the whole change with
+	// ErrAlreadyReviewed when the transaction already has one.
+	Review *ReviewDecision
+	// Limits are the daily and weekly limits of a new transaction, checked again before it is inserted.
+	// Fails the whole change with a *limits.Violation when the transaction breaks one.
+	Limits *limits.Recheck
+}
+
+type OutboxRepository interface {
+	// Claim takes the relay lock. ok is false when another instance is already relaying.
+	// The lock is held until release is called.
+	Claim(ctx context.Context) (release func(), ok bool, err error)
+
+	// FetchPending returns the oldest unsent events that are due at now, in the order they were written.
+	// Events behind an event of the same aggregate that is waiting for its retry are left out.
+	FetchPending(ctx context.Context, now time.Time, limit int) ([]*OutboxEvent, error)
+
+	MarkSent(ctx context.Context, id int64) error
+
+	// MarkFailed records a failed publish and when it should be tried again.
+	MarkFailed(ctx context.Context, id int64, attempts int, lastError string, nextAttemptAt time.Time) error
+
+	// DeadLetter moves an event that can't be published to the dead_letter_events table.
+	DeadLetter(ctx context.Context, event *OutboxEvent, topic string) error
+}
+
+type SQLOutboxRepository struct {
+	db *sql.DB
+}
+
+func NewOutboxRepository(db *sql.DB) OutboxRepository {
+	return &SQLOutboxRepository{db: db}
+}
+
+func (r *SQLOutboxRepository) Claim(ctx context.Context) (func(), bool, error) {
+	// Advisory locks belong to a session, so we keep one connection for as long as we hold it.
+	// If the instance dies the connection is closed and postgres releases the lock for us.
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get connection: %v", err)
+	}
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, outboxRelayLockID).Scan(&locked); err != nil {
+		conn.Close()
+		return nil, false, fmt.Errorf("failed to take relay lock: %v", err)
+	}
+	if !locked {
+		conn.Close()
+		return nil, false, nil
+	}
+
+	release := func() {
+		conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, outboxRelayLockID)
+		conn.Close()
+	}
+	return release, true, nil
+}
+
+func (r *SQLOutboxRepository) FetchPending(ctx context.Context, now time.Time, limit int) ([]*OutboxEvent, error) {
+	// Events waiting for their retry, and the events of their aggregate after them, can't be published
+	// yet. Leaving them out keeps them from filling the batch and holding back everything else.
+	query := `
+		SELECT e.id, e.aggregate_type, e.aggregate_id, e.event_type, e.data_format, e.payload, e.attempts,
+			   COALESCE(e.last_error, ''), e.next_attempt_at, e.created_at
+		FROM outbox_events e
+		WHERE e.sent_at IS NULL
+		  AND e.next_attempt_at <= $1
+		  AND NOT EXISTS (
+			  SELECT 1 FROM outbox_events earlier
+			  WHERE earlier.sent_at IS NULL
+				AND earlier.aggregate_type = e.aggregate_type
+				AND earlier.aggregate_id = e.aggregate_id
+				AND earlier.id < e.id
+				AND earlier.next_attempt_at > $1
+		  )
+		ORDER BY e.id
+		LIMIT $2`
+
+	rows, err := r.db.QueryContext(ctx, query, now, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch outbox events: %v", err)
+	}
+	defer rows.Close()
+
+	var events []*OutboxEvent
+	for rows.Next() {
+		var event OutboxEvent
+		if err := rows.Scan(
+			&event.ID,
+			&event.AggregateType,
+			&event.AggregateID,
+			&event.EventType,
+			&event.DataFormat,
+			&event.Payload,
+			&event.Attempts,
+			&event.LastError,
+			&event.NextAttemptAt,
+			&event.CreatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan outbox event: %v", err)
+		}
+		events = append(events, &event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (r *SQLOutboxRepository) MarkSent(ctx context.Context, id int64) error {
+	if _, err := r.db.ExecContext(ctx, `UPDATE outbox_events SET sent_at = $1 WHERE id = $2`, time.Now(), id); err != nil {
+		return fmt.Errorf("failed to mark outbox event %d as sent: %v", id, err)
+	}
+	return nil
+}
+
+func (r *SQLOutboxRepository) MarkFailed(ctx context.Context, id int64, attempts int, lastError string, nextAttemptAt time.Time) error {
+	query := `UPDATE outbox_events SET attempts = $1, last_error = $2, next_attempt_at = $3 WHERE id = $4`
+	if _, err := r.db.ExecContext(ctx, query, attempts, lastError, nextAttemptAt, id); err != nil {
+		return fmt.Errorf("failed to mark outbox event %d as failed: %v", id, err)
+	}
+	return nil
+}
+
+func (r *SQLOutboxRepository) DeadLetter(ctx context.Context, event *OutboxEvent, topic string) error {
+	return RunInTx(ctx, r.db, func(tx *sql.Tx) error {
+		query := `INSERT INTO dead_letter_events (outbox_event_id, aggregate_type, aggregate_id, event_type, data_format,
+					  topic, payload, attempts, last_error, created_at, dead_lettered_at)
+				  VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, $9, $10, $11)`
+		_, err := tx.ExecContext(ctx, query,
+			event.ID,
+			event.AggregateType,
+			event.AggregateID,
+			event.EventType,
+			event.DataFormat,
+			topic,
+			event.Payload,
+			event.Attempts,
+			event.LastError,
+			event.CreatedAt,
+			time.Now(),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to dead-letter outbox event %d: %v", event.ID, err)
+		}
+
+		if _, err := tx.ExecContext(ctx, `DELETE FROM outbox_events WHERE id = $1`, event.ID); err != nil {
+			return fmt.Errorf("failed to remove outbox event %d: %v", event.ID, err)
+		}
+		return nil
+	})
+}
+
+// InsertOutboxEvent writes the event using the given connection or transaction.
+func InsertOutboxEvent(ctx context.Context, q DBTX, event *OutboxEvent) error {
+	query := `INSERT INTO outbox_events (aggregate_type, aggregate_id, event_type, data_format, payload, next_attempt_at, created_at)
+			  VALUES ($1, $2, $3, $4, $5, $6, $6) RETURNING id`
+
+	now := time.Now()
+	err := q.QueryRowContext(ctx, query,
+		event.AggregateType,
+		event.AggregateID,
+		event.EventType,
+		event.DataFormat,
+		event.Payload,
+		now,
+	).Scan(&event.ID)
+	if err != nil {
+		return fmt.Errorf("failed to insert outbox event: %v", err)
+	}
+
+	event.NextAttemptAt = now
+	event.CreatedAt = now
+	return nil
+}
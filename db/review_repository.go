@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"payment-gateway/internal/compliance"
+
+	"github.com/lib/pq"
+)
+
+// Actions of a review decision.
+const (
+	ReviewApprove = "approve"
+	ReviewReject  = "reject"
+)
+
+// ErrAlreadyReviewed is returned when a transaction already has a review decision.
+var ErrAlreadyReviewed = errors.New("transaction has already been reviewed")
+
+// ReviewDecision is what an operator decided about a transaction parked for review.
+// Decisions are append-only, they are the audit trail of the review queue.
+type ReviewDecision struct {
+	ID            int64
+	TransactionID int
+	ReviewerID    int
+	Action        string
+	Reason        string
+	CreatedAt     time.Time
+}
+
+// ReviewCase is a transaction waiting in the review queue, with the compliance decision that parked it.
+type ReviewCase struct {
+	Transaction *Transaction
+	Compliance  *compliance.Decision
+}
+
+// InsertReviewDecision stores the decision. A transaction is only ever reviewed once, a second
+// decision returns ErrAlreadyReviewed, so two operators can't both act on the same transaction.
+func InsertReviewDecision(ctx context.Context, q DBTX, decision *ReviewDecision) error {
+	query := `INSERT INTO review_decisions (transaction_id, reviewer_id, action, reason, created_at)
+			  VALUES ($1, $2, $3, $4, $5) RETURNING id`
+
+	if decision.CreatedAt.IsZero() {
+		decision.CreatedAt = time.Now()
+	}
+	err := q.QueryRowContext(ctx, query, decision.TransactionID, decision.ReviewerID, decision.Action, decision.Reason, decision.CreatedAt).
+		Scan(&decision.ID)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrAlreadyReviewed
+	}
+	if err != nil {
+		return fmt.Errorf("failed to insert review decision: %v", err)
+	}
+	return nil
+}
+
+// ListReviewQueue returns the transactions in review, oldest first, with their latest compliance decision.
+func ListReviewQueue(ctx context.Context, q DBTX, limit int) ([]*ReviewCase, error) {
+	query := `SELECT ` + transactionColumns + `, d.outcome, d.results, d.decided_at
+			  FROM transactions t
+			  LEFT JOIN LATERAL (
+				  SELECT outcome, results, created_at AS decided_at FROM compliance_decisions
+				  WHERE transaction_id = t.id ORDER BY id DESC LIMIT 1
+			  ) d ON TRUE
+			  WHERE t.status = $1
+			  ORDER BY t.created_at, t.id
+			  LIMIT $2`
+
+	rows, err := q.QueryContext(ctx, query, StatusReview, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch review queue: %v", err)
+	}
+	defer rows.Close()
+
+	var cases []*ReviewCase
+	for rows.Next() {
+		var trx Transaction
+		var outcome sql.NullString
+		var results []byte
+		var decidedAt sql.NullTime
+		if err := rows.Scan(
+			&trx.ID,
+			&trx.GatewayTxnId,
+			&trx.Amount.Minor,
+			&trx.Amount.Currency,
+			&trx.Type,
+			&trx.Status,
+			&trx.UserID,
+			&trx.GatewayID,
+			&trx.CountryID,
+			&trx.ParentID,
+			&trx.CreatedAt,
+			&trx.RequestedGatewayID,
+			&trx.FallbackReason,
+			&outcome,
+			&results,
+			&decidedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan review case: %v", err)
+		}
+
+		reviewCase := &ReviewCase{Transaction: &trx}
+		if outcome.Valid {
+			decision := &compliance.Decision{TransactionID: trx.ID, Outcome: outcome.String, CreatedAt: decidedAt.Time}
+			if err := json.Unmarshal(results, &decision.Results); err != nil {
+				return nil, fmt.Errorf("failed to decode compliance results of transaction %d: %v", trx.ID, err)
+			}
+			reviewCase.Compliance = decision
+		}
+		cases = append(cases, reviewCase)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return cases, nil
+}
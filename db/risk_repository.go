@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"payment-gateway/internal/risk"
+)
+
+// RiskRepository is what the risk scorer reads from the database.
+type RiskRepository interface {
+	risk.History
+}
+
+type SQLRiskRepository struct {
+	db *sql.DB
+}
+
+func NewRiskRepository(db *sql.DB) RiskRepository {
+	return &SQLRiskRepository{db: db}
+}
+
+func (r *SQLRiskRepository) CountRecent(ctx context.Context, userID int, since time.Time) (int, error) {
+	query := `SELECT COUNT(*) FROM transactions WHERE user_id = $1 AND created_at >= $2`
+
+	var count int
+	if err := r.db.QueryRowContext(ctx, query, userID, since).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count transactions: %v", err)
+	}
+	return count, nil
+}
+
+func (r *SQLRiskRepository) RecentAmounts(ctx context.Context, userID int, transactionType string, currency string, limit int) ([]int64, error) {
+	query := `SELECT amount FROM transactions
+			  WHERE user_id = $1 AND type = $2 AND currency = $3 AND status = $4
+			  ORDER BY created_at DESC, id DESC
+			  LIMIT $5`
+
+	rows, err := r.db.QueryContext(ctx, query, userID, transactionType, currency, StatusCompleted, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch amounts: %v", err)
+	}
+	defer rows.Close()
+
+	var amounts []int64
+	for rows.Next() {
+		var amount int64
+		if err := rows.Scan(&amount); err != nil {
+			return nil, fmt.Errorf("failed to scan amount: %v", err)
+		}
+		amounts = append(amounts, amount)
+	}
+	return amounts, rows.Err()
+}
+
+func (r *SQLRiskRepository) UsedGateway(ctx context.Context, userID int, gatewayID int) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM transactions WHERE user_id = $1 AND gateway_id = $2 AND status = $3)`
+
+	var used bool
+	if err := r.db.QueryRowContext(ctx, query, userID, gatewayID, StatusCompleted).Scan(&used); err != nil {
+		return false, fmt.Errorf("failed to check gateway usage: %v", err)
+	}
+	return used, nil
+}
+
+func (r *SQLRiskRepository) UserCountry(ctx context.Context, userID int) (int, bool, error) {
+	query := `SELECT country_id FROM users WHERE id = $1`
+
+	var country sql.NullInt64
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(&country)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to fetch user country: %v", err)
+	}
+	return int(country.Int64), country.Valid, nil
+}
+
+// InsertRiskAssessment stores the risk score a transaction was created with.
+func InsertRiskAssessment(ctx context.Context, q DBTX, assessment *risk.Assessment) error {
+	query := `INSERT INTO risk_assessments (transaction_id, score, outcome, features, created_at)
+			  VALUES ($1, $2, $3, $4, $5) RETURNING id`
+
+	features, err := json.Marshal(assessment.Features)
+	if err != nil {
+		return fmt.Errorf("failed to encode risk features: %v", err)
+	}
+	if assessment.CreatedAt.IsZero() {
+		assessment.CreatedAt = time.Now()
+	}
+	err = q.QueryRowContext(ctx, query, assessment.TransactionID, assessment.Score, assessment.Outcome, features, assessment.CreatedAt).Scan(&assessment.ID)
+	if err != nil {
+		return fmt.Errorf("failed to insert risk assessment: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"payment-gateway/internal/routing"
+)
+
+// InsertRoutingDecision stores the gateway the router picked for a transaction and the scores it picked it on.
+func InsertRoutingDecision(ctx context.Context, q DBTX, decision *routing.Decision) error {
+	query := `INSERT INTO routing_decisions (transaction_id, country_id, gateway_id, weights, scores, created_at)
+			  VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+
+	weights, err := json.Marshal(decision.Weights)
+	if err != nil {
+		return fmt.Errorf("failed to encode routing weights: %v", err)
+	}
+	scores, err := json.Marshal(decision.Scores)
+	if err != nil {
+		return fmt.Errorf("failed to encode routing scores: %v", err)
+	}
+	if decision.CreatedAt.IsZero() {
+		decision.CreatedAt = time.Now()
+	}
+	err = q.QueryRowContext(ctx, query, decision.TransactionID, decision.CountryID, decision.GatewayID, weights, scores, decision.CreatedAt).Scan(&decision.ID)
+	if err != nil {
+		return fmt.Errorf("failed to insert routing decision: %v", err)
+	}
+	return nil
+}
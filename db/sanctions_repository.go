@@ -0,0 +1,107 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"payment-gateway/internal/sanctions"
+
+	"github.com/lib/pq"
+)
+
+// SanctionsRepository stores the sanctions lists and looks up the names users are screened by.
+type SanctionsRepository interface {
+	sanctions.Store
+	sanctions.UserStore
+}
+
+type SQLSanctionsRepository struct {
+	db *sql.DB
+}
+
+func NewSanctionsRepository(db *sql.DB) SanctionsRepository {
+	return &SQLSanctionsRepository{db: db}
+}
+
+func (r *SQLSanctionsRepository) Entries(ctx context.Context) ([]*sanctions.Entry, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT list, ref, type, names FROM sanctions_entries ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch sanctions entries: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []*sanctions.Entry
+	for rows.Next() {
+		var entry sanctions.Entry
+		if err := rows.Scan(&entry.List, &entry.Ref, &entry.Type, pq.Array(&entry.Names)); err != nil {
+			return nil, fmt.Errorf("failed to scan sanctions entry: %v", err)
+		}
+		entries = append(entries, &entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (r *SQLSanctionsRepository) Lists(ctx context.Context) ([]*sanctions.ListInfo, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT name, source, entries, refreshed_at FROM sanctions_lists ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch sanctions lists: %v", err)
+	}
+	defer rows.Close()
+
+	var lists []*sanctions.ListInfo
+	for rows.Next() {
+		var list sanctions.ListInfo
+		if err := rows.Scan(&list.Name, &list.Source, &list.Entries, &list.RefreshedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan sanctions list: %v", err)
+		}
+		lists = append(lists, &list)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return lists, nil
+}
+
+// ReplaceList replaces the entries of the list in one transaction, screening never sees half a list.
+func (r *SQLSanctionsRepository) ReplaceList(ctx context.Context, list string, source string, entries []*sanctions.Entry) error {
+	return RunInTx(ctx, r.db, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `INSERT INTO sanctions_lists (name, source, entries, refreshed_at) VALUES ($1, $2, $3, $4)
+						   ON CONFLICT (name) DO UPDATE SET source = EXCLUDED.source, entries = EXCLUDED.entries, refreshed_at = EXCLUDED.refreshed_at`,
+			list, source, len(entries), time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to save sanctions list: %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM sanctions_entries WHERE list = $1`, list); err != nil {
+			return fmt.Errorf("failed to delete sanctions entries: %v", err)
+		}
+
+		stmt, err := tx.Prepare(`INSERT INTO sanctions_entries (list, ref, type, names) VALUES ($1, $2, $3, $4)`)
+		if err != nil {
+			return fmt.Errorf("failed to prepare sanctions entry insert: %v", err)
+		}
+		defer stmt.Close()
+		for _, entry := range entries {
+			if _, err := stmt.ExecContext(ctx, list, entry.Ref, entry.Type, pq.Array(entry.Names)); err != nil {
+				return fmt.Errorf("failed to insert sanctions entry %s: %v", entry.Ref, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (r *SQLSanctionsRepository) ScreeningName(ctx context.Context, userID int) (string, error) {
+	var name string
+	err := r.db.QueryRowContext(ctx, `SELECT COALESCE(NULLIF(full_name, ''), username) FROM users WHERE id = $1`, userID).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("user %d not found", userID)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch user: %v", err)
+	}
+	return name, nil
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// TransactionEvent is one change of a transaction's status. The events are append-only,
+// so we can always tell when and why a transaction ended up where it is.
+type TransactionEvent struct {
+	ID            int64
+	TransactionID int
+	// FromStatus is empty for the status a transaction is created with.
+	FromStatus string
+	ToStatus   string
+	Reason     string
+	// Source is what caused the change, e.g. "api", "gateway", "callback" or "reconciler".
+	Source string
+	// Payload is the raw body of the callback that caused the change, as the gateway sent it.
+	Payload       []byte
+	PayloadFormat string
+	CreatedAt     time.Time
+}
+
+// InsertTransactionEvent writes the event using the given connection or transaction.
+func InsertTransactionEvent(ctx context.Context, q DBTX, event *TransactionEvent) error {
+	query := `INSERT INTO transaction_events (transaction_id, from_status, to_status, reason, source, payload, payload_format, created_at)
+			  VALUES ($1, NULLIF($2, ''), $3, $4, $5, $6, NULLIF($7, ''), $8) RETURNING id`
+
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	err := q.QueryRowContext(ctx, query,
+		event.TransactionID,
+		event.FromStatus,
+		event.ToStatus,
+		event.Reason,
+		event.Source,
+		event.Payload,
+		event.PayloadFormat,
+		event.CreatedAt,
+	).Scan(&event.ID)
+	if err != nil {
+		return fmt.Errorf("failed to insert transaction event: %v", err)
+	}
+	return nil
+}
+
+// GetTransactionEvents returns the events of a transaction, oldest first.
+func GetTransactionEvents(ctx context.Context, db DBTX, transactionID int) ([]*TransactionEvent, error) {
+	query := `SELECT id, transaction_id, COALESCE(from_status, ''), to_status, reason, source, payload,
+				  COALESCE(payload_format, ''), created_at
+			  FROM transaction_events WHERE transaction_id = $1 ORDER BY id`
+
+	rows, err := db.QueryContext(ctx, query, transactionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch transaction events: %v", err)
+	}
+	defer rows.Close()
+
+	var events []*TransactionEvent
+	for rows.Next() {
+		var event TransactionEvent
+		if err := rows.Scan(
+			&event.ID,
+			&event.TransactionID,
+			&event.FromStatus,
+			&event.ToStatus,
+			&event.Reason,
+			&event.Source,
+			&event.Payload,
+			&event.PayloadFormat,
+			&event.CreatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan transaction event: %v", err)
+		}
+		events = append(events, &event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -1,13 +1,46 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"strconv"
 )
 
+// ErrRefundExceedsAmount is returned when a refund would take the total refunded above the amount of the transaction.
+var ErrRefundExceedsAmount = errors.New("refund exceeds the refundable amount")
+
+// ErrStaleTransaction is returned when a transaction is saved from a status it is no longer in,
+// because another change was saved first.
+var ErrStaleTransaction = errors.New("transaction has changed")
+
 type TransactionRepository interface {
-	Create(tx *Transaction) (*Transaction, error)
-	Update(tx Transaction) error
-	GetTransactionByGatewayTxnId(gatewayTxnId string) (*Transaction, error)
+	// Create saves the transaction together with its effects, all or nothing.
+	Create(ctx context.Context, tx *Transaction, effects *Effects) (*Transaction, error)
+	// Update saves the transaction together with its effects, all or nothing, if it is still in status from.
+	// Returns ErrStaleTransaction when it isn't.
+	Update(ctx context.Context, tx Transaction, from string, effects *Effects) error
+	// GetTransactionByGatewayTxnId returns the transaction of the gateway with that id, ids are only unique
+	// within a gateway. Nil when there is none.
+	GetTransactionByGatewayTxnId(ctx context.Context, gatewayID int, gatewayTxnId string) (*Transaction, error)
+	GetTransactionByID(ctx context.Context, id int) (*Transaction, error)
+
+	// ListTransactions returns a page of a user's transactions, newest first.
+	ListTransactions(ctx context.Context, filter TransactionFilter) ([]*Transaction, error)
+
+	// GetRefundedAmount returns how much of a transaction has been refunded so far, failed refunds excluded.
+	GetRefundedAmount(ctx context.Context, parentID int) (int64, error)
+	GetRefunds(ctx context.Context, parentID int) ([]*Transaction, error)
+
+	// GetEvents returns the status history of a transaction, oldest first.
+	GetEvents(ctx context.Context, transactionID int) ([]*TransactionEvent, error)
+
+	// CreateRefund saves a refund of refund.ParentID. The parent is locked while the refunds are summed,
+	// so concurrent refunds can never add up to more than its amount. Returns ErrRefundExceedsAmount when they would.
+	CreateRefund(ctx context.Context, refund *Transaction, effects *Effects) (*Transaction, error)
+
+	// ListReviewQueue returns the transactions waiting for an operator, oldest first.
+	ListReviewQueue(ctx context.Context, limit int) ([]*ReviewCase, error)
 }
 
 type SQLTransactionRepository struct {
@@ -20,14 +53,179 @@ var NewTransactionRepository = func(db *sql.DB) TransactionRepository {
 	}
 }
 
-func (r *SQLTransactionRepository) Create(tx *Transaction) (*Transaction, error) {
-	return CreateTransaction(r.db, tx)
+func (r *SQLTransactionRepository) Create(ctx context.Context, tx *Transaction, effects *Effects) (*Transaction, error) {
+	var created *Transaction
+	err := RunInTx(ctx, r.db, func(sqlTx *sql.Tx) error {
+		if effects != nil && effects.Limits != nil {
+			if err := RecheckLimits(ctx, sqlTx, effects.Limits); err != nil {
+				return err
+			}
+		}
+		var err error
+		created, err = CreateTransaction(ctx, sqlTx, tx)
+		if err != nil {
+			return err
+		}
+		return writeEffects(ctx, sqlTx, created, effects)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (r *SQLTransactionRepository) Update(ctx context.Context, tx Transaction, from string, effects *Effects) error {
+	return RunInTx(ctx, r.db, func(sqlTx *sql.Tx) error {
+		if err := UpdateTransaction(ctx, sqlTx, tx, from); err != nil {
+			return err
+		}
+		return writeEffects(ctx, sqlTx, &tx, effects)
+	})
+}
+
+func (r *SQLTransactionRepository) GetTransactionByGatewayTxnId(ctx context.Context, gatewayID int, gatewayTxnId string) (*Transaction, error) {
+	return GetTransactionByGatewayTxnId(ctx, r.db, gatewayID, gatewayTxnId)
 }
 
-func (r *SQLTransactionRepository) Update(tx Transaction) error {
-	return UpdateTransaction(r.db, tx)
+func (r *SQLTransactionRepository) GetTransactionByID(ctx context.Context, id int) (*Transaction, error) {
+	return GetTransactionByID(ctx, r.db, id, false)
 }
 
-func (r *SQLTransactionRepository) GetTransactionByGatewayTxnId(gatewayTxnId string) (*Transaction, error) {
-	return GetTransactionByGatewayTxnId(r.db, gatewayTxnId)
+func (r *SQLTransactionRepository) ListTransactions(ctx context.Context, filter TransactionFilter) ([]*Transaction, error) {
+	return ListTransactions(ctx, r.db, filter)
+}
+
+func (r *SQLTransactionRepository) GetRefundedAmount(ctx context.Context, parentID int) (int64, error) {
+	return GetRefundedAmount(ctx, r.db, parentID)
+}
+
+func (r *SQLTransactionRepository) GetRefunds(ctx context.Context, parentID int) ([]*Transaction, error) {
+	return GetRefunds(ctx, r.db, parentID)
+}
+
+func (r *SQLTransactionRepository) GetEvents(ctx context.Context, transactionID int) ([]*TransactionEvent, error) {
+	return GetTransactionEvents(ctx, r.db, transactionID)
+}
+
+func (r *SQLTransactionRepository) CreateRefund(ctx context.Context, refund *Transaction, effects *Effects) (*Transaction, error) {
+	var created *Transaction
+	err := RunInTx(ctx, r.db, func(sqlTx *sql.Tx) error {
+		parent, err := GetTransactionByID(ctx, sqlTx, refund.ParentID, true)
+		if err != nil {
+			return err
+		}
+		if parent == nil {
+			return sql.ErrNoRows
+		}
+
+		refunded, err := GetRefundedAmount(ctx, sqlTx, parent.ID)
+		if err != nil {
+			return err
+		}
+		if refunded+refund.Amount.Minor > parent.Amount.Minor {
+			return ErrRefundExceedsAmount
+		}
+
+		created, err = CreateTransaction(ctx, sqlTx, refund)
+		if err != nil {
+			return err
+		}
+		return writeEffects(ctx, sqlTx, created, effects)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+func (r *SQLTransactionRepository) ListReviewQueue(ctx context.Context, limit int) ([]*ReviewCase, error) {
+	return ListReviewQueue(ctx, r.db, limit)
+}
+
+func writeEffects(ctx context.Context, q DBTX, trx *Transaction, effects *Effects) error {
+	if effects == nil {
+		return nil
+	}
+
+	for _, event := range effects.History {
+		if event.TransactionID == 0 {
+			event.TransactionID = trx.ID
+		}
+		if err := InsertTransactionEvent(ctx, q, event); err != nil {
+			return err
+		}
+	}
+
+	if decision := effects.Compliance; decision != nil {
+		if decision.TransactionID == 0 {
+			decision.TransactionID = trx.ID
+		}
+		if err := InsertComplianceDecision(ctx, q, decision); err != nil {
+			return err
+		}
+	}
+
+	if assessment := effects.Risk; assessment != nil {
+		if assessment.TransactionID == 0 {
+			assessment.TransactionID = trx.ID
+		}
+		if err := InsertRiskAssessment(ctx, q, assessment); err != nil {
+			return err
+		}
+	}
+
+	if decision := effects.Routing; decision != nil {
+		if decision.TransactionID == 0 {
+			decision.TransactionID = trx.ID
+		}
+		if err := InsertRoutingDecision(ctx, q, decision); err != nil {
+			return err
+		}
+	}
+
+	if decision := effects.Review; decision != nil {
+		if decision.TransactionID == 0 {
+			decision.TransactionID = trx.ID
+		}
+		if err := InsertReviewDecision(ctx, q, decision); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range effects.Journal {
+		if entry.TransactionID == 0 {
+			entry.TransactionID = trx.ID
+		}
+		if err := InsertJournalEntry(ctx, q, entry); err != nil {
+			return err
+		}
+	}
+
+	for _, hold := range effects.Holds {
+		if hold.TransactionID == 0 {
+			hold.TransactionID = trx.ID
+		}
+		if err := PlaceHold(ctx, q, hold); err != nil {
+			return err
+		}
+	}
+
+	for _, settlement := range effects.Settlements {
+		if settlement.TransactionID == 0 {
+			settlement.TransactionID = trx.ID
+		}
+		if err := SettleHold(ctx, q, settlement); err != nil {
+			return err
+		}
+	}
+
+	for _, event := range effects.Outbox {
+		// The id of a new transaction is only known after the insert.
+		if event.AggregateID == "" {
+			event.AggregateID = strconv.Itoa(trx.ID)
+		}
+		if err := InsertOutboxEvent(ctx, q, event); err != nil {
+			return err
+		}
+	}
+	return nil
 }
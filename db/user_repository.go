@@ -0,0 +1,32 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+type UserRepository interface {
+	// GetUserEmail returns the email of the user, which is also where payouts to PayPal go.
+	GetUserEmail(ctx context.Context, userID int) (string, error)
+}
+
+type userRepository struct {
+	db *sql.DB
+}
+
+func NewUserRepository(db *sql.DB) UserRepository {
+	return &userRepository{db: db}
+}
+
+func (r *userRepository) GetUserEmail(ctx context.Context, userID int) (string, error) {
+	var email string
+	err := r.db.QueryRowContext(ctx, `SELECT email FROM users WHERE id = $1`, userID).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("user %d not found", userID)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch user: %v", err)
+	}
+	return email, nil
+}
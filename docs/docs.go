@@ -23,8 +23,282 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/admin/reviews": {
+            "get": {
+                "security": [
+                    {
+                        "Bearer": []
+                    }
+                ],
+                "description": "Transactions flagged by the compliance checks or a limit, oldest first. They are not sent to the gateway until an operator approves them.",
+                "produces": [
+                    "application/json",
+                    "application/xml"
+                ],
+                "tags": [
+                    "Reviews"
+                ],
+                "summary": "List the review queue",
+                "parameters": [
+                    {
+                        "maximum": 100,
+                        "minimum": 1,
+                        "type": "integer",
+                        "description": "Number of transactions, 20 by default",
+                        "name": "limit",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Transactions in review",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/models.APIResponse"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/models.ReviewQueue"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid limit",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing, invalid or expired bearer token",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "403": {
+                        "description": "Token without the reviewer role",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/reviews/{id}/approve": {
+            "post": {
+                "security": [
+                    {
+                        "Bearer": []
+                    }
+                ],
+                "description": "Sends the transaction to its gateway. The decision is audited with the reviewer taken from the token.",
+                "consumes": [
+                    "application/json",
+                    "application/xml"
+                ],
+                "produces": [
+                    "application/json",
+                    "application/xml"
+                ],
+                "tags": [
+                    "Reviews"
+                ],
+                "summary": "Approve a transaction in review",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Transaction identifier",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Reason of the approval",
+                        "name": "request",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/models.ReviewRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Transaction approved",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/models.APIResponse"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/models.ReviewResult"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing, invalid or expired bearer token",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "403": {
+                        "description": "Token without the reviewer role",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "404": {
+                        "description": "Transaction not found",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "409": {
+                        "description": "Transaction is not in review, has already been reviewed or its hold has expired",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "502": {
+                        "description": "Payment gateway error, the transaction failed",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/reviews/{id}/reject": {
+            "post": {
+                "security": [
+                    {
+                        "Bearer": []
+                    }
+                ],
+                "description": "Fails the transaction without sending it to the gateway and gives back what was held for it.\nThe decision is audited with the reviewer taken from the token.",
+                "consumes": [
+                    "application/json",
+                    "application/xml"
+                ],
+                "produces": [
+                    "application/json",
+                    "application/xml"
+                ],
+                "tags": [
+                    "Reviews"
+                ],
+                "summary": "Reject a transaction in review",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Transaction identifier",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Reason of the rejection",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/models.ReviewRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Transaction rejected",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/models.APIResponse"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/models.ReviewResult"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request or missing reason",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing, invalid or expired bearer token",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "403": {
+                        "description": "Token without the reviewer role",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "404": {
+                        "description": "Transaction not found",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "409": {
+                        "description": "Transaction is not in review or has already been reviewed",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    }
+                }
+            }
+        },
         "/deposit": {
             "post": {
+                "security": [
+                    {
+                        "Bearer": []
+                    }
+                ],
                 "description": "Process a deposit request with idempotency support",
                 "consumes": [
                     "application/json",
@@ -82,8 +356,32 @@ const docTemplate = `{
                             "$ref": "#/definitions/models.APIError"
                         }
                     },
+                    "401": {
+                        "description": "Missing, invalid or expired bearer token",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "402": {
+                        "description": "Declined by the payment gateway, reason tells why",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "403": {
+                        "description": "Rejected by compliance checks",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "409": {
+                        "description": "A request with the same Idempotency-Key is in progress",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
                     "422": {
-                        "description": "Payment processing failed",
+                        "description": "A limit is exceeded (code tells which), payment processing failed or Idempotency-Key reused with a different request",
                         "schema": {
                             "$ref": "#/definitions/models.APIError"
                         }
@@ -99,13 +397,19 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/models.APIError"
                         }
+                    },
+                    "503": {
+                        "description": "The gateway is disabled and the merchant has no fallback for it, or no gateway can take a transaction without gateway_id",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
                     }
                 }
             }
         },
-        "/payment-callback": {
+        "/payment-callback/{gateway}": {
             "post": {
-                "description": "Process callback notifications from payment gateways",
+                "description": "Process callback notifications from payment gateways, for payments and refunds alike.\nCallbacks for a status the transaction has already moved past are acknowledged and ignored.\nGateways with a format of their own, like the webhook events of Stripe and PayPal, are read by their adapter instead.",
                 "consumes": [
                     "application/json",
                     "application/xml"
@@ -119,6 +423,31 @@ const docTemplate = `{
                 ],
                 "summary": "Handle payment gateway callback",
                 "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Name of the gateway sending the callback, e.g. stripe",
+                        "name": "gateway",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "API key of the gateway sending the callback (hmac-sha256 scheme)",
+                        "name": "X-Gateway-API-Key",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Unix timestamp the callback was signed at (hmac-sha256 scheme)",
+                        "name": "X-Timestamp",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Hex encoded HMAC-SHA256 of timestamp.body (hmac-sha256 scheme)",
+                        "name": "X-Signature",
+                        "in": "header"
+                    },
                     {
                         "description": "Callback notification details",
                         "name": "request",
@@ -127,17 +456,376 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/models.PaymentCallback"
                         }
-                    }
-                ],
-                "responses": {
-                    "200": {
-                        "description": "Callback processed successfully",
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Callback processed successfully",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid callback data or validation error",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "401": {
+                        "description": "Unknown gateway or invalid signature",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "404": {
+                        "description": "Transaction not found",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "409": {
+                        "description": "The transaction can't move to this status, e.g. it already failed",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    }
+                }
+            }
+        },
+        "/transactions": {
+            "get": {
+                "security": [
+                    {
+                        "Bearer": []
+                    }
+                ],
+                "description": "The user's transactions, newest first. Pass next_cursor of a page as cursor to get the next one,\nwith the same filters. There are no more pages when next_cursor is missing.",
+                "produces": [
+                    "application/json",
+                    "application/xml"
+                ],
+                "tags": [
+                    "Transactions"
+                ],
+                "summary": "List transactions",
+                "parameters": [
+                    {
+                        "enum": [
+                            "initiated",
+                            "review",
+                            "pending",
+                            "authorized",
+                            "completed",
+                            "failed",
+                            "refunded",
+                            "reversed"
+                        ],
+                        "type": "string",
+                        "description": "Only transactions with this status",
+                        "name": "status",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "deposit",
+                            "withdraw",
+                            "refund"
+                        ],
+                        "type": "string",
+                        "description": "Only transactions of this type",
+                        "name": "type",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Only transactions of this gateway",
+                        "name": "gateway_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "example": "USD",
+                        "description": "Only transactions in this currency (ISO 4217)",
+                        "name": "currency",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "example": "2024-01-01T00:00:00Z",
+                        "description": "Only transactions created at or after this time (RFC 3339)",
+                        "name": "created_from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "example": "2024-02-01T00:00:00Z",
+                        "description": "Only transactions created before this time (RFC 3339)",
+                        "name": "created_to",
+                        "in": "query"
+                    },
+                    {
+                        "maximum": 100,
+                        "minimum": 1,
+                        "type": "integer",
+                        "description": "Page size, 20 by default",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "next_cursor of the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Page of transactions",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/models.APIResponse"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/models.TransactionPage"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid filter or cursor",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing, invalid or expired bearer token",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    }
+                }
+            }
+        },
+        "/transactions/{id}": {
+            "get": {
+                "security": [
+                    {
+                        "Bearer": []
+                    }
+                ],
+                "description": "One of the user's transactions. Transactions of other users are reported as not found.\nThe response is JSON or XML, as asked for in the Accept header.",
+                "produces": [
+                    "application/json",
+                    "application/xml"
+                ],
+                "tags": [
+                    "Transactions"
+                ],
+                "summary": "Get a transaction",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Transaction identifier",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "The transaction",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/models.APIResponse"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/models.Transaction"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "401": {
+                        "description": "Missing, invalid or expired bearer token",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "404": {
+                        "description": "Transaction not found",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    }
+                }
+            }
+        },
+        "/transactions/{id}/events": {
+            "get": {
+                "security": [
+                    {
+                        "Bearer": []
+                    }
+                ],
+                "description": "Every status change of one of the user's transactions, oldest first, with its source, reason and the raw gateway callback.\nThe response is JSON or XML, as asked for in the Accept header.",
+                "produces": [
+                    "application/json",
+                    "application/xml"
+                ],
+                "tags": [
+                    "Transactions"
+                ],
+                "summary": "Get the status history of a transaction",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Transaction identifier",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Status history of the transaction",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/models.APIResponse"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/models.TransactionTimeline"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "401": {
+                        "description": "Missing, invalid or expired bearer token",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "404": {
+                        "description": "Transaction not found",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    }
+                }
+            }
+        },
+        "/transactions/{id}/refunds": {
+            "post": {
+                "security": [
+                    {
+                        "Bearer": []
+                    }
+                ],
+                "description": "Refund a completed deposit fully or partially. Without an amount whatever hasn't been refunded yet is refunded.\nThe refund is a transaction of its own, the gateway confirms it through the payment callback.",
+                "consumes": [
+                    "application/json",
+                    "application/xml"
+                ],
+                "produces": [
+                    "application/json",
+                    "application/xml"
+                ],
+                "tags": [
+                    "Transactions"
+                ],
+                "summary": "Refund a transaction",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Identifier of the transaction to refund",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "example": "123e4567-e89b-12d3-a456-426614174000",
+                        "description": "Unique key for request idempotency (UUID format)",
+                        "name": "Idempotency-Key",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "description": "Refund details",
+                        "name": "request",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/models.RefundRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Refund initiated successfully",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/models.APIResponse"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/models.RefundResult"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request parameters or refund exceeds the refundable amount",
                         "schema": {
-                            "$ref": "#/definitions/models.APIResponse"
+                            "$ref": "#/definitions/models.APIError"
                         }
                     },
-                    "400": {
-                        "description": "Invalid callback data or validation error",
+                    "401": {
+                        "description": "Missing, invalid or expired bearer token",
                         "schema": {
                             "$ref": "#/definitions/models.APIError"
                         }
@@ -148,17 +836,40 @@ const docTemplate = `{
                             "$ref": "#/definitions/models.APIError"
                         }
                     },
+                    "409": {
+                        "description": "Transaction is not completed or already fully refunded, or a request with the same Idempotency-Key is in progress",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "422": {
+                        "description": "Insufficient funds or Idempotency-Key reused with a different request",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
                             "$ref": "#/definitions/models.APIError"
                         }
+                    },
+                    "502": {
+                        "description": "Payment gateway error",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
                     }
                 }
             }
         },
         "/withdraw": {
             "post": {
+                "security": [
+                    {
+                        "Bearer": []
+                    }
+                ],
                 "description": "Process a withdrawal request with idempotency support",
                 "consumes": [
                     "application/json",
@@ -216,8 +927,32 @@ const docTemplate = `{
                             "$ref": "#/definitions/models.APIError"
                         }
                     },
+                    "401": {
+                        "description": "Missing, invalid or expired bearer token",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "402": {
+                        "description": "Declined by the payment gateway, reason tells why",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "403": {
+                        "description": "Rejected by compliance checks",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
+                    "409": {
+                        "description": "A request with the same Idempotency-Key is in progress",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
+                    },
                     "422": {
-                        "description": "Insufficient funds or payment processing failed",
+                        "description": "Insufficient funds, a limit is exceeded (code tells which), payment processing failed or Idempotency-Key reused with a different request",
                         "schema": {
                             "$ref": "#/definitions/models.APIError"
                         }
@@ -227,6 +962,12 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/models.APIError"
                         }
+                    },
+                    "503": {
+                        "description": "The gateway is disabled and the merchant has no fallback for it, or no gateway can take a transaction without gateway_id",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIError"
+                        }
                     }
                 }
             }
@@ -237,6 +978,11 @@ const docTemplate = `{
             "description": "Error response model",
             "type": "object",
             "properties": {
+                "code": {
+                    "description": "Machine-readable reason of the error, e.g. the limit that was exceeded\nrequired: false",
+                    "type": "string",
+                    "example": "daily_limit_exceeded"
+                },
                 "error": {
                     "description": "Error message\nrequired: true",
                     "type": "string",
@@ -268,12 +1014,28 @@ const docTemplate = `{
                 }
             }
         },
+        "models.Money": {
+            "description": "Amount in minor units of an ISO 4217 currency",
+            "type": "object",
+            "properties": {
+                "amount": {
+                    "description": "Amount in minor units of the currency",
+                    "type": "integer",
+                    "example": 9999
+                },
+                "currency": {
+                    "description": "Currency code in ISO 4217 format",
+                    "type": "string",
+                    "example": "USD"
+                }
+            }
+        },
         "models.PaymentCallback": {
             "description": "Payment gateway callback model",
             "type": "object",
             "properties": {
                 "error_message": {
-                    "description": "Optional error message\nrequired: false",
+                    "description": "Optional error message, recorded as the reason of the status change\nrequired: false",
                     "type": "string",
                     "example": "Transaction proceeded successfully."
                 },
@@ -283,7 +1045,7 @@ const docTemplate = `{
                     "example": "123456"
                 },
                 "status": {
-                    "description": "Transaction status\nrequired: true",
+                    "description": "Transaction status: pending, authorized, completed, failed, refunded or reversed\nrequired: true",
                     "type": "string",
                     "example": "completed"
                 }
@@ -293,6 +1055,193 @@ const docTemplate = `{
             "description": "Payment transaction result model",
             "type": "object",
             "properties": {
+                "client_secret": {
+                    "description": "Secret the client confirms the payment with on the gateway's side, e.g. the client_secret of a Stripe\nPaymentIntent. Only set for deposits the user still has to confirm.\nrequired: false",
+                    "type": "string",
+                    "example": "pi_3Mtw_secret_YrKJ"
+                },
+                "approval_url": {
+                    "description": "Page the user approves the payment on, e.g. the approve link of a PayPal order. Only set for deposits the user\nstill has to approve.\nrequired: false",
+                    "type": "string",
+                    "example": "https://www.paypal.com/checkoutnow?token=5O190127TN364715T"
+                },
+                "status": {
+                    "description": "Transaction status, review when the transaction waits for an operator before it goes to the gateway\nrequired: true",
+                    "type": "string",
+                    "example": "pending"
+                },
+                "transaction_id": {
+                    "description": "Transaction identifier\nrequired: true",
+                    "type": "integer",
+                    "example": 123456
+                }
+            }
+        },
+        "models.RefundRequest": {
+            "description": "Refund request model. Without an amount the whole remaining amount is refunded.",
+            "type": "object",
+            "properties": {
+                "amount": {
+                    "description": "Amount to refund in minor units of the transaction's currency. Omit it for a full refund.\nrequired: false",
+                    "type": "integer",
+                    "example": 2500
+                },
+                "currency": {
+                    "description": "Currency code in ISO 4217 format, has to be the currency of the transaction when given\nrequired: false",
+                    "type": "string",
+                    "example": "USD"
+                }
+            }
+        },
+        "models.RefundResult": {
+            "description": "Refund result model",
+            "type": "object",
+            "properties": {
+                "amount": {
+                    "description": "Refunded amount\nrequired: true",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/models.Money"
+                        }
+                    ]
+                },
+                "refund_id": {
+                    "description": "Refund identifier, the refund is a transaction of its own\nrequired: true",
+                    "type": "integer",
+                    "example": 123457
+                },
+                "status": {
+                    "description": "Refund status\nrequired: true",
+                    "type": "string",
+                    "example": "pending"
+                },
+                "transaction_id": {
+                    "description": "Identifier of the refunded transaction\nrequired: true",
+                    "type": "integer",
+                    "example": 123456
+                }
+            }
+        },
+        "models.ReviewFlag": {
+            "description": "Check that flagged a transaction",
+            "type": "object",
+            "properties": {
+                "reason": {
+                    "description": "Why the check flagged the transaction\nrequired: true",
+                    "type": "string",
+                    "example": "amount of 15000.00 USD is at or above the threshold of 10000.00 USD"
+                },
+                "rule": {
+                    "description": "Name of the compliance rule or code of the limit\nrequired: true",
+                    "type": "string",
+                    "example": "large withdrawals"
+                }
+            }
+        },
+        "models.ReviewItem": {
+            "description": "Transaction in review with the checks that flagged it",
+            "type": "object",
+            "properties": {
+                "amount": {
+                    "description": "Transaction amount\nrequired: true",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/models.Money"
+                        }
+                    ]
+                },
+                "country_id": {
+                    "description": "Country identifier (ISO 3166-1 numeric)\nrequired: true",
+                    "type": "integer",
+                    "example": 840
+                },
+                "created_at": {
+                    "description": "When the transaction was created\nrequired: true",
+                    "type": "string",
+                    "example": "2024-01-02T15:04:05Z"
+                },
+                "flags": {
+                    "description": "Checks that sent the transaction to review\nrequired: true",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/models.ReviewFlag"
+                    }
+                },
+                "gateway_id": {
+                    "description": "Payment gateway identifier, the gateway that moved the money\nrequired: true",
+                    "type": "integer",
+                    "example": 112
+                },
+                "id": {
+                    "description": "Transaction identifier\nrequired: true",
+                    "type": "integer",
+                    "example": 123456
+                },
+                "parent_id": {
+                    "description": "Identifier of the refunded transaction, only set for refunds\nrequired: false",
+                    "type": "integer",
+                    "example": 123455
+                },
+                "requested_gateway_id": {
+                    "description": "Gateway that was asked for, only set when the merchant's fallback policy sent the transaction to another one\nrequired: false",
+                    "type": "integer",
+                    "example": 111
+                },
+                "status": {
+                    "description": "Transaction status\nrequired: true",
+                    "type": "string",
+                    "example": "completed"
+                },
+                "type": {
+                    "description": "Transaction type: deposit, withdraw or refund\nrequired: true",
+                    "type": "string",
+                    "example": "deposit"
+                },
+                "user_id": {
+                    "description": "Owner of the transaction\nrequired: true",
+                    "type": "integer",
+                    "example": 42
+                }
+            }
+        },
+        "models.ReviewQueue": {
+            "description": "Transactions in review, oldest first",
+            "type": "object",
+            "properties": {
+                "items": {
+                    "description": "Transactions in review\nrequired: true",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/models.ReviewItem"
+                    }
+                }
+            }
+        },
+        "models.ReviewRequest": {
+            "description": "Review decision. A reason is required to reject.",
+            "type": "object",
+            "properties": {
+                "reason": {
+                    "description": "Why the transaction is approved or rejected, kept in the audit trail\nrequired: false",
+                    "type": "string",
+                    "example": "Source of funds confirmed by phone"
+                }
+            }
+        },
+        "models.ReviewResult": {
+            "description": "Result of a review decision",
+            "type": "object",
+            "properties": {
+                "action": {
+                    "description": "approve or reject\nrequired: true",
+                    "type": "string",
+                    "example": "approve"
+                },
+                "status": {
+                    "description": "Status of the transaction after the decision\nrequired: true",
+                    "type": "string",
+                    "example": "pending"
+                },
                 "transaction_id": {
                     "description": "Transaction identifier\nrequired: true",
                     "type": "integer",
@@ -300,14 +1249,127 @@ const docTemplate = `{
                 }
             }
         },
+        "models.Transaction": {
+            "description": "Transaction model",
+            "type": "object",
+            "properties": {
+                "amount": {
+                    "description": "Transaction amount\nrequired: true",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/models.Money"
+                        }
+                    ]
+                },
+                "country_id": {
+                    "description": "Country identifier (ISO 3166-1 numeric)\nrequired: true",
+                    "type": "integer",
+                    "example": 840
+                },
+                "created_at": {
+                    "description": "When the transaction was created\nrequired: true",
+                    "type": "string",
+                    "example": "2024-01-02T15:04:05Z"
+                },
+                "gateway_id": {
+                    "description": "Payment gateway identifier, the gateway that moved the money\nrequired: true",
+                    "type": "integer",
+                    "example": 112
+                },
+                "id": {
+                    "description": "Transaction identifier\nrequired: true",
+                    "type": "integer",
+                    "example": 123456
+                },
+                "parent_id": {
+                    "description": "Identifier of the refunded transaction, only set for refunds\nrequired: false",
+                    "type": "integer",
+                    "example": 123455
+                },
+                "requested_gateway_id": {
+                    "description": "Gateway that was asked for, only set when the merchant's fallback policy sent the transaction to another one\nrequired: false",
+                    "type": "integer",
+                    "example": 111
+                },
+                "status": {
+                    "description": "Transaction status\nrequired: true",
+                    "type": "string",
+                    "example": "completed"
+                },
+                "type": {
+                    "description": "Transaction type: deposit, withdraw or refund\nrequired: true",
+                    "type": "string",
+                    "example": "deposit"
+                }
+            }
+        },
+        "models.TransactionEvent": {
+            "description": "Status change of a transaction",
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "description": "When the status changed\nrequired: true",
+                    "type": "string",
+                    "example": "2024-01-02T15:04:05Z"
+                },
+                "from_status": {
+                    "description": "Status before the change, empty for the status the transaction was created with\nrequired: false",
+                    "type": "string",
+                    "example": "pending"
+                },
+                "payload": {
+                    "description": "Raw callback body as the gateway sent it\nrequired: false",
+                    "type": "string",
+                    "example": "{\"gateway_txn_id\":\"123456\",\"status\":\"completed\"}"
+                },
+                "payload_format": {
+                    "description": "Content type of the payload\nrequired: false",
+                    "type": "string",
+                    "example": "application/json"
+                },
+                "reason": {
+                    "description": "Why the status changed, e.g. the error message of the gateway\nrequired: true",
+                    "type": "string",
+                    "example": "gateway callback"
+                },
+                "source": {
+                    "description": "What changed the status: api, gateway, callback or reconciler\nrequired: true",
+                    "type": "string",
+                    "example": "callback"
+                },
+                "to_status": {
+                    "description": "Status after the change\nrequired: true",
+                    "type": "string",
+                    "example": "completed"
+                }
+            }
+        },
+        "models.TransactionPage": {
+            "description": "Page of transactions, newest first",
+            "type": "object",
+            "properties": {
+                "next_cursor": {
+                    "description": "Cursor of the next page, empty on the last page\nrequired: false",
+                    "type": "string",
+                    "example": "MTcwNDIwNzg0NTAwMDAwMDoxMjM0NTY"
+                },
+                "transactions": {
+                    "description": "Transactions of this page\nrequired: true",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/models.Transaction"
+                    }
+                }
+            }
+        },
         "models.TransactionRequest": {
             "description": "Transaction request model",
             "type": "object",
             "properties": {
                 "amount": {
-                    "description": "Amount to process\nrequired: true",
-                    "type": "number",
-                    "example": 99.99
+                    "description": "Amount to process in minor units of the currency, e.g. 9999 for 99.99 USD\nrequired: true",
+                    "type": "integer",
+                    "example": 9999
                 },
                 "country_id": {
                     "description": "Country identifier (ISO 3166-1 numeric)\nrequired: true",
@@ -320,11 +1382,54 @@ const docTemplate = `{
                     "example": "USD"
                 },
                 "gateway_id": {
-                    "description": "Payment gateway identifier\nrequired: true",
+                    "description": "Payment gateway identifier. Left out, the gateway is picked by smart routing when it is enabled.\nrequired: false",
                     "type": "integer",
                     "example": 112
                 }
             }
+        },
+        "models.TransactionTimeline": {
+            "description": "Status history of a transaction",
+            "type": "object",
+            "properties": {
+                "amount": {
+                    "description": "Transaction amount\nrequired: true",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/models.Money"
+                        }
+                    ]
+                },
+                "events": {
+                    "description": "Status changes, oldest first\nrequired: true",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/models.TransactionEvent"
+                    }
+                },
+                "status": {
+                    "description": "Current status of the transaction\nrequired: true",
+                    "type": "string",
+                    "example": "completed"
+                },
+                "transaction_id": {
+                    "description": "Transaction identifier\nrequired: true",
+                    "type": "integer",
+                    "example": 123456
+                },
+                "type": {
+                    "description": "Transaction type: deposit, withdraw or refund\nrequired: true",
+                    "type": "string",
+                    "example": "deposit"
+                }
+            }
+        }
+    },
+    "securityDefinitions": {
+        "Bearer": {
+            "type": "apiKey",
+            "name": "Authorization",
+            "in": "header"
         }
     }
 }`
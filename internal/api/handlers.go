@@ -1,20 +1,36 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"payment-gateway/internal/cache"
 	"payment-gateway/internal/middleware"
 	"payment-gateway/internal/models"
 	"payment-gateway/internal/services"
 	"payment-gateway/internal/utils"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
 )
 
 type PaymentHandler struct {
 	paymentService services.PaymentService
+	idempotency    cache.IdempotencyStore
 }
 
 func NewPaymentHandler() *PaymentHandler {
 	return &PaymentHandler{
 		paymentService: services.NewPaymentService(),
+		idempotency:    cache.NewIdempotencyStore(),
 	}
 }
 
@@ -23,19 +39,27 @@ func NewPaymentHandler() *PaymentHandler {
 // @Tags Transactions
 // @Accept json,application/xml
 // @Produce json,application/xml
+// @Security Bearer
 // @Param Idempotency-Key header string true "Unique key for request idempotency (UUID format)" example(123e4567-e89b-12d3-a456-426614174000)
 // @Param request body models.TransactionRequest true "Deposit request details"
 // @Success 200 {object} models.APIResponse{data=models.PaymentResult} "Deposit initiated successfully"
 // @Failure 400 {object} models.APIError "Invalid request parameters or validation error"
-// @Failure 422 {object} models.APIError "Payment processing failed"
+// @Failure 401 {object} models.APIError "Missing, invalid or expired bearer token"
+// @Failure 402 {object} models.APIError "Declined by the payment gateway, reason tells why"
+// @Failure 403 {object} models.APIError "Rejected by compliance checks"
+// @Failure 409 {object} models.APIError "A request with the same Idempotency-Key is in progress"
+// @Failure 422 {object} models.APIError "A limit is exceeded (code tells which), payment processing failed or Idempotency-Key reused with a different request"
 // @Failure 500 {object} models.APIError "Internal server error"
 // @Failure 502 {object} models.APIError "Payment gateway error"
+// @Failure 503 {object} models.APIError "The gateway is disabled and the merchant has no fallback for it, or no gateway can take a transaction without gateway_id"
 // @Router /deposit [post]
 func (ph *PaymentHandler) Deposit(w http.ResponseWriter, r *http.Request) {
 	userID, _ := r.Context().Value(middleware.UserIDKey).(int)
+	merchantID, _ := r.Context().Value(middleware.MerchantIDKey).(string)
 
 	req := models.TransactionRequest{
-		UserID: userID,
+		UserID:     userID,
+		MerchantID: merchantID,
 	}
 	if err := utils.DecodeRequest(r, &req); err != nil {
 		utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeValidation, "Could not parse data"))
@@ -47,8 +71,8 @@ func (ph *PaymentHandler) Deposit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ph.handleIdempotency(w, r, func() (*models.APIResponse, error) {
-		result, err := ph.paymentService.Deposit(&req)
+	ph.handleIdempotency(w, r, &req, func() (*models.APIResponse, error) {
+		result, err := ph.paymentService.Deposit(r.Context(), &req)
 		if err != nil {
 			return nil, err
 		}
@@ -65,12 +89,18 @@ func (ph *PaymentHandler) Deposit(w http.ResponseWriter, r *http.Request) {
 // @Tags Transactions
 // @Accept json,application/xml
 // @Produce json,application/xml
+// @Security Bearer
 // @Param Idempotency-Key header string true "Unique key for request idempotency (UUID format)" example(123e4567-e89b-12d3-a456-426614174000)
 // @Param request body models.TransactionRequest true "Withdrawal request details"
 // @Success 200 {object} models.APIResponse{data=models.PaymentResult} "Withdrawal initiated successfully"
 // @Failure 400 {object} models.APIError "Invalid request parameters or validation error"
-// @Failure 422 {object} models.APIError "Insufficient funds or payment processing failed"
+// @Failure 401 {object} models.APIError "Missing, invalid or expired bearer token"
+// @Failure 402 {object} models.APIError "Declined by the payment gateway, reason tells why"
+// @Failure 403 {object} models.APIError "Rejected by compliance checks"
+// @Failure 409 {object} models.APIError "A request with the same Idempotency-Key is in progress"
+// @Failure 422 {object} models.APIError "Insufficient funds, a limit is exceeded (code tells which), payment processing failed or Idempotency-Key reused with a different request"
 // @Failure 500 {object} models.APIError "Internal server error"
+// @Failure 503 {object} models.APIError "The gateway is disabled and the merchant has no fallback for it, or no gateway can take a transaction without gateway_id"
 // @Router /withdraw [post]
 func (ph *PaymentHandler) WithdrawalHandler(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(middleware.UserIDKey).(int)
@@ -78,9 +108,11 @@ func (ph *PaymentHandler) WithdrawalHandler(w http.ResponseWriter, r *http.Reque
 		utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeUnauthorized, "User ID not found in context"))
 		return
 	}
+	merchantID, _ := r.Context().Value(middleware.MerchantIDKey).(string)
 
 	req := models.TransactionRequest{
-		UserID: userID,
+		UserID:     userID,
+		MerchantID: merchantID,
 	}
 	if err := utils.DecodeRequest(r, &req); err != nil {
 		utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeValidation, "Could not parse data"))
@@ -92,8 +124,8 @@ func (ph *PaymentHandler) WithdrawalHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	ph.handleIdempotency(w, r, func() (*models.APIResponse, error) {
-		result, err := ph.paymentService.Withdraw(&req)
+	ph.handleIdempotency(w, r, &req, func() (*models.APIResponse, error) {
+		result, err := ph.paymentService.Withdraw(r.Context(), &req)
 		if err != nil {
 			return nil, err
 		}
@@ -105,34 +137,237 @@ func (ph *PaymentHandler) WithdrawalHandler(w http.ResponseWriter, r *http.Reque
 	})
 }
 
+// @Summary Refund a transaction
+// @Description Refund a completed deposit fully or partially. Without an amount whatever hasn't been refunded yet is refunded.
+// @Description The refund is a transaction of its own, the gateway confirms it through the payment callback.
+// @Tags Transactions
+// @Accept json,application/xml
+// @Produce json,application/xml
+// @Security Bearer
+// @Param id path int true "Identifier of the transaction to refund"
+// @Param Idempotency-Key header string true "Unique key for request idempotency (UUID format)" example(123e4567-e89b-12d3-a456-426614174000)
+// @Param request body models.RefundRequest false "Refund details"
+// @Success 200 {object} models.APIResponse{data=models.RefundResult} "Refund initiated successfully"
+// @Failure 400 {object} models.APIError "Invalid request parameters or refund exceeds the refundable amount"
+// @Failure 401 {object} models.APIError "Missing, invalid or expired bearer token"
+// @Failure 404 {object} models.APIError "Transaction not found"
+// @Failure 409 {object} models.APIError "Transaction is not completed or already fully refunded, or a request with the same Idempotency-Key is in progress"
+// @Failure 422 {object} models.APIError "Insufficient funds or Idempotency-Key reused with a different request"
+// @Failure 500 {object} models.APIError "Internal server error"
+// @Failure 502 {object} models.APIError "Payment gateway error"
+// @Router /transactions/{id}/refunds [post]
+func (ph *PaymentHandler) RefundHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value(middleware.UserIDKey).(int)
+	transactionID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	req := models.RefundRequest{}
+	// An empty body is a full refund.
+	if err := utils.DecodeRefundRequest(r, &req); err != nil && !errors.Is(err, io.EOF) {
+		utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeValidation, "Could not parse data"))
+		return
+	}
+	req.TransactionID = transactionID
+	req.UserID = userID
+
+	if err := req.Validate(); err != nil {
+		utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeValidation, err.Error()))
+		return
+	}
+
+	ph.handleIdempotency(w, r, &req, func() (*models.APIResponse, error) {
+		result, err := ph.paymentService.Refund(r.Context(), &req)
+		if err != nil {
+			return nil, err
+		}
+		return &models.APIResponse{
+			StatusCode: http.StatusOK,
+			Message:    "Refund initiated",
+			Data:       result,
+		}, nil
+	})
+}
+
+// @Summary Get a transaction
+// @Description One of the user's transactions. Transactions of other users are reported as not found.
+// @Description The response is JSON or XML, as asked for in the Accept header.
+// @Tags Transactions
+// @Produce json,application/xml
+// @Security Bearer
+// @Param id path int true "Transaction identifier"
+// @Success 200 {object} models.APIResponse{data=models.Transaction} "The transaction"
+// @Failure 401 {object} models.APIError "Missing, invalid or expired bearer token"
+// @Failure 404 {object} models.APIError "Transaction not found"
+// @Failure 500 {object} models.APIError "Internal server error"
+// @Router /transactions/{id} [get]
+func (ph *PaymentHandler) GetTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value(middleware.UserIDKey).(int)
+	transactionID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	transaction, err := ph.paymentService.GetTransaction(r.Context(), userID, transactionID)
+	if err != nil {
+		utils.WriteErrorResponse(w, r, err)
+		return
+	}
+
+	utils.WriteResponse(w, r, http.StatusOK, models.APIResponse{
+		StatusCode: http.StatusOK,
+		Message:    "Transaction",
+		Data:       transaction,
+	})
+}
+
+// @Summary List transactions
+// @Description The user's transactions, newest first. Pass next_cursor of a page as cursor to get the next one,
+// @Description with the same filters. There are no more pages when next_cursor is missing.
+// @Tags Transactions
+// @Produce json,application/xml
+// @Security Bearer
+// @Param status query string false "Only transactions with this status" Enums(initiated, review, pending, authorized, completed, failed, refunded, reversed)
+// @Param type query string false "Only transactions of this type" Enums(deposit, withdraw, refund)
+// @Param gateway_id query int false "Only transactions of this gateway"
+// @Param currency query string false "Only transactions in this currency (ISO 4217)" example(USD)
+// @Param created_from query string false "Only transactions created at or after this time (RFC 3339)" example(2024-01-01T00:00:00Z)
+// @Param created_to query string false "Only transactions created before this time (RFC 3339)" example(2024-02-01T00:00:00Z)
+// @Param limit query int false "Page size, 20 by default" minimum(1) maximum(100)
+// @Param cursor query string false "next_cursor of the previous page"
+// @Success 200 {object} models.APIResponse{data=models.TransactionPage} "Page of transactions"
+// @Failure 400 {object} models.APIError "Invalid filter or cursor"
+// @Failure 401 {object} models.APIError "Missing, invalid or expired bearer token"
+// @Failure 500 {object} models.APIError "Internal server error"
+// @Router /transactions [get]
+func (ph *PaymentHandler) ListTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := parseTransactionQuery(r)
+	if err != nil {
+		utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeValidation, err.Error()))
+		return
+	}
+	query.UserID, _ = r.Context().Value(middleware.UserIDKey).(int)
+
+	if err := query.Validate(); err != nil {
+		utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeValidation, err.Error()))
+		return
+	}
+
+	page, err := ph.paymentService.ListTransactions(r.Context(), query)
+	if err != nil {
+		utils.WriteErrorResponse(w, r, err)
+		return
+	}
+
+	utils.WriteResponse(w, r, http.StatusOK, models.APIResponse{
+		StatusCode: http.StatusOK,
+		Message:    "Transactions",
+		Data:       page,
+	})
+}
+
+// parseTransactionQuery reads the filters of a transaction listing from the query string.
+func parseTransactionQuery(r *http.Request) (*models.TransactionQuery, error) {
+	values := r.URL.Query()
+	query := &models.TransactionQuery{
+		Status:   values.Get("status"),
+		Type:     values.Get("type"),
+		Currency: values.Get("currency"),
+		Cursor:   values.Get("cursor"),
+		Limit:    models.DefaultPageSize,
+	}
+
+	var err error
+	if v := values.Get("gateway_id"); v != "" {
+		if query.GatewayID, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid gateway_id")
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		if query.Limit, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid limit")
+		}
+	}
+	if v := values.Get("created_from"); v != "" {
+		if query.CreatedFrom, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, fmt.Errorf("created_from has to be an RFC 3339 time")
+		}
+	}
+	if v := values.Get("created_to"); v != "" {
+		if query.CreatedTo, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, fmt.Errorf("created_to has to be an RFC 3339 time")
+		}
+	}
+	return query, nil
+}
+
+// @Summary Get the status history of a transaction
+// @Description Every status change of one of the user's transactions, oldest first, with its source, reason and the raw gateway callback.
+// @Description The response is JSON or XML, as asked for in the Accept header.
+// @Tags Transactions
+// @Produce json,application/xml
+// @Security Bearer
+// @Param id path int true "Transaction identifier"
+// @Success 200 {object} models.APIResponse{data=models.TransactionTimeline} "Status history of the transaction"
+// @Failure 401 {object} models.APIError "Missing, invalid or expired bearer token"
+// @Failure 404 {object} models.APIError "Transaction not found"
+// @Failure 500 {object} models.APIError "Internal server error"
+// @Router /transactions/{id}/events [get]
+func (ph *PaymentHandler) TransactionEventsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value(middleware.UserIDKey).(int)
+	transactionID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	timeline, err := ph.paymentService.GetTransactionEvents(r.Context(), userID, transactionID)
+	if err != nil {
+		utils.WriteErrorResponse(w, r, err)
+		return
+	}
+
+	utils.WriteResponse(w, r, http.StatusOK, models.APIResponse{
+		StatusCode: http.StatusOK,
+		Message:    "Transaction events",
+		Data:       timeline,
+	})
+}
+
 // @Summary Handle payment gateway callback
-// @Description Process callback notifications from payment gateways
+// @Description Process callback notifications from payment gateways, for payments and refunds alike.
+// @Description Callbacks for a status the transaction has already moved past are acknowledged and ignored.
+// @Description Gateways with a format of their own, like the webhook events of Stripe and PayPal, are read by their adapter instead.
 // @Tags Callbacks
 // @Accept json,application/xml
 // @Produce json,application/xml
+// @Param gateway path string true "Name of the gateway sending the callback, e.g. stripe"
+// @Param X-Gateway-API-Key header string false "API key of the gateway sending the callback (hmac-sha256 scheme)"
+// @Param X-Timestamp header string false "Unix timestamp the callback was signed at (hmac-sha256 scheme)"
+// @Param X-Signature header string false "Hex encoded HMAC-SHA256 of timestamp.body (hmac-sha256 scheme)"
 // @Param request body models.PaymentCallback true "Callback notification details"
 // @Success 200 {object} models.APIResponse "Callback processed successfully"
 // @Failure 400 {object} models.APIError "Invalid callback data or validation error"
+// @Failure 401 {object} models.APIError "Unknown gateway or invalid signature"
 // @Failure 404 {object} models.APIError "Transaction not found"
+// @Failure 409 {object} models.APIError "The transaction can't move to this status, e.g. it already failed"
 // @Failure 500 {object} models.APIError "Internal server error"
-// @Router /payment-callback [post]
+// @Router /payment-callback/{gateway} [post]
 func (ph *PaymentHandler) PaymentCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	gatewayID, _ := r.Context().Value(middleware.GatewayIDKey).(int)
 
+	// The raw body is kept with the status change, so we can always see what the gateway told us.
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeValidation, "Could not read request body"))
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
 	callback := models.PaymentCallback{
-		GatewayID: gatewayID,
+		GatewayID:     gatewayID,
+		RawPayload:    body,
+		PayloadFormat: r.Header.Get("Content-Type"),
 	}
 	if err := utils.DecodeCallbackRequest(r, &callback); err != nil {
 		utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeValidation, "Invalid data. It should include transaction ID and status"))
 		return
 	}
 
-	if err := callback.Validate(); err != nil {
-		utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeValidation, err.Error()))
-		return
-	}
-
-	if err := ph.paymentService.HandleCallback(&callback); err != nil {
+	// Gateways with a callback format of their own are parsed by their adapter, the service validates
+	// the callback once it is parsed.
+	if err := ph.paymentService.HandleCallback(r.Context(), &callback); err != nil {
 		utils.WriteErrorResponse(w, r, err)
 		return
 	}
@@ -143,18 +378,91 @@ func (ph *PaymentHandler) PaymentCallbackHandler(w http.ResponseWriter, r *http.
 	})
 }
 
-func (ph *PaymentHandler) handleIdempotency(w http.ResponseWriter, r *http.Request, process func() (*models.APIResponse, error)) {
+// handleIdempotency makes sure that a request is processed only once per Idempotency-Key.
+// Retries of a completed request get the stored response back, a retry that comes in while
+// the first one is still running gets 409 and reusing a key for a different payload gets 422.
+func (ph *PaymentHandler) handleIdempotency(w http.ResponseWriter, r *http.Request, payload interface{}, process func() (*models.APIResponse, error)) {
 	idempotencyKey := r.Header.Get("Idempotency-Key")
 	if idempotencyKey == "" {
 		utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeValidation, "Idempotency-Key header is required"))
 		return
 	}
 
+	fingerprint, err := requestFingerprint(r, payload)
+	if err != nil {
+		utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeValidation, "Could not parse data"))
+		return
+	}
+
+	// Keys are scoped per user so two users can never collide on the same key.
+	userID, _ := r.Context().Value(middleware.UserIDKey).(int)
+	key := fmt.Sprintf("%d:%s", userID, idempotencyKey)
+
+	record, err := ph.idempotency.Lock(r.Context(), key, fingerprint)
+	switch {
+	case errors.Is(err, cache.ErrIdempotencyInFlight):
+		utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeConflict, "A request with this Idempotency-Key is already in progress"))
+		return
+	case errors.Is(err, cache.ErrIdempotencyMismatch):
+		utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeIdempotencyMismatch, "Idempotency-Key has already been used with a different request"))
+		return
+	case err != nil:
+		log.Printf("idempotency lock failed: %v", err)
+		utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeUnknown, "Could not process request"))
+		return
+	case record != nil:
+		utils.WriteEncodedResponse(w, record.ContentType, record.StatusCode, record.Body)
+		return
+	}
+
+	// The key has to be completed even if the client goes away in the middle of the request.
+	storeCtx := context.WithoutCancel(r.Context())
+
+	var status int
+	var data interface{}
 	response, err := process()
 	if err != nil {
-		utils.WriteErrorResponse(w, r, err)
+		errResponse := utils.HandleError(err)
+		status, data = errResponse.StatusCode, errResponse
+	} else {
+		status, data = response.StatusCode, response
+	}
+
+	contentType := utils.ResponseContentType(r)
+	body, err := utils.EncodeResponse(contentType, data)
+	if err != nil {
+		log.Printf("Error encoding response: %v", err)
+		if err := ph.idempotency.Unlock(storeCtx, key); err != nil {
+			log.Printf("failed to release idempotency key: %v", err)
+		}
+		w.WriteHeader(status)
 		return
 	}
 
-	utils.WriteResponse(w, r, response.StatusCode, response)
+	// Every outcome is stored, failures included. Once process() has run we can't be sure
+	// the gateway didn't move the money, so the client has to use a new key to try again.
+	if err := ph.idempotency.Complete(storeCtx, key, &cache.IdempotencyRecord{
+		Fingerprint: fingerprint,
+		StatusCode:  status,
+		ContentType: contentType,
+		Body:        body,
+	}); err != nil {
+		log.Printf("failed to store idempotent response: %v", err)
+	}
+
+	utils.WriteEncodedResponse(w, contentType, status, body)
+}
+
+// requestFingerprint hashes the decoded payload together with the endpoint, so the same
+// request sent as JSON or XML gives the same fingerprint.
+func requestFingerprint(r *http.Request, payload interface{}) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	hash.Write(data)
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
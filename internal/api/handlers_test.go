@@ -3,41 +3,110 @@ package api
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"payment-gateway/db"
+	"payment-gateway/internal/cache"
 	"payment-gateway/internal/middleware"
 	"payment-gateway/internal/models"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
 )
 
 // ---------------- Mock Setup ------------------------------//
 type mockPaymentService struct {
-	shouldFail bool
+	shouldFail   bool
+	depositCalls int
+	lastRefund   *models.RefundRequest
+	lastCallback *models.PaymentCallback
+	lastQuery    *models.TransactionQuery
+	withdrawErr  error
 }
 
-func (m *mockPaymentService) Deposit(req *models.TransactionRequest) (*models.PaymentResult, error) {
+func (m *mockPaymentService) Deposit(ctx context.Context, req *models.TransactionRequest) (*models.PaymentResult, error) {
+	m.depositCalls++
 	if m.shouldFail {
 		return nil, errors.New("deposit failed")
 	}
 	return &models.PaymentResult{TransactionId: 1}, nil
 }
 
-func (m *mockPaymentService) Withdraw(req *models.TransactionRequest) (*models.PaymentResult, error) {
+func (m *mockPaymentService) Withdraw(ctx context.Context, req *models.TransactionRequest) (*models.PaymentResult, error) {
+	if m.withdrawErr != nil {
+		return nil, m.withdrawErr
+	}
 	if m.shouldFail {
 		return nil, errors.New("withdrawal failed")
 	}
 	return &models.PaymentResult{TransactionId: 1}, nil
 }
 
-func (m *mockPaymentService) HandleCallback(callback *models.PaymentCallback) error {
+func (m *mockPaymentService) Refund(ctx context.Context, req *models.RefundRequest) (*models.RefundResult, error) {
+	m.lastRefund = req
+	if m.shouldFail {
+		return nil, errors.New("refund failed")
+	}
+	return &models.RefundResult{RefundID: 2, TransactionID: req.TransactionID, Status: "pending"}, nil
+}
+
+func (m *mockPaymentService) HandleCallback(ctx context.Context, callback *models.PaymentCallback) error {
+	m.lastCallback = callback
 	if m.shouldFail {
 		return errors.New("callback failed")
 	}
 	return nil
 }
 
+func (m *mockPaymentService) GetTransactionEvents(ctx context.Context, userID int, transactionID int) (*models.TransactionTimeline, error) {
+	if userID != 1 || transactionID != 7 {
+		return nil, models.NewServiceError(models.ErrorCodeNotFound, "Transaction not found")
+	}
+	return &models.TransactionTimeline{
+		TransactionID: 7,
+		Type:          "deposit",
+		Status:        "completed",
+		Amount:        models.Money{Minor: 10000, Currency: "USD"},
+		Events: []models.TransactionEvent{
+			{ToStatus: "initiated", Reason: "deposit requested", Source: "api", CreatedAt: time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)},
+			{FromStatus: "initiated", ToStatus: "pending", Reason: "accepted by gateway", Source: "gateway", CreatedAt: time.Date(2024, 1, 2, 15, 4, 6, 0, time.UTC)},
+			{FromStatus: "pending", ToStatus: "completed", Reason: "gateway callback", Source: "callback", Payload: `{"status":"completed"}`, PayloadFormat: "application/json", CreatedAt: time.Date(2024, 1, 2, 15, 5, 0, 0, time.UTC)},
+		},
+	}, nil
+}
+
+func (m *mockPaymentService) GetTransaction(ctx context.Context, userID int, transactionID int) (*models.Transaction, error) {
+	if userID != 1 || transactionID != 7 {
+		return nil, models.NewServiceError(models.ErrorCodeNotFound, "Transaction not found")
+	}
+	return &models.Transaction{
+		ID:        7,
+		Type:      "deposit",
+		Status:    "completed",
+		Amount:    models.Money{Minor: 10000, Currency: "USD"},
+		GatewayID: 1,
+		CountryID: 840,
+		CreatedAt: time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC),
+	}, nil
+}
+
+func (m *mockPaymentService) ListTransactions(ctx context.Context, query *models.TransactionQuery) (*models.TransactionPage, error) {
+	m.lastQuery = query
+	transaction, _ := m.GetTransaction(ctx, 1, 7)
+	return &models.TransactionPage{
+		Transactions: []models.Transaction{*transaction},
+		NextCursor:   "next",
+	}, nil
+}
+
 // --------------------------------//
 
 // Test helper functions
@@ -46,6 +115,7 @@ func setupTestHandler() (*PaymentHandler, *mockPaymentService) {
 
 	handler := &PaymentHandler{
 		paymentService: mockService,
+		idempotency:    cache.NewMemoryIdempotencyStore(),
 	}
 	return handler, mockService
 }
@@ -60,7 +130,7 @@ func createTestRequest(method, path string, body interface{}) *http.Request {
 	}
 	req := httptest.NewRequest(method, path, bodyReader)
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Idempotency-Key", "test-key")
+	req.Header.Set("Idempotency-Key", "test-key")
 
 	// Add user context that would normally be set by auth middleware
 	ctx := req.Context()
@@ -72,7 +142,7 @@ func TestDeposit_ValidPayload(t *testing.T) {
 	handler, _ := setupTestHandler()
 
 	req := createTestRequest(http.MethodPost, "/deposit", &models.TransactionRequest{
-		Amount:    100.50,
+		Amount:    10050,
 		Currency:  "USD",
 		GatewayID: 112,
 		CountryID: 840,
@@ -102,10 +172,10 @@ func TestDeposit_MissingAmount(t *testing.T) {
 		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rr.Code)
 	}
 
-	var response models.APIResponse
+	var response models.APIError
 	json.Unmarshal(rr.Body.Bytes(), &response)
-	if response.Message != "invalid amount" {
-		t.Errorf("Expected error message 'invalid amount', got: %s", response.Message)
+	if response.Error != "invalid amount" {
+		t.Errorf("Expected error message 'invalid amount', got: %s", response.Error)
 	}
 }
 
@@ -113,7 +183,7 @@ func TestDeposit_InvalidAmount(t *testing.T) {
 	handler, _ := setupTestHandler()
 
 	req := createTestRequest(http.MethodPost, "/deposit", &models.TransactionRequest{
-		Amount:    -100,
+		Amount:    -10000,
 		Currency:  "USD",
 		GatewayID: 112,
 		CountryID: 840,
@@ -126,10 +196,10 @@ func TestDeposit_InvalidAmount(t *testing.T) {
 		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rr.Code)
 	}
 
-	var response models.APIResponse
+	var response models.APIError
 	json.Unmarshal(rr.Body.Bytes(), &response)
-	if response.Message != "invalid amount" {
-		t.Errorf("Expected error message 'invalid amount', got: %s", response.Message)
+	if response.Error != "invalid amount" {
+		t.Errorf("Expected error message 'invalid amount', got: %s", response.Error)
 	}
 }
 
@@ -137,7 +207,7 @@ func TestDeposit_InvalidCurrency(t *testing.T) {
 	handler, _ := setupTestHandler()
 
 	req := createTestRequest(http.MethodPost, "/deposit", &models.TransactionRequest{
-		Amount:    100.50,
+		Amount:    10050,
 		Currency:  "INVALID", // Invalid currency code
 		GatewayID: 112,
 		CountryID: 840,
@@ -150,10 +220,10 @@ func TestDeposit_InvalidCurrency(t *testing.T) {
 		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rr.Code)
 	}
 
-	var response models.APIResponse
+	var response models.APIError
 	json.Unmarshal(rr.Body.Bytes(), &response)
-	if response.Message != "invalid currency code" {
-		t.Errorf("Expected error message 'invalid currency code', got: %s", response.Message)
+	if response.Error != "invalid currency code" {
+		t.Errorf("Expected error message 'invalid currency code', got: %s", response.Error)
 	}
 }
 
@@ -161,7 +231,7 @@ func TestDeposit_MissingCurrency(t *testing.T) {
 	handler, _ := setupTestHandler()
 
 	req := createTestRequest(http.MethodPost, "/deposit", &models.TransactionRequest{
-		Amount:    100.50,
+		Amount:    10050,
 		GatewayID: 112,
 		CountryID: 840,
 	})
@@ -173,19 +243,21 @@ func TestDeposit_MissingCurrency(t *testing.T) {
 		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rr.Code)
 	}
 
-	var response models.APIResponse
+	var response models.APIError
 	json.Unmarshal(rr.Body.Bytes(), &response)
-	if response.Message != "invalid currency code" {
-		t.Errorf("Expected error message 'invalid currency code', got: %s", response.Message)
+	if response.Error != "invalid currency code" {
+		t.Errorf("Expected error message 'invalid currency code', got: %s", response.Error)
 	}
 }
 
-func TestDeposit_MissingGatewayID(t *testing.T) {
+func TestDeposit_InvalidGatewayID(t *testing.T) {
 	handler, _ := setupTestHandler()
 
+	// Without a gateway id the service picks one, a negative one is never valid.
 	req := createTestRequest(http.MethodPost, "/deposit", &models.TransactionRequest{
-		Amount:    100.50,
+		Amount:    10050,
 		Currency:  "USD",
+		GatewayID: -1,
 		CountryID: 840,
 	})
 	rr := httptest.NewRecorder()
@@ -196,10 +268,10 @@ func TestDeposit_MissingGatewayID(t *testing.T) {
 		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rr.Code)
 	}
 
-	var response models.APIResponse
+	var response models.APIError
 	json.Unmarshal(rr.Body.Bytes(), &response)
-	if response.Message != "invalid gateway id" {
-		t.Errorf("Expected error message 'invalid gateway id', got: %s", response.Message)
+	if response.Error != "invalid gateway id" {
+		t.Errorf("Expected error message 'invalid gateway id', got: %s", response.Error)
 	}
 }
 
@@ -207,7 +279,7 @@ func TestDeposit_MissingCountryID(t *testing.T) {
 	handler, _ := setupTestHandler()
 
 	req := createTestRequest(http.MethodPost, "/deposit", &models.TransactionRequest{
-		Amount:    100.50,
+		Amount:    10050,
 		Currency:  "USD",
 		GatewayID: 112,
 	})
@@ -219,10 +291,10 @@ func TestDeposit_MissingCountryID(t *testing.T) {
 		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rr.Code)
 	}
 
-	var response models.APIResponse
+	var response models.APIError
 	json.Unmarshal(rr.Body.Bytes(), &response)
-	if response.Message != "invalid country id" {
-		t.Errorf("Expected error message 'invalid country id', got: %s", response.Message)
+	if response.Error != "invalid country id" {
+		t.Errorf("Expected error message 'invalid country id', got: %s", response.Error)
 	}
 }
 
@@ -230,7 +302,7 @@ func TestWithdraw_ValidPayload(t *testing.T) {
 	handler, _ := setupTestHandler()
 
 	req := createTestRequest(http.MethodPost, "/withdraw", &models.TransactionRequest{
-		Amount:    100.50,
+		Amount:    10050,
 		Currency:  "USD",
 		GatewayID: 112,
 		CountryID: 840,
@@ -244,6 +316,32 @@ func TestWithdraw_ValidPayload(t *testing.T) {
 	}
 }
 
+func TestWithdraw_LimitExceeded(t *testing.T) {
+	handler, mockService := setupTestHandler()
+	mockService.withdrawErr = models.NewServiceErrorWithReason(
+		models.ErrorCodeLimitExceeded, "daily_limit_exceeded", "daily withdraw limit of 200.00 USD exceeded, 150.00 USD already used",
+	)
+
+	req := createTestRequest(http.MethodPost, "/withdraw", &models.TransactionRequest{
+		Amount:    10050,
+		Currency:  "USD",
+		GatewayID: 112,
+		CountryID: 840,
+	})
+	rr := httptest.NewRecorder()
+
+	handler.WithdrawalHandler(rr, req)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status %d, got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+	var response models.APIError
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	if response.Code != "daily_limit_exceeded" {
+		t.Errorf("Expected code 'daily_limit_exceeded', got %q", response.Code)
+	}
+}
+
 func TestWithdraw_MissingAmount(t *testing.T) {
 	handler, _ := setupTestHandler()
 
@@ -260,10 +358,10 @@ func TestWithdraw_MissingAmount(t *testing.T) {
 		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rr.Code)
 	}
 
-	var response models.APIResponse
+	var response models.APIError
 	json.Unmarshal(rr.Body.Bytes(), &response)
-	if response.Message != "invalid amount" {
-		t.Errorf("Expected error message 'invalid amount', got: %s", response.Message)
+	if response.Error != "invalid amount" {
+		t.Errorf("Expected error message 'invalid amount', got: %s", response.Error)
 	}
 }
 
@@ -271,7 +369,7 @@ func TestWithdraw_InvalidAmount(t *testing.T) {
 	handler, _ := setupTestHandler()
 
 	req := createTestRequest(http.MethodPost, "/withdraw", &models.TransactionRequest{
-		Amount:    -100,
+		Amount:    -10000,
 		Currency:  "USD",
 		GatewayID: 112,
 		CountryID: 840,
@@ -284,10 +382,10 @@ func TestWithdraw_InvalidAmount(t *testing.T) {
 		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rr.Code)
 	}
 
-	var response models.APIResponse
+	var response models.APIError
 	json.Unmarshal(rr.Body.Bytes(), &response)
-	if response.Message != "invalid amount" {
-		t.Errorf("Expected error message 'invalid amount', got: %s", response.Message)
+	if response.Error != "invalid amount" {
+		t.Errorf("Expected error message 'invalid amount', got: %s", response.Error)
 	}
 }
 
@@ -295,7 +393,7 @@ func TestWithdraw_InvalidCurrency(t *testing.T) {
 	handler, _ := setupTestHandler()
 
 	req := createTestRequest(http.MethodPost, "/withdraw", &models.TransactionRequest{
-		Amount:    100.50,
+		Amount:    10050,
 		Currency:  "INVALID", // Invalid currency code
 		GatewayID: 112,
 		CountryID: 840,
@@ -308,10 +406,10 @@ func TestWithdraw_InvalidCurrency(t *testing.T) {
 		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rr.Code)
 	}
 
-	var response models.APIResponse
+	var response models.APIError
 	json.Unmarshal(rr.Body.Bytes(), &response)
-	if response.Message != "invalid currency code" {
-		t.Errorf("Expected error message 'invalid currency code', got: %s", response.Message)
+	if response.Error != "invalid currency code" {
+		t.Errorf("Expected error message 'invalid currency code', got: %s", response.Error)
 	}
 }
 
@@ -319,7 +417,7 @@ func TestWithdraw_MissingCurrency(t *testing.T) {
 	handler, _ := setupTestHandler()
 
 	req := createTestRequest(http.MethodPost, "/withdraw", &models.TransactionRequest{
-		Amount:    100.50,
+		Amount:    10050,
 		GatewayID: 112,
 		CountryID: 840,
 	})
@@ -331,19 +429,21 @@ func TestWithdraw_MissingCurrency(t *testing.T) {
 		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rr.Code)
 	}
 
-	var response models.APIResponse
+	var response models.APIError
 	json.Unmarshal(rr.Body.Bytes(), &response)
-	if response.Message != "invalid currency code" {
-		t.Errorf("Expected error message 'invalid currency code', got: %s", response.Message)
+	if response.Error != "invalid currency code" {
+		t.Errorf("Expected error message 'invalid currency code', got: %s", response.Error)
 	}
 }
 
-func TestWithdraw_MissingGatewayID(t *testing.T) {
+func TestWithdraw_InvalidGatewayID(t *testing.T) {
 	handler, _ := setupTestHandler()
 
+	// Without a gateway id the service picks one, a negative one is never valid.
 	req := createTestRequest(http.MethodPost, "/withdraw", &models.TransactionRequest{
-		Amount:    100.50,
+		Amount:    10050,
 		Currency:  "USD",
+		GatewayID: -1,
 		CountryID: 840,
 	})
 	rr := httptest.NewRecorder()
@@ -354,10 +454,10 @@ func TestWithdraw_MissingGatewayID(t *testing.T) {
 		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rr.Code)
 	}
 
-	var response models.APIResponse
+	var response models.APIError
 	json.Unmarshal(rr.Body.Bytes(), &response)
-	if response.Message != "invalid gateway id" {
-		t.Errorf("Expected error message 'invalid gateway id', got: %s", response.Message)
+	if response.Error != "invalid gateway id" {
+		t.Errorf("Expected error message 'invalid gateway id', got: %s", response.Error)
 	}
 }
 
@@ -365,7 +465,7 @@ func TestWithdraw_MissingCountryID(t *testing.T) {
 	handler, _ := setupTestHandler()
 
 	req := createTestRequest(http.MethodPost, "/withdraw", &models.TransactionRequest{
-		Amount:    100.50,
+		Amount:    10050,
 		Currency:  "USD",
 		GatewayID: 112,
 	})
@@ -377,9 +477,439 @@ func TestWithdraw_MissingCountryID(t *testing.T) {
 		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rr.Code)
 	}
 
-	var response models.APIResponse
+	var response models.APIError
 	json.Unmarshal(rr.Body.Bytes(), &response)
-	if response.Message != "invalid country id" {
-		t.Errorf("Expected error message 'invalid country id', got: %s", response.Message)
+	if response.Error != "invalid country id" {
+		t.Errorf("Expected error message 'invalid country id', got: %s", response.Error)
+	}
+}
+
+//----------------------------------------  Refund Test ----------------------------------------------------//
+
+func createRefundRequest(transactionID string, body interface{}) *http.Request {
+	req := createTestRequest(http.MethodPost, "/transactions/"+transactionID+"/refunds", body)
+	return mux.SetURLVars(req, map[string]string{"id": transactionID})
+}
+
+func TestRefund_PartialRefund(t *testing.T) {
+	handler, mockService := setupTestHandler()
+
+	rr := httptest.NewRecorder()
+	handler.RefundHandler(rr, createRefundRequest("7", &models.RefundRequest{Amount: 2500, Currency: "USD"}))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	refund := mockService.lastRefund
+	if refund.TransactionID != 7 || refund.UserID != 1 || refund.Amount != 2500 {
+		t.Errorf("Expected a refund of 2500 of transaction 7 for user 1, got %+v", refund)
+	}
+}
+
+func TestRefund_EmptyBodyIsFullRefund(t *testing.T) {
+	handler, mockService := setupTestHandler()
+
+	rr := httptest.NewRecorder()
+	handler.RefundHandler(rr, createRefundRequest("7", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if mockService.lastRefund.Amount != 0 {
+		t.Errorf("Expected a full refund, got amount %d", mockService.lastRefund.Amount)
+	}
+}
+
+func TestRefund_InvalidAmount(t *testing.T) {
+	handler, mockService := setupTestHandler()
+
+	rr := httptest.NewRecorder()
+	handler.RefundHandler(rr, createRefundRequest("7", &models.RefundRequest{Amount: -100}))
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+	if mockService.lastRefund != nil {
+		t.Error("Expected the refund not to be processed")
+	}
+}
+
+//----------------------------------------  Transaction Events Test ----------------------------------------------------//
+
+func createEventsRequest(transactionID string, accept string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/transactions/"+transactionID+"/events", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), middleware.UserIDKey, 1))
+	return mux.SetURLVars(req, map[string]string{"id": transactionID})
+}
+
+func TestTransactionEvents_DefaultsToJSON(t *testing.T) {
+	handler, _ := setupTestHandler()
+
+	rr := httptest.NewRecorder()
+	handler.TransactionEventsHandler(rr, createEventsRequest("7", ""))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if rr.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected JSON response, got %s", rr.Header().Get("Content-Type"))
+	}
+
+	var response struct {
+		Data models.TransactionTimeline `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(response.Data.Events) != 3 || response.Data.Events[2].Payload != `{"status":"completed"}` {
+		t.Errorf("Unexpected timeline: %+v", response.Data)
+	}
+}
+
+func TestTransactionEvents_XML(t *testing.T) {
+	handler, _ := setupTestHandler()
+
+	rr := httptest.NewRecorder()
+	handler.TransactionEventsHandler(rr, createEventsRequest("7", "application/xml, application/json;q=0.9"))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if rr.Header().Get("Content-Type") != "application/xml" {
+		t.Errorf("Expected XML response, got %s", rr.Header().Get("Content-Type"))
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "<events><event><to_status>initiated</to_status>") || !strings.Contains(body, "<created_at>2024-01-02T15:05:00Z</created_at>") {
+		t.Errorf("Unexpected XML body: %s", body)
+	}
+}
+
+func TestTransactionEvents_NotFound(t *testing.T) {
+	handler, _ := setupTestHandler()
+
+	rr := httptest.NewRecorder()
+	handler.TransactionEventsHandler(rr, createEventsRequest("8", ""))
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestGetTransaction(t *testing.T) {
+	handler, _ := setupTestHandler()
+
+	rr := httptest.NewRecorder()
+	handler.GetTransactionHandler(rr, createEventsRequest("7", ""))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	var response struct {
+		Data models.Transaction `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if response.Data.ID != 7 || response.Data.Amount.Minor != 10000 {
+		t.Errorf("Unexpected transaction: %+v", response.Data)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.GetTransactionHandler(rr, createEventsRequest("8", ""))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+func createListRequest(query string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/transactions?"+query, nil)
+	return req.WithContext(context.WithValue(req.Context(), middleware.UserIDKey, 1))
+}
+
+func TestListTransactions_ParsesFilters(t *testing.T) {
+	handler, mockService := setupTestHandler()
+
+	rr := httptest.NewRecorder()
+	handler.ListTransactionsHandler(rr, createListRequest(
+		"status=completed&type=deposit&gateway_id=2&currency=USD&created_from=2024-01-01T00:00:00Z&created_to=2024-02-01T00:00:00Z&limit=50&cursor=abc",
+	))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	expected := models.TransactionQuery{
+		UserID:      1,
+		Status:      "completed",
+		Type:        "deposit",
+		GatewayID:   2,
+		Currency:    "USD",
+		CreatedFrom: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		CreatedTo:   time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		Cursor:      "abc",
+		Limit:       50,
+	}
+	if mockService.lastQuery == nil || *mockService.lastQuery != expected {
+		t.Errorf("Expected query %+v, got %+v", expected, mockService.lastQuery)
+	}
+	if !strings.Contains(rr.Body.String(), `"next_cursor":"next"`) {
+		t.Errorf("Expected the next cursor in the response, got %s", rr.Body.String())
+	}
+}
+
+func TestListTransactions_DefaultLimit(t *testing.T) {
+	handler, mockService := setupTestHandler()
+
+	rr := httptest.NewRecorder()
+	handler.ListTransactionsHandler(rr, createListRequest(""))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if mockService.lastQuery.Limit != models.DefaultPageSize {
+		t.Errorf("Expected limit %d, got %d", models.DefaultPageSize, mockService.lastQuery.Limit)
+	}
+}
+
+func TestListTransactions_InvalidQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"limit too large", "limit=101"},
+		{"limit not a number", "limit=ten"},
+		{"invalid currency", "currency=usd"},
+		{"invalid time", "created_from=yesterday"},
+		{"empty range", "created_from=2024-02-01T00:00:00Z&created_to=2024-01-01T00:00:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mockService := setupTestHandler()
+
+			rr := httptest.NewRecorder()
+			handler.ListTransactionsHandler(rr, createListRequest(tt.query))
+
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rr.Code)
+			}
+			if mockService.lastQuery != nil {
+				t.Error("Expected the service not to be called")
+			}
+		})
+	}
+}
+
+func TestPaymentCallback_KeepsRawPayload(t *testing.T) {
+	handler, mockService := setupTestHandler()
+
+	body := `{"gateway_txn_id": "txn123", "status": "completed", "error_message": "ok"}`
+	req := httptest.NewRequest(http.MethodPost, "/payment-callback", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(context.WithValue(req.Context(), middleware.GatewayIDKey, 1))
+	rr := httptest.NewRecorder()
+
+	handler.PaymentCallbackHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	callback := mockService.lastCallback
+	if callback.Status != "completed" || string(callback.RawPayload) != body || callback.PayloadFormat != "application/json" {
+		t.Errorf("Expected the raw body to be passed on, got %+v", callback)
+	}
+}
+
+func TestPaymentCallback_ContentTypeWithCharset(t *testing.T) {
+	handler, mockService := setupTestHandler()
+
+	body := `{"id": "evt_1", "type": "payment_intent.succeeded", "data": {"object": {"id": "pi_1"}}}`
+	req := httptest.NewRequest(http.MethodPost, "/payment-callback", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req = req.WithContext(context.WithValue(req.Context(), middleware.GatewayIDKey, 1))
+	rr := httptest.NewRecorder()
+
+	handler.PaymentCallbackHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	// The adapter of the gateway reads its own format, the body reaches the service as it is.
+	if callback := mockService.lastCallback; string(callback.RawPayload) != body || callback.GatewayID != 1 {
+		t.Errorf("Expected the raw body to be passed on, got %+v", callback)
+	}
+}
+
+type mockGatewayLookup struct {
+	gateways map[string]*db.Gateway
+}
+
+func (m *mockGatewayLookup) GetGatewayByName(ctx context.Context, name string) (*db.Gateway, error) {
+	return m.gateways[name], nil
+}
+
+func TestPaymentCallback_StripeWebhook(t *testing.T) {
+	handler, mockService := setupTestHandler()
+	middleware.InitGatewayAuth(&mockGatewayLookup{gateways: map[string]*db.Gateway{
+		"stripe": {ID: 1, Name: "stripe", SigningSecret: "whsec_test", SignatureScheme: middleware.SchemeStripe},
+	}})
+	t.Cleanup(func() { middleware.InitGatewayAuth(nil) })
+	router := mux.NewRouter()
+	callbackRoutes(router, handler)
+
+	// A webhook as Stripe sends it: the gateway is in the path, the signature in Stripe-Signature, no api key.
+	body := `{"id": "evt_1", "object": "event", "type": "payment_intent.succeeded", "data": {"object": {"id": "pi_1", "object": "payment_intent", "status": "succeeded"}}}`
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte("whsec_test"))
+	mac.Write([]byte(timestamp + "." + body))
+	req := httptest.NewRequest(http.MethodPost, "/payment-callback/stripe", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Stripe-Signature", "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+	rr := httptest.NewRecorder()
+
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	if callback := mockService.lastCallback; callback == nil || callback.GatewayID != 1 || string(callback.RawPayload) != body {
+		t.Errorf("Expected the webhook to reach the service for gateway 1, got %+v", callback)
+	}
+
+	// The same webhook with a forged signature doesn't get through.
+	mockService.lastCallback = nil
+	req = httptest.NewRequest(http.MethodPost, "/payment-callback/stripe", strings.NewReader(body))
+	req.Header.Set("Stripe-Signature", "t="+timestamp+",v1=deadbeef")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized || mockService.lastCallback != nil {
+		t.Errorf("Expected a forged webhook to be rejected, got status %d", rr.Code)
+	}
+}
+
+//----------------------------------------  Idempotency Test ----------------------------------------------------//
+
+func TestDeposit_IdempotentReplay(t *testing.T) {
+	handler, mockService := setupTestHandler()
+
+	payload := &models.TransactionRequest{
+		Amount:    10050,
+		Currency:  "USD",
+		GatewayID: 112,
+		CountryID: 840,
+	}
+
+	first := httptest.NewRecorder()
+	handler.Deposit(first, createTestRequest(http.MethodPost, "/deposit", payload))
+
+	second := httptest.NewRecorder()
+	handler.Deposit(second, createTestRequest(http.MethodPost, "/deposit", payload))
+
+	if mockService.depositCalls != 1 {
+		t.Errorf("Expected deposit to be processed once, got %d", mockService.depositCalls)
+	}
+	if second.Code != first.Code {
+		t.Errorf("Expected replayed status %d, got %d", first.Code, second.Code)
+	}
+	if second.Body.String() != first.Body.String() {
+		t.Errorf("Expected replayed body %s, got %s", first.Body.String(), second.Body.String())
+	}
+}
+
+func TestDeposit_IdempotentReplayOfFailure(t *testing.T) {
+	handler, mockService := setupTestHandler()
+	mockService.shouldFail = true
+
+	payload := &models.TransactionRequest{
+		Amount:    10050,
+		Currency:  "USD",
+		GatewayID: 112,
+		CountryID: 840,
+	}
+
+	first := httptest.NewRecorder()
+	handler.Deposit(first, createTestRequest(http.MethodPost, "/deposit", payload))
+
+	mockService.shouldFail = false
+	second := httptest.NewRecorder()
+	handler.Deposit(second, createTestRequest(http.MethodPost, "/deposit", payload))
+
+	if mockService.depositCalls != 1 {
+		t.Errorf("Expected deposit to be processed once, got %d", mockService.depositCalls)
+	}
+	if second.Code != http.StatusInternalServerError {
+		t.Errorf("Expected replayed status %d, got %d", http.StatusInternalServerError, second.Code)
+	}
+}
+
+func TestDeposit_IdempotencyKeyReusedWithDifferentPayload(t *testing.T) {
+	handler, mockService := setupTestHandler()
+
+	handler.Deposit(httptest.NewRecorder(), createTestRequest(http.MethodPost, "/deposit", &models.TransactionRequest{
+		Amount:    10050,
+		Currency:  "USD",
+		GatewayID: 112,
+		CountryID: 840,
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.Deposit(rr, createTestRequest(http.MethodPost, "/deposit", &models.TransactionRequest{
+		Amount:    20000,
+		Currency:  "USD",
+		GatewayID: 112,
+		CountryID: 840,
+	}))
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status %d, got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+	if mockService.depositCalls != 1 {
+		t.Errorf("Expected deposit to be processed once, got %d", mockService.depositCalls)
+	}
+}
+
+func TestDeposit_IdempotencyKeyInFlight(t *testing.T) {
+	handler, mockService := setupTestHandler()
+
+	payload := &models.TransactionRequest{
+		Amount:    10050,
+		Currency:  "USD",
+		GatewayID: 112,
+		CountryID: 840,
+	}
+
+	// Simulate another instance still processing the same request.
+	req := createTestRequest(http.MethodPost, "/deposit", payload)
+	fingerprint, _ := requestFingerprint(req, payload)
+	handler.idempotency.Lock(context.Background(), "1:test-key", fingerprint)
+
+	rr := httptest.NewRecorder()
+	handler.Deposit(rr, req)
+
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Expected status %d, got %d", http.StatusConflict, rr.Code)
+	}
+	if mockService.depositCalls != 0 {
+		t.Errorf("Expected deposit not to be processed, got %d calls", mockService.depositCalls)
+	}
+}
+
+func TestDeposit_MissingIdempotencyKey(t *testing.T) {
+	handler, _ := setupTestHandler()
+
+	req := createTestRequest(http.MethodPost, "/deposit", &models.TransactionRequest{
+		Amount:    10050,
+		Currency:  "USD",
+		GatewayID: 112,
+		CountryID: 840,
+	})
+	req.Header.Del("Idempotency-Key")
+	rr := httptest.NewRecorder()
+
+	handler.Deposit(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rr.Code)
 	}
 }
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"payment-gateway/internal/middleware"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/services"
+	"payment-gateway/internal/utils"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// ReviewHandler serves the review queue to operators.
+type ReviewHandler struct {
+	reviewService services.ReviewService
+}
+
+func NewReviewHandler() *ReviewHandler {
+	return &ReviewHandler{
+		reviewService: services.NewReviewService(),
+	}
+}
+
+// @Summary List the review queue
+// @Description Transactions flagged by the compliance checks or a limit, oldest first. They are not sent to the gateway until an operator approves them.
+// @Tags Reviews
+// @Produce json,application/xml
+// @Security Bearer
+// @Param limit query int false "Number of transactions, 20 by default" minimum(1) maximum(100)
+// @Success 200 {object} models.APIResponse{data=models.ReviewQueue} "Transactions in review"
+// @Failure 400 {object} models.APIError "Invalid limit"
+// @Failure 401 {object} models.APIError "Missing, invalid or expired bearer token"
+// @Failure 403 {object} models.APIError "Token without the reviewer role"
+// @Failure 500 {object} models.APIError "Internal server error"
+// @Router /admin/reviews [get]
+func (rh *ReviewHandler) ListReviewsHandler(w http.ResponseWriter, r *http.Request) {
+	limit := models.DefaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > models.MaxPageSize {
+			utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeValidation, "invalid limit"))
+			return
+		}
+	}
+
+	queue, err := rh.reviewService.ListReviewQueue(r.Context(), limit)
+	if err != nil {
+		utils.WriteErrorResponse(w, r, err)
+		return
+	}
+
+	utils.WriteResponse(w, r, http.StatusOK, models.APIResponse{
+		StatusCode: http.StatusOK,
+		Message:    "Review queue",
+		Data:       queue,
+	})
+}
+
+// @Summary Approve a transaction in review
+// @Description Sends the transaction to its gateway. The decision is audited with the reviewer taken from the token.
+// @Tags Reviews
+// @Accept json,application/xml
+// @Produce json,application/xml
+// @Security Bearer
+// @Param id path int true "Transaction identifier"
+// @Param request body models.ReviewRequest false "Reason of the approval"
+// @Success 200 {object} models.APIResponse{data=models.ReviewResult} "Transaction approved"
+// @Failure 400 {object} models.APIError "Invalid request"
+// @Failure 401 {object} models.APIError "Missing, invalid or expired bearer token"
+// @Failure 403 {object} models.APIError "Token without the reviewer role"
+// @Failure 404 {object} models.APIError "Transaction not found"
+// @Failure 409 {object} models.APIError "Transaction is not in review, has already been reviewed or its hold has expired"
+// @Failure 500 {object} models.APIError "Internal server error"
+// @Failure 502 {object} models.APIError "Payment gateway error, the transaction failed"
+// @Router /admin/reviews/{id}/approve [post]
+func (rh *ReviewHandler) ApproveReviewHandler(w http.ResponseWriter, r *http.Request) {
+	rh.handleDecision(w, r, "Transaction approved", rh.reviewService.ApproveReview)
+}
+
+// @Summary Reject a transaction in review
+// @Description Fails the transaction without sending it to the gateway and gives back what was held for it.
+// @Description The decision is audited with the reviewer taken from the token.
+// @Tags Reviews
+// @Accept json,application/xml
+// @Produce json,application/xml
+// @Security Bearer
+// @Param id path int true "Transaction identifier"
+// @Param request body models.ReviewRequest true "Reason of the rejection"
+// @Success 200 {object} models.APIResponse{data=models.ReviewResult} "Transaction rejected"
+// @Failure 400 {object} models.APIError "Invalid request or missing reason"
+// @Failure 401 {object} models.APIError "Missing, invalid or expired bearer token"
+// @Failure 403 {object} models.APIError "Token without the reviewer role"
+// @Failure 404 {object} models.APIError "Transaction not found"
+// @Failure 409 {object} models.APIError "Transaction is not in review or has already been reviewed"
+// @Failure 500 {object} models.APIError "Internal server error"
+// @Router /admin/reviews/{id}/reject [post]
+func (rh *ReviewHandler) RejectReviewHandler(w http.ResponseWriter, r *http.Request) {
+	rh.handleDecision(w, r, "Transaction rejected", rh.reviewService.RejectReview)
+}
+
+func (rh *ReviewHandler) handleDecision(w http.ResponseWriter, r *http.Request, message string, decide func(context.Context, *models.ReviewRequest) (*models.ReviewResult, error)) {
+	reviewerID, ok := r.Context().Value(middleware.ReviewerIDKey).(int)
+	if !ok {
+		utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeUnauthorized, "Reviewer not found in context"))
+		return
+	}
+	transactionID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	req := models.ReviewRequest{}
+	// An approval doesn't need a body, nor a content type then.
+	if r.ContentLength != 0 {
+		if err := utils.DecodeReviewRequest(r, &req); err != nil && !errors.Is(err, io.EOF) {
+			utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeValidation, "Could not parse data"))
+			return
+		}
+	}
+	req.TransactionID = transactionID
+	req.ReviewerID = reviewerID
+
+	if err := req.Validate(); err != nil {
+		utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeValidation, err.Error()))
+		return
+	}
+
+	result, err := decide(r.Context(), &req)
+	if err != nil {
+		utils.WriteErrorResponse(w, r, err)
+		return
+	}
+
+	utils.WriteResponse(w, r, http.StatusOK, models.APIResponse{
+		StatusCode: http.StatusOK,
+		Message:    message,
+		Data:       result,
+	})
+}
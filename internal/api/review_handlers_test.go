@@ -0,0 +1,126 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"payment-gateway/internal/middleware"
+	"payment-gateway/internal/models"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+type mockReviewService struct {
+	lastLimit    int
+	lastApproval *models.ReviewRequest
+	lastReject   *models.ReviewRequest
+}
+
+func (m *mockReviewService) ListReviewQueue(ctx context.Context, limit int) (*models.ReviewQueue, error) {
+	m.lastLimit = limit
+	return &models.ReviewQueue{Items: []models.ReviewItem{{
+		Transaction: models.Transaction{ID: 7, Type: "withdraw", Status: "review", Amount: models.Money{Minor: 1500000, Currency: "USD"}},
+		UserID:      1,
+		Flags:       []models.ReviewFlag{{Rule: "large withdrawals", Reason: "amount of 15000.00 USD is at or above the threshold of 10000.00 USD"}},
+	}}}, nil
+}
+
+func (m *mockReviewService) ApproveReview(ctx context.Context, req *models.ReviewRequest) (*models.ReviewResult, error) {
+	m.lastApproval = req
+	if req.TransactionID != 7 {
+		return nil, models.NewServiceError(models.ErrorCodeConflict, "Transaction is not waiting for a review")
+	}
+	return &models.ReviewResult{TransactionID: 7, Action: "approve", Status: "pending"}, nil
+}
+
+func (m *mockReviewService) RejectReview(ctx context.Context, req *models.ReviewRequest) (*models.ReviewResult, error) {
+	m.lastReject = req
+	return &models.ReviewResult{TransactionID: req.TransactionID, Action: "reject", Status: "failed"}, nil
+}
+
+func createReviewRequest(method, path, body string) *http.Request {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if parts := strings.Split(path, "/"); len(parts) > 3 {
+		req = mux.SetURLVars(req, map[string]string{"id": parts[3]})
+	}
+	return req.WithContext(context.WithValue(req.Context(), middleware.ReviewerIDKey, 9))
+}
+
+func TestListReviews(t *testing.T) {
+	mockService := &mockReviewService{}
+	handler := &ReviewHandler{reviewService: mockService}
+
+	rr := httptest.NewRecorder()
+	handler.ListReviewsHandler(rr, createReviewRequest(http.MethodGet, "/admin/reviews?limit=5", ""))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	if mockService.lastLimit != 5 {
+		t.Errorf("Expected limit 5, got %d", mockService.lastLimit)
+	}
+	var response struct {
+		Data models.ReviewQueue `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(response.Data.Items) != 1 || response.Data.Items[0].ID != 7 || response.Data.Items[0].Flags[0].Rule != "large withdrawals" {
+		t.Errorf("Unexpected queue: %+v", response.Data)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ListReviewsHandler(rr, createReviewRequest(http.MethodGet, "/admin/reviews?limit=1000", ""))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a too large limit, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestApproveReview_TakesReviewerFromContext(t *testing.T) {
+	mockService := &mockReviewService{}
+	handler := &ReviewHandler{reviewService: mockService}
+
+	// No body is needed to approve.
+	rr := httptest.NewRecorder()
+	handler.ApproveReviewHandler(rr, createReviewRequest(http.MethodPost, "/admin/reviews/7/approve", ""))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	if req := mockService.lastApproval; req == nil || req.TransactionID != 7 || req.ReviewerID != 9 {
+		t.Errorf("Expected reviewer 9 to approve transaction 7, got %+v", req)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ApproveReviewHandler(rr, createReviewRequest(http.MethodPost, "/admin/reviews/8/approve", ""))
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Expected status %d, got %d", http.StatusConflict, rr.Code)
+	}
+}
+
+func TestRejectReview_PassesReason(t *testing.T) {
+	mockService := &mockReviewService{}
+	handler := &ReviewHandler{reviewService: mockService}
+
+	rr := httptest.NewRecorder()
+	handler.RejectReviewHandler(rr, createReviewRequest(http.MethodPost, "/admin/reviews/7/reject", `{"reason": "unverified source of funds"}`))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	if req := mockService.lastReject; req == nil || req.Reason != "unverified source of funds" || req.ReviewerID != 9 {
+		t.Errorf("Expected the reason and reviewer to be passed on, got %+v", req)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.RejectReviewHandler(rr, createReviewRequest(http.MethodPost, "/admin/reviews/7/reject", `{"reason": `))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a broken body, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
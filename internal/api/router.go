@@ -18,16 +18,33 @@ func SetupRouter() *mux.Router {
 	// Initialize payment handler with unified service
 	ph := NewPaymentHandler()
 
-	// User authenticated routes (deposit/withdraw)
+	// User authenticated routes (deposit/withdraw/refund/history)
 	userAPI := router.PathPrefix("").Subrouter()
 	userAPI.Use(middleware.UserAuthMiddleware)
 	userAPI.HandleFunc("/deposit", ph.Deposit).Methods(http.MethodPost)
 	userAPI.HandleFunc("/withdraw", ph.WithdrawalHandler).Methods(http.MethodPost)
+	userAPI.HandleFunc("/transactions", ph.ListTransactionsHandler).Methods(http.MethodGet)
+	userAPI.HandleFunc("/transactions/{id:[0-9]+}", ph.GetTransactionHandler).Methods(http.MethodGet)
+	userAPI.HandleFunc("/transactions/{id:[0-9]+}/refunds", ph.RefundHandler).Methods(http.MethodPost)
+	userAPI.HandleFunc("/transactions/{id:[0-9]+}/events", ph.TransactionEventsHandler).Methods(http.MethodGet)
 
 	// Gateway authenticated routes (payment callbacks)
-	gatewayAPI := router.PathPrefix("").Subrouter()
-	gatewayAPI.Use(middleware.GatewayAuthMiddleware)
-	gatewayAPI.HandleFunc("/payment-callback", ph.PaymentCallbackHandler).Methods(http.MethodPost)
+	callbackRoutes(router, ph)
+
+	// Operator routes (review queue), the token has to carry the reviewer role
+	rh := NewReviewHandler()
+	adminAPI := router.PathPrefix("/admin").Subrouter()
+	adminAPI.Use(middleware.ReviewerAuthMiddleware)
+	adminAPI.HandleFunc("/reviews", rh.ListReviewsHandler).Methods(http.MethodGet)
+	adminAPI.HandleFunc("/reviews/{id:[0-9]+}/approve", rh.ApproveReviewHandler).Methods(http.MethodPost)
+	adminAPI.HandleFunc("/reviews/{id:[0-9]+}/reject", rh.RejectReviewHandler).Methods(http.MethodPost)
 
 	return router
 }
+
+// callbackRoutes adds the callback endpoint, every gateway posts to its own: /payment-callback/stripe.
+func callbackRoutes(router *mux.Router, ph *PaymentHandler) {
+	gatewayAPI := router.PathPrefix("").Subrouter()
+	gatewayAPI.Use(middleware.GatewayAuthMiddleware)
+	gatewayAPI.HandleFunc("/payment-callback/{"+middleware.GatewayRouteVar+"}", ph.PaymentCallbackHandler).Methods(http.MethodPost)
+}
@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// How long an in-flight request holds its key. It should be longer than the slowest
+	// deposit/withdraw we expect, otherwise a retry could run the payment a second time.
+	idempotencyLockTTL = 2 * time.Minute
+	// How long a completed response is kept around for replay.
+	idempotencyRecordTTL = 24 * time.Hour
+
+	idempotencyKeyPrefix = "idempotency:"
+)
+
+var (
+	// ErrIdempotencyInFlight is returned when another request with the same key is still running.
+	ErrIdempotencyInFlight = errors.New("request with this idempotency key is in progress")
+	// ErrIdempotencyMismatch is returned when a key is reused with a different request payload.
+	ErrIdempotencyMismatch = errors.New("idempotency key was used with a different request")
+)
+
+// IdempotencyRecord is what we keep for every Idempotency-Key.
+type IdempotencyRecord struct {
+	// Fingerprint of the request that first used the key.
+	Fingerprint string `json:"fingerprint"`
+	// Completed is false while the first request is still being processed.
+	Completed   bool   `json:"completed"`
+	StatusCode  int    `json:"status_code,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+type IdempotencyStore interface {
+	// Lock reserves the key for a new request and returns nil, nil when the caller
+	// should go ahead and process it. When the key has already completed it returns
+	// the stored record so the response can be replayed.
+	// It returns ErrIdempotencyInFlight or ErrIdempotencyMismatch otherwise.
+	Lock(ctx context.Context, key string, fingerprint string) (*IdempotencyRecord, error)
+
+	// Complete stores the final response for the key.
+	Complete(ctx context.Context, key string, record *IdempotencyRecord) error
+
+	// Unlock releases a key without storing a response, so the request can be retried.
+	Unlock(ctx context.Context, key string) error
+}
+
+// NewIdempotencyStore returns the redis backed store. InitRedis should be called before this.
+func NewIdempotencyStore() IdempotencyStore {
+	return &RedisIdempotencyStore{
+		cache: cache,
+	}
+}
+
+type RedisIdempotencyStore struct {
+	cache *RedisCache
+}
+
+func (s *RedisIdempotencyStore) Lock(ctx context.Context, key string, fingerprint string) (*IdempotencyRecord, error) {
+	if s.cache == nil {
+		return nil, fmt.Errorf("redis is not initialized")
+	}
+
+	inFlight, err := json.Marshal(&IdempotencyRecord{Fingerprint: fingerprint})
+	if err != nil {
+		return nil, err
+	}
+
+	// SETNX makes sure only one request can own the key, even across multiple app instances.
+	acquired, err := s.cache.client.SetNX(ctx, idempotencyKeyPrefix+key, inFlight, idempotencyLockTTL).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock idempotency key: %w", err)
+	}
+	if acquired {
+		return nil, nil
+	}
+
+	data, err := s.cache.client.Get(ctx, idempotencyKeyPrefix+key).Bytes()
+	if err == redis.Nil {
+		// The key expired between SETNX and GET, the client can simply retry.
+		return nil, ErrIdempotencyInFlight
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read idempotency key: %w", err)
+	}
+
+	var record IdempotencyRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to decode idempotency record: %w", err)
+	}
+
+	return checkIdempotencyRecord(&record, fingerprint)
+}
+
+func (s *RedisIdempotencyStore) Complete(ctx context.Context, key string, record *IdempotencyRecord) error {
+	if s.cache == nil {
+		return fmt.Errorf("redis is not initialized")
+	}
+
+	record.Completed = true
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if err := s.cache.client.Set(ctx, idempotencyKeyPrefix+key, data, idempotencyRecordTTL).Err(); err != nil {
+		return fmt.Errorf("failed to store idempotency record: %w", err)
+	}
+	return nil
+}
+
+func (s *RedisIdempotencyStore) Unlock(ctx context.Context, key string) error {
+	if s.cache == nil {
+		return fmt.Errorf("redis is not initialized")
+	}
+	return s.cache.client.Del(ctx, idempotencyKeyPrefix+key).Err()
+}
+
+// checkIdempotencyRecord decides what to do with a key that is already taken.
+func checkIdempotencyRecord(record *IdempotencyRecord, fingerprint string) (*IdempotencyRecord, error) {
+	if record.Fingerprint != fingerprint {
+		return nil, ErrIdempotencyMismatch
+	}
+	if !record.Completed {
+		return nil, ErrIdempotencyInFlight
+	}
+	return record, nil
+}
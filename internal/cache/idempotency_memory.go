@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryIdempotencyStore keeps idempotency keys in process memory.
+// It is only meant for tests and local runs, since keys are not shared between instances.
+type MemoryIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[string]memoryIdempotencyEntry
+	now     func() time.Time
+}
+
+type memoryIdempotencyEntry struct {
+	record    IdempotencyRecord
+	expiresAt time.Time
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		records: make(map[string]memoryIdempotencyEntry),
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryIdempotencyStore) Lock(ctx context.Context, key string, fingerprint string) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, exists := s.records[key]
+	if !exists || s.now().After(entry.expiresAt) {
+		s.records[key] = memoryIdempotencyEntry{
+			record:    IdempotencyRecord{Fingerprint: fingerprint},
+			expiresAt: s.now().Add(idempotencyLockTTL),
+		}
+		return nil, nil
+	}
+
+	record := entry.record
+	return checkIdempotencyRecord(&record, fingerprint)
+}
+
+func (s *MemoryIdempotencyStore) Complete(ctx context.Context, key string, record *IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record.Completed = true
+	s.records[key] = memoryIdempotencyEntry{
+		record:    *record,
+		expiresAt: s.now().Add(idempotencyRecordTTL),
+	}
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Unlock(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key)
+	return nil
+}
@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"payment-gateway/internal/limits"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const limitRulesKey = "limits:rules"
+
+// NewLimitRuleCache returns the redis backed cache of the limit rules. InitRedis should be called before this.
+func NewLimitRuleCache() limits.RuleCache {
+	return &RedisLimitRuleCache{
+		cache: cache,
+	}
+}
+
+// RedisLimitRuleCache shares the rules between all instances, so invalidating it once applies a change everywhere.
+type RedisLimitRuleCache struct {
+	cache *RedisCache
+}
+
+func (c *RedisLimitRuleCache) Get(ctx context.Context) ([]*limits.Rule, bool, error) {
+	if c.cache == nil {
+		return nil, false, fmt.Errorf("redis is not initialized")
+	}
+
+	data, err := c.cache.client.Get(ctx, limitRulesKey).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read limit rules: %w", err)
+	}
+
+	var rules []*limits.Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, false, fmt.Errorf("failed to decode limit rules: %w", err)
+	}
+	return rules, true, nil
+}
+
+func (c *RedisLimitRuleCache) Set(ctx context.Context, rules []*limits.Rule, ttl time.Duration) error {
+	if c.cache == nil {
+		return fmt.Errorf("redis is not initialized")
+	}
+
+	// An empty list is cached as well, "no rules" is an answer too.
+	if rules == nil {
+		rules = []*limits.Rule{}
+	}
+	data, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	if err := c.cache.client.Set(ctx, limitRulesKey, data, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to store limit rules: %w", err)
+	}
+	return nil
+}
+
+func (c *RedisLimitRuleCache) Invalidate(ctx context.Context) error {
+	if c.cache == nil {
+		return fmt.Errorf("redis is not initialized")
+	}
+	return c.cache.client.Del(ctx, limitRulesKey).Err()
+}
@@ -3,6 +3,7 @@ package cache
 import (
 	"context"
 	"fmt"
+	"os"
 
 	"github.com/go-redis/redis/v8"
 )
@@ -14,9 +15,19 @@ type RedisCache struct {
 }
 
 func InitRedis() error {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+
+	password, ok := os.LookupEnv("REDIS_PASSWORD")
+	if !ok {
+		password = "password"
+	}
+
 	client := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "password",
+		Addr:     addr,
+		Password: password,
 		DB:       0,
 	})
 
@@ -30,3 +41,11 @@ func InitRedis() error {
 	}
 	return nil
 }
+
+// Close closes the redis connection when the system shut down
+func Close() error {
+	if cache == nil {
+		return nil
+	}
+	return cache.client.Close()
+}
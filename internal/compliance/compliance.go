@@ -0,0 +1,120 @@
+package compliance
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"payment-gateway/internal/models"
+)
+
+// Outcomes of a rule and of a whole decision, from the least to the most strict.
+const (
+	OutcomeApprove = "approve"
+	OutcomeReview  = "review"
+	OutcomeReject  = "reject"
+)
+
+var severity = map[string]int{
+	OutcomeApprove: 0,
+	OutcomeReview:  1,
+	OutcomeReject:  2,
+}
+
+func IsKnownOutcome(outcome string) bool {
+	_, ok := severity[outcome]
+	return ok
+}
+
+// Request is the transaction the rules are checked for, before it is created.
+type Request struct {
+	UserID          int
+	CountryID       int
+	GatewayID       int
+	TransactionType string
+	Amount          models.Money
+}
+
+// Result is what one rule decided, Reason is empty when it approved.
+type Result struct {
+	Rule    string `json:"rule"`
+	Outcome string `json:"outcome"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+func approve(rule string) Result {
+	return Result{Rule: rule, Outcome: OutcomeApprove}
+}
+
+// Decision is the outcome of all the rules for one transaction. It is stored with the transaction.
+type Decision struct {
+	ID            int64
+	TransactionID int
+	// Outcome is the strictest outcome of the rules.
+	Outcome string
+	// Results of the rules in the order they ran. Rules after a reject aren't run.
+	Results   []Result
+	CreatedAt time.Time
+}
+
+func (d *Decision) Approved() bool {
+	return d.Outcome == OutcomeApprove
+}
+
+// Add records the result of a check, making the decision stricter when the result is.
+func (d *Decision) Add(result Result) {
+	d.Results = append(d.Results, result)
+	if severity[result.Outcome] > severity[d.Outcome] {
+		d.Outcome = result.Outcome
+	}
+}
+
+// Reasons lists why the transaction wasn't simply approved.
+func (d *Decision) Reasons() string {
+	var reasons []string
+	for _, result := range d.Results {
+		if result.Outcome != OutcomeApprove {
+			reasons = append(reasons, result.Reason)
+		}
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// Rule is one compliance check. It only returns an error when it couldn't decide,
+// e.g. because its data couldn't be loaded.
+type Rule interface {
+	Evaluate(ctx context.Context, req *Request) (Result, error)
+}
+
+type Checker interface {
+	Check(ctx context.Context, req *Request) (*Decision, error)
+}
+
+// Pipeline runs its rules in order. The strictest outcome wins and a reject ends the check,
+// nothing after it can change the decision.
+type Pipeline struct {
+	rules []Rule
+}
+
+func NewPipeline(rules ...Rule) *Pipeline {
+	return &Pipeline{rules: rules}
+}
+
+func (p *Pipeline) Check(ctx context.Context, req *Request) (*Decision, error) {
+	decision := &Decision{Outcome: OutcomeApprove, CreatedAt: time.Now()}
+	for _, rule := range p.rules {
+		result, err := rule.Evaluate(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if !IsKnownOutcome(result.Outcome) {
+			return nil, fmt.Errorf("compliance rule %q returned unknown outcome %q", result.Rule, result.Outcome)
+		}
+		decision.Add(result)
+		if decision.Outcome == OutcomeReject {
+			break
+		}
+	}
+	return decision, nil
+}
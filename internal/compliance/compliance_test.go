@@ -0,0 +1,224 @@
+package compliance
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"payment-gateway/internal/models"
+)
+
+type mockActivity struct {
+	count int
+	since time.Time
+}
+
+func (m *mockActivity) CountTransactions(ctx context.Context, userID int, transactionType string, since time.Time) (int, error) {
+	m.since = since
+	return m.count, nil
+}
+
+type mockScreener struct {
+	matches   []Match
+	calls     int
+	threshold float64
+}
+
+func (m *mockScreener) Screen(ctx context.Context, userID int, threshold float64) ([]Match, error) {
+	m.calls++
+	m.threshold = threshold
+	return m.matches, nil
+}
+
+type failingRule struct{}
+
+func (failingRule) Evaluate(ctx context.Context, req *Request) (Result, error) {
+	return Result{}, errors.New("rule failed")
+}
+
+func usd(minor int64) models.Money {
+	return models.Money{Minor: minor, Currency: "USD"}
+}
+
+func withdrawal(amount int64) *Request {
+	return &Request{UserID: 1, CountryID: 840, GatewayID: 1, TransactionType: "withdraw", Amount: usd(amount)}
+}
+
+func TestPipeline_StrictestOutcomeWins(t *testing.T) {
+	screener := &mockScreener{}
+	pipeline := NewPipeline(
+		&AmountThresholdRule{Name: "large", Threshold: usd(1000), Outcome: OutcomeReview},
+		&CountryBlockRule{Name: "blocked", Countries: []int{408}, Outcome: OutcomeReject},
+		&SanctionsRule{Name: "sanctions", Outcome: OutcomeReject, Screener: screener},
+	)
+
+	decision, err := pipeline.Check(context.Background(), withdrawal(500))
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !decision.Approved() || len(decision.Results) != 3 || decision.Reasons() != "" {
+		t.Errorf("Expected an approval from all three rules, got %+v", decision)
+	}
+
+	decision, _ = pipeline.Check(context.Background(), withdrawal(1000))
+	if decision.Outcome != OutcomeReview || decision.Reasons() != "amount of 10.00 USD is at or above the threshold of 10.00 USD" {
+		t.Errorf("Expected a review with the reason of the threshold, got %+v", decision)
+	}
+
+	// A reject ends the check, the rules after it aren't run.
+	req := withdrawal(1000)
+	req.CountryID = 408
+	decision, _ = pipeline.Check(context.Background(), req)
+	if decision.Outcome != OutcomeReject || len(decision.Results) != 2 {
+		t.Errorf("Expected a reject after two rules, got %+v", decision)
+	}
+	if screener.calls != 2 {
+		t.Errorf("Expected the screener not to be called after the reject, got %d calls", screener.calls)
+	}
+}
+
+func TestPipeline_RuleError(t *testing.T) {
+	pipeline := NewPipeline(&CountryBlockRule{Name: "blocked", Countries: []int{408}, Outcome: OutcomeReject}, failingRule{})
+	if _, err := pipeline.Check(context.Background(), withdrawal(100)); err == nil {
+		t.Error("Expected the error of the rule, a decision can't be made without it")
+	}
+}
+
+func TestRules_TransactionType(t *testing.T) {
+	rule := &AmountThresholdRule{Name: "large deposits", TransactionType: "deposit", Threshold: usd(100), Outcome: OutcomeReview}
+	result, _ := rule.Evaluate(context.Background(), withdrawal(1000))
+	if result.Outcome != OutcomeApprove {
+		t.Errorf("Expected a deposit rule to approve withdrawals, got %+v", result)
+	}
+
+	// Thresholds only apply to their own currency.
+	rule.TransactionType = ""
+	req := withdrawal(1000)
+	req.Amount.Currency = "EUR"
+	if result, _ = rule.Evaluate(context.Background(), req); result.Outcome != OutcomeApprove {
+		t.Errorf("Expected a USD threshold to approve EUR, got %+v", result)
+	}
+}
+
+func TestVelocityRule(t *testing.T) {
+	activity := &mockActivity{count: 4}
+	rule := &VelocityRule{Name: "velocity", MaxCount: 5, Window: time.Hour, Outcome: OutcomeReview, Activity: activity}
+
+	result, err := rule.Evaluate(context.Background(), withdrawal(100))
+	if err != nil || result.Outcome != OutcomeApprove {
+		t.Fatalf("Expected the 5th transaction to be approved, got %+v, %v", result, err)
+	}
+	if since := time.Since(activity.since); since < time.Hour || since > time.Hour+time.Minute {
+		t.Errorf("Expected the transactions of the last hour to be counted, since %v", activity.since)
+	}
+
+	activity.count = 5
+	result, _ = rule.Evaluate(context.Background(), withdrawal(100))
+	if result.Outcome != OutcomeReview || result.Reason != "5 transactions within 1h0m0s, the limit is 5" {
+		t.Errorf("Expected the 6th transaction to be reviewed, got %+v", result)
+	}
+}
+
+func TestSanctionsRule(t *testing.T) {
+	screener := &mockScreener{matches: []Match{{List: "OFAC SDN", Ref: "36", Name: "JOHN DOE", Score: 0.93}}}
+	rule := &SanctionsRule{Name: "sanctions", Threshold: 0.9, Outcome: OutcomeReview, Screener: screener}
+
+	result, err := rule.Evaluate(context.Background(), withdrawal(100))
+	if err != nil || result.Outcome != OutcomeReview {
+		t.Fatalf("Expected a review, got %+v, %v", result, err)
+	}
+	if result.Reason != `user matches "JOHN DOE", entry 36 of the OFAC SDN list (score 0.93)` {
+		t.Errorf("Unexpected reason %q", result.Reason)
+	}
+	if screener.threshold != 0.9 {
+		t.Errorf("Expected the threshold of the rule to be used, got %v", screener.threshold)
+	}
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	yamlPath := writeFile(t, "rules.yaml", `
+rules:
+  - type: country_block
+    outcome: reject
+    countries: [408]
+  - type: velocity
+    name: fast withdrawals
+    outcome: review
+    transaction_type: withdraw
+    max_count: 3
+    window: 10m
+`)
+	jsonPath := writeFile(t, "rules.json", `{"rules": [
+		{"type": "country_block", "outcome": "reject", "countries": [408]},
+		{"type": "velocity", "name": "fast withdrawals", "outcome": "review", "transaction_type": "withdraw", "max_count": 3, "window": "10m"}
+	]}`)
+
+	for _, path := range []string{yamlPath, jsonPath} {
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			t.Fatalf("LoadConfig(%s) failed: %v", filepath.Base(path), err)
+		}
+		pipeline, err := cfg.Build(Dependencies{Activity: &mockActivity{count: 3}})
+		if err != nil {
+			t.Fatalf("Build(%s) failed: %v", filepath.Base(path), err)
+		}
+
+		decision, err := pipeline.Check(context.Background(), withdrawal(100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decision.Outcome != OutcomeReview || decision.Results[0].Rule != TypeCountryBlock || decision.Results[1].Rule != "fast withdrawals" {
+			t.Errorf("%s: expected the velocity rule to review, got %+v", filepath.Base(path), decision)
+		}
+	}
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		err   string
+	}{
+		{"unknown field", "rules:\n  - type: country_block\n    outcome: reject\n    country: [408]\n", "field country not found"},
+		{"unknown type", "rules:\n  - type: weather\n    outcome: reject\n", "unknown rule type"},
+		{"unknown outcome", "rules:\n  - type: country_block\n    outcome: maybe\n    countries: [408]\n", `unknown outcome "maybe"`},
+		{"invalid currency", "rules:\n  - type: amount_threshold\n    outcome: review\n    currency: XXY\n    amount: 100\n", "XXY"},
+		{"invalid window", "rules:\n  - type: velocity\n    outcome: review\n    max_count: 3\n    window: soon\n", "invalid window"},
+		{"no screener", "rules:\n  - type: sanctions\n    outcome: review\n", "no sanctions screener"},
+		{"invalid threshold", "rules:\n  - type: sanctions\n    outcome: review\n    threshold: 1.5\n", "between 0 and 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeFile(t, "rules.yml", tt.rules))
+			if err == nil {
+				_, err = cfg.Build(Dependencies{Activity: &mockActivity{}})
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_ShippedRules(t *testing.T) {
+	cfg, err := LoadConfig("../../config/compliance.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.Build(Dependencies{Activity: &mockActivity{}, Screener: &mockScreener{}}); err != nil {
+		t.Errorf("The shipped rules don't build: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package compliance
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"payment-gateway/internal/models"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Types of the rules in a rules file.
+const (
+	TypeAmountThreshold = "amount_threshold"
+	TypeCountryBlock    = "country_block"
+	TypeVelocity        = "velocity"
+	TypeSanctions       = "sanctions"
+)
+
+// Config is the content of a rules file. The rules run in the order they are listed.
+type Config struct {
+	Rules []RuleConfig `yaml:"rules" json:"rules"`
+}
+
+// RuleConfig is one rule of a rules file. Which fields are used depends on the type.
+type RuleConfig struct {
+	Type    string `yaml:"type" json:"type"`
+	Name    string `yaml:"name" json:"name"`
+	Outcome string `yaml:"outcome" json:"outcome"`
+	// TransactionType limits the rule to deposits or withdrawals, empty applies to both.
+	TransactionType string `yaml:"transaction_type" json:"transaction_type"`
+
+	// amount_threshold, in minor units of the currency.
+	Currency string `yaml:"currency" json:"currency"`
+	Amount   int64  `yaml:"amount" json:"amount"`
+
+	// country_block
+	Countries []int `yaml:"countries" json:"countries"`
+
+	// velocity, e.g. at most 5 transactions within "1h".
+	MaxCount int    `yaml:"max_count" json:"max_count"`
+	Window   string `yaml:"window" json:"window"`
+
+	// sanctions, the lowest match score (0 to 1) that counts, DefaultMatchThreshold when not set.
+	Threshold float64 `yaml:"threshold" json:"threshold"`
+}
+
+// LoadConfig reads a rules file, as JSON when it ends in .json and as YAML otherwise.
+// Unknown fields are errors, so a misspelled field doesn't silently disable a rule.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compliance rules: %v", err)
+	}
+
+	cfg := &Config{}
+	if filepath.Ext(path) == ".json" {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(cfg)
+	} else {
+		err = yaml.UnmarshalStrict(data, cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse compliance rules %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Dependencies are the data sources rules can need. Building a rule whose source is missing fails.
+type Dependencies struct {
+	Activity ActivityStore
+	Screener Screener
+}
+
+// Build turns the rules of the file into a pipeline, checking every rule on the way.
+func (c *Config) Build(deps Dependencies) (*Pipeline, error) {
+	rules := make([]Rule, 0, len(c.Rules))
+	for i, rc := range c.Rules {
+		rule, err := rc.build(deps)
+		if err != nil {
+			return nil, fmt.Errorf("compliance rule %d (%s): %v", i+1, rc.Type, err)
+		}
+		rules = append(rules, rule)
+	}
+	return NewPipeline(rules...), nil
+}
+
+func (rc *RuleConfig) build(deps Dependencies) (Rule, error) {
+	if !IsKnownOutcome(rc.Outcome) {
+		return nil, fmt.Errorf("unknown outcome %q", rc.Outcome)
+	}
+	name := rc.Name
+	if name == "" {
+		name = rc.Type
+	}
+
+	switch rc.Type {
+	case TypeAmountThreshold:
+		threshold, err := models.NewMoney(rc.Amount, rc.Currency)
+		if err != nil {
+			return nil, err
+		}
+		if !threshold.IsPositive() {
+			return nil, fmt.Errorf("amount has to be positive")
+		}
+		return &AmountThresholdRule{Name: name, TransactionType: rc.TransactionType, Threshold: threshold, Outcome: rc.Outcome}, nil
+	case TypeCountryBlock:
+		if len(rc.Countries) == 0 {
+			return nil, fmt.Errorf("no countries listed")
+		}
+		return &CountryBlockRule{Name: name, TransactionType: rc.TransactionType, Countries: rc.Countries, Outcome: rc.Outcome}, nil
+	case TypeVelocity:
+		window, err := time.ParseDuration(rc.Window)
+		if err != nil {
+			return nil, fmt.Errorf("invalid window: %v", err)
+		}
+		if window <= 0 || rc.MaxCount <= 0 {
+			return nil, fmt.Errorf("window and max_count have to be positive")
+		}
+		if deps.Activity == nil {
+			return nil, fmt.Errorf("no transaction activity to check against")
+		}
+		return &VelocityRule{
+			Name:            name,
+			TransactionType: rc.TransactionType,
+			MaxCount:        rc.MaxCount,
+			Window:          window,
+			Outcome:         rc.Outcome,
+			Activity:        deps.Activity,
+		}, nil
+	case TypeSanctions:
+		threshold := rc.Threshold
+		if threshold == 0 {
+			threshold = DefaultMatchThreshold
+		}
+		if threshold < 0 || threshold > 1 {
+			return nil, fmt.Errorf("threshold has to be between 0 and 1")
+		}
+		if deps.Screener == nil {
+			return nil, fmt.Errorf("no sanctions screener configured")
+		}
+		return &SanctionsRule{
+			Name:            name,
+			TransactionType: rc.TransactionType,
+			Threshold:       threshold,
+			Outcome:         rc.Outcome,
+			Screener:        deps.Screener,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown rule type")
+	}
+}
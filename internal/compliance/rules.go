@@ -0,0 +1,140 @@
+package compliance
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"payment-gateway/internal/models"
+)
+
+// appliesTo reports whether a rule for this transaction type applies to the request, "" applies to all.
+func appliesTo(transactionType string, req *Request) bool {
+	return transactionType == "" || transactionType == req.TransactionType
+}
+
+// AmountThresholdRule flags transactions of at least Threshold, in the currency of the threshold.
+type AmountThresholdRule struct {
+	Name            string
+	TransactionType string
+	Threshold       models.Money
+	Outcome         string
+}
+
+func (r *AmountThresholdRule) Evaluate(ctx context.Context, req *Request) (Result, error) {
+	if !appliesTo(r.TransactionType, req) ||
+		req.Amount.Currency != r.Threshold.Currency ||
+		req.Amount.Minor < r.Threshold.Minor {
+		return approve(r.Name), nil
+	}
+	return Result{
+		Rule:    r.Name,
+		Outcome: r.Outcome,
+		Reason:  fmt.Sprintf("amount of %s is at or above the threshold of %s", req.Amount, r.Threshold),
+	}, nil
+}
+
+// CountryBlockRule flags transactions of the listed countries.
+type CountryBlockRule struct {
+	Name            string
+	TransactionType string
+	Countries       []int
+	Outcome         string
+}
+
+func (r *CountryBlockRule) Evaluate(ctx context.Context, req *Request) (Result, error) {
+	if appliesTo(r.TransactionType, req) {
+		for _, country := range r.Countries {
+			if country == req.CountryID {
+				return Result{
+					Rule:    r.Name,
+					Outcome: r.Outcome,
+					Reason:  fmt.Sprintf("country %d is blocked", req.CountryID),
+				}, nil
+			}
+		}
+	}
+	return approve(r.Name), nil
+}
+
+// ActivityStore is where the velocity rules get the user's recent transactions from.
+type ActivityStore interface {
+	// CountTransactions returns how many transactions of this type the user created since then,
+	// whatever their status. An empty type counts all types.
+	CountTransactions(ctx context.Context, userID int, transactionType string, since time.Time) (int, error)
+}
+
+// VelocityRule flags users who already created MaxCount transactions within Window.
+type VelocityRule struct {
+	Name            string
+	TransactionType string
+	MaxCount        int
+	Window          time.Duration
+	Outcome         string
+	Activity        ActivityStore
+}
+
+func (r *VelocityRule) Evaluate(ctx context.Context, req *Request) (Result, error) {
+	if !appliesTo(r.TransactionType, req) {
+		return approve(r.Name), nil
+	}
+	count, err := r.Activity.CountTransactions(ctx, req.UserID, r.TransactionType, time.Now().Add(-r.Window))
+	if err != nil {
+		return Result{}, fmt.Errorf("compliance rule %q: failed to count transactions: %v", r.Name, err)
+	}
+	if count < r.MaxCount {
+		return approve(r.Name), nil
+	}
+	return Result{
+		Rule:    r.Name,
+		Outcome: r.Outcome,
+		Reason:  fmt.Sprintf("%d transactions within %s, the limit is %d", count, r.Window, r.MaxCount),
+	}, nil
+}
+
+// Match is an entry of a sanctions list the user may be.
+type Match struct {
+	List string
+	// Ref is the id of the entry on its list.
+	Ref   string
+	Name  string
+	Score float64
+}
+
+// Screener checks users against the sanctions lists.
+type Screener interface {
+	// Screen returns the list entries that match the user with at least the threshold score
+	// (0 to 1), best match first.
+	Screen(ctx context.Context, userID int, threshold float64) ([]Match, error)
+}
+
+// DefaultMatchThreshold is the score from which a sanctions match counts, unless the rule sets its own.
+const DefaultMatchThreshold = 0.85
+
+// SanctionsRule flags users who match an entry of a sanctions list.
+type SanctionsRule struct {
+	Name            string
+	TransactionType string
+	Threshold       float64
+	Outcome         string
+	Screener        Screener
+}
+
+func (r *SanctionsRule) Evaluate(ctx context.Context, req *Request) (Result, error) {
+	if !appliesTo(r.TransactionType, req) {
+		return approve(r.Name), nil
+	}
+	matches, err := r.Screener.Screen(ctx, req.UserID, r.Threshold)
+	if err != nil {
+		return Result{}, fmt.Errorf("compliance rule %q: failed to screen user: %v", r.Name, err)
+	}
+	if len(matches) == 0 {
+		return approve(r.Name), nil
+	}
+	best := matches[0]
+	return Result{
+		Rule:    r.Name,
+		Outcome: r.Outcome,
+		Reason:  fmt.Sprintf("user matches %q, entry %s of the %s list (score %.2f)", best.Name, best.Ref, best.List, best.Score),
+	}, nil
+}
@@ -20,8 +20,9 @@ func Init() {
 	}
 
 	writer = &kafka.Writer{
-		Addr:                   kafka.TCP(kafkaURL),
-		Balancer:               &kafka.LeastBytes{},
+		Addr: kafka.TCP(kafkaURL),
+		// Messages of a transaction share its id as the key, hashing it keeps them on one partition and in order.
+		Balancer:               &kafka.Hash{},
 		AllowAutoTopicCreation: true,
 		BatchTimeout:           10 * time.Millisecond,
 	}
@@ -43,8 +44,11 @@ func GetTopic(dataFormat string) (string, error) {
 	}
 }
 
+// EventTypeHeader is the kafka header with the type of the event, e.g. "refund.created".
+const EventTypeHeader = "event_type"
+
 // publishes a message to the Kafka topic
-func PublishTransaction(ctx context.Context, transactionID string, message []byte, dataFormat string) error {
+func PublishTransaction(ctx context.Context, transactionID string, eventType string, message []byte, dataFormat string) error {
 	if writer == nil {
 		log.Println("Kafka writer is nil, cannot publish to Kafka.")
 		return fmt.Errorf("Kafka writer is not initialized")
@@ -58,9 +62,10 @@ func PublishTransaction(ctx context.Context, transactionID string, message []byt
 	log.Printf("Publishing message to Kafka topic: %s...", topic)
 
 	kafkaMessage := kafka.Message{
-		Key:   []byte(transactionID),
-		Value: message,
-		Topic: topic,
+		Key:     []byte(transactionID),
+		Value:   message,
+		Topic:   topic,
+		Headers: []kafka.Header{{Key: EventTypeHeader, Value: []byte(eventType)}},
 	}
 
 	err = writer.WriteMessages(ctx, kafkaMessage)
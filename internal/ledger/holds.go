@@ -0,0 +1,80 @@
+package ledger
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrHoldSettled       = errors.New("hold has already been settled")
+)
+
+// Statuses of a hold.
+const (
+	HoldActive   = "active"
+	HoldCaptured = "captured"
+	HoldReleased = "released"
+	HoldExpired  = "expired"
+)
+
+// Hold reserves part of a user's available balance for a withdrawal or refund in flight. Placing it
+// moves the amount to the user's held account, so it can't be spent twice.
+type Hold struct {
+	ID            int64
+	TransactionID int
+	UserID        int
+	Currency      string
+	Amount        int64
+	Status        string
+	// ExpiresAt is when the hold is given back to the user if the transaction hasn't settled by then.
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+// Settlement ends the hold of a transaction. A captured hold moves to the counterparty,
+// a released one goes back to the user's available balance.
+type Settlement struct {
+	TransactionID int
+	Capture       bool
+	Counterparty  Account
+	// Kind is the kind of the entry of a capture, KindWithdrawal when empty.
+	Kind string
+}
+
+// PlaceEntry moves the hold from the available to the held account.
+func (hold *Hold) PlaceEntry() *Entry {
+	return Transfer(KindHold, hold.TransactionID, UserAvailable(hold.UserID, hold.Currency), UserHeld(hold.UserID, hold.Currency), hold.Amount)
+}
+
+// Settle returns the entry that settles the hold, nil when there is nothing to move, and the new status of the hold.
+// An expired hold is already back in the available balance, so a capture takes the amount from
+// there: the gateway paid it out, whatever the user did with the balance in the meantime.
+func (hold *Hold) Settle(settlement *Settlement) (*Entry, string, error) {
+	available := UserAvailable(hold.UserID, hold.Currency)
+	held := UserHeld(hold.UserID, hold.Currency)
+	kind := settlement.Kind
+	if kind == "" {
+		kind = KindWithdrawal
+	}
+
+	switch hold.Status {
+	case HoldActive:
+		if settlement.Capture {
+			return Transfer(kind, hold.TransactionID, held, settlement.Counterparty, hold.Amount), HoldCaptured, nil
+		}
+		return Transfer(KindHoldRelease, hold.TransactionID, held, available, hold.Amount), HoldReleased, nil
+	case HoldExpired:
+		if settlement.Capture {
+			return Transfer(kind, hold.TransactionID, available, settlement.Counterparty, hold.Amount), HoldCaptured, nil
+		}
+		return nil, HoldReleased, nil
+	default:
+		return nil, "", ErrHoldSettled
+	}
+}
+
+// ExpireEntry gives an expired hold back to the user.
+func (hold *Hold) ExpireEntry() *Entry {
+	return Transfer(KindHoldExpired, hold.TransactionID, UserHeld(hold.UserID, hold.Currency), UserAvailable(hold.UserID, hold.Currency), hold.Amount)
+}
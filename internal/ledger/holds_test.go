@@ -0,0 +1,131 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func fundedStore(t *testing.T, balance int64) *MemoryStore {
+	store := NewMemoryStore()
+	if err := store.Post(context.Background(), Transfer(KindDeposit, 0, GatewayClearing(1, "USD"), UserAvailable(1, "USD"), balance)); err != nil {
+		t.Fatalf("Failed to fund the store: %v", err)
+	}
+	return store
+}
+
+func assertBalance(t *testing.T, store *MemoryStore, account Account, want int64) {
+	t.Helper()
+	if got, _ := store.Balance(context.Background(), account); got != want {
+		t.Errorf("Expected %s at %d, got %d", account.Name, want, got)
+	}
+}
+
+func TestMemoryStore_ConcurrentHolds(t *testing.T) {
+	store := fundedStore(t, 10000)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	placed := 0
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(transactionID int) {
+			defer wg.Done()
+			err := store.PlaceHold(context.Background(), &Hold{TransactionID: transactionID, UserID: 1, Currency: "USD", Amount: 3000})
+			if err == nil {
+				mu.Lock()
+				placed++
+				mu.Unlock()
+			} else if !errors.Is(err, ErrInsufficientFunds) {
+				t.Errorf("Expected insufficient funds error, got: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if placed != 3 {
+		t.Errorf("Expected 3 holds to fit in the balance, got %d", placed)
+	}
+	assertBalance(t, store, UserAvailable(1, "USD"), 1000)
+	assertBalance(t, store, UserHeld(1, "USD"), 9000)
+}
+
+func TestMemoryStore_SettleHold(t *testing.T) {
+	clearing := GatewayClearing(1, "USD")
+
+	tests := []struct {
+		name      string
+		expire    bool
+		capture   bool
+		available int64
+		status    string
+	}{
+		{"capture", false, true, 6000, HoldCaptured},
+		{"release", false, false, 10000, HoldReleased},
+		{"capture after expiry", true, true, 6000, HoldCaptured},
+		{"release after expiry", true, false, 10000, HoldReleased},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := fundedStore(t, 10000)
+			hold := &Hold{TransactionID: 7, UserID: 1, Currency: "USD", Amount: 4000, ExpiresAt: time.Now().Add(time.Hour)}
+			if err := store.PlaceHold(context.Background(), hold); err != nil {
+				t.Fatalf("Expected the hold to be placed, got: %v", err)
+			}
+			if tt.expire {
+				if _, err := store.ExpireHolds(context.Background(), time.Now().Add(2*time.Hour), 10); err != nil {
+					t.Fatalf("Failed to expire holds: %v", err)
+				}
+			}
+
+			if err := store.SettleHold(context.Background(), &Settlement{TransactionID: 7, Capture: tt.capture, Counterparty: clearing}); err != nil {
+				t.Fatalf("Expected the hold to be settled, got: %v", err)
+			}
+			assertBalance(t, store, UserAvailable(1, "USD"), tt.available)
+			assertBalance(t, store, UserHeld(1, "USD"), 0)
+			if hold.Status != tt.status {
+				t.Errorf("Expected status %s, got %s", tt.status, hold.Status)
+			}
+
+			err := store.SettleHold(context.Background(), &Settlement{TransactionID: 7, Capture: tt.capture, Counterparty: clearing})
+			if !errors.Is(err, ErrHoldSettled) {
+				t.Errorf("Expected a second settlement to fail, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestMemoryStore_SettleWithoutHold(t *testing.T) {
+	store := NewMemoryStore()
+	if err := store.SettleHold(context.Background(), &Settlement{TransactionID: 7, Capture: true, Counterparty: GatewayClearing(1, "USD")}); err != nil {
+		t.Errorf("Expected transactions without a hold to be ignored, got: %v", err)
+	}
+}
+
+func TestHoldSweeper_ExpiresDueHolds(t *testing.T) {
+	store := fundedStore(t, 10000)
+	now := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+	for i, expiresIn := range []time.Duration{-2 * time.Hour, -time.Minute, -time.Second, time.Hour} {
+		hold := &Hold{TransactionID: i + 1, UserID: 1, Currency: "USD", Amount: 1000, ExpiresAt: now.Add(expiresIn)}
+		if err := store.PlaceHold(context.Background(), hold); err != nil {
+			t.Fatalf("Expected the hold to be placed, got: %v", err)
+		}
+	}
+
+	sweeper := NewHoldSweeper(store)
+	sweeper.now = func() time.Time { return now }
+	sweeper.BatchSize = 2
+
+	if err := sweeper.SweepOnce(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	for transactionID, status := range map[int]string{1: HoldExpired, 2: HoldExpired, 3: HoldExpired, 4: HoldActive} {
+		if hold := store.Hold(transactionID); hold.Status != status {
+			t.Errorf("Expected hold of transaction %d to be %s, got %s", transactionID, status, hold.Status)
+		}
+	}
+	assertBalance(t, store, UserAvailable(1, "USD"), 9000)
+	assertBalance(t, store, UserHeld(1, "USD"), 1000)
+}
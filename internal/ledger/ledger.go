@@ -0,0 +1,139 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"payment-gateway/internal/models"
+)
+
+var (
+	ErrUnbalancedEntry = errors.New("journal entry does not balance")
+	ErrInvalidEntry    = errors.New("invalid journal entry")
+	// ErrDuplicateEntry means the transaction already has an entry of the kind, e.g. a deposit credited twice.
+	ErrDuplicateEntry = errors.New("duplicate journal entry")
+)
+
+// Kinds of journal entries.
+const (
+	KindDeposit     = "deposit"
+	KindWithdrawal  = "withdrawal"
+	KindRefund      = "refund"
+	KindReversal    = "reversal"
+	KindHold        = "hold"
+	KindHoldRelease = "hold_release"
+	KindHoldExpired = "hold_expired"
+)
+
+// Account is one balance in the ledger. Every user has an available and a held account per currency,
+// every gateway a clearing account per currency for the money that moved in or out through it.
+type Account struct {
+	Name     string
+	Currency string
+}
+
+func UserAvailable(userID int, currency string) Account {
+	return Account{Name: fmt.Sprintf("user:%d:available", userID), Currency: currency}
+}
+
+// UserHeld holds the user's money that is reserved for withdrawals in flight.
+func UserHeld(userID int, currency string) Account {
+	return Account{Name: fmt.Sprintf("user:%d:held", userID), Currency: currency}
+}
+
+// GatewayClearing goes negative for money that came in through the gateway and positive for money
+// that went out, so the balances of all accounts together are always zero.
+func GatewayClearing(gatewayID int, currency string) Account {
+	return Account{Name: fmt.Sprintf("gateway:%d:clearing", gatewayID), Currency: currency}
+}
+
+// Posting changes the balance of one account. Positive amounts increase the balance, negative decrease it.
+type Posting struct {
+	Account Account
+	Amount  int64
+}
+
+// Entry is a set of postings that is written all or nothing. The postings of every currency add up to
+// zero, so money is only ever moved between accounts, never created or lost.
+type Entry struct {
+	ID int64
+	// TransactionID is the transaction that caused the entry.
+	TransactionID int
+	Kind          string
+	Postings      []Posting
+	CreatedAt     time.Time
+}
+
+// Transfer moves amount from one account to another.
+func Transfer(kind string, transactionID int, from Account, to Account, amount int64) *Entry {
+	return &Entry{
+		TransactionID: transactionID,
+		Kind:          kind,
+		Postings: []Posting{
+			{Account: from, Amount: -amount},
+			{Account: to, Amount: amount},
+		},
+		CreatedAt: time.Now(),
+	}
+}
+
+// Validate checks that the entry can be posted: it moves money between at least two accounts
+// in known currencies and the postings of every currency balance.
+func (e *Entry) Validate() error {
+	if e.Kind == "" {
+		return fmt.Errorf("%w: missing kind", ErrInvalidEntry)
+	}
+	if len(e.Postings) < 2 {
+		return fmt.Errorf("%w: needs at least two postings", ErrInvalidEntry)
+	}
+
+	sums := make(map[string]int64)
+	for _, posting := range e.Postings {
+		if posting.Account.Name == "" {
+			return fmt.Errorf("%w: posting without account", ErrInvalidEntry)
+		}
+		if _, ok := models.CurrencyExponent(posting.Account.Currency); !ok {
+			return fmt.Errorf("%w: unknown currency %q", ErrInvalidEntry, posting.Account.Currency)
+		}
+		if posting.Amount == 0 || posting.Amount == math.MinInt64 {
+			return fmt.Errorf("%w: invalid amount %d for %s", ErrInvalidEntry, posting.Amount, posting.Account.Name)
+		}
+		sum, err := models.Money{Minor: sums[posting.Account.Currency], Currency: posting.Account.Currency}.
+			Add(models.Money{Minor: posting.Amount, Currency: posting.Account.Currency})
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidEntry, err)
+		}
+		sums[posting.Account.Currency] = sum.Minor
+	}
+
+	for currency, sum := range sums {
+		if sum != 0 {
+			return fmt.Errorf("%w: %s postings add up to %d", ErrUnbalancedEntry, currency, sum)
+		}
+	}
+	return nil
+}
+
+// Store keeps the journal and the balances of the accounts.
+type Store interface {
+	// Post validates the entry and writes it, all postings or none. A transaction has at most one
+	// entry of every kind, a second one returns ErrDuplicateEntry.
+	Post(ctx context.Context, entry *Entry) error
+
+	// Balance returns the balance of the account, 0 for an account without postings.
+	Balance(ctx context.Context, account Account) (int64, error)
+
+	// PlaceHold reserves the amount of the hold if the user's available balance covers it, and
+	// returns ErrInsufficientFunds otherwise. Checking the balance and placing the hold is atomic,
+	// concurrent holds on the same account wait for each other.
+	PlaceHold(ctx context.Context, hold *Hold) error
+
+	// SettleHold captures or releases the hold of settlement.TransactionID. Transactions without a hold are ignored.
+	SettleHold(ctx context.Context, settlement *Settlement) error
+
+	// ExpireHolds gives back up to limit active holds that expired before now, and returns them.
+	ExpireHolds(ctx context.Context, now time.Time, limit int) ([]*Hold, error)
+}
@@ -0,0 +1,96 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestEntry_Validate(t *testing.T) {
+	alice := UserAvailable(1, "USD")
+	clearing := GatewayClearing(1, "USD")
+
+	tests := []struct {
+		name     string
+		postings []Posting
+		err      error
+	}{
+		{"balanced", []Posting{{clearing, -100}, {alice, 100}}, nil},
+		{"split", []Posting{{clearing, -100}, {alice, 60}, {UserHeld(1, "USD"), 40}}, nil},
+		{"unbalanced", []Posting{{clearing, -100}, {alice, 90}}, ErrUnbalancedEntry},
+		{"balanced across currencies only", []Posting{{clearing, -100}, {UserAvailable(1, "EUR"), 100}}, ErrUnbalancedEntry},
+		{"single posting", []Posting{{alice, 100}}, ErrInvalidEntry},
+		{"zero amount", []Posting{{clearing, 0}, {alice, 0}}, ErrInvalidEntry},
+		{"unknown currency", []Posting{{GatewayClearing(1, "XYZ"), -100}, {UserAvailable(1, "XYZ"), 100}}, ErrInvalidEntry},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := &Entry{Kind: KindDeposit, Postings: tt.postings}
+			if err := entry.Validate(); !errors.Is(err, tt.err) {
+				t.Errorf("Expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestMemoryStore_Post(t *testing.T) {
+	store := NewMemoryStore()
+	available := UserAvailable(1, "USD")
+	held := UserHeld(1, "USD")
+	clearing := GatewayClearing(1, "USD")
+
+	for _, entry := range []*Entry{
+		Transfer(KindDeposit, 1, clearing, available, 10000),
+		Transfer(KindHold, 2, available, held, 4000),
+		Transfer(KindWithdrawal, 2, held, clearing, 4000),
+	} {
+		if err := store.Post(context.Background(), entry); err != nil {
+			t.Fatalf("Expected the entry to be posted, got: %v", err)
+		}
+	}
+
+	expected := map[Account]int64{available: 6000, held: 0, clearing: -6000}
+	for account, want := range expected {
+		if got, _ := store.Balance(context.Background(), account); got != want {
+			t.Errorf("Expected %s at %d, got %d", account.Name, want, got)
+		}
+	}
+	if got, _ := store.Balance(context.Background(), UserAvailable(2, "USD")); got != 0 {
+		t.Errorf("Expected an account without postings at 0, got %d", got)
+	}
+}
+
+func TestMemoryStore_RejectsUnbalancedEntry(t *testing.T) {
+	store := NewMemoryStore()
+	entry := &Entry{Kind: KindDeposit, Postings: []Posting{
+		{GatewayClearing(1, "USD"), -100},
+		{UserAvailable(1, "USD"), 99},
+	}}
+
+	if err := store.Post(context.Background(), entry); !errors.Is(err, ErrUnbalancedEntry) {
+		t.Fatalf("Expected unbalanced entry error, got: %v", err)
+	}
+	if len(store.Entries()) != 0 {
+		t.Error("Expected nothing to be posted")
+	}
+	if got, _ := store.Balance(context.Background(), UserAvailable(1, "USD")); got != 0 {
+		t.Errorf("Expected the balance to stay 0, got %d", got)
+	}
+}
+
+func TestMemoryStore_RejectsDuplicateEntry(t *testing.T) {
+	store := NewMemoryStore()
+	credit := func() *Entry {
+		return Transfer(KindDeposit, 1, GatewayClearing(1, "USD"), UserAvailable(1, "USD"), 10000)
+	}
+
+	if err := store.Post(context.Background(), credit()); err != nil {
+		t.Fatalf("Expected the entry to be posted, got: %v", err)
+	}
+	if err := store.Post(context.Background(), credit()); !errors.Is(err, ErrDuplicateEntry) {
+		t.Fatalf("Expected duplicate entry error, got: %v", err)
+	}
+	if got, _ := store.Balance(context.Background(), UserAvailable(1, "USD")); got != 10000 {
+		t.Errorf("Expected the deposit to be credited once, got %d", got)
+	}
+}
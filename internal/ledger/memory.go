@@ -0,0 +1,139 @@
+package ledger
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps the ledger in process memory. It is only meant for tests and local runs.
+type MemoryStore struct {
+	mu       sync.Mutex
+	entries  []*Entry
+	balances map[Account]int64
+	// holds by transaction
+	holds map[int]*Hold
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		balances: make(map[Account]int64),
+		holds:    make(map[int]*Hold),
+	}
+}
+
+func (s *MemoryStore) Post(ctx context.Context, entry *Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.post(entry)
+}
+
+func (s *MemoryStore) post(entry *Entry) error {
+	if err := entry.Validate(); err != nil {
+		return err
+	}
+	if entry.TransactionID != 0 {
+		for _, posted := range s.entries {
+			if posted.TransactionID == entry.TransactionID && posted.Kind == entry.Kind {
+				return ErrDuplicateEntry
+			}
+		}
+	}
+
+	entry.ID = int64(len(s.entries) + 1)
+	s.entries = append(s.entries, entry)
+	for _, posting := range entry.Postings {
+		s.balances[posting.Account] += posting.Amount
+	}
+	return nil
+}
+
+func (s *MemoryStore) Balance(ctx context.Context, account Account) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.balances[account], nil
+}
+
+func (s *MemoryStore) PlaceHold(ctx context.Context, hold *Hold) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.balances[UserAvailable(hold.UserID, hold.Currency)] < hold.Amount {
+		return ErrInsufficientFunds
+	}
+	if err := s.post(hold.PlaceEntry()); err != nil {
+		return err
+	}
+
+	hold.ID = int64(len(s.holds) + 1)
+	hold.Status = HoldActive
+	if hold.CreatedAt.IsZero() {
+		hold.CreatedAt = time.Now()
+	}
+	s.holds[hold.TransactionID] = hold
+	return nil
+}
+
+func (s *MemoryStore) SettleHold(ctx context.Context, settlement *Settlement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hold, ok := s.holds[settlement.TransactionID]
+	if !ok {
+		return nil
+	}
+	entry, status, err := hold.Settle(settlement)
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		if err := s.post(entry); err != nil {
+			return err
+		}
+	}
+	hold.Status = status
+	return nil
+}
+
+func (s *MemoryStore) ExpireHolds(ctx context.Context, now time.Time, limit int) ([]*Hold, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []*Hold
+	for _, hold := range s.holds {
+		if hold.Status == HoldActive && hold.ExpiresAt.Before(now) {
+			expired = append(expired, hold)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].ExpiresAt.Before(expired[j].ExpiresAt) })
+	if len(expired) > limit {
+		expired = expired[:limit]
+	}
+
+	for _, hold := range expired {
+		if err := s.post(hold.ExpireEntry()); err != nil {
+			return nil, err
+		}
+		hold.Status = HoldExpired
+	}
+	return expired, nil
+}
+
+// Entries returns the posted entries, oldest first.
+func (s *MemoryStore) Entries() []*Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*Entry(nil), s.entries...)
+}
+
+// Hold returns the hold of a transaction, nil if it has none.
+func (s *MemoryStore) Hold(transactionID int) *Hold {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.holds[transactionID]
+}
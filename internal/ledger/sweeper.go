@@ -0,0 +1,60 @@
+package ledger
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// HoldSweeper gives back holds of withdrawals that never settled, e.g. because we crashed before
+// calling the gateway or the gateway never sent a callback. Several instances can run at once,
+// every hold is only expired by one of them.
+type HoldSweeper struct {
+	store Store
+	now   func() time.Time
+
+	Interval  time.Duration
+	BatchSize int
+}
+
+func NewHoldSweeper(store Store) *HoldSweeper {
+	return &HoldSweeper{
+		store:     store,
+		now:       time.Now,
+		Interval:  time.Minute,
+		BatchSize: 100,
+	}
+}
+
+// Run expires holds until the context is cancelled.
+func (s *HoldSweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.SweepOnce(ctx); err != nil {
+				log.Printf("hold sweeper failed: %v", err)
+			}
+		}
+	}
+}
+
+// SweepOnce expires the holds that are due, a batch at a time.
+func (s *HoldSweeper) SweepOnce(ctx context.Context) error {
+	for {
+		expired, err := s.store.ExpireHolds(ctx, s.now(), s.BatchSize)
+		if err != nil {
+			return err
+		}
+		for _, hold := range expired {
+			log.Printf("hold of transaction %d expired, %d %s given back to user %d", hold.TransactionID, hold.Amount, hold.Currency, hold.UserID)
+		}
+		if len(expired) < s.BatchSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package limits
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"payment-gateway/internal/models"
+)
+
+// Kinds of limits.
+const (
+	KindMinAmount    = "min_amount"
+	KindMaxAmount    = "max_amount"
+	KindDailyAmount  = "daily_amount"
+	KindWeeklyAmount = "weekly_amount"
+)
+
+// Machine-readable codes of the violations, returned to clients with the error.
+const (
+	CodeBelowMinimum        = "amount_below_minimum"
+	CodeAboveMaximum        = "amount_above_maximum"
+	CodeDailyLimitExceeded  = "daily_limit_exceeded"
+	CodeWeeklyLimitExceeded = "weekly_limit_exceeded"
+)
+
+// Actions of a rule, what happens to a transaction that breaks it.
+const (
+	// ActionReject refuses the transaction, the default.
+	ActionReject = "reject"
+	// ActionReview lets the transaction be created, but parks it until an operator reviews it.
+	ActionReview = "review"
+)
+
+// kinds lists the known kinds in the order they are checked, with the window of the usage they count.
+var kinds = []struct {
+	kind   string
+	code   string
+	period string
+	window time.Duration
+}{
+	{KindMinAmount, CodeBelowMinimum, "", 0},
+	{KindMaxAmount, CodeAboveMaximum, "", 0},
+	{KindDailyAmount, CodeDailyLimitExceeded, "daily", 24 * time.Hour},
+	{KindWeeklyAmount, CodeWeeklyLimitExceeded, "weekly", 7 * 24 * time.Hour},
+}
+
+func kindIndex(kind string) int {
+	for i, k := range kinds {
+		if k.kind == kind {
+			return i
+		}
+	}
+	return -1
+}
+
+func IsKnownKind(kind string) bool {
+	return kindIndex(kind) >= 0
+}
+
+// Rule is one limit. Zero scope fields apply to everyone, e.g. a rule with only CountryID set
+// applies to all users of that country. KYCTier is nil for every tier, 0 is a tier of its own:
+// the unverified users. Amounts are in minor units of Currency, rules only apply to transactions
+// in their currency.
+type Rule struct {
+	ID              int    `json:"id"`
+	Kind            string `json:"kind"`
+	TransactionType string `json:"transaction_type"`
+	Currency        string `json:"currency"`
+	Amount          int64  `json:"amount"`
+	UserID          int    `json:"user_id,omitempty"`
+	CountryID       int    `json:"country_id,omitempty"`
+	GatewayID       int    `json:"gateway_id,omitempty"`
+	KYCTier         *int   `json:"kyc_tier,omitempty"`
+	Action          string `json:"action"`
+	Enabled         bool   `json:"enabled"`
+	Description     string `json:"description,omitempty"`
+}
+
+func (r *Rule) Validate() error {
+	if !IsKnownKind(r.Kind) {
+		return fmt.Errorf("unknown limit kind %q", r.Kind)
+	}
+	if r.TransactionType == "" {
+		return fmt.Errorf("missing transaction type")
+	}
+	if _, err := models.NewMoney(r.Amount, r.Currency); err != nil {
+		return err
+	}
+	if r.Amount < 0 {
+		return fmt.Errorf("amount can't be negative")
+	}
+	if r.KYCTier != nil && *r.KYCTier < 0 {
+		return fmt.Errorf("kyc tier can't be negative")
+	}
+	if r.Action != ActionReject && r.Action != ActionReview {
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	return nil
+}
+
+// Request is the transaction the limits are checked for.
+type Request struct {
+	UserID          int
+	CountryID       int
+	GatewayID       int
+	TransactionType string
+	Amount          models.Money
+}
+
+func (r *Rule) matches(req *Request, kycTier int) bool {
+	return r.Enabled &&
+		r.TransactionType == req.TransactionType &&
+		r.Currency == req.Amount.Currency &&
+		(r.UserID == 0 || r.UserID == req.UserID) &&
+		(r.CountryID == 0 || r.CountryID == req.CountryID) &&
+		(r.GatewayID == 0 || r.GatewayID == req.GatewayID) &&
+		(r.KYCTier == nil || *r.KYCTier == kycTier)
+}
+
+// Violation is returned when a transaction would break a limit.
+type Violation struct {
+	Rule *Rule
+	Code string
+	// Used is what the user already used of the limit in its window, 0 for per-transaction limits.
+	Used int64
+}
+
+// NeedsReview reports whether the transaction may go ahead once an operator has reviewed it.
+func (v *Violation) NeedsReview() bool {
+	return v.Rule.Action == ActionReview
+}
+
+func (v *Violation) Error() string {
+	limit := models.Money{Minor: v.Rule.Amount, Currency: v.Rule.Currency}
+	switch v.Rule.Kind {
+	case KindMinAmount:
+		return fmt.Sprintf("%s amount has to be at least %s", v.Rule.TransactionType, limit)
+	case KindMaxAmount:
+		return fmt.Sprintf("%s amount can't be more than %s", v.Rule.TransactionType, limit)
+	default:
+		used := models.Money{Minor: v.Used, Currency: v.Rule.Currency}
+		return fmt.Sprintf("%s %s limit of %s exceeded, %s already used", kinds[kindIndex(v.Rule.Kind)].period, v.Rule.TransactionType, limit, used)
+	}
+}
+
+// UsageStore is where the usage comes from.
+type UsageStore interface {
+	// Usage returns the total of the user's transactions of this type and currency created since then,
+	// failed and reversed ones excluded.
+	Usage(ctx context.Context, userID int, transactionType string, currency string, since time.Time) (int64, error)
+}
+
+// Store is where the rules and the usage come from.
+type Store interface {
+	UsageStore
+
+	// Rules returns the enabled rules.
+	Rules(ctx context.Context) ([]*Rule, error)
+
+	// KYCTier returns the KYC tier of the user.
+	KYCTier(ctx context.Context, userID int) (int, error)
+}
+
+// RuleCache keeps the rules between checks, so not every payment has to load them.
+type RuleCache interface {
+	// Get returns ok false when the rules aren't cached.
+	Get(ctx context.Context) (rules []*Rule, ok bool, err error)
+	Set(ctx context.Context, rules []*Rule, ttl time.Duration) error
+	// Invalidate drops the cached rules, so changed rules apply right away.
+	Invalidate(ctx context.Context) error
+}
+
+type Checker interface {
+	// Check returns a *Violation when the transaction breaks one of the limits. A rule that rejects
+	// wins over one that sends the transaction to review. Unless the transaction is rejected, the daily and
+	// weekly limits it was checked against are returned to be checked again when it is saved, see Recheck,
+	// nil when there are none.
+	Check(ctx context.Context, req *Request) (*Recheck, error)
+}
+
+// Recheck is the daily and weekly limits of a transaction. Two transactions of a user checked at the same time
+// both fit in what is left of a limit, so they are checked again under a lock on the user, in the database
+// transaction the transaction is saved in.
+type Recheck struct {
+	Request *Request
+	// Rules are the daily and weekly rules the transaction matched, in the order they are checked.
+	Rules []*Rule
+	now   func() time.Time
+}
+
+// Check returns a *Violation when the transaction breaks one of the limits with the usage of the store,
+// like Engine.Check.
+func (r *Recheck) Check(ctx context.Context, store UsageStore) error {
+	return check(ctx, store, r.Request, r.Rules, r.now())
+}
+
+// Rejecting returns the recheck of the rules that reject the transaction, for a transaction already going to review.
+// It is nil when none of them do.
+func (r *Recheck) Rejecting() *Recheck {
+	var rejecting *Recheck
+	for _, rule := range r.Rules {
+		if rule.Action != ActionReject {
+			continue
+		}
+		if rejecting == nil {
+			rejecting = &Recheck{Request: r.Request, now: r.now}
+		}
+		rejecting.Rules = append(rejecting.Rules, rule)
+	}
+	return rejecting
+}
+
+// DefaultCacheTTL is how long the rules are cached by default.
+const DefaultCacheTTL = time.Minute
+
+// Engine checks transactions against the rules of the store.
+type Engine struct {
+	store Store
+	cache RuleCache
+	now   func() time.Time
+
+	// CacheTTL is the longest a changed rule takes to apply when the cache isn't invalidated.
+	CacheTTL time.Duration
+}
+
+func NewEngine(store Store, cache RuleCache) *Engine {
+	return &Engine{
+		store:    store,
+		cache:    cache,
+		now:      time.Now,
+		CacheTTL: DefaultCacheTTL,
+	}
+}
+
+func (e *Engine) Check(ctx context.Context, req *Request) (*Recheck, error) {
+	rules, err := e.rules(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The tier is only looked up when a rule depends on it.
+	kycTier := -1
+	var matching []*Rule
+	for _, rule := range rules {
+		if rule.KYCTier != nil && kycTier < 0 {
+			if kycTier, err = e.store.KYCTier(ctx, req.UserID); err != nil {
+				return nil, fmt.Errorf("failed to get kyc tier: %v", err)
+			}
+		}
+		if rule.matches(req, kycTier) {
+			matching = append(matching, rule)
+		}
+	}
+	// Per-transaction limits first, they don't need the usage. The strictest rule of a kind wins.
+	sort.SliceStable(matching, func(i, j int) bool {
+		ki, kj := kindIndex(matching[i].Kind), kindIndex(matching[j].Kind)
+		if ki != kj {
+			return ki < kj
+		}
+		if matching[i].Kind == KindMinAmount {
+			return matching[i].Amount > matching[j].Amount
+		}
+		return matching[i].Amount < matching[j].Amount
+	})
+
+	var recheck *Recheck
+	for _, rule := range matching {
+		if kinds[kindIndex(rule.Kind)].window == 0 {
+			continue
+		}
+		if recheck == nil {
+			recheck = &Recheck{Request: req, now: e.now}
+		}
+		recheck.Rules = append(recheck.Rules, rule)
+	}
+	err = check(ctx, e.store, req, matching, e.now())
+	var violation *Violation
+	if err != nil && !(errors.As(err, &violation) && violation.NeedsReview()) {
+		return nil, err
+	}
+	return recheck, err
+}
+
+// check checks the transaction against the sorted rules. A review is only returned once no rule rejects the transaction.
+func check(ctx context.Context, store UsageStore, req *Request, rules []*Rule, now time.Time) error {
+	var review *Violation
+	usage := make(map[time.Duration]int64)
+	for _, rule := range rules {
+		if review != nil && rule.Action == ActionReview {
+			continue
+		}
+		k := kinds[kindIndex(rule.Kind)]
+		var violation *Violation
+		switch {
+		case rule.Kind == KindMinAmount:
+			if req.Amount.Minor < rule.Amount {
+				violation = &Violation{Rule: rule, Code: k.code}
+			}
+		case rule.Kind == KindMaxAmount:
+			if req.Amount.Minor > rule.Amount {
+				violation = &Violation{Rule: rule, Code: k.code}
+			}
+		default:
+			used, ok := usage[k.window]
+			if !ok {
+				var err error
+				used, err = store.Usage(ctx, req.UserID, req.TransactionType, req.Amount.Currency, now.Add(-k.window))
+				if err != nil {
+					return err
+				}
+				usage[k.window] = used
+			}
+			if used+req.Amount.Minor > rule.Amount {
+				violation = &Violation{Rule: rule, Code: k.code, Used: used}
+			}
+		}
+		if violation == nil {
+			continue
+		}
+		if !violation.NeedsReview() {
+			return violation
+		}
+		review = violation
+	}
+	if review != nil {
+		return review
+	}
+	return nil
+}
+
+// rules returns the cached rules, loading them from the store when they aren't cached.
+// A broken cache only makes the check slower, it never lets a payment through unchecked.
+func (e *Engine) rules(ctx context.Context) ([]*Rule, error) {
+	if e.cache != nil {
+		rules, ok, err := e.cache.Get(ctx)
+		if err != nil {
+			log.Printf("failed to read cached limit rules: %v", err)
+		} else if ok {
+			return rules, nil
+		}
+	}
+
+	rules, err := e.store.Rules(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load limit rules: %v", err)
+	}
+	if e.cache != nil {
+		if err := e.cache.Set(ctx, rules, e.CacheTTL); err != nil {
+			log.Printf("failed to cache limit rules: %v", err)
+		}
+	}
+	return rules, nil
+}
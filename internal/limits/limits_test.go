@@ -0,0 +1,229 @@
+package limits
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"payment-gateway/internal/models"
+)
+
+type mockStore struct {
+	rules      []*Rule
+	used       map[time.Duration]int64
+	now        time.Time
+	ruleLoads  int
+	usageCalls int
+}
+
+func (m *mockStore) Rules(ctx context.Context) ([]*Rule, error) {
+	m.ruleLoads++
+	return m.rules, nil
+}
+
+func (m *mockStore) Usage(ctx context.Context, userID int, transactionType string, currency string, since time.Time) (int64, error) {
+	m.usageCalls++
+	return m.used[m.now.Sub(since)], nil
+}
+
+func (m *mockStore) KYCTier(ctx context.Context, userID int) (int, error) {
+	return 0, nil
+}
+
+type mockCache struct {
+	rules  []*Rule
+	cached bool
+	err    error
+}
+
+func (m *mockCache) Get(ctx context.Context) ([]*Rule, bool, error) {
+	return m.rules, m.cached, m.err
+}
+
+func (m *mockCache) Set(ctx context.Context, rules []*Rule, ttl time.Duration) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.rules, m.cached = rules, true
+	return nil
+}
+
+func (m *mockCache) Invalidate(ctx context.Context) error {
+	m.rules, m.cached = nil, false
+	return nil
+}
+
+func newTestEngine(store *mockStore, cache RuleCache) *Engine {
+	store.now = time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+	engine := NewEngine(store, cache)
+	engine.now = func() time.Time { return store.now }
+	return engine
+}
+
+func withdrawal(amount int64) *Request {
+	return &Request{UserID: 1, CountryID: 840, GatewayID: 1, TransactionType: "withdraw", Amount: models.Money{Minor: amount, Currency: "USD"}}
+}
+
+func rule(kind string, amount int64) *Rule {
+	return &Rule{Kind: kind, TransactionType: "withdraw", Currency: "USD", Amount: amount, Action: ActionReject, Enabled: true}
+}
+
+func TestEngine_StrictestRuleWins(t *testing.T) {
+	store := &mockStore{rules: []*Rule{
+		rule(KindWeeklyAmount, 50000),
+		rule(KindDailyAmount, 30000),
+		rule(KindDailyAmount, 20000),
+	}, used: map[time.Duration]int64{24 * time.Hour: 15000, 7 * 24 * time.Hour: 45000}}
+	engine := newTestEngine(store, nil)
+
+	_, err := engine.Check(context.Background(), withdrawal(6000))
+	var violation *Violation
+	if !errors.As(err, &violation) {
+		t.Fatalf("Expected a violation, got: %v", err)
+	}
+	if violation.Code != CodeDailyLimitExceeded || violation.Rule.Amount != 20000 || violation.Used != 15000 {
+		t.Errorf("Expected the 200.00 USD daily limit to be exceeded, got %+v", violation)
+	}
+	if err.Error() != "daily withdraw limit of 200.00 USD exceeded, 150.00 USD already used" {
+		t.Errorf("Unexpected message %q", err.Error())
+	}
+	// Both daily rules share one usage query.
+	if store.usageCalls != 1 {
+		t.Errorf("Expected 1 usage query, got %d", store.usageCalls)
+	}
+
+	if _, err := engine.Check(context.Background(), withdrawal(5000)); err != nil {
+		t.Errorf("Expected a withdrawal within the limits to pass, got: %v", err)
+	}
+}
+
+func TestEngine_WeeklyLimit(t *testing.T) {
+	store := &mockStore{rules: []*Rule{rule(KindDailyAmount, 20000), rule(KindWeeklyAmount, 50000)},
+		used: map[time.Duration]int64{24 * time.Hour: 0, 7 * 24 * time.Hour: 45000}}
+	engine := newTestEngine(store, nil)
+
+	var violation *Violation
+	if _, err := engine.Check(context.Background(), withdrawal(6000)); !errors.As(err, &violation) || violation.Code != CodeWeeklyLimitExceeded {
+		t.Errorf("Expected the weekly limit to be exceeded, got: %v", err)
+	}
+}
+
+func TestEngine_PerTransactionLimitsDontQueryUsage(t *testing.T) {
+	store := &mockStore{rules: []*Rule{rule(KindMaxAmount, 1000), rule(KindDailyAmount, 20000)}}
+	engine := newTestEngine(store, nil)
+
+	var violation *Violation
+	if _, err := engine.Check(context.Background(), withdrawal(6000)); !errors.As(err, &violation) || violation.Code != CodeAboveMaximum {
+		t.Errorf("Expected the maximum to be exceeded, got: %v", err)
+	}
+	if store.usageCalls != 0 {
+		t.Errorf("Expected no usage query, got %d", store.usageCalls)
+	}
+}
+
+func TestEngine_RejectWinsOverReview(t *testing.T) {
+	review := rule(KindMaxAmount, 1000)
+	review.Action = ActionReview
+	store := &mockStore{rules: []*Rule{review, rule(KindDailyAmount, 20000)},
+		used: map[time.Duration]int64{24 * time.Hour: 15000}}
+	engine := newTestEngine(store, nil)
+
+	var violation *Violation
+	if _, err := engine.Check(context.Background(), withdrawal(6000)); !errors.As(err, &violation) || violation.NeedsReview() {
+		t.Errorf("Expected the daily limit to reject the withdrawal, got: %v", err)
+	}
+
+	// Within the daily limit only the review is left.
+	_, err := engine.Check(context.Background(), withdrawal(2000))
+	if !errors.As(err, &violation) || !violation.NeedsReview() || violation.Code != CodeAboveMaximum {
+		t.Errorf("Expected the withdrawal to need a review, got: %v", err)
+	}
+}
+
+func TestEngine_Recheck(t *testing.T) {
+	review := rule(KindWeeklyAmount, 40000)
+	review.Action = ActionReview
+	store := &mockStore{rules: []*Rule{rule(KindMaxAmount, 10000), rule(KindDailyAmount, 20000), review},
+		used: map[time.Duration]int64{24 * time.Hour: 10000, 7 * 24 * time.Hour: 10000}}
+	engine := newTestEngine(store, nil)
+
+	recheck, err := engine.Check(context.Background(), withdrawal(6000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recheck == nil || len(recheck.Rules) != 2 || recheck.Rules[0].Kind != KindDailyAmount || recheck.Rules[1].Kind != KindWeeklyAmount {
+		t.Fatalf("Expected the daily and weekly rules to be checked again, got %+v", recheck)
+	}
+
+	// Another withdrawal of the user was saved in between.
+	store.used = map[time.Duration]int64{24 * time.Hour: 16000, 7 * 24 * time.Hour: 36000}
+	var violation *Violation
+	if err := recheck.Check(context.Background(), store); !errors.As(err, &violation) || violation.Code != CodeDailyLimitExceeded || violation.Used != 16000 {
+		t.Errorf("Expected the daily limit to be exceeded on the recheck, got: %v", err)
+	}
+	store.used[24*time.Hour] = 10000
+	if err := recheck.Check(context.Background(), store); !errors.As(err, &violation) || !violation.NeedsReview() {
+		t.Errorf("Expected the weekly limit to send the withdrawal to review, got: %v", err)
+	}
+	if err := recheck.Rejecting().Check(context.Background(), store); err != nil {
+		t.Errorf("Expected only the rejecting rules to be checked again, got: %v", err)
+	}
+
+	// Per-transaction limits don't change, there is nothing to check again.
+	store.rules = []*Rule{rule(KindMaxAmount, 10000)}
+	if recheck, err := engine.Check(context.Background(), withdrawal(6000)); recheck != nil || err != nil {
+		t.Errorf("Expected no recheck, got %+v, %v", recheck, err)
+	}
+}
+
+func TestEngine_CachesRules(t *testing.T) {
+	store := &mockStore{rules: []*Rule{rule(KindMaxAmount, 1000)}}
+	cache := &mockCache{}
+	engine := newTestEngine(store, cache)
+
+	for i := 0; i < 3; i++ {
+		if _, err := engine.Check(context.Background(), withdrawal(6000)); err == nil {
+			t.Fatal("Expected a violation")
+		}
+	}
+	if store.ruleLoads != 1 {
+		t.Errorf("Expected the rules to be loaded once, got %d", store.ruleLoads)
+	}
+
+	// A changed rule applies once the cache is invalidated.
+	store.rules = []*Rule{rule(KindMaxAmount, 10000)}
+	cache.Invalidate(context.Background())
+	if _, err := engine.Check(context.Background(), withdrawal(6000)); err != nil {
+		t.Errorf("Expected the changed rule to apply, got: %v", err)
+	}
+}
+
+func TestEngine_BrokenCacheFallsBackToStore(t *testing.T) {
+	store := &mockStore{rules: []*Rule{rule(KindMaxAmount, 1000)}}
+	engine := newTestEngine(store, &mockCache{err: errors.New("connection refused")})
+
+	var violation *Violation
+	if _, err := engine.Check(context.Background(), withdrawal(6000)); !errors.As(err, &violation) {
+		t.Errorf("Expected the rules of the store to apply, got: %v", err)
+	}
+}
+
+func TestRule_Validate(t *testing.T) {
+	if err := rule(KindDailyAmount, 100).Validate(); err != nil {
+		t.Errorf("Expected a valid rule, got: %v", err)
+	}
+	if err := rule("monthly_amount", 100).Validate(); err == nil {
+		t.Error("Expected an unknown kind to be rejected")
+	}
+	invalid := rule(KindDailyAmount, 100)
+	invalid.Currency = "XYZ"
+	if err := invalid.Validate(); err == nil {
+		t.Error("Expected an unknown currency to be rejected")
+	}
+	invalid = rule(KindDailyAmount, 100)
+	invalid.Action = "warn"
+	if err := invalid.Validate(); err == nil {
+		t.Error("Expected an unknown action to be rejected")
+	}
+}
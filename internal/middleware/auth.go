@@ -1,8 +1,20 @@
 package middleware
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log"
 	"net/http"
+	"payment-gateway/db"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/utils"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
 )
 
 type contextKey string
@@ -10,41 +22,182 @@ type contextKey string
 const (
 	UserIDKey    contextKey = "user_id"
 	GatewayIDKey contextKey = "gateway_id"
+	// ReviewerIDKey holds the user ID of the operator working the review queue.
+	ReviewerIDKey contextKey = "reviewer_id"
+	// MerchantIDKey holds the merchant of the user's token, when it has one.
+	MerchantIDKey contextKey = "merchant_id"
 )
 
+var userAuth *JWTValidator
+
+// InitUserAuth sets up the validator for the bearer tokens issued by our auth service.
+func InitUserAuth(cfg JWTConfig) error {
+	validator, err := NewJWTValidator(cfg)
+	if err != nil {
+		return err
+	}
+	userAuth = validator
+	return nil
+}
+
 // This middleware is used to authorize User.
+// It expects a JWT from the auth service in the Authorization header and takes the user ID from its claims.
 func UserAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok {
+			utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeUnauthorized, "Bearer token is required"))
+			return
+		}
 
-		// We should get user information from UserService or any other relevant service.
-		// For now, I will just put a static userID.
+		if userAuth == nil {
+			log.Println("user auth is not initialized, rejecting request")
+			utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeUnauthorized, "Invalid or expired token"))
+			return
+		}
 
-		userId := 33322
+		userId, merchantID, err := userAuth.ValidateUser(token)
+		if err != nil {
+			log.Printf("rejected bearer token: %v", err)
+			utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeUnauthorized, "Invalid or expired token"))
+			return
+		}
 
 		// Add user ID to request context
 		ctx := context.WithValue(r.Context(), UserIDKey, userId)
+		if merchantID != "" {
+			ctx = context.WithValue(ctx, MerchantIDKey, merchantID)
+		}
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// This middleware is used to authorize the operators of the review queue.
+// It takes the same tokens as UserAuthMiddleware, but the token has to carry the reviewer role.
+func ReviewerAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok {
+			utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeUnauthorized, "Bearer token is required"))
+			return
+		}
+
+		if userAuth == nil {
+			log.Println("user auth is not initialized, rejecting request")
+			utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeUnauthorized, "Invalid or expired token"))
+			return
+		}
+
+		reviewerID, err := userAuth.ValidateReviewer(token)
+		if errors.Is(err, ErrMissingRole) {
+			utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeForbidden, "Reviewer role is required"))
+			return
+		}
+		if err != nil {
+			log.Printf("rejected bearer token: %v", err)
+			utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeUnauthorized, "Invalid or expired token"))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), ReviewerIDKey, reviewerID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+const (
+	// Callbacks older than this are rejected, so a captured request can't be replayed later.
+	defaultReplayWindow = 5 * time.Minute
+	// Callbacks are small, anything bigger than this is not coming from a gateway.
+	maxCallbackBodySize = 1 << 20
+)
+
+// GatewayLookup is the part of the gateway repository the middleware needs.
+type GatewayLookup interface {
+	GetGatewayByName(ctx context.Context, name string) (*db.Gateway, error)
+}
+
+var gatewayAuth GatewayLookup
+
+// InitGatewayAuth sets where the gateway credentials are looked up from.
+func InitGatewayAuth(gateways GatewayLookup) {
+	gatewayAuth = gateways
+}
+
+// GatewayRouteVar is the variable of the callback route that names the gateway, /payment-callback/{gateway}.
+const GatewayRouteVar = "gateway"
+
 // This middleware is used to authorize payment gateway.
+// The gateway is named by the route and the raw body has to be signed with the gateway's own secret,
+// using the signature scheme configured for that gateway. Only our own hmac-sha256 scheme also takes
+// the gateway's api key, Stripe and PayPal send nothing but their signature.
 func GatewayAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// apiKey := r.Header.Get("X-Gateway-API-Key")
-		// if apiKey == "" {
-		// 	utils.WriteResponse(w, r, http.StatusUnauthorized, models.APIResponse{
-		// 		StatusCode: http.StatusUnauthorized,
-		// 		Message:    "Gateway API key is required",
-		// 	})
-		// 	return
-		// }
-
-		// We should get gateway ID from GatewayService or any other relevant source.
-		// For now, I will just put a static gatewayID.
-		gatewayId := 433434
+		name := mux.Vars(r)[GatewayRouteVar]
+		if name == "" {
+			utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeUnauthorized, "Gateway is required"))
+			return
+		}
+
+		if gatewayAuth == nil {
+			log.Println("gateway auth is not initialized, rejecting callback")
+			utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeUnauthorized, "Invalid gateway credentials"))
+			return
+		}
+
+		gateway, err := gatewayAuth.GetGatewayByName(r.Context(), name)
+		if err != nil {
+			utils.WriteErrorResponse(w, r, err)
+			return
+		}
+		if gateway == nil || gateway.SigningSecret == "" {
+			utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeUnauthorized, "Invalid gateway credentials"))
+			return
+		}
+
+		if gateway.SignatureScheme == SchemeHMACSHA256 {
+			apiKey := r.Header.Get("X-Gateway-API-Key")
+			if apiKey == "" {
+				utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeUnauthorized, "Gateway API key is required"))
+				return
+			}
+			if subtle.ConstantTimeCompare([]byte(db.HashAPIKey(apiKey)), []byte(gateway.APIKeyHash)) != 1 {
+				utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeUnauthorized, "Invalid gateway credentials"))
+				return
+			}
+		}
+
+		verifier, ok := getCallbackVerifier(gateway.SignatureScheme)
+		if !ok {
+			log.Printf("no callback verifier for scheme %q of gateway %d", gateway.SignatureScheme, gateway.ID)
+			utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeUnauthorized, "Invalid gateway credentials"))
+			return
+		}
+
+		// The signature is computed over the raw body, so we read it here and put it back for the handler.
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxCallbackBodySize+1))
+		if err != nil || len(body) > maxCallbackBodySize {
+			utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeValidation, "Could not read callback body"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		if err := verifier.Verify(r, body, gateway.SigningSecret, time.Now()); err != nil {
+			log.Printf("rejected callback for gateway %d: %v", gateway.ID, err)
+			utils.WriteErrorResponse(w, r, models.NewServiceError(models.ErrorCodeUnauthorized, "Invalid callback signature"))
+			return
+		}
 
 		// Add gateway ID to request context
-		ctx := context.WithValue(r.Context(), GatewayIDKey, gatewayId)
+		ctx := context.WithValue(r.Context(), GatewayIDKey, gateway.ID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
@@ -0,0 +1,251 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testSecret = "test-secret"
+
+// Test setup helper
+func setupUserAuth(t *testing.T, cfg JWTConfig) {
+	original := userAuth
+	if err := InitUserAuth(cfg); err != nil {
+		t.Fatalf("Failed to init user auth: %v", err)
+	}
+	t.Cleanup(func() {
+		userAuth = original
+	})
+}
+
+func signHS256(t *testing.T, claims jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return token
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub": "42",
+		"iss": "auth-service",
+		"aud": "payment-gateway",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+// serveWithToken runs the middleware and returns the response and the user id the handler saw.
+func serveWithToken(token string) (*httptest.ResponseRecorder, int) {
+	var userID int
+	handler := UserAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ = r.Context().Value(UserIDKey).(int)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/deposit", nil)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr, userID
+}
+
+func TestUserAuth_ValidHS256Token(t *testing.T) {
+	setupUserAuth(t, JWTConfig{HMACSecret: testSecret, Issuer: "auth-service", Audience: "payment-gateway"})
+
+	rr, userID := serveWithToken(signHS256(t, validClaims()))
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if userID != 42 {
+		t.Errorf("Expected user id 42, got %d", userID)
+	}
+}
+
+func TestUserAuth_CustomUserIDClaim(t *testing.T) {
+	setupUserAuth(t, JWTConfig{HMACSecret: testSecret, UserIDClaim: "uid"})
+
+	claims := validClaims()
+	claims["uid"] = 7
+	rr, userID := serveWithToken(signHS256(t, claims))
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if userID != 7 {
+		t.Errorf("Expected user id 7, got %d", userID)
+	}
+}
+
+func TestUserAuth_MerchantClaim(t *testing.T) {
+	setupUserAuth(t, JWTConfig{HMACSecret: testSecret})
+
+	var merchantID string
+	var found bool
+	handler := UserAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		merchantID, found = r.Context().Value(MerchantIDKey).(string)
+	}))
+	serve := func(claims jwt.MapClaims) {
+		req := httptest.NewRequest(http.MethodPost, "/deposit", nil)
+		req.Header.Set("Authorization", "Bearer "+signHS256(t, claims))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	claims := validClaims()
+	claims["merchant_id"] = "shop-7"
+	serve(claims)
+	if merchantID != "shop-7" {
+		t.Errorf("Expected merchant shop-7, got %q", merchantID)
+	}
+
+	serve(validClaims())
+	if found {
+		t.Errorf("Expected no merchant for a token without one, got %q", merchantID)
+	}
+}
+
+func TestUserAuth_RejectsInvalidTokens(t *testing.T) {
+	setupUserAuth(t, JWTConfig{HMACSecret: testSecret, Issuer: "auth-service", Audience: "payment-gateway"})
+
+	tests := map[string]func(jwt.MapClaims){
+		"expired":        func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"missing exp":    func(c jwt.MapClaims) { delete(c, "exp") },
+		"not yet valid":  func(c jwt.MapClaims) { c["nbf"] = time.Now().Add(time.Hour).Unix() },
+		"wrong issuer":   func(c jwt.MapClaims) { c["iss"] = "someone-else" },
+		"wrong audience": func(c jwt.MapClaims) { c["aud"] = "another-service" },
+		"missing user":   func(c jwt.MapClaims) { delete(c, "sub") },
+	}
+
+	for name, mutate := range tests {
+		t.Run(name, func(t *testing.T) {
+			claims := validClaims()
+			mutate(claims)
+
+			rr, _ := serveWithToken(signHS256(t, claims))
+			if rr.Code != http.StatusUnauthorized {
+				t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+			}
+		})
+	}
+}
+
+func TestUserAuth_RejectsWrongSignature(t *testing.T) {
+	setupUserAuth(t, JWTConfig{HMACSecret: testSecret})
+
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims()).SignedString([]byte("not-the-secret"))
+	rr, _ := serveWithToken(token)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+	}
+}
+
+func TestUserAuth_MissingToken(t *testing.T) {
+	setupUserAuth(t, JWTConfig{HMACSecret: testSecret})
+
+	rr, _ := serveWithToken("")
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+	}
+}
+
+func TestUserAuth_RS256WithJWKSFile(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "key-1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(path, jwks, 0o600)
+
+	setupUserAuth(t, JWTConfig{JWKSFile: path})
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, validClaims())
+	token.Header["kid"] = "key-1"
+	signed, _ := token.SignedString(key)
+
+	rr, userID := serveWithToken(signed)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if userID != 42 {
+		t.Errorf("Expected user id 42, got %d", userID)
+	}
+
+	// HS256 is not configured, so such tokens must not be accepted.
+	rr, _ = serveWithToken(signHS256(t, validClaims()))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+	}
+}
+
+func serveReviewer(token string) (*httptest.ResponseRecorder, int) {
+	var reviewerID int
+	handler := ReviewerAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reviewerID, _ = r.Context().Value(ReviewerIDKey).(int)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/reviews", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr, reviewerID
+}
+
+func TestReviewerAuth_RequiresReviewerRole(t *testing.T) {
+	setupUserAuth(t, JWTConfig{HMACSecret: testSecret})
+
+	claims := validClaims()
+	claims["roles"] = []string{"payments:reviewer"}
+	rr, reviewerID := serveReviewer(signHS256(t, claims))
+	if rr.Code != http.StatusOK || reviewerID != 42 {
+		t.Errorf("Expected reviewer 42 to get through, got status %d and reviewer %d", rr.Code, reviewerID)
+	}
+
+	// A regular user token is valid, but not allowed.
+	rr, _ = serveReviewer(signHS256(t, validClaims()))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 without the role, got %d", rr.Code)
+	}
+
+	rr, _ = serveReviewer("not-a-token")
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for an invalid token, got %d", rr.Code)
+	}
+}
+
+func TestReviewerAuth_CustomRolesClaim(t *testing.T) {
+	setupUserAuth(t, JWTConfig{HMACSecret: testSecret, RolesClaim: "scope", ReviewerRole: "review"})
+
+	claims := validClaims()
+	claims["scope"] = "payments review"
+	if rr, reviewerID := serveReviewer(signHS256(t, claims)); rr.Code != http.StatusOK || reviewerID != 42 {
+		t.Errorf("Expected the role in a space separated claim to count, got status %d", rr.Code)
+	}
+}
@@ -0,0 +1,195 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"payment-gateway/internal/paypal"
+)
+
+const (
+	SchemeHMACSHA256 = "hmac-sha256"
+	SchemeStripe     = "stripe"
+	SchemePaypal     = "paypal"
+)
+
+// CallbackVerifier checks that a callback was really signed by the gateway.
+// Every gateway signs its callbacks in its own way, so each scheme gets its own implementation.
+type CallbackVerifier interface {
+	Verify(r *http.Request, body []byte, secret string, now time.Time) error
+}
+
+var (
+	verifiersMu       sync.RWMutex
+	callbackVerifiers = map[string]CallbackVerifier{
+		SchemeHMACSHA256: &HMACVerifier{Window: defaultReplayWindow},
+		SchemeStripe:     &StripeVerifier{Window: defaultReplayWindow},
+	}
+)
+
+// RegisterCallbackVerifier adds or replaces the verifier used for a signature scheme.
+func RegisterCallbackVerifier(scheme string, verifier CallbackVerifier) {
+	verifiersMu.Lock()
+	defer verifiersMu.Unlock()
+	callbackVerifiers[scheme] = verifier
+}
+
+func getCallbackVerifier(scheme string) (CallbackVerifier, bool) {
+	verifiersMu.RLock()
+	defer verifiersMu.RUnlock()
+	verifier, ok := callbackVerifiers[scheme]
+	return verifier, ok
+}
+
+// HMACVerifier is our default scheme. The gateway sends
+//
+//	X-Timestamp: <unix seconds>
+//	X-Signature: hex(HMAC-SHA256(secret, "<timestamp>.<raw body>"))
+type HMACVerifier struct {
+	// How old (or how far in the future) a callback can be before we treat it as a replay.
+	Window time.Duration
+}
+
+func (v *HMACVerifier) Verify(r *http.Request, body []byte, secret string, now time.Time) error {
+	timestamp := r.Header.Get("X-Timestamp")
+	signature := r.Header.Get("X-Signature")
+	if timestamp == "" || signature == "" {
+		return errors.New("missing signature headers")
+	}
+
+	if err := checkTimestamp(timestamp, now, v.Window); err != nil {
+		return err
+	}
+
+	if !validSignature(secret, timestamp, body, signature) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// StripeVerifier follows the Stripe-Signature header format, t=<timestamp>,v1=<signature>[,v1=...].
+// Stripe may send more than one v1 signature while a secret is being rolled.
+type StripeVerifier struct {
+	Window time.Duration
+}
+
+func (v *StripeVerifier) Verify(r *http.Request, body []byte, secret string, now time.Time) error {
+	header := r.Header.Get("Stripe-Signature")
+	if header == "" {
+		return errors.New("missing Stripe-Signature header")
+	}
+
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return errors.New("malformed Stripe-Signature header")
+	}
+
+	if err := checkTimestamp(timestamp, now, v.Window); err != nil {
+		return err
+	}
+
+	for _, signature := range signatures {
+		if validSignature(secret, timestamp, body, signature) {
+			return nil
+		}
+	}
+	return errors.New("signature mismatch")
+}
+
+// PaypalVerifier checks the PAYPAL-* transmission headers of a webhook with the verify-webhook-signature API
+// of PayPal. The signing secret of the gateway is the id of the webhook in the PayPal app, PayPal only takes
+// the signature for the webhook it was sent to.
+type PaypalVerifier struct {
+	// Client asks PayPal, with the credentials of the app the webhook belongs to.
+	Client *paypal.Client
+	Window time.Duration
+}
+
+// NewPaypalVerifier returns the verifier of the paypal scheme, it has to be registered with the app's client.
+func NewPaypalVerifier(client *paypal.Client) *PaypalVerifier {
+	return &PaypalVerifier{Client: client, Window: defaultReplayWindow}
+}
+
+func (v *PaypalVerifier) Verify(r *http.Request, body []byte, secret string, now time.Time) error {
+	if v.Client == nil {
+		return errors.New("paypal verifier has no client")
+	}
+
+	signature := &paypal.WebhookSignature{
+		AuthAlgo:         r.Header.Get("PAYPAL-AUTH-ALGO"),
+		CertURL:          r.Header.Get("PAYPAL-CERT-URL"),
+		TransmissionID:   r.Header.Get("PAYPAL-TRANSMISSION-ID"),
+		TransmissionSig:  r.Header.Get("PAYPAL-TRANSMISSION-SIG"),
+		TransmissionTime: r.Header.Get("PAYPAL-TRANSMISSION-TIME"),
+		WebhookID:        secret,
+		Event:            body,
+	}
+	if signature.AuthAlgo == "" || signature.CertURL == "" || signature.TransmissionID == "" ||
+		signature.TransmissionSig == "" || signature.TransmissionTime == "" {
+		return errors.New("missing PayPal transmission headers")
+	}
+
+	sent, err := time.Parse(time.RFC3339, signature.TransmissionTime)
+	if err != nil {
+		return fmt.Errorf("invalid transmission time %q", signature.TransmissionTime)
+	}
+	if err := checkTimestamp(strconv.FormatInt(sent.Unix(), 10), now, v.Window); err != nil {
+		return err
+	}
+
+	ok, err := v.Client.VerifyWebhookSignature(r.Context(), signature)
+	if err != nil {
+		return fmt.Errorf("failed to verify the signature with paypal: %w", err)
+	}
+	if !ok {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+func checkTimestamp(timestamp string, now time.Time, window time.Duration) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > window || age < -window {
+		return fmt.Errorf("timestamp outside of the replay window: %s", age)
+	}
+	return nil
+}
+
+func validSignature(secret string, timestamp string, body []byte, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
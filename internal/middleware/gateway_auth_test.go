@@ -0,0 +1,207 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"payment-gateway/db"
+	"payment-gateway/internal/paypal"
+	"payment-gateway/internal/paypal/paypaltest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ----------- Mock Setup ------------------//
+type mockGatewayLookup struct {
+	gateways map[string]*db.Gateway
+}
+
+func (m *mockGatewayLookup) GetGatewayByName(ctx context.Context, name string) (*db.Gateway, error) {
+	return m.gateways[name], nil
+}
+
+// ---------------------------------------------- //
+
+const callbackBody = `{"gateway_txn_id":"txn123","status":"completed"}`
+
+func setupGatewayAuth(t *testing.T) {
+	original := gatewayAuth
+	InitGatewayAuth(&mockGatewayLookup{
+		gateways: map[string]*db.Gateway{
+			"stripe": {ID: 1, Name: "stripe", SigningSecret: "whsec_stripe", SignatureScheme: SchemeStripe},
+			"acme":   {ID: 2, Name: "acme", APIKeyHash: db.HashAPIKey("acme-key"), SigningSecret: "acme-secret", SignatureScheme: SchemeHMACSHA256},
+			"paypal": {ID: 3, Name: "paypal", SigningSecret: "WH-1", SignatureScheme: SchemePaypal},
+		},
+	})
+	t.Cleanup(func() {
+		gatewayAuth = original
+	})
+}
+
+func sign(secret string, timestamp string, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// serveCallback runs the middleware and returns the response, the gateway id and the body the handler saw.
+func serveCallback(req *http.Request) (*httptest.ResponseRecorder, int, string) {
+	var gatewayID int
+	var body []byte
+	handler := GatewayAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gatewayID, _ = r.Context().Value(GatewayIDKey).(int)
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr, gatewayID, string(body)
+}
+
+// newCallbackRequest returns a callback posted to the route of the gateway, without credentials.
+func newCallbackRequest(gateway string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/payment-callback/"+gateway, bytes.NewBufferString(callbackBody))
+	req.Header.Set("Content-Type", "application/json")
+	return mux.SetURLVars(req, map[string]string{GatewayRouteVar: gateway})
+}
+
+func TestGatewayAuth_ValidHMACSignature(t *testing.T) {
+	setupGatewayAuth(t)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req := newCallbackRequest("acme")
+	req.Header.Set("X-Gateway-API-Key", "acme-key")
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Signature", sign("acme-secret", timestamp, callbackBody))
+
+	rr, gatewayID, body := serveCallback(req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if gatewayID != 2 {
+		t.Errorf("Expected gateway id 2, got %d", gatewayID)
+	}
+	if body != callbackBody {
+		t.Errorf("Expected handler to receive the original body, got %s", body)
+	}
+}
+
+func TestGatewayAuth_ValidStripeSignature(t *testing.T) {
+	setupGatewayAuth(t)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	// Stripe sends no api key, the signature is all there is.
+	req := newCallbackRequest("stripe")
+	req.Header.Set("Stripe-Signature", "t="+timestamp+",v1=deadbeef,v1="+sign("whsec_stripe", timestamp, callbackBody))
+
+	rr, gatewayID, _ := serveCallback(req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if gatewayID != 1 {
+		t.Errorf("Expected gateway id 1, got %d", gatewayID)
+	}
+}
+
+func TestGatewayAuth_PaypalSignature(t *testing.T) {
+	setupGatewayAuth(t)
+	server := paypaltest.NewServer()
+	defer server.Close()
+	client := paypal.NewClient(paypal.Config{BaseURL: server.URL, ClientID: paypaltest.ClientID, ClientSecret: paypaltest.ClientSecret})
+	RegisterCallbackVerifier(SchemePaypal, NewPaypalVerifier(client))
+	t.Cleanup(func() {
+		verifiersMu.Lock()
+		defer verifiersMu.Unlock()
+		delete(callbackVerifiers, SchemePaypal)
+	})
+
+	newRequest := func(signature string, sent time.Time) *http.Request {
+		req := newCallbackRequest("paypal")
+		req.Header.Set("PAYPAL-AUTH-ALGO", "SHA256withRSA")
+		req.Header.Set("PAYPAL-CERT-URL", "https://api.sandbox.paypal.com/v1/notifications/certs/CERT-360caa42")
+		req.Header.Set("PAYPAL-TRANSMISSION-ID", "69cd13f0-d67a-11e5-baa3-778b53f4ae55")
+		req.Header.Set("PAYPAL-TRANSMISSION-SIG", signature)
+		req.Header.Set("PAYPAL-TRANSMISSION-TIME", sent.UTC().Format(time.RFC3339))
+		return req
+	}
+
+	rr, gatewayID, _ := serveCallback(newRequest(paypaltest.WebhookSignature, time.Now()))
+	if rr.Code != http.StatusOK || gatewayID != 3 {
+		t.Fatalf("Expected the callback of gateway 3 to pass, got status %d and gateway %d", rr.Code, gatewayID)
+	}
+	sent := server.Requests()[0]
+	if sent.Path != "/v1/notifications/verify-webhook-signature" || sent.Body["webhook_id"] != "WH-1" {
+		t.Errorf("Expected PayPal to verify the signature for the gateway's webhook, got %+v", sent)
+	}
+
+	if rr, _, _ := serveCallback(newRequest("forged", time.Now())); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a forged signature to be rejected, got status %d", rr.Code)
+	}
+	if rr, _, _ := serveCallback(newRequest(paypaltest.WebhookSignature, time.Now().Add(-10*time.Minute))); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a replay outside of the window to be rejected, got status %d", rr.Code)
+	}
+}
+
+func TestGatewayAuth_Rejected(t *testing.T) {
+	setupGatewayAuth(t)
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+
+	tests := map[string]func(*http.Request){
+		"unknown gateway": func(r *http.Request) {
+			*r = *mux.SetURLVars(r, map[string]string{GatewayRouteVar: "nope"})
+			r.Header.Set("X-Timestamp", now)
+			r.Header.Set("X-Signature", sign("acme-secret", now, callbackBody))
+		},
+		"wrong api key": func(r *http.Request) {
+			r.Header.Set("X-Gateway-API-Key", "stripe-key")
+			r.Header.Set("X-Timestamp", now)
+			r.Header.Set("X-Signature", sign("acme-secret", now, callbackBody))
+		},
+		"missing api key": func(r *http.Request) {
+			r.Header.Del("X-Gateway-API-Key")
+			r.Header.Set("X-Timestamp", now)
+			r.Header.Set("X-Signature", sign("acme-secret", now, callbackBody))
+		},
+		"missing signature": func(r *http.Request) {
+			r.Header.Set("X-Timestamp", now)
+		},
+		"signed with another gateway's secret": func(r *http.Request) {
+			r.Header.Set("X-Timestamp", now)
+			r.Header.Set("X-Signature", sign("whsec_stripe", now, callbackBody))
+		},
+		"replayed outside of the window": func(r *http.Request) {
+			r.Header.Set("X-Timestamp", old)
+			r.Header.Set("X-Signature", sign("acme-secret", old, callbackBody))
+		},
+		"tampered timestamp": func(r *http.Request) {
+			r.Header.Set("X-Timestamp", now)
+			r.Header.Set("X-Signature", sign("acme-secret", old, callbackBody))
+		},
+	}
+
+	for name, mutate := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := newCallbackRequest("acme")
+			req.Header.Set("X-Gateway-API-Key", "acme-key")
+			mutate(req)
+
+			rr, _, _ := serveCallback(req)
+			if rr.Code != http.StatusUnauthorized {
+				t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,337 @@
+package middleware
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrMissingRole is returned for a valid token that doesn't carry the role asked for.
+var ErrMissingRole = errors.New("token does not carry the required role")
+
+// How often we are allowed to hit the JWKS url again when a token comes with a kid we don't know.
+const jwksRefreshInterval = time.Minute
+
+// JWTConfig holds everything we need to validate the tokens issued by the auth service.
+type JWTConfig struct {
+	// Shared secret for HS256 tokens. HS256 is disabled when empty.
+	HMACSecret string
+	// JWKS with the RS256 public keys, either from a local file or an url.
+	JWKSFile string
+	JWKSURL  string
+	// Expected "iss" and "aud" claims. They are not checked when empty.
+	Issuer   string
+	Audience string
+	// Claim that holds the user id, "sub" by default.
+	UserIDClaim string
+	// Claim that holds the roles of the user, "roles" by default. Either a list or a space separated string.
+	RolesClaim string
+	// Role operators of the review queue need, "payments:reviewer" by default.
+	ReviewerRole string
+	// Claim that holds the merchant the user pays through, "merchant_id" by default. Tokens don't need one.
+	MerchantClaim string
+	// Allowed clock skew for exp and nbf.
+	Leeway time.Duration
+}
+
+// LoadJWTConfig reads the JWT configuration from the environment.
+func LoadJWTConfig() JWTConfig {
+	cfg := JWTConfig{
+		HMACSecret:    os.Getenv("JWT_HS256_SECRET"),
+		JWKSFile:      os.Getenv("JWT_JWKS_FILE"),
+		JWKSURL:       os.Getenv("JWT_JWKS_URL"),
+		Issuer:        os.Getenv("JWT_ISSUER"),
+		Audience:      os.Getenv("JWT_AUDIENCE"),
+		UserIDClaim:   os.Getenv("JWT_USER_ID_CLAIM"),
+		RolesClaim:    os.Getenv("JWT_ROLES_CLAIM"),
+		ReviewerRole:  os.Getenv("JWT_REVIEWER_ROLE"),
+		MerchantClaim: os.Getenv("JWT_MERCHANT_CLAIM"),
+		Leeway:        30 * time.Second,
+	}
+
+	if leeway, err := time.ParseDuration(os.Getenv("JWT_LEEWAY")); err == nil {
+		cfg.Leeway = leeway
+	}
+	return cfg
+}
+
+type JWTValidator struct {
+	cfg     JWTConfig
+	methods []string
+	parser  *jwt.Parser
+
+	mu          sync.RWMutex
+	keys        map[string]*rsa.PublicKey
+	lastFetched time.Time
+}
+
+func NewJWTValidator(cfg JWTConfig) (*JWTValidator, error) {
+	if cfg.UserIDClaim == "" {
+		cfg.UserIDClaim = "sub"
+	}
+	if cfg.RolesClaim == "" {
+		cfg.RolesClaim = "roles"
+	}
+	if cfg.ReviewerRole == "" {
+		cfg.ReviewerRole = "payments:reviewer"
+	}
+	if cfg.MerchantClaim == "" {
+		cfg.MerchantClaim = "merchant_id"
+	}
+
+	v := &JWTValidator{
+		cfg:  cfg,
+		keys: make(map[string]*rsa.PublicKey),
+	}
+
+	if cfg.HMACSecret != "" {
+		v.methods = append(v.methods, jwt.SigningMethodHS256.Alg())
+	}
+	if cfg.JWKSFile != "" || cfg.JWKSURL != "" {
+		if err := v.loadKeys(); err != nil {
+			return nil, err
+		}
+		v.methods = append(v.methods, jwt.SigningMethodRS256.Alg())
+	}
+	if len(v.methods) == 0 {
+		return nil, errors.New("no JWT signing key configured, set JWT_HS256_SECRET or a JWKS file/url")
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(v.methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(cfg.Leeway),
+	}
+	if cfg.Issuer != "" {
+		options = append(options, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		options = append(options, jwt.WithAudience(cfg.Audience))
+	}
+	v.parser = jwt.NewParser(options...)
+
+	return v, nil
+}
+
+// Validate checks the signature and the registered claims of the token and returns the user id.
+// The nbf claim is checked by the parser whenever the token has one.
+func (v *JWTValidator) Validate(tokenString string) (int, error) {
+	userID, _, err := v.ValidateUser(tokenString)
+	return userID, err
+}
+
+// ValidateUser validates the token like Validate and also returns the merchant of the token, empty when it has none.
+func (v *JWTValidator) ValidateUser(tokenString string) (int, string, error) {
+	claims := jwt.MapClaims{}
+	if _, err := v.parser.ParseWithClaims(tokenString, claims, v.keyFunc); err != nil {
+		return 0, "", err
+	}
+
+	userID, err := userIDFromClaim(claims[v.cfg.UserIDClaim])
+	if err != nil {
+		return 0, "", err
+	}
+	merchantID, _ := claims[v.cfg.MerchantClaim].(string)
+	return userID, merchantID, nil
+}
+
+// ValidateReviewer validates the token like Validate and also requires the reviewer role.
+// Returns ErrMissingRole when the token is valid but doesn't carry it.
+func (v *JWTValidator) ValidateReviewer(tokenString string) (int, error) {
+	claims := jwt.MapClaims{}
+	if _, err := v.parser.ParseWithClaims(tokenString, claims, v.keyFunc); err != nil {
+		return 0, err
+	}
+
+	userID, err := userIDFromClaim(claims[v.cfg.UserIDClaim])
+	if err != nil {
+		return 0, err
+	}
+	for _, role := range rolesFromClaim(claims[v.cfg.RolesClaim]) {
+		if role == v.cfg.ReviewerRole {
+			return userID, nil
+		}
+	}
+	return 0, ErrMissingRole
+}
+
+func (v *JWTValidator) keyFunc(token *jwt.Token) (interface{}, error) {
+	switch token.Method.Alg() {
+	case jwt.SigningMethodHS256.Alg():
+		return []byte(v.cfg.HMACSecret), nil
+	case jwt.SigningMethodRS256.Alg():
+		kid, _ := token.Header["kid"].(string)
+		return v.publicKey(kid)
+	default:
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+}
+
+func (v *JWTValidator) publicKey(kid string) (*rsa.PublicKey, error) {
+	if key := v.lookupKey(kid); key != nil {
+		return key, nil
+	}
+
+	// The auth service might have rotated its keys, so try to fetch them again.
+	v.mu.RLock()
+	canRefresh := v.cfg.JWKSURL != "" && time.Since(v.lastFetched) > jwksRefreshInterval
+	v.mu.RUnlock()
+	if canRefresh {
+		if err := v.loadKeys(); err != nil {
+			return nil, err
+		}
+		if key := v.lookupKey(kid); key != nil {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (v *JWTValidator) lookupKey(kid string) *rsa.PublicKey {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	if kid == "" && len(v.keys) == 1 {
+		// A token without kid is fine as long as there is only one key to pick from.
+		for _, key := range v.keys {
+			return key
+		}
+	}
+	return v.keys[kid]
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (v *JWTValidator) loadKeys() error {
+	var data []byte
+	var err error
+	if v.cfg.JWKSFile != "" {
+		data, err = os.ReadFile(v.cfg.JWKSFile)
+	} else {
+		data, err = fetchJWKS(v.cfg.JWKSURL)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load JWKS: %w", err)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		key, err := k.rsaPublicKey()
+		if err != nil {
+			return fmt.Errorf("invalid key %q in JWKS: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("JWKS does not contain any RSA signing key")
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.lastFetched = time.Now()
+	v.mu.Unlock()
+	return nil
+}
+
+func (k jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+func fetchJWKS(url string) ([]byte, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// userIDFromClaim accepts the user id both as a JSON number and as a string, since "sub" is always a string.
+func userIDFromClaim(value interface{}) (int, error) {
+	var userID int
+	switch id := value.(type) {
+	case float64:
+		if id != math.Trunc(id) {
+			return 0, fmt.Errorf("user id claim is not an integer: %v", id)
+		}
+		userID = int(id)
+	case string:
+		parsed, err := strconv.Atoi(id)
+		if err != nil {
+			return 0, fmt.Errorf("user id claim is not a number: %q", id)
+		}
+		userID = parsed
+	default:
+		return 0, errors.New("user id claim is missing")
+	}
+
+	if userID <= 0 {
+		return 0, fmt.Errorf("invalid user id %d", userID)
+	}
+	return userID, nil
+}
+
+// rolesFromClaim accepts the roles both as a list and as a space separated string, like the "scope" claim.
+func rolesFromClaim(value interface{}) []string {
+	switch roles := value.(type) {
+	case string:
+		return strings.Fields(roles)
+	case []interface{}:
+		var names []string
+		for _, role := range roles {
+			if name, ok := role.(string); ok {
+				names = append(names, name)
+			}
+		}
+		return names
+	default:
+		return nil
+	}
+}
@@ -4,6 +4,8 @@ package models
 type ServiceError struct {
 	Code    ErrorCode
 	Message string
+	// Reason is a machine-readable code clients can act on, e.g. "daily_limit_exceeded".
+	Reason string
 }
 
 func (e *ServiceError) Error() string {
@@ -20,6 +22,14 @@ const (
 	ErrorCodeInsufficientFunds
 	ErrorCodeGatewayError
 	ErrorCodeUnauthorized
+	ErrorCodeConflict
+	ErrorCodeIdempotencyMismatch
+	ErrorCodeLimitExceeded
+	ErrorCodeComplianceRejected
+	ErrorCodeForbidden
+	ErrorCodeTimeout
+	ErrorCodePaymentDeclined
+	ErrorCodeGatewayUnavailable
 )
 
 // NewServiceError creates a new ServiceError
@@ -30,14 +40,31 @@ func NewServiceError(code ErrorCode, message string) *ServiceError {
 	}
 }
 
+// NewServiceErrorWithReason creates a new ServiceError with a machine-readable reason
+func NewServiceErrorWithReason(code ErrorCode, reason string, message string) *ServiceError {
+	return &ServiceError{
+		Code:    code,
+		Message: message,
+		Reason:  reason,
+	}
+}
+
 // Error response mapping to HTTP status codes
 var errorToStatusCode = map[ErrorCode]int{
-	ErrorCodeUnknown:           500,
-	ErrorCodeValidation:        400,
-	ErrorCodeNotFound:          404,
-	ErrorCodeInsufficientFunds: 422,
-	ErrorCodeGatewayError:      502,
-	ErrorCodeUnauthorized:      401,
+	ErrorCodeUnknown:             500,
+	ErrorCodeValidation:          400,
+	ErrorCodeNotFound:            404,
+	ErrorCodeInsufficientFunds:   422,
+	ErrorCodeGatewayError:        502,
+	ErrorCodeUnauthorized:        401,
+	ErrorCodeConflict:            409,
+	ErrorCodeIdempotencyMismatch: 422,
+	ErrorCodeLimitExceeded:       422,
+	ErrorCodeComplianceRejected:  403,
+	ErrorCodeForbidden:           403,
+	ErrorCodeTimeout:             504,
+	ErrorCodePaymentDeclined:     402,
+	ErrorCodeGatewayUnavailable:  503,
 }
 
 // GetStatusCode returns the appropriate HTTP status code for an error
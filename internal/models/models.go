@@ -1,6 +1,9 @@
 package models
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // @title Payment Gateway API
 // @version 1.0
@@ -17,29 +20,31 @@ import "fmt"
 // TransactionRequest represents the request payload for transactions
 // @Description Transaction request model
 type TransactionRequest struct {
-	// Amount to process
+	// Amount to process in minor units of the currency, e.g. 9999 for 99.99 USD
 	// required: true
-	Amount float64 `json:"amount" xml:"amount" example:"99.99"`
+	Amount int64 `json:"amount" xml:"amount" example:"9999"`
 	// Currency code in ISO 4217 format
 	// required: true
 	Currency string `json:"currency" xml:"currency" example:"USD"`
-	// Payment gateway identifier
-	// required: true
+	// Payment gateway identifier. Left out, the gateway is picked by smart routing when it is enabled.
+	// required: false
 	GatewayID int `json:"gateway_id" xml:"gateway_id" example:"112"`
 	// Country identifier (ISO 3166-1 numeric)
 	// required: true
 	CountryID int `json:"country_id" xml:"country_id" example:"840"`
 
-	// Internal field, not exposed in swagger
-	UserID int `json:"user_id" xml:"user_id" swaggerignore:"true"`
+	// Internal field, not exposed in swagger. It is taken from the auth token and never from the body.
+	UserID int `json:"-" xml:"-" swaggerignore:"true"`
+	// Internal field, the merchant of the auth token, empty when it has none.
+	MerchantID string `json:"-" xml:"-" swaggerignore:"true"`
 }
 
 func (t *TransactionRequest) Validate() error {
 	if t.Amount <= 0 {
 		return fmt.Errorf("invalid amount")
-	} else if t.Currency == "" || len(t.Currency) > 3 {
+	} else if !IsValidCurrency(t.Currency) {
 		return fmt.Errorf("invalid currency code")
-	} else if t.GatewayID <= 0 {
+	} else if t.GatewayID < 0 {
 		return fmt.Errorf("invalid gateway id")
 	} else if t.CountryID <= 0 {
 		return fmt.Errorf("invalid country id")
@@ -47,6 +52,11 @@ func (t *TransactionRequest) Validate() error {
 	return nil
 }
 
+// Money returns the amount of the request together with its currency.
+func (t *TransactionRequest) Money() (Money, error) {
+	return NewMoney(t.Amount, t.Currency)
+}
+
 // APIResponse represents the successful API response structure
 // @Description Successful API response model
 type APIResponse struct {
@@ -70,6 +80,9 @@ type APIError struct {
 	// Error message
 	// required: true
 	Error string `json:"error" xml:"error" example:"Invalid request parameters"`
+	// Machine-readable reason of the error, e.g. the limit that was exceeded
+	// required: false
+	Code string `json:"code,omitempty" xml:"code,omitempty" example:"daily_limit_exceeded"`
 }
 
 // PaymentCallback represents the callback request from payment gateways
@@ -78,14 +91,17 @@ type PaymentCallback struct {
 	// Transaction identifier
 	// required: true
 	GatewayTxnID string `json:"gateway_txn_id" xml:"gateway_txn_id" example:"123456"`
-	// Transaction status
+	// Transaction status: pending, authorized, completed, failed, refunded or reversed
 	// required: true
 	Status string `json:"status" xml:"status" example:"completed"`
-	// Optional error message
+	// Optional error message, recorded as the reason of the status change
 	// required: false
 	ErrorMessage string `json:"error_message,omitempty" xml:"error_message,omitempty" example:"Transaction proceeded successfully."`
-	// Internal field, not exposed in swagger
-	GatewayID int `json:"gateway_id" xml:"gateway_id" swaggerignore:"true"`
+	// Internal field, not exposed in swagger. It is resolved from the gateway's api key and never from the body.
+	GatewayID int `json:"-" xml:"-" swaggerignore:"true"`
+	// Internal fields, not exposed in swagger. The body as the gateway sent it, kept with the status change.
+	RawPayload    []byte `json:"-" xml:"-" swaggerignore:"true"`
+	PayloadFormat string `json:"-" xml:"-" swaggerignore:"true"`
 }
 
 func (pc *PaymentCallback) Validate() error {
@@ -107,4 +123,255 @@ type PaymentResult struct {
 	// Transaction identifier
 	// required: true
 	TransactionId int `json:"transaction_id" xml:"transaction_id" example:"123456"`
+	// Transaction status, review when the transaction waits for an operator before it goes to the gateway
+	// required: true
+	Status string `json:"status" xml:"status" example:"pending"`
+	// Secret the client confirms the payment with on the gateway's side, e.g. the client_secret of a Stripe
+	// PaymentIntent. Only set for deposits the user still has to confirm.
+	// required: false
+	ClientSecret string `json:"client_secret,omitempty" xml:"client_secret,omitempty" example:"pi_3Mtw_secret_YrKJ"`
+	// Page the user approves the payment on, e.g. the approve link of a PayPal order. Only set for deposits the user
+	// still has to approve.
+	// required: false
+	ApprovalURL string `json:"approval_url,omitempty" xml:"approval_url,omitempty" example:"https://www.paypal.com/checkoutnow?token=5O190127TN364715T"`
+}
+
+// RefundRequest represents the request payload for refunds
+// @Description Refund request model. Without an amount the whole remaining amount is refunded.
+type RefundRequest struct {
+	// Amount to refund in minor units of the transaction's currency. Omit it for a full refund.
+	// required: false
+	Amount int64 `json:"amount,omitempty" xml:"amount,omitempty" example:"2500"`
+	// Currency code in ISO 4217 format, has to be the currency of the transaction when given
+	// required: false
+	Currency string `json:"currency,omitempty" xml:"currency,omitempty" example:"USD"`
+
+	// Internal fields, not exposed in swagger. They are taken from the path and the auth token.
+	TransactionID int `json:"-" xml:"-" swaggerignore:"true"`
+	UserID        int `json:"-" xml:"-" swaggerignore:"true"`
+}
+
+func (r *RefundRequest) Validate() error {
+	if r.Amount < 0 {
+		return fmt.Errorf("invalid amount")
+	} else if r.Currency != "" && !IsValidCurrency(r.Currency) {
+		return fmt.Errorf("invalid currency code")
+	} else if r.TransactionID <= 0 {
+		return fmt.Errorf("invalid transaction id")
+	}
+	return nil
+}
+
+// RefundResult represents the result of a refund
+// @Description Refund result model
+type RefundResult struct {
+	// Refund identifier, the refund is a transaction of its own
+	// required: true
+	RefundID int `json:"refund_id" xml:"refund_id" example:"123457"`
+	// Identifier of the refunded transaction
+	// required: true
+	TransactionID int `json:"transaction_id" xml:"transaction_id" example:"123456"`
+	// Refunded amount
+	// required: true
+	Amount Money `json:"amount" xml:"amount"`
+	// Refund status
+	// required: true
+	Status string `json:"status" xml:"status" example:"pending"`
+}
+
+// TransactionTimeline represents a transaction together with every change of its status
+// @Description Status history of a transaction
+type TransactionTimeline struct {
+	// Transaction identifier
+	// required: true
+	TransactionID int `json:"transaction_id" xml:"transaction_id" example:"123456"`
+	// Transaction type: deposit, withdraw or refund
+	// required: true
+	Type string `json:"type" xml:"type" example:"deposit"`
+	// Current status of the transaction
+	// required: true
+	Status string `json:"status" xml:"status" example:"completed"`
+	// Transaction amount
+	// required: true
+	Amount Money `json:"amount" xml:"amount"`
+	// Status changes, oldest first
+	// required: true
+	Events []TransactionEvent `json:"events" xml:"events>event"`
+}
+
+// TransactionEvent represents one change of a transaction's status
+// @Description Status change of a transaction
+type TransactionEvent struct {
+	// Status before the change, empty for the status the transaction was created with
+	// required: false
+	FromStatus string `json:"from_status,omitempty" xml:"from_status,omitempty" example:"pending"`
+	// Status after the change
+	// required: true
+	ToStatus string `json:"to_status" xml:"to_status" example:"completed"`
+	// Why the status changed, e.g. the error message of the gateway
+	// required: true
+	Reason string `json:"reason" xml:"reason" example:"gateway callback"`
+	// What changed the status: api, gateway, callback or reconciler
+	// required: true
+	Source string `json:"source" xml:"source" example:"callback"`
+	// Raw callback body as the gateway sent it
+	// required: false
+	Payload string `json:"payload,omitempty" xml:"payload,omitempty" example:"{\"gateway_txn_id\":\"123456\",\"status\":\"completed\"}"`
+	// Content type of the payload
+	// required: false
+	PayloadFormat string `json:"payload_format,omitempty" xml:"payload_format,omitempty" example:"application/json"`
+	// When the status changed
+	// required: true
+	CreatedAt time.Time `json:"created_at" xml:"created_at" example:"2024-01-02T15:04:05Z"`
+}
+
+// Transaction represents a transaction of the user
+// @Description Transaction model
+type Transaction struct {
+	// Transaction identifier
+	// required: true
+	ID int `json:"id" xml:"id" example:"123456"`
+	// Transaction type: deposit, withdraw or refund
+	// required: true
+	Type string `json:"type" xml:"type" example:"deposit"`
+	// Transaction status
+	// required: true
+	Status string `json:"status" xml:"status" example:"completed"`
+	// Transaction amount
+	// required: true
+	Amount Money `json:"amount" xml:"amount"`
+	// Payment gateway identifier, the gateway that moved the money
+	// required: true
+	GatewayID int `json:"gateway_id" xml:"gateway_id" example:"112"`
+	// Gateway that was asked for, only set when the merchant's fallback policy sent the transaction to another one
+	// required: false
+	RequestedGatewayID int `json:"requested_gateway_id,omitempty" xml:"requested_gateway_id,omitempty" example:"111"`
+	// Country identifier (ISO 3166-1 numeric)
+	// required: true
+	CountryID int `json:"country_id" xml:"country_id" example:"840"`
+	// Identifier of the refunded transaction, only set for refunds
+	// required: false
+	ParentID int `json:"parent_id,omitempty" xml:"parent_id,omitempty" example:"123455"`
+	// When the transaction was created
+	// required: true
+	CreatedAt time.Time `json:"created_at" xml:"created_at" example:"2024-01-02T15:04:05Z"`
+}
+
+// TransactionPage represents one page of a transaction listing
+// @Description Page of transactions, newest first
+type TransactionPage struct {
+	// Transactions of this page
+	// required: true
+	Transactions []Transaction `json:"transactions" xml:"transactions>transaction"`
+	// Cursor of the next page, empty on the last page
+	// required: false
+	NextCursor string `json:"next_cursor,omitempty" xml:"next_cursor,omitempty" example:"MTcwNDIwNzg0NTAwMDAwMDoxMjM0NTY"`
+}
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+// TransactionQuery holds the filters of a transaction listing, taken from the query string.
+type TransactionQuery struct {
+	UserID      int
+	Status      string
+	Type        string
+	GatewayID   int
+	Currency    string
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	Cursor      string
+	Limit       int
+}
+
+func (q *TransactionQuery) Validate() error {
+	if q.Currency != "" && !IsValidCurrency(q.Currency) {
+		return fmt.Errorf("invalid currency code")
+	} else if q.GatewayID < 0 {
+		return fmt.Errorf("invalid gateway id")
+	} else if q.Limit < 1 || q.Limit > MaxPageSize {
+		return fmt.Errorf("limit has to be between 1 and %d", MaxPageSize)
+	} else if !q.CreatedFrom.IsZero() && !q.CreatedTo.IsZero() && !q.CreatedFrom.Before(q.CreatedTo) {
+		return fmt.Errorf("created_from has to be before created_to")
+	}
+	return nil
+}
+
+// ReviewQueue represents the transactions waiting for an operator
+// @Description Transactions in review, oldest first
+type ReviewQueue struct {
+	// Transactions in review
+	// required: true
+	Items []ReviewItem `json:"items" xml:"items>item"`
+}
+
+// ReviewItem represents a transaction in the review queue
+// @Description Transaction in review with the checks that flagged it
+type ReviewItem struct {
+	Transaction
+	// Owner of the transaction
+	// required: true
+	UserID int `json:"user_id" xml:"user_id" example:"42"`
+	// Checks that sent the transaction to review
+	// required: true
+	Flags []ReviewFlag `json:"flags" xml:"flags>flag"`
+}
+
+// ReviewFlag represents a check that sent a transaction to review
+// @Description Check that flagged a transaction
+type ReviewFlag struct {
+	// Name of the compliance rule or code of the limit
+	// required: true
+	Rule string `json:"rule" xml:"rule" example:"large withdrawals"`
+	// Why the check flagged the transaction
+	// required: true
+	Reason string `json:"reason" xml:"reason" example:"amount of 15000.00 USD is at or above the threshold of 10000.00 USD"`
+}
+
+// ReviewRequest represents an operator's decision on a transaction in review
+// @Description Review decision. A reason is required to reject.
+type ReviewRequest struct {
+	// Why the transaction is approved or rejected, kept in the audit trail
+	// required: false
+	Reason string `json:"reason" xml:"reason" example:"Source of funds confirmed by phone"`
+
+	// Internal fields, not exposed in swagger. They are taken from the path and the auth token.
+	TransactionID int `json:"-" xml:"-" swaggerignore:"true"`
+	ReviewerID    int `json:"-" xml:"-" swaggerignore:"true"`
+}
+
+// MaxReviewReasonLength keeps the audit trail readable.
+const MaxReviewReasonLength = 1000
+
+func (r *ReviewRequest) Validate() error {
+	if r.TransactionID <= 0 {
+		return fmt.Errorf("invalid transaction id")
+	} else if len(r.Reason) > MaxReviewReasonLength {
+		return fmt.Errorf("reason can't be longer than %d characters", MaxReviewReasonLength)
+	}
+	return nil
+}
+
+// ReviewResult represents the outcome of a review decision
+// @Description Result of a review decision
+type ReviewResult struct {
+	// Transaction identifier
+	// required: true
+	TransactionID int `json:"transaction_id" xml:"transaction_id" example:"123456"`
+	// approve or reject
+	// required: true
+	Action string `json:"action" xml:"action" example:"approve"`
+	// Status of the transaction after the decision
+	// required: true
+	Status string `json:"status" xml:"status" example:"pending"`
+}
+
+// Balance is what a user has in one currency.
+type Balance struct {
+	// Amount the user can spend
+	Available Money `json:"available" xml:"available"`
+	// Amount held for withdrawals that are still in flight
+	Pending Money `json:"pending" xml:"pending"`
 }
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnknownCurrency  = errors.New("unknown currency")
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+	ErrAmountOverflow   = errors.New("amount overflow")
+)
+
+// Money is an amount in the minor unit of its currency, e.g. cents for USD, yen for JPY
+// and fils for KWD. We never use floats for money, so there is nothing to round.
+// @Description Amount in minor units of an ISO 4217 currency
+type Money struct {
+	// Amount in minor units of the currency
+	Minor int64 `json:"amount" xml:"amount" example:"9999"`
+	// Currency code in ISO 4217 format
+	Currency string `json:"currency" xml:"currency" example:"USD"`
+}
+
+// NewMoney creates Money for a known ISO 4217 currency.
+func NewMoney(minor int64, currency string) (Money, error) {
+	if _, ok := CurrencyExponent(currency); !ok {
+		return Money{}, fmt.Errorf("%w: %q", ErrUnknownCurrency, currency)
+	}
+	return Money{Minor: minor, Currency: currency}, nil
+}
+
+// Add returns m + other. Both have to be in the same currency.
+func (m Money) Add(other Money) (Money, error) {
+	if err := m.sameCurrency(other); err != nil {
+		return Money{}, err
+	}
+	if (other.Minor > 0 && m.Minor > math.MaxInt64-other.Minor) ||
+		(other.Minor < 0 && m.Minor < math.MinInt64-other.Minor) {
+		return Money{}, ErrAmountOverflow
+	}
+	return Money{Minor: m.Minor + other.Minor, Currency: m.Currency}, nil
+}
+
+// Sub returns m - other. Both have to be in the same currency.
+func (m Money) Sub(other Money) (Money, error) {
+	if other.Minor == math.MinInt64 {
+		return Money{}, ErrAmountOverflow
+	}
+	return m.Add(Money{Minor: -other.Minor, Currency: other.Currency})
+}
+
+// Cmp returns -1, 0 or 1 when m is less than, equal to or greater than other.
+func (m Money) Cmp(other Money) (int, error) {
+	if err := m.sameCurrency(other); err != nil {
+		return 0, err
+	}
+	switch {
+	case m.Minor < other.Minor:
+		return -1, nil
+	case m.Minor > other.Minor:
+		return 1, nil
+	default:
+		return 0, nil
+	}
+}
+
+func (m Money) IsPositive() bool {
+	return m.Minor > 0
+}
+
+func (m Money) IsZero() bool {
+	return m.Minor == 0
+}
+
+// String formats the amount in major units, e.g. "99.99 USD", "1000 JPY" or "1.500 KWD".
+func (m Money) String() string {
+	return strings.TrimSpace(m.Decimal() + " " + m.Currency)
+}
+
+// Decimal formats the amount in major units without the currency, e.g. "99.99", "1000" or "1.500",
+// like APIs that take decimal amounts expect them.
+func (m Money) Decimal() string {
+	exponent, ok := CurrencyExponent(m.Currency)
+	if !ok || exponent == 0 {
+		return strconv.FormatInt(m.Minor, 10)
+	}
+
+	sign := ""
+	digits := strconv.FormatUint(absMinor(m.Minor), 10)
+	if m.Minor < 0 {
+		sign = "-"
+	}
+	if len(digits) <= exponent {
+		digits = strings.Repeat("0", exponent-len(digits)+1) + digits
+	}
+
+	point := len(digits) - exponent
+	return sign + digits[:point] + "." + digits[point:]
+}
+
+func (m Money) sameCurrency(other Money) error {
+	if m.Currency != other.Currency {
+		return fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, other.Currency)
+	}
+	return nil
+}
+
+func absMinor(minor int64) uint64 {
+	if minor < 0 {
+		return uint64(-(minor + 1)) + 1
+	}
+	return uint64(minor)
+}
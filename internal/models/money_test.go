@@ -0,0 +1,88 @@
+package models
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestNewMoney_UnknownCurrency(t *testing.T) {
+	if _, err := NewMoney(100, "XYZ"); !errors.Is(err, ErrUnknownCurrency) {
+		t.Errorf("Expected unknown currency error, got: %v", err)
+	}
+	if _, err := NewMoney(100, "usd"); !errors.Is(err, ErrUnknownCurrency) {
+		t.Errorf("Expected currency codes to be upper case, got: %v", err)
+	}
+}
+
+func TestMoney_Add(t *testing.T) {
+	sum, err := Money{Minor: 1050, Currency: "USD"}.Add(Money{Minor: 1, Currency: "USD"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if sum.Minor != 1051 || sum.Currency != "USD" {
+		t.Errorf("Expected 1051 USD, got %v", sum)
+	}
+}
+
+func TestMoney_AddCurrencyMismatch(t *testing.T) {
+	_, err := Money{Minor: 100, Currency: "USD"}.Add(Money{Minor: 100, Currency: "EUR"})
+	if !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("Expected currency mismatch error, got: %v", err)
+	}
+
+	_, err = Money{Minor: 100, Currency: "USD"}.Cmp(Money{Minor: 100, Currency: "EUR"})
+	if !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("Expected currency mismatch error, got: %v", err)
+	}
+}
+
+func TestMoney_Overflow(t *testing.T) {
+	_, err := Money{Minor: math.MaxInt64, Currency: "USD"}.Add(Money{Minor: 1, Currency: "USD"})
+	if !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("Expected overflow error, got: %v", err)
+	}
+
+	_, err = Money{Minor: math.MinInt64, Currency: "USD"}.Sub(Money{Minor: 1, Currency: "USD"})
+	if !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("Expected overflow error, got: %v", err)
+	}
+
+	_, err = Money{Minor: 0, Currency: "USD"}.Sub(Money{Minor: math.MinInt64, Currency: "USD"})
+	if !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("Expected overflow error, got: %v", err)
+	}
+}
+
+func TestMoney_Cmp(t *testing.T) {
+	balance := Money{Minor: 5000, Currency: "USD"}
+
+	if cmp, _ := balance.Cmp(Money{Minor: 10000, Currency: "USD"}); cmp != -1 {
+		t.Errorf("Expected -1, got %d", cmp)
+	}
+	if cmp, _ := balance.Cmp(Money{Minor: 5000, Currency: "USD"}); cmp != 0 {
+		t.Errorf("Expected 0, got %d", cmp)
+	}
+	if cmp, _ := balance.Cmp(Money{Minor: 1, Currency: "USD"}); cmp != 1 {
+		t.Errorf("Expected 1, got %d", cmp)
+	}
+}
+
+func TestMoney_String(t *testing.T) {
+	tests := map[Money]string{
+		{Minor: 9999, Currency: "USD"}:          "99.99 USD",
+		{Minor: 5, Currency: "USD"}:             "0.05 USD",
+		{Minor: -150, Currency: "EUR"}:          "-1.50 EUR",
+		{Minor: 1000, Currency: "JPY"}:          "1000 JPY",
+		{Minor: 1500, Currency: "KWD"}:          "1.500 KWD",
+		{Minor: 1, Currency: "KWD"}:             "0.001 KWD",
+		{Minor: math.MinInt64, Currency: "USD"}: "-92233720368547758.08 USD",
+		{Minor: math.MaxInt64, Currency: "JPY"}: "9223372036854775807 JPY",
+	}
+
+	for money, expected := range tests {
+		if got := money.String(); got != expected {
+			t.Errorf("Expected %q, got %q", expected, got)
+		}
+	}
+}
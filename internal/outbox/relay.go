@@ -0,0 +1,151 @@
+package outbox
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"payment-gateway/db"
+	"payment-gateway/internal/kafka"
+	"payment-gateway/internal/utils"
+)
+
+// Publisher sends one event to the broker. The event type goes with it, so consumers can tell e.g. a refund
+// from a deposit update without reading the payload.
+type Publisher func(ctx context.Context, key string, eventType string, payload []byte, dataFormat string) error
+
+// Relay publishes the events from the outbox table to kafka.
+// Events of the same aggregate (transaction) are published in the order they were written:
+// when one of them fails, the following ones wait until it has been sent or dead-lettered.
+type Relay struct {
+	repo    db.OutboxRepository
+	publish Publisher
+	now     func() time.Time
+
+	PollInterval time.Duration
+	BatchSize    int
+	// PublishTimeout bounds the publish of one event, a broker that doesn't answer counts as a failed attempt.
+	PublishTimeout time.Duration
+	// Failed events are retried after BaseDelay, doubling every attempt up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// After MaxAttempts failed publishes the event is moved to the dead-letter table.
+	MaxAttempts int
+}
+
+func NewRelay(repo db.OutboxRepository) *Relay {
+	return &Relay{
+		repo:           repo,
+		publish:        publishToKafka,
+		now:            time.Now,
+		PollInterval:   time.Second,
+		BatchSize:      100,
+		PublishTimeout: 10 * time.Second,
+		BaseDelay:      time.Second,
+		MaxDelay:       5 * time.Minute,
+		MaxAttempts:    20,
+	}
+}
+
+func publishToKafka(ctx context.Context, key string, eventType string, payload []byte, dataFormat string) error {
+	return utils.PublishWithCircuitBreaker(func() error {
+		return kafka.PublishTransaction(ctx, key, eventType, payload, dataFormat)
+	})
+}
+
+// Run relays events until the context is cancelled.
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.RelayOnce(ctx); err != nil {
+				log.Printf("outbox relay failed: %v", err)
+			}
+		}
+	}
+}
+
+// RelayOnce publishes one batch of pending events. It does nothing when another
+// instance of the service is relaying at the moment.
+func (r *Relay) RelayOnce(ctx context.Context) error {
+	release, ok, err := r.repo.Claim(ctx)
+	if err != nil || !ok {
+		return err
+	}
+	defer release()
+
+	events, err := r.repo.FetchPending(ctx, r.now(), r.BatchSize)
+	if err != nil {
+		return err
+	}
+
+	// Aggregates that have an unsent event earlier in the batch, we can't publish anything after it.
+	blocked := make(map[string]bool)
+	for _, event := range events {
+		key := event.AggregateType + ":" + event.AggregateID
+		if blocked[key] {
+			continue
+		}
+		if event.NextAttemptAt.After(r.now()) {
+			blocked[key] = true
+			continue
+		}
+
+		if err := r.publishEvent(ctx, event); err != nil {
+			if ctx.Err() != nil {
+				// Stopped while publishing, that isn't the broker's fault and doesn't cost an attempt.
+				return ctx.Err()
+			}
+			blocked[key] = true
+			if err := r.fail(ctx, event, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := r.repo.MarkSent(ctx, event.ID); err != nil {
+			// The event will be sent again, consumers have to handle duplicates anyway.
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Relay) publishEvent(ctx context.Context, event *db.OutboxEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, r.PublishTimeout)
+	defer cancel()
+	return r.publish(ctx, event.AggregateID, event.EventType, event.Payload, event.DataFormat)
+}
+
+// fail records a failed publish, moving the event to the dead-letter table once it ran out of attempts.
+func (r *Relay) fail(ctx context.Context, event *db.OutboxEvent, publishErr error) error {
+	event.Attempts++
+	event.LastError = publishErr.Error()
+	log.Printf("failed to publish outbox event %d (attempt %d): %v", event.ID, event.Attempts, publishErr)
+
+	if event.Attempts < r.MaxAttempts {
+		return r.repo.MarkFailed(ctx, event.ID, event.Attempts, event.LastError, r.now().Add(r.backoff(event.Attempts)))
+	}
+
+	// The topic is only stored so ops can see where the event was going, an unknown format has none.
+	topic, _ := kafka.GetTopic(event.DataFormat)
+	log.Printf("outbox event %d of %s %s moved to the dead-letter table", event.ID, event.AggregateType, event.AggregateID)
+	return r.repo.DeadLetter(ctx, event, topic)
+}
+
+// backoff returns how long to wait before the given attempt is retried.
+func (r *Relay) backoff(attempts int) time.Duration {
+	delay := r.BaseDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= r.MaxDelay {
+			return r.MaxDelay
+		}
+	}
+	return delay
+}
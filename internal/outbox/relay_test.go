@@ -0,0 +1,301 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"payment-gateway/db"
+)
+
+// ----------- Mock Setup ------------------//
+type mockOutboxRepository struct {
+	events       []*db.OutboxEvent
+	deadLettered map[int64]string
+	locked       bool
+}
+
+func (m *mockOutboxRepository) Claim(ctx context.Context) (func(), bool, error) {
+	if m.locked {
+		return nil, false, nil
+	}
+	return func() {}, true, nil
+}
+
+func (m *mockOutboxRepository) FetchPending(ctx context.Context, now time.Time, limit int) ([]*db.OutboxEvent, error) {
+	var pending []*db.OutboxEvent
+	waiting := make(map[string]bool)
+	for _, event := range m.events {
+		if event.SentAt != nil {
+			continue
+		}
+		key := event.AggregateType + ":" + event.AggregateID
+		if event.NextAttemptAt.After(now) {
+			waiting[key] = true
+		}
+		if !waiting[key] && len(pending) < limit {
+			pending = append(pending, event)
+		}
+	}
+	return pending, nil
+}
+
+func (m *mockOutboxRepository) MarkSent(ctx context.Context, id int64) error {
+	now := time.Now()
+	m.find(id).SentAt = &now
+	return nil
+}
+
+func (m *mockOutboxRepository) MarkFailed(ctx context.Context, id int64, attempts int, lastError string, nextAttemptAt time.Time) error {
+	event := m.find(id)
+	event.Attempts = attempts
+	event.LastError = lastError
+	event.NextAttemptAt = nextAttemptAt
+	return nil
+}
+
+func (m *mockOutboxRepository) DeadLetter(ctx context.Context, event *db.OutboxEvent, topic string) error {
+	m.deadLettered[event.ID] = topic
+	for i, e := range m.events {
+		if e.ID == event.ID {
+			m.events = append(m.events[:i], m.events[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *mockOutboxRepository) find(id int64) *db.OutboxEvent {
+	for _, event := range m.events {
+		if event.ID == id {
+			return event
+		}
+	}
+	return nil
+}
+
+type mockPublisher struct {
+	published []string
+	// eventTypes are the types the published payloads were sent with, in the same order.
+	eventTypes []string
+	failing    map[string]bool
+	// hanging payloads are only given up on when the context is done, like a broker that doesn't answer.
+	hanging map[string]bool
+}
+
+func (m *mockPublisher) publish(ctx context.Context, key string, eventType string, payload []byte, dataFormat string) error {
+	if m.hanging[string(payload)] {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if m.failing[string(payload)] {
+		return errors.New("broker is down")
+	}
+	m.published = append(m.published, string(payload))
+	m.eventTypes = append(m.eventTypes, eventType)
+	return nil
+}
+
+// ---------------------------------------------- //
+
+var now = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func setupRelay(events ...*db.OutboxEvent) (*Relay, *mockOutboxRepository, *mockPublisher) {
+	repo := &mockOutboxRepository{events: events, deadLettered: make(map[int64]string)}
+	publisher := &mockPublisher{failing: make(map[string]bool), hanging: make(map[string]bool)}
+
+	relay := NewRelay(repo)
+	relay.publish = publisher.publish
+	relay.now = func() time.Time { return now }
+	return relay, repo, publisher
+}
+
+func event(id int64, aggregateID string, payload string) *db.OutboxEvent {
+	return &db.OutboxEvent{
+		ID:            id,
+		AggregateType: "transaction",
+		AggregateID:   aggregateID,
+		EventType:     "transaction.updated",
+		DataFormat:    "application/json",
+		Payload:       []byte(payload),
+		NextAttemptAt: now,
+	}
+}
+
+func TestRelay_PublishesInOrder(t *testing.T) {
+	refund := event(2, "11", "11-created")
+	refund.EventType = "refund.created"
+	relay, repo, publisher := setupRelay(
+		event(1, "10", "10-created"),
+		refund,
+		event(3, "10", "10-completed"),
+	)
+
+	if err := relay.RelayOnce(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expected := []string{"10-created", "11-created", "10-completed"}
+	if len(publisher.published) != len(expected) {
+		t.Fatalf("Expected %v to be published, got %v", expected, publisher.published)
+	}
+	for i := range expected {
+		if publisher.published[i] != expected[i] {
+			t.Errorf("Expected %v to be published, got %v", expected, publisher.published)
+		}
+	}
+	if types := []string{"transaction.updated", "refund.created", "transaction.updated"}; fmt.Sprint(publisher.eventTypes) != fmt.Sprint(types) {
+		t.Errorf("Expected the events to be published with their types %v, got %v", types, publisher.eventTypes)
+	}
+	for _, event := range repo.events {
+		if event.SentAt == nil {
+			t.Errorf("Expected event %d to be marked as sent", event.ID)
+		}
+	}
+}
+
+func TestRelay_FailureBlocksLaterEventsOfSameAggregate(t *testing.T) {
+	relay, repo, publisher := setupRelay(
+		event(1, "10", "10-created"),
+		event(2, "11", "11-created"),
+		event(3, "10", "10-completed"),
+	)
+	publisher.failing["10-created"] = true
+
+	relay.RelayOnce(context.Background())
+
+	if len(publisher.published) != 1 || publisher.published[0] != "11-created" {
+		t.Fatalf("Expected only the other aggregate to be published, got %v", publisher.published)
+	}
+
+	failed := repo.find(1)
+	if failed.Attempts != 1 || failed.LastError != "broker is down" {
+		t.Errorf("Expected the failure to be recorded, got attempts=%d error=%q", failed.Attempts, failed.LastError)
+	}
+	if !failed.NextAttemptAt.Equal(now.Add(relay.BaseDelay)) {
+		t.Errorf("Expected retry at %v, got %v", now.Add(relay.BaseDelay), failed.NextAttemptAt)
+	}
+	if repo.find(3).SentAt != nil {
+		t.Error("Expected the later event of the same transaction to wait")
+	}
+
+	// Nothing happens before the retry is due.
+	publisher.failing["10-created"] = false
+	relay.RelayOnce(context.Background())
+	if len(publisher.published) != 1 {
+		t.Fatalf("Expected no publish before the retry is due, got %v", publisher.published)
+	}
+
+	relay.now = func() time.Time { return now.Add(relay.BaseDelay) }
+	relay.RelayOnce(context.Background())
+	if len(publisher.published) != 3 || publisher.published[1] != "10-created" || publisher.published[2] != "10-completed" {
+		t.Errorf("Expected the transaction events to be published in order, got %v", publisher.published)
+	}
+}
+
+func TestRelay_EventsWaitingForRetryDontFillTheBatch(t *testing.T) {
+	var events []*db.OutboxEvent
+	for i := int64(1); i <= 3; i++ {
+		waiting := event(i, fmt.Sprint(i), fmt.Sprintf("%d-created", i))
+		waiting.Attempts = 1
+		waiting.NextAttemptAt = now.Add(time.Minute)
+		events = append(events, waiting, event(i+10, fmt.Sprint(i), fmt.Sprintf("%d-completed", i)))
+	}
+	events = append(events, event(20, "20", "20-created"))
+	relay, _, publisher := setupRelay(events...)
+	relay.BatchSize = 3
+
+	relay.RelayOnce(context.Background())
+
+	if len(publisher.published) != 1 || publisher.published[0] != "20-created" {
+		t.Errorf("Expected the due event to be published past the waiting ones, got %v", publisher.published)
+	}
+}
+
+func TestRelay_DeadLettersAfterMaxAttempts(t *testing.T) {
+	failing := event(1, "10", "10-created")
+	failing.Attempts = 2
+	relay, repo, publisher := setupRelay(failing, event(2, "10", "10-completed"))
+	relay.MaxAttempts = 3
+	publisher.failing["10-created"] = true
+
+	relay.RelayOnce(context.Background())
+
+	topic, ok := repo.deadLettered[1]
+	if !ok {
+		t.Fatal("Expected the event to be dead-lettered")
+	}
+	if topic != "transactions.json" {
+		t.Errorf("Expected the original topic transactions.json, got %q", topic)
+	}
+	if failing.Attempts != 3 || failing.LastError != "broker is down" {
+		t.Errorf("Expected the last failure to be recorded, got attempts=%d error=%q", failing.Attempts, failing.LastError)
+	}
+
+	// The following events of the transaction are no longer held back.
+	relay.RelayOnce(context.Background())
+	if len(publisher.published) != 1 || publisher.published[0] != "10-completed" {
+		t.Errorf("Expected the next event to be published, got %v", publisher.published)
+	}
+}
+
+func TestRelay_SkipsWhenAnotherInstanceHoldsTheLock(t *testing.T) {
+	relay, repo, publisher := setupRelay(event(1, "10", "10-created"))
+	repo.locked = true
+
+	relay.RelayOnce(context.Background())
+
+	if len(publisher.published) != 0 {
+		t.Errorf("Expected nothing to be published, got %v", publisher.published)
+	}
+}
+
+func TestRelay_Backoff(t *testing.T) {
+	relay, _, _ := setupRelay()
+
+	tests := map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		9:  256 * time.Second,
+		10: 5 * time.Minute,
+		60: 5 * time.Minute,
+	}
+	for attempts, expected := range tests {
+		if got := relay.backoff(attempts); got != expected {
+			t.Errorf("Expected backoff %v for attempt %d, got %v", expected, attempts, got)
+		}
+	}
+}
+
+func TestRelay_PublishTimeoutIsAFailedAttempt(t *testing.T) {
+	relay, repo, publisher := setupRelay(event(1, "10", "10-created"), event(2, "11", "11-created"))
+	relay.PublishTimeout = 10 * time.Millisecond
+	publisher.hanging["10-created"] = true
+
+	if err := relay.RelayOnce(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if failed := repo.find(1); failed.Attempts != 1 || failed.LastError != context.DeadlineExceeded.Error() {
+		t.Errorf("Expected the timeout to be recorded, got attempts=%d error=%q", failed.Attempts, failed.LastError)
+	}
+	if len(publisher.published) != 1 || publisher.published[0] != "11-created" {
+		t.Errorf("Expected the other aggregate to be published, got %v", publisher.published)
+	}
+}
+
+func TestRelay_StoppingDoesNotCostAnAttempt(t *testing.T) {
+	relay, repo, publisher := setupRelay(event(1, "10", "10-created"))
+	publisher.hanging["10-created"] = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := relay.RelayOnce(ctx); err == nil {
+		t.Fatal("Expected the relay to stop with the context")
+	}
+	if event := repo.find(1); event.Attempts != 0 || event.SentAt != nil {
+		t.Errorf("Expected the event to be left as it was, got attempts=%d sent=%v", event.Attempts, event.SentAt)
+	}
+}
@@ -0,0 +1,334 @@
+package paypal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultBaseURL is the sandbox, so a missing setting never moves real money.
+const DefaultBaseURL = "https://api-m.sandbox.paypal.com"
+
+// Config is where and as which app the client talks to PayPal.
+type Config struct {
+	BaseURL      string
+	ClientID     string
+	ClientSecret string
+	HTTPClient   *http.Client
+}
+
+// LoadConfig reads the PayPal configuration from the environment.
+func LoadConfig() Config {
+	return Config{
+		BaseURL:      os.Getenv("PAYPAL_API_BASE_URL"),
+		ClientID:     os.Getenv("PAYPAL_CLIENT_ID"),
+		ClientSecret: os.Getenv("PAYPAL_CLIENT_SECRET"),
+	}
+}
+
+// Client calls the Orders, Payouts and Webhooks APIs of PayPal, with an OAuth2 token it gets and renews itself.
+type Client struct {
+	baseURL string
+	http    *http.Client
+	tokens  *tokenSource
+}
+
+func NewClient(cfg Config) *Client {
+	c := &Client{
+		baseURL: strings.TrimSuffix(cfg.BaseURL, "/"),
+		http:    cfg.HTTPClient,
+	}
+	if c.baseURL == "" {
+		c.baseURL = DefaultBaseURL
+	}
+	if c.http == nil {
+		// The caller's context bounds every request, this only catches a context without a deadline.
+		c.http = &http.Client{Timeout: time.Minute}
+	}
+	c.tokens = &tokenSource{
+		url:          c.baseURL + "/v1/oauth2/token",
+		clientID:     cfg.ClientID,
+		clientSecret: cfg.ClientSecret,
+		http:         c.http,
+		now:          time.Now,
+	}
+	return c
+}
+
+// Amount is a decimal amount, the way PayPal takes and returns them.
+type Amount struct {
+	CurrencyCode string `json:"currency_code"`
+	Value        string `json:"value"`
+}
+
+// Order is the part of a PayPal order we use.
+type Order struct {
+	ID            string         `json:"id"`
+	Status        string         `json:"status"`
+	PurchaseUnits []PurchaseUnit `json:"purchase_units,omitempty"`
+	Links         []Link         `json:"links,omitempty"`
+}
+
+// Link is a HATEOAS link of a PayPal resource, Rel says what it is for.
+type Link struct {
+	Href   string `json:"href"`
+	Rel    string `json:"rel"`
+	Method string `json:"method,omitempty"`
+}
+
+// ApproveURL is where the payer approves the order, empty when PayPal didn't send one.
+func (o *Order) ApproveURL() string {
+	for _, link := range o.Links {
+		// Orders created with a payment_source name it payer-action instead.
+		if link.Rel == "approve" || link.Rel == "payer-action" {
+			return link.Href
+		}
+	}
+	return ""
+}
+
+type PurchaseUnit struct {
+	ReferenceID string `json:"reference_id,omitempty"`
+	CustomID    string `json:"custom_id,omitempty"`
+	Amount      Amount `json:"amount"`
+	Payments    *struct {
+		Captures []Capture `json:"captures,omitempty"`
+	} `json:"payments,omitempty"`
+}
+
+// Capture is the money actually taken for an order, refunds are made against it.
+type Capture struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Amount Amount `json:"amount"`
+}
+
+// Refund is the part of a PayPal refund we use.
+type Refund struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// PayoutBatch is the answer to a payout, made of one item here.
+type PayoutBatch struct {
+	BatchHeader struct {
+		PayoutBatchID string `json:"payout_batch_id"`
+		BatchStatus   string `json:"batch_status"`
+	} `json:"batch_header"`
+}
+
+// OrderParams are the params of an order with a single purchase unit.
+type OrderParams struct {
+	// ReferenceID identifies the purchase unit, CustomID is ours to reconcile it.
+	ReferenceID string
+	CustomID    string
+	Amount      Amount
+}
+
+// PayoutParams send Amount to the PayPal account with the Receiver email.
+type PayoutParams struct {
+	// SenderBatchID is ours to reconcile the payout, PayPal refuses a second batch with the same id.
+	SenderBatchID string
+	Receiver      string
+	Amount        Amount
+	Note          string
+}
+
+// CreateOrder creates an order the user approves on PayPal, at its ApproveURL. Once approved it still has
+// to be captured, see CaptureOrder.
+func (c *Client) CreateOrder(ctx context.Context, params *OrderParams, requestID string) (*Order, error) {
+	body := map[string]interface{}{
+		"intent": "CAPTURE",
+		"purchase_units": []PurchaseUnit{{
+			ReferenceID: params.ReferenceID,
+			CustomID:    params.CustomID,
+			Amount:      params.Amount,
+		}},
+	}
+	order := &Order{}
+	if err := c.do(ctx, http.MethodPost, "/v2/checkout/orders", body, requestID, order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// CaptureOrder takes the money of an order the payer approved. The order comes back with its capture,
+// which can still be PENDING, e.g. for an eCheck. Its outcome then comes back as a webhook.
+func (c *Client) CaptureOrder(ctx context.Context, orderID string, requestID string) (*Order, error) {
+	order := &Order{}
+	path := "/v2/checkout/orders/" + url.PathEscape(orderID) + "/capture"
+	if err := c.do(ctx, http.MethodPost, path, nil, requestID, order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// GetOrder returns an order with its captures.
+func (c *Client) GetOrder(ctx context.Context, orderID string) (*Order, error) {
+	order := &Order{}
+	if err := c.do(ctx, http.MethodGet, "/v2/checkout/orders/"+url.PathEscape(orderID), nil, "", order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// RefundCapture gives back part or all of a capture.
+func (c *Client) RefundCapture(ctx context.Context, captureID string, amount Amount, requestID string) (*Refund, error) {
+	refund := &Refund{}
+	path := "/v2/payments/captures/" + url.PathEscape(captureID) + "/refund"
+	if err := c.do(ctx, http.MethodPost, path, map[string]interface{}{"amount": amount}, requestID, refund); err != nil {
+		return nil, err
+	}
+	return refund, nil
+}
+
+// CreatePayout sends money to a PayPal account.
+func (c *Client) CreatePayout(ctx context.Context, params *PayoutParams, requestID string) (*PayoutBatch, error) {
+	body := map[string]interface{}{
+		"sender_batch_header": map[string]string{
+			"sender_batch_id": params.SenderBatchID,
+		},
+		"items": []map[string]interface{}{{
+			"recipient_type": "EMAIL",
+			"receiver":       params.Receiver,
+			"note":           params.Note,
+			"sender_item_id": params.SenderBatchID,
+			"amount":         map[string]string{"currency": params.Amount.CurrencyCode, "value": params.Amount.Value},
+		}},
+	}
+	batch := &PayoutBatch{}
+	if err := c.do(ctx, http.MethodPost, "/v1/payments/payouts", body, requestID, batch); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// do sends a JSON request with a bearer token. A token PayPal no longer takes, e.g. revoked before it expired,
+// is dropped and the request is sent once more with a new one. The PayPal-Request-Id makes PayPal answer a
+// repeated request with the result of the first one.
+func (c *Client) do(ctx context.Context, method string, path string, body interface{}, requestID string, out interface{}) error {
+	var payload []byte
+	if body == nil && method == http.MethodPost {
+		// PayPal wants a JSON body on every POST, e.g. the capture of an order.
+		payload = []byte("{}")
+	}
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		token, err := c.tokens.Token(ctx)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		if requestID != "" {
+			req.Header.Set("PayPal-Request-Id", requestID)
+		}
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			c.tokens.Invalidate(token)
+			continue
+		}
+		if resp.StatusCode >= 300 {
+			return parseError(resp, data)
+		}
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("failed to decode paypal response: %v", err)
+		}
+		return nil
+	}
+}
+
+// Error is an error response of the PayPal API.
+type Error struct {
+	HTTPStatus int    `json:"-"`
+	DebugID    string `json:"debug_id"`
+	Name       string `json:"name"`
+	Message    string `json:"message"`
+	Details    []struct {
+		Issue       string `json:"issue"`
+		Description string `json:"description"`
+	} `json:"details"`
+}
+
+func (e *Error) Error() string {
+	if issue := e.Issue(); issue != "" {
+		return fmt.Sprintf("paypal %s (%s): %s", e.Name, issue, e.Message)
+	}
+	return fmt.Sprintf("paypal %s: %s", e.Name, e.Message)
+}
+
+// Issue is the first detail of the error, e.g. INSTRUMENT_DECLINED, the most precise reason PayPal gives.
+func (e *Error) Issue() string {
+	if len(e.Details) == 0 {
+		return ""
+	}
+	return e.Details[0].Issue
+}
+
+// Retryable is true for errors on PayPal's side and rate limits, everything else fails the same way again.
+func (e *Error) Retryable() bool {
+	return e.HTTPStatus == http.StatusTooManyRequests || e.HTTPStatus >= 500
+}
+
+func parseError(resp *http.Response, body []byte) error {
+	apiErr := &Error{}
+	if err := json.Unmarshal(body, apiErr); err != nil || apiErr.Name == "" {
+		// The token endpoint answers in the OAuth2 format.
+		var oauth struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		json.Unmarshal(body, &oauth)
+		apiErr = &Error{Name: oauth.Error, Message: oauth.Description}
+		if apiErr.Name == "" {
+			apiErr.Name, apiErr.Message = "HTTP_ERROR", http.StatusText(resp.StatusCode)
+		}
+	}
+	apiErr.HTTPStatus = resp.StatusCode
+	if apiErr.DebugID == "" {
+		apiErr.DebugID = resp.Header.Get("Paypal-Debug-Id")
+	}
+	return apiErr
+}
+
+// ErrNoCapture is returned when an order has nothing captured to refund.
+var ErrNoCapture = errors.New("paypal order has no capture")
+
+// CaptureOf returns the first capture of the order.
+func CaptureOf(order *Order) (*Capture, error) {
+	for _, unit := range order.PurchaseUnits {
+		if unit.Payments != nil && len(unit.Payments.Captures) > 0 {
+			return &unit.Payments.Captures[0], nil
+		}
+	}
+	return nil, ErrNoCapture
+}
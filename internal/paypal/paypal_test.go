@@ -0,0 +1,230 @@
+package paypal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"payment-gateway/internal/paypal/paypaltest"
+)
+
+func newTestClient(t *testing.T) (*Client, *paypaltest.Server) {
+	server := paypaltest.NewServer()
+	t.Cleanup(server.Close)
+	return NewClient(Config{BaseURL: server.URL, ClientID: paypaltest.ClientID, ClientSecret: paypaltest.ClientSecret}), server
+}
+
+func order(t *testing.T, client *Client, requestID string) *Order {
+	t.Helper()
+	params := &OrderParams{ReferenceID: requestID, CustomID: "7", Amount: Amount{CurrencyCode: "USD", Value: "10.50"}}
+	created, err := client.CreateOrder(context.Background(), params, requestID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return created
+}
+
+func TestClient_CreateOrder(t *testing.T) {
+	client, server := newTestClient(t)
+
+	created := order(t, client, "deposit-7")
+	if created.ID == "" || created.Status != "CREATED" {
+		t.Errorf("Unexpected order %+v", created)
+	}
+	if replayed := order(t, client, "deposit-7"); replayed.ID != created.ID {
+		t.Errorf("Expected the retry to get the same order, got %s and %s", created.ID, replayed.ID)
+	}
+
+	requests := server.Requests()
+	if len(requests) != 2 || requests[0].RequestID != "deposit-7" || requests[0].Body["intent"] != "CAPTURE" {
+		t.Errorf("Unexpected requests %+v", requests)
+	}
+}
+
+func TestClient_RefundsTheCapture(t *testing.T) {
+	client, server := newTestClient(t)
+	created := order(t, client, "deposit-1")
+
+	fetched, _ := client.GetOrder(context.Background(), created.ID)
+	if _, err := CaptureOf(fetched); !errors.Is(err, ErrNoCapture) {
+		t.Errorf("Expected no capture before the payer approved, got %v", err)
+	}
+
+	captureID := server.CaptureOrder(created.ID)
+	fetched, err := client.GetOrder(context.Background(), created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	capture, err := CaptureOf(fetched)
+	if err != nil || capture.ID != captureID || fetched.Status != "COMPLETED" {
+		t.Fatalf("Expected capture %s, got %+v, %v", captureID, capture, err)
+	}
+
+	refund, err := client.RefundCapture(context.Background(), capture.ID, Amount{CurrencyCode: "USD", Value: "2.00"}, "refund-2")
+	if err != nil || refund.Status != "COMPLETED" {
+		t.Errorf("Expected a completed refund, got %+v, %v", refund, err)
+	}
+}
+
+func TestClient_ReusesToken(t *testing.T) {
+	client, server := newTestClient(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.CreatePayout(context.Background(), &PayoutParams{SenderBatchID: "withdraw-1", Receiver: "user@example.com", Amount: Amount{CurrencyCode: "EUR", Value: "5.00"}}, ""); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := server.TokenRequests(); got != 1 {
+		t.Errorf("Expected concurrent requests to share one token, %d were fetched", got)
+	}
+}
+
+func TestClient_RenewsExpiredToken(t *testing.T) {
+	client, server := newTestClient(t)
+	now := time.Now()
+	client.tokens.now = func() time.Time { return now }
+
+	order(t, client, "")
+	// The token lives 9 hours, it is renewed a minute before it expires.
+	now = now.Add(9*time.Hour - 2*time.Minute)
+	order(t, client, "")
+	if got := server.TokenRequests(); got != 1 {
+		t.Errorf("Expected the token to be reused before it expires, %d were fetched", got)
+	}
+
+	now = now.Add(time.Minute)
+	order(t, client, "")
+	if got := server.TokenRequests(); got != 2 {
+		t.Errorf("Expected the token to be renewed, %d were fetched", got)
+	}
+}
+
+func TestClient_RevokedToken(t *testing.T) {
+	client, server := newTestClient(t)
+	order(t, client, "")
+
+	server.RevokeTokens()
+	order(t, client, "")
+	if got := server.TokenRequests(); got != 2 {
+		t.Errorf("Expected a new token after the old one was refused, %d were fetched", got)
+	}
+}
+
+func TestClient_InvalidCredentials(t *testing.T) {
+	server := paypaltest.NewServer()
+	defer server.Close()
+	client := NewClient(Config{BaseURL: server.URL, ClientID: paypaltest.ClientID, ClientSecret: "wrong"})
+
+	_, err := client.CreateOrder(context.Background(), &OrderParams{Amount: Amount{CurrencyCode: "USD", Value: "1.00"}}, "")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Name != "invalid_client" || apiErr.Retryable() {
+		t.Errorf("Expected a final authentication error, got %v", err)
+	}
+}
+
+func TestClient_Errors(t *testing.T) {
+	tests := []struct {
+		name      string
+		failure   paypaltest.Failure
+		retryable bool
+	}{
+		{"declined", paypaltest.Failure{Status: http.StatusUnprocessableEntity, Name: "UNPROCESSABLE_ENTITY", Issue: "INSTRUMENT_DECLINED"}, false},
+		{"invalid request", paypaltest.Failure{Status: http.StatusBadRequest, Name: "INVALID_REQUEST", Issue: "INVALID_PARAMETER_VALUE"}, false},
+		{"paypal is down", paypaltest.Failure{Status: http.StatusServiceUnavailable, Name: "SERVICE_UNAVAILABLE"}, true},
+		{"rate limited", paypaltest.Failure{Status: http.StatusTooManyRequests, Name: "RATE_LIMIT_REACHED"}, true},
+	}
+	for _, tt := range tests {
+		client, server := newTestClient(t)
+		server.Fail(tt.failure)
+
+		_, err := client.CreateOrder(context.Background(), &OrderParams{Amount: Amount{CurrencyCode: "USD", Value: "1.00"}}, "")
+		var apiErr *Error
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("%s: expected a paypal error, got %v", tt.name, err)
+		}
+		if apiErr.Name != tt.failure.Name || apiErr.Issue() != tt.failure.Issue || apiErr.HTTPStatus != tt.failure.Status {
+			t.Errorf("%s: unexpected error %+v", tt.name, apiErr)
+		}
+		if apiErr.Retryable() != tt.retryable {
+			t.Errorf("%s: expected retryable to be %v", tt.name, tt.retryable)
+		}
+	}
+}
+
+func TestClient_CaptureOrder(t *testing.T) {
+	client, server := newTestClient(t)
+	created := order(t, client, "deposit-1")
+	if created.ApproveURL() == "" {
+		t.Errorf("Expected the approve link of the order, got %+v", created.Links)
+	}
+
+	_, err := client.CaptureOrder(context.Background(), created.ID, "capture-1")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Issue() != "ORDER_NOT_APPROVED" {
+		t.Fatalf("Expected an order the payer didn't approve not to be captured, got %v", err)
+	}
+
+	server.ApproveOrder(created.ID)
+	captured, err := client.CaptureOrder(context.Background(), created.ID, "capture-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	capture, err := CaptureOf(captured)
+	if err != nil || captured.Status != "COMPLETED" || capture.Status != "COMPLETED" {
+		t.Errorf("Expected a completed capture, got %+v, %v", captured, err)
+	}
+	sent := server.Requests()[len(server.Requests())-1]
+	if sent.Method != http.MethodPost || sent.Path != "/v2/checkout/orders/"+created.ID+"/capture" || sent.RequestID != "capture-1" {
+		t.Errorf("Unexpected request %+v", sent)
+	}
+}
+
+func TestClient_VerifyWebhookSignature(t *testing.T) {
+	client, server := newTestClient(t)
+	signature := &WebhookSignature{
+		AuthAlgo:         "SHA256withRSA",
+		CertURL:          "https://api.sandbox.paypal.com/v1/notifications/certs/CERT-360caa42",
+		TransmissionID:   "69cd13f0-d67a-11e5-baa3-778b53f4ae55",
+		TransmissionSig:  paypaltest.WebhookSignature,
+		TransmissionTime: "2026-10-17T12:00:00Z",
+		WebhookID:        "WH-1",
+		Event:            []byte(`{"id": "WH-EVENT-1", "event_type": "CHECKOUT.ORDER.APPROVED"}`),
+	}
+	if ok, err := client.VerifyWebhookSignature(context.Background(), signature); err != nil || !ok {
+		t.Fatalf("Expected the signature to be verified, got %v, %v", ok, err)
+	}
+	if sent := server.Requests()[0]; sent.Body["webhook_id"] != "WH-1" || sent.Body["webhook_event"].(map[string]interface{})["id"] != "WH-EVENT-1" {
+		t.Errorf("Unexpected request %+v", sent)
+	}
+
+	signature.TransmissionSig = "forged"
+	if ok, err := client.VerifyWebhookSignature(context.Background(), signature); err != nil || ok {
+		t.Errorf("Expected a forged signature to be refused, got %v, %v", ok, err)
+	}
+}
+
+func TestParseEvent(t *testing.T) {
+	body := `{"id": "WH-1", "event_type": "PAYMENT.CAPTURE.COMPLETED", "resource_type": "capture", "resource": {
+		"id": "CAPTURE-1", "status": "COMPLETED", "supplementary_data": {"related_ids": {"order_id": "ORDER-1"}}}}`
+	event, err := ParseEvent([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.ResourceType != ResourceCapture || event.Resource.ID != "CAPTURE-1" || event.Resource.SupplementaryData.RelatedIDs.OrderID != "ORDER-1" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+
+	if _, err := ParseEvent([]byte(`{"gateway_txn_id": "ORDER-1", "status": "completed"}`)); err == nil {
+		t.Error("Expected a body without an event to be rejected")
+	}
+}
@@ -0,0 +1,271 @@
+package paypaltest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Credentials of the app the stub accepts.
+const (
+	ClientID     = "stub-client"
+	ClientSecret = "stub-secret"
+)
+
+// WebhookSignature is the only transmission signature the stub's verify-webhook-signature accepts.
+const WebhookSignature = "stub-transmission-sig"
+
+// Request is a request the stub received, the token requests aside.
+type Request struct {
+	Method    string
+	Path      string
+	RequestID string
+	Body      map[string]interface{}
+}
+
+// Failure is an error the stub answers the next API request with.
+type Failure struct {
+	Status  int
+	Name    string
+	Issue   string
+	Message string
+}
+
+// Server is a local stand-in for the PayPal Orders, Payments, Payouts and Webhooks APIs. It hands out OAuth2 tokens
+// for the client credentials, takes only the tokens it handed out and replays the answer of a request
+// with a PayPal-Request-Id it has seen before.
+type Server struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	// TokenLifetime is the expires_in of the tokens, in seconds.
+	TokenLifetime int
+	tokens        map[string]bool
+	tokenRequests int
+	requests      []Request
+	failures      []Failure
+	orders        map[string]map[string]interface{}
+	replies       map[string][]byte
+	lastID        int
+}
+
+func NewServer() *Server {
+	s := &Server{
+		TokenLifetime: 32400,
+		tokens:        make(map[string]bool),
+		orders:        make(map[string]map[string]interface{}),
+		replies:       make(map[string][]byte),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/oauth2/token", s.token)
+	mux.HandleFunc("/v2/checkout/orders", s.api(s.createOrder))
+	mux.HandleFunc("/v2/checkout/orders/", s.api(s.getOrder))
+	mux.HandleFunc("/v2/payments/captures/", s.api(s.refundCapture))
+	mux.HandleFunc("/v1/payments/payouts", s.api(s.createPayout))
+	mux.HandleFunc("/v1/notifications/verify-webhook-signature", s.api(s.verifyWebhookSignature))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Fail makes the stub answer the next API requests with the failures, one each, in order.
+func (s *Server) Fail(failures ...Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, failures...)
+}
+
+// Requests returns the API requests received so far, replays included.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// TokenRequests returns how many tokens were handed out.
+func (s *Server) TokenRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokenRequests
+}
+
+// RevokeTokens stops accepting the tokens handed out so far, like PayPal does when the app's secret changes.
+func (s *Server) RevokeTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = make(map[string]bool)
+}
+
+// ApproveOrder approves an order as if the payer had done it, it can be captured then.
+func (s *Server) ApproveOrder(orderID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.orders[orderID]["status"] = "APPROVED"
+}
+
+// CaptureOrder completes an order as if the payer had approved it and the money was captured.
+func (s *Server) CaptureOrder(orderID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.capture(s.orders[orderID])
+}
+
+func (s *Server) capture(order map[string]interface{}) string {
+	s.lastID++
+	captureID := fmt.Sprintf("CAPTURE-%d", s.lastID)
+	unit := order["purchase_units"].([]interface{})[0].(map[string]interface{})
+	unit["payments"] = map[string]interface{}{
+		"captures": []map[string]interface{}{{"id": captureID, "status": "COMPLETED", "amount": unit["amount"]}},
+	}
+	order["status"] = "COMPLETED"
+	return captureID
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != ClientID || secret != ClientSecret || r.FormValue("grant_type") != "client_credentials" {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client", "error_description": "Client Authentication failed"})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokenRequests++
+	token := fmt.Sprintf("A21_stub_%d", s.tokenRequests)
+	s.tokens[token] = true
+	writeJSON(w, http.StatusOK, map[string]interface{}{"access_token": token, "token_type": "Bearer", "expires_in": s.TokenLifetime})
+}
+
+// api checks the token, records the request and answers with a replay, a queued failure or the handler.
+func (s *Server) api(handler func(r *http.Request, body map[string]interface{}) (int, interface{})) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if !s.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_token", "error_description": "Token signature verification failed"})
+			return
+		}
+
+		var body map[string]interface{}
+		data, _ := io.ReadAll(r.Body)
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &body); err != nil {
+				writeError(w, Failure{Status: http.StatusBadRequest, Name: "INVALID_REQUEST", Issue: "MALFORMED_REQUEST_JSON", Message: err.Error()})
+				return
+			}
+		}
+		requestID := r.Header.Get("PayPal-Request-Id")
+		s.requests = append(s.requests, Request{Method: r.Method, Path: r.URL.Path, RequestID: requestID, Body: body})
+
+		if reply, ok := s.replies[requestID]; ok && requestID != "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(reply)
+			return
+		}
+		if len(s.failures) > 0 {
+			failure := s.failures[0]
+			s.failures = s.failures[1:]
+			writeError(w, failure)
+			return
+		}
+
+		status, reply := handler(r, body)
+		data, _ = json.Marshal(reply)
+		if status < 300 && requestID != "" {
+			s.replies[requestID] = data
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(data)
+	}
+}
+
+func (s *Server) createOrder(r *http.Request, body map[string]interface{}) (int, interface{}) {
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, nil
+	}
+	s.lastID++
+	id := fmt.Sprintf("ORDER-%d", s.lastID)
+	s.orders[id] = map[string]interface{}{
+		"id":             id,
+		"status":         "CREATED",
+		"purchase_units": body["purchase_units"],
+		"links": []map[string]string{
+			{"href": s.URL + "/v2/checkout/orders/" + id, "rel": "self", "method": "GET"},
+			{"href": "https://www.sandbox.paypal.com/checkoutnow?token=" + id, "rel": "approve", "method": "GET"},
+			{"href": s.URL + "/v2/checkout/orders/" + id + "/capture", "rel": "capture", "method": "POST"},
+		},
+	}
+	return http.StatusCreated, s.orders[id]
+}
+
+// getOrder answers GET /v2/checkout/orders/{id} and POST /v2/checkout/orders/{id}/capture.
+func (s *Server) getOrder(r *http.Request, body map[string]interface{}) (int, interface{}) {
+	id, capture := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/v2/checkout/orders/"), "/capture")
+	order, ok := s.orders[id]
+	if !ok {
+		return http.StatusNotFound, errorBody(Failure{Name: "RESOURCE_NOT_FOUND", Issue: "INVALID_RESOURCE_ID", Message: "The specified resource does not exist."})
+	}
+	if !capture {
+		return http.StatusOK, order
+	}
+
+	switch order["status"] {
+	case "APPROVED":
+		s.capture(order)
+		return http.StatusCreated, order
+	case "COMPLETED":
+		return http.StatusUnprocessableEntity, errorBody(Failure{Name: "UNPROCESSABLE_ENTITY", Issue: "ORDER_ALREADY_CAPTURED", Message: "Order already captured."})
+	default:
+		return http.StatusUnprocessableEntity, errorBody(Failure{Name: "UNPROCESSABLE_ENTITY", Issue: "ORDER_NOT_APPROVED", Message: "Payer has not yet approved the Order for payment."})
+	}
+}
+
+func (s *Server) verifyWebhookSignature(r *http.Request, body map[string]interface{}) (int, interface{}) {
+	status := "FAILURE"
+	if body["transmission_sig"] == WebhookSignature && body["webhook_id"] != "" && body["webhook_event"] != nil {
+		status = "SUCCESS"
+	}
+	return http.StatusOK, map[string]string{"verification_status": status}
+}
+
+func (s *Server) refundCapture(r *http.Request, body map[string]interface{}) (int, interface{}) {
+	if !strings.HasSuffix(r.URL.Path, "/refund") {
+		return http.StatusNotFound, nil
+	}
+	s.lastID++
+	return http.StatusCreated, map[string]string{"id": fmt.Sprintf("REFUND-%d", s.lastID), "status": "COMPLETED"}
+}
+
+func (s *Server) createPayout(r *http.Request, body map[string]interface{}) (int, interface{}) {
+	s.lastID++
+	return http.StatusCreated, map[string]interface{}{
+		"batch_header": map[string]string{"payout_batch_id": fmt.Sprintf("BATCH-%d", s.lastID), "batch_status": "PENDING"},
+	}
+}
+
+func errorBody(failure Failure) map[string]interface{} {
+	body := map[string]interface{}{"name": failure.Name, "message": failure.Message, "debug_id": "stub"}
+	if failure.Issue != "" {
+		body["details"] = []map[string]string{{"issue": failure.Issue}}
+	}
+	return body
+}
+
+func writeError(w http.ResponseWriter, failure Failure) {
+	status := failure.Status
+	if status == 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	writeJSON(w, status, errorBody(failure))
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
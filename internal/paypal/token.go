@@ -0,0 +1,122 @@
+package paypal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenExpiryMargin renews a token a bit before PayPal says it expires, so it doesn't expire on the way.
+const tokenExpiryMargin = time.Minute
+
+// tokenSource gets OAuth2 client-credentials tokens and keeps them until they expire. Callers that need a
+// token while one is being fetched wait for it instead of fetching their own.
+type tokenSource struct {
+	url          string
+	clientID     string
+	clientSecret string
+	http         *http.Client
+	now          func() time.Time
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+	// fetching is closed when the fetch in flight is done, nil when there is none.
+	fetching chan struct{}
+	fetchErr error
+}
+
+// Token returns a valid access token, fetching a new one when there is none or it is about to expire.
+func (s *tokenSource) Token(ctx context.Context) (string, error) {
+	for {
+		s.mu.Lock()
+		if s.token != "" && s.now().Before(s.expires) {
+			token := s.token
+			s.mu.Unlock()
+			return token, nil
+		}
+		if s.fetching == nil {
+			s.fetching = make(chan struct{})
+			s.mu.Unlock()
+			return s.fetch(ctx)
+		}
+		fetching := s.fetching
+		s.mu.Unlock()
+
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		s.mu.Lock()
+		err := s.fetchErr
+		s.mu.Unlock()
+		// A fetch that was cancelled by its own caller is tried again by the next one.
+		if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			return "", err
+		}
+	}
+}
+
+// Invalidate drops the token when it is still the one cached, a newer token fetched meanwhile is kept.
+func (s *tokenSource) Invalidate(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == token {
+		s.token = ""
+	}
+}
+
+func (s *tokenSource) fetch(ctx context.Context) (string, error) {
+	token, expiresIn, err := s.request(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.token = token
+		s.expires = s.now().Add(expiresIn - tokenExpiryMargin)
+	}
+	s.fetchErr = err
+	close(s.fetching)
+	s.fetching = nil
+	return token, err
+}
+
+func (s *tokenSource) request(ctx context.Context) (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.SetBasicAuth(s.clientID, s.clientSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.StatusCode >= 300 {
+		return "", 0, parseError(resp, body)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return "", 0, fmt.Errorf("failed to decode paypal token: %v", err)
+	}
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second, nil
+}
@@ -0,0 +1,92 @@
+package paypal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Types of the resources a webhook event can be about, the resource_type of the event.
+const (
+	ResourceOrder   = "checkout-order"
+	ResourceCapture = "capture"
+	ResourceRefund  = "refund"
+	ResourcePayouts = "payouts"
+)
+
+// Event is a webhook event. The resource it is about is in Resource, as it is after the event.
+type Event struct {
+	ID           string        `json:"id"`
+	EventType    string        `json:"event_type"`
+	ResourceType string        `json:"resource_type"`
+	Summary      string        `json:"summary"`
+	Resource     EventResource `json:"resource"`
+}
+
+// EventResource is the part of the order, capture, refund or payout batch of an event we use.
+type EventResource struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	// The order a capture belongs to.
+	SupplementaryData struct {
+		RelatedIDs struct {
+			OrderID string `json:"order_id"`
+		} `json:"related_ids"`
+	} `json:"supplementary_data"`
+	// Why a capture is pending or was declined.
+	StatusDetails struct {
+		Reason string `json:"reason"`
+	} `json:"status_details"`
+	// Set on payout batches, which have no id or status of their own.
+	BatchHeader *struct {
+		PayoutBatchID string `json:"payout_batch_id"`
+		BatchStatus   string `json:"batch_status"`
+	} `json:"batch_header"`
+}
+
+// ParseEvent decodes the body of a webhook. It doesn't check its signature, see VerifyWebhookSignature.
+func ParseEvent(body []byte) (*Event, error) {
+	event := &Event{}
+	if err := json.Unmarshal(body, event); err != nil {
+		return nil, fmt.Errorf("failed to decode paypal event: %v", err)
+	}
+	if event.EventType == "" || event.ResourceType == "" {
+		return nil, errors.New("not a paypal event")
+	}
+	return event, nil
+}
+
+// WebhookSignature is what PayPal sends with a webhook in its PAYPAL-* headers, with the id of the webhook
+// it was sent to and the raw event.
+type WebhookSignature struct {
+	AuthAlgo         string
+	CertURL          string
+	TransmissionID   string
+	TransmissionSig  string
+	TransmissionTime string
+	WebhookID        string
+	Event            json.RawMessage
+}
+
+// VerifyWebhookSignature asks PayPal whether the webhook was signed by PayPal for our webhook. ok is false for
+// a signature PayPal doesn't recognise, err only says PayPal couldn't tell.
+func (c *Client) VerifyWebhookSignature(ctx context.Context, signature *WebhookSignature) (bool, error) {
+	body := map[string]interface{}{
+		"auth_algo":         signature.AuthAlgo,
+		"cert_url":          signature.CertURL,
+		"transmission_id":   signature.TransmissionID,
+		"transmission_sig":  signature.TransmissionSig,
+		"transmission_time": signature.TransmissionTime,
+		"webhook_id":        signature.WebhookID,
+		"webhook_event":     signature.Event,
+	}
+	var result struct {
+		VerificationStatus string `json:"verification_status"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/notifications/verify-webhook-signature", body, "", &result); err != nil {
+		return false, err
+	}
+	return result.VerificationStatus == "SUCCESS", nil
+}
@@ -0,0 +1,102 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Policy is how often and how far apart an operation is tried.
+type Policy struct {
+	// MaxAttempts counts the first attempt too, 1 doesn't retry at all.
+	MaxAttempts int
+	// The wait before a retry is random between 0 and BaseDelay, doubling every attempt up to MaxDelay.
+	// The randomness ("full jitter") keeps clients that failed together from retrying together.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Classify decides whether a failed attempt is worth trying again. Retryable is used when it is nil.
+	Classify func(err error) bool
+}
+
+// Permanent marks an error that retrying won't fix, e.g. a declined card.
+// Do gives up on it right away and returns it, still wrapping err.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// IsPermanent reports whether the error, or one it wraps, was marked with Permanent.
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+// Retryable is the default classifier. Errors marked with Permanent are not retried, nor are errors that
+// tell so themselves with a Retryable() bool method. Everything else is, since most failures of a remote
+// call, like a timeout or a refused connection, are gone on the next attempt.
+func Retryable(err error) bool {
+	if IsPermanent(err) {
+		return false
+	}
+	var classified interface{ Retryable() bool }
+	if errors.As(err, &classified) {
+		return classified.Retryable()
+	}
+	return true
+}
+
+// Do runs op until it succeeds, fails with an error that isn't retryable, runs out of attempts or ctx is done.
+// The last error of op is wrapped in the error returned, so errors.Is and errors.As see through it.
+func Do(ctx context.Context, policy Policy, op func(ctx context.Context) error) error {
+	classify := policy.Classify
+	if classify == nil {
+		classify = Retryable
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = op(ctx); err == nil {
+			return nil
+		}
+		if !classify(err) {
+			return fmt.Errorf("not retried after attempt %d: %w", attempt, err)
+		}
+		if attempt >= policy.MaxAttempts {
+			return fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		}
+
+		timer := time.NewTimer(policy.delay(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w after %d attempts, last error: %w", ctx.Err(), attempt, err)
+		}
+	}
+}
+
+// delay returns a random wait before the retry following the given attempt.
+func (p Policy) delay(attempt int) time.Duration {
+	ceiling := p.BaseDelay
+	for i := 1; i < attempt && ceiling < p.MaxDelay; i++ {
+		ceiling *= 2
+	}
+	if p.MaxDelay > 0 && ceiling > p.MaxDelay {
+		ceiling = p.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
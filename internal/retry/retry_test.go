@@ -0,0 +1,118 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var errUnavailable = errors.New("service unavailable")
+
+type declinedError struct{}
+
+func (declinedError) Error() string   { return "card declined" }
+func (declinedError) Retryable() bool { return false }
+
+func quickPolicy(attempts int) Policy {
+	return Policy{MaxAttempts: attempts, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+}
+
+func TestDo_RetriesUntilSuccess(t *testing.T) {
+	calls := 0
+	err := Do(context.Background(), quickPolicy(3), func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return errUnavailable
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Expected success on the third attempt, got %v after %d calls", err, calls)
+	}
+}
+
+func TestDo_ReturnsLastError(t *testing.T) {
+	calls := 0
+	err := Do(context.Background(), quickPolicy(3), func(ctx context.Context) error {
+		calls++
+		return errUnavailable
+	})
+	if calls != 3 {
+		t.Errorf("Expected 3 attempts, got %d", calls)
+	}
+	if !errors.Is(err, errUnavailable) || err.Error() != "gave up after 3 attempts: service unavailable" {
+		t.Errorf("Expected the last error to be wrapped, got %v", err)
+	}
+}
+
+func TestDo_DoesNotRetryTerminalErrors(t *testing.T) {
+	tests := map[string]error{
+		"permanent":           Permanent(errors.New("card declined")),
+		"classified by error": declinedError{},
+	}
+	for name, terminal := range tests {
+		calls := 0
+		err := Do(context.Background(), quickPolicy(3), func(ctx context.Context) error {
+			calls++
+			return terminal
+		})
+		if calls != 1 {
+			t.Errorf("%s: expected a single attempt, got %d", name, calls)
+		}
+		if err == nil || !strings.HasSuffix(err.Error(), "card declined") {
+			t.Errorf("%s: expected the decline to be returned, got %v", name, err)
+		}
+	}
+
+	if !IsPermanent(Do(context.Background(), quickPolicy(3), func(ctx context.Context) error {
+		return Permanent(errUnavailable)
+	})) {
+		t.Error("Expected the returned error to still be permanent")
+	}
+}
+
+func TestDo_CustomClassifier(t *testing.T) {
+	policy := quickPolicy(3)
+	policy.Classify = func(err error) bool { return !errors.Is(err, errUnavailable) }
+
+	calls := 0
+	Do(context.Background(), policy, func(ctx context.Context) error {
+		calls++
+		return errUnavailable
+	})
+	if calls != 1 {
+		t.Errorf("Expected the classifier to stop the retries, got %d attempts", calls)
+	}
+}
+
+func TestDo_StopsWhenContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := Policy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}
+
+	calls := 0
+	err := Do(ctx, policy, func(ctx context.Context) error {
+		calls++
+		cancel()
+		return errUnavailable
+	})
+	if calls != 1 {
+		t.Errorf("Expected no retry once the context is done, got %d attempts", calls)
+	}
+	if !errors.Is(err, context.Canceled) || !errors.Is(err, errUnavailable) {
+		t.Errorf("Expected both the cancellation and the last error, got %v", err)
+	}
+}
+
+func TestPolicy_Delay(t *testing.T) {
+	policy := Policy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	ceilings := map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second}
+	for attempt, ceiling := range ceilings {
+		for i := 0; i < 100; i++ {
+			if delay := policy.delay(attempt); delay < 0 || delay > ceiling {
+				t.Fatalf("Expected the delay after attempt %d within [0, %s], got %s", attempt, ceiling, delay)
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package risk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the content of a risk scoring file: the weight of every feature and the thresholds on the total.
+type Config struct {
+	Thresholds      Thresholds            `yaml:"thresholds" json:"thresholds"`
+	Velocity        VelocityConfig        `yaml:"velocity" json:"velocity"`
+	AmountDeviation AmountDeviationConfig `yaml:"amount_deviation" json:"amount_deviation"`
+	NewGateway      WeightConfig          `yaml:"new_gateway" json:"new_gateway"`
+	CountryMismatch WeightConfig          `yaml:"country_mismatch" json:"country_mismatch"`
+}
+
+// Thresholds turn a score into an outcome. Scores below Review are allowed, scores of at least Block are blocked.
+type Thresholds struct {
+	Review float64 `yaml:"review" json:"review"`
+	Block  float64 `yaml:"block" json:"block"`
+}
+
+func (t Thresholds) outcome(score float64) string {
+	switch {
+	case score >= t.Block:
+		return OutcomeBlock
+	case score >= t.Review:
+		return OutcomeReview
+	default:
+		return OutcomeAllow
+	}
+}
+
+// WeightConfig is the configuration of a yes or no feature, scoring its weight when it applies.
+type WeightConfig struct {
+	Weight float64 `yaml:"weight" json:"weight"`
+}
+
+// VelocityConfig scores the full weight at MaxCount transactions within Window, e.g. "10m".
+type VelocityConfig struct {
+	Weight   float64 `yaml:"weight" json:"weight"`
+	Window   string  `yaml:"window" json:"window"`
+	MaxCount int     `yaml:"max_count" json:"max_count"`
+
+	window time.Duration
+}
+
+// AmountDeviationConfig compares the amount with the user's last History transactions, if they have at least
+// MinHistory, and scores the full weight at MaxDeviation standard deviations above their mean.
+type AmountDeviationConfig struct {
+	Weight       float64 `yaml:"weight" json:"weight"`
+	History      int     `yaml:"history" json:"history"`
+	MinHistory   int     `yaml:"min_history" json:"min_history"`
+	MaxDeviation float64 `yaml:"max_deviation" json:"max_deviation"`
+}
+
+// DefaultConfig is used when no risk scoring file is given. The weights add up to 100.
+func DefaultConfig() *Config {
+	return &Config{
+		Thresholds:      Thresholds{Review: 50, Block: 80},
+		Velocity:        VelocityConfig{Weight: 30, Window: "10m", MaxCount: 5},
+		AmountDeviation: AmountDeviationConfig{Weight: 30, History: 20, MinHistory: 3, MaxDeviation: 4},
+		NewGateway:      WeightConfig{Weight: 15},
+		CountryMismatch: WeightConfig{Weight: 25},
+	}
+}
+
+// LoadConfig reads a risk scoring file, as JSON when it ends in .json and as YAML otherwise.
+// Without a path the defaults are used. Unknown fields are errors, like in the compliance rules.
+func LoadConfig(path string) (*Config, error) {
+	if path == "" {
+		return DefaultConfig(), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read risk scoring config: %v", err)
+	}
+
+	cfg := &Config{}
+	if filepath.Ext(path) == ".json" {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(cfg)
+	} else {
+		err = yaml.UnmarshalStrict(data, cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse risk scoring config %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks the config. The scorer is only built with a valid config.
+func (c *Config) Validate() error {
+	if c.Thresholds.Review <= 0 || c.Thresholds.Block < c.Thresholds.Review {
+		return fmt.Errorf("thresholds: review has to be positive and block at least review")
+	}
+	weights := map[string]float64{
+		FeatureVelocity:        c.Velocity.Weight,
+		FeatureAmountDeviation: c.AmountDeviation.Weight,
+		FeatureNewGateway:      c.NewGateway.Weight,
+		FeatureCountryMismatch: c.CountryMismatch.Weight,
+	}
+	for feature, weight := range weights {
+		if weight < 0 {
+			return fmt.Errorf("%s: weight can't be negative", feature)
+		}
+	}
+
+	window, err := time.ParseDuration(c.Velocity.Window)
+	if err != nil || window <= 0 {
+		return fmt.Errorf("%s: invalid window %q", FeatureVelocity, c.Velocity.Window)
+	}
+	if c.Velocity.MaxCount <= 0 {
+		return fmt.Errorf("%s: max_count has to be positive", FeatureVelocity)
+	}
+	c.Velocity.window = window
+
+	if c.AmountDeviation.History <= 0 || c.AmountDeviation.MinHistory <= 0 || c.AmountDeviation.MinHistory > c.AmountDeviation.History {
+		return fmt.Errorf("%s: history and min_history have to be positive, min_history at most history", FeatureAmountDeviation)
+	}
+	if c.AmountDeviation.MaxDeviation <= 0 {
+		return fmt.Errorf("%s: max_deviation has to be positive", FeatureAmountDeviation)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package risk
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"payment-gateway/internal/models"
+)
+
+// Outcomes of an assessment, from the least to the most strict.
+const (
+	OutcomeAllow  = "allow"
+	OutcomeReview = "review"
+	OutcomeBlock  = "block"
+)
+
+// Names of the features of the feature scorer.
+const (
+	FeatureVelocity        = "velocity"
+	FeatureAmountDeviation = "amount_deviation"
+	FeatureNewGateway      = "new_gateway"
+	FeatureCountryMismatch = "country_mismatch"
+)
+
+// Request is the transaction to score, before it is created.
+type Request struct {
+	UserID          int
+	CountryID       int
+	GatewayID       int
+	TransactionType string
+	Amount          models.Money
+}
+
+// Feature is what one feature measured and how much it added to the score.
+type Feature struct {
+	Name string `json:"name"`
+	// Value is what was measured, e.g. the number of recent transactions. 1 or 0 for yes or no features.
+	Value  float64 `json:"value"`
+	Score  float64 `json:"score"`
+	Detail string  `json:"detail,omitempty"`
+}
+
+// Assessment is the risk score of one transaction and the features it is made of. It is stored with the transaction.
+type Assessment struct {
+	ID            int64
+	TransactionID int
+	Score         float64
+	Outcome       string
+	Features      []Feature
+	CreatedAt     time.Time
+}
+
+// Reason describes the score and the features that contributed to it.
+func (a *Assessment) Reason() string {
+	var contributing []string
+	for _, feature := range a.Features {
+		if feature.Score > 0 {
+			contributing = append(contributing, fmt.Sprintf("%s %.2f", feature.Name, feature.Score))
+		}
+	}
+	if len(contributing) == 0 {
+		return fmt.Sprintf("risk score %.2f", a.Score)
+	}
+	return fmt.Sprintf("risk score %.2f (%s)", a.Score, strings.Join(contributing, ", "))
+}
+
+// Scorer scores the risk of a transaction before it is sent to the gateway.
+type Scorer interface {
+	Score(ctx context.Context, req *Request) (*Assessment, error)
+}
+
+// History is where the feature scorer gets what it knows about the user from.
+type History interface {
+	// CountRecent counts the user's transactions created since the given time, whatever their status.
+	CountRecent(ctx context.Context, userID int, since time.Time) (int, error)
+
+	// RecentAmounts returns the amounts of the user's latest completed transactions of the type in the currency, newest first.
+	RecentAmounts(ctx context.Context, userID int, transactionType string, currency string, limit int) ([]int64, error)
+
+	// UsedGateway reports whether the user has completed a transaction through the gateway before.
+	UsedGateway(ctx context.Context, userID int, gatewayID int) (bool, error)
+
+	// UserCountry returns the country of the user, ok is false when it isn't known.
+	UserCountry(ctx context.Context, userID int) (countryID int, ok bool, err error)
+}
+
+// FeatureScorer adds up the scores of a few features of the transaction and the user's history.
+// Every feature adds at most its weight, so the score goes from 0 to the sum of the weights.
+type FeatureScorer struct {
+	cfg     *Config
+	history History
+	now     func() time.Time
+}
+
+// NewFeatureScorer validates the config and builds a scorer with it.
+func NewFeatureScorer(cfg *Config, history History) (*FeatureScorer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("risk scoring config: %v", err)
+	}
+	return &FeatureScorer{cfg: cfg, history: history, now: time.Now}, nil
+}
+
+func (s *FeatureScorer) Score(ctx context.Context, req *Request) (*Assessment, error) {
+	features := []func(context.Context, *Request) (Feature, error){
+		s.velocity,
+		s.amountDeviation,
+		s.newGateway,
+		s.countryMismatch,
+	}
+
+	assessment := &Assessment{Features: make([]Feature, 0, len(features))}
+	for _, feature := range features {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		result, err := feature(ctx, req)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", result.Name, err)
+		}
+		result.Score = round(result.Score)
+		assessment.Features = append(assessment.Features, result)
+		assessment.Score += result.Score
+	}
+	assessment.Score = round(assessment.Score)
+	assessment.Outcome = s.cfg.Thresholds.outcome(assessment.Score)
+	return assessment, nil
+}
+
+// velocity scores the number of transactions of the user within the window, the full weight at MaxCount.
+func (s *FeatureScorer) velocity(ctx context.Context, req *Request) (Feature, error) {
+	cfg := s.cfg.Velocity
+	feature := Feature{Name: FeatureVelocity}
+	count, err := s.history.CountRecent(ctx, req.UserID, s.now().Add(-cfg.window))
+	if err != nil {
+		return feature, err
+	}
+	feature.Value = float64(count)
+	feature.Score = cfg.Weight * math.Min(float64(count)/float64(cfg.MaxCount), 1)
+	feature.Detail = fmt.Sprintf("%d transactions within %s", count, cfg.window)
+	return feature, nil
+}
+
+// amountDeviation scores how far the amount is above what the user usually moves, in standard deviations
+// of their latest amounts. The full weight is reached at MaxDeviation. Amounts below the usual don't count.
+func (s *FeatureScorer) amountDeviation(ctx context.Context, req *Request) (Feature, error) {
+	cfg := s.cfg.AmountDeviation
+	feature := Feature{Name: FeatureAmountDeviation}
+	amounts, err := s.history.RecentAmounts(ctx, req.UserID, req.TransactionType, req.Amount.Currency, cfg.History)
+	if err != nil {
+		return feature, err
+	}
+	if len(amounts) < cfg.MinHistory {
+		// Too few transactions to know what is usual. New users are scored by the other features.
+		feature.Detail = fmt.Sprintf("%d previous transactions, not enough to compare", len(amounts))
+		return feature, nil
+	}
+
+	var mean, variance float64
+	for _, amount := range amounts {
+		mean += float64(amount)
+	}
+	mean /= float64(len(amounts))
+	for _, amount := range amounts {
+		variance += (float64(amount) - mean) * (float64(amount) - mean)
+	}
+	// A user who always moves the same amount has no deviation at all, a tenth of the mean
+	// keeps a slightly larger amount from scoring as if it were far off.
+	spread := math.Max(math.Sqrt(variance/float64(len(amounts))), mean/10)
+	if spread == 0 {
+		spread = 1
+	}
+
+	deviation := (float64(req.Amount.Minor) - mean) / spread
+	feature.Value = round(deviation)
+	feature.Score = cfg.Weight * math.Min(math.Max(deviation/cfg.MaxDeviation, 0), 1)
+	feature.Detail = fmt.Sprintf("%.2f standard deviations from the mean of %d transactions", deviation, len(amounts))
+	return feature, nil
+}
+
+// newGateway scores the full weight when the user has never completed a transaction through the gateway.
+func (s *FeatureScorer) newGateway(ctx context.Context, req *Request) (Feature, error) {
+	feature := Feature{Name: FeatureNewGateway}
+	used, err := s.history.UsedGateway(ctx, req.UserID, req.GatewayID)
+	if err != nil {
+		return feature, err
+	}
+	if !used {
+		feature.Value = 1
+		feature.Score = s.cfg.NewGateway.Weight
+		feature.Detail = fmt.Sprintf("first transaction through gateway %d", req.GatewayID)
+	}
+	return feature, nil
+}
+
+// countryMismatch scores the full weight when the transaction isn't in the user's country.
+func (s *FeatureScorer) countryMismatch(ctx context.Context, req *Request) (Feature, error) {
+	feature := Feature{Name: FeatureCountryMismatch}
+	country, ok, err := s.history.UserCountry(ctx, req.UserID)
+	if err != nil {
+		return feature, err
+	}
+	if !ok {
+		feature.Detail = "country of the user is not known"
+		return feature, nil
+	}
+	if country != req.CountryID {
+		feature.Value = 1
+		feature.Score = s.cfg.CountryMismatch.Weight
+		feature.Detail = fmt.Sprintf("user is from country %d, transaction is in %d", country, req.CountryID)
+	}
+	return feature, nil
+}
+
+func round(score float64) float64 {
+	return math.Round(score*100) / 100
+}
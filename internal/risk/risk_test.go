@@ -0,0 +1,178 @@
+package risk
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"payment-gateway/internal/models"
+)
+
+type mockHistory struct {
+	recent   int
+	since    time.Time
+	amounts  []int64
+	gateways map[int]bool
+	country  int
+	err      error
+}
+
+func (m *mockHistory) CountRecent(ctx context.Context, userID int, since time.Time) (int, error) {
+	m.since = since
+	return m.recent, m.err
+}
+
+func (m *mockHistory) RecentAmounts(ctx context.Context, userID int, transactionType string, currency string, limit int) ([]int64, error) {
+	if len(m.amounts) > limit {
+		return m.amounts[:limit], nil
+	}
+	return m.amounts, nil
+}
+
+func (m *mockHistory) UsedGateway(ctx context.Context, userID int, gatewayID int) (bool, error) {
+	return m.gateways[gatewayID], nil
+}
+
+func (m *mockHistory) UserCountry(ctx context.Context, userID int) (int, bool, error) {
+	return m.country, m.country != 0, nil
+}
+
+func withdrawal(amount int64) *Request {
+	return &Request{UserID: 1, CountryID: 840, GatewayID: 1, TransactionType: "withdraw", Amount: models.Money{Minor: amount, Currency: "USD"}}
+}
+
+func newScorer(t *testing.T, history History) *FeatureScorer {
+	scorer, err := NewFeatureScorer(DefaultConfig(), history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return scorer
+}
+
+func scores(assessment *Assessment) map[string]float64 {
+	scores := make(map[string]float64)
+	for _, feature := range assessment.Features {
+		scores[feature.Name] = feature.Score
+	}
+	return scores
+}
+
+func TestFeatureScorer_UsualTransactionIsAllowed(t *testing.T) {
+	history := &mockHistory{
+		recent:   1,
+		amounts:  []int64{10000, 12000, 9000, 11000},
+		gateways: map[int]bool{1: true},
+		country:  840,
+	}
+	now := time.Now()
+	scorer := newScorer(t, history)
+	scorer.now = func() time.Time { return now }
+
+	assessment, err := scorer.Score(context.Background(), withdrawal(10500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assessment.Outcome != OutcomeAllow || assessment.Score != 6 {
+		t.Errorf("Expected an allowed score of 6 from velocity only, got %.2f %s: %+v", assessment.Score, assessment.Outcome, assessment.Features)
+	}
+	if len(assessment.Features) != 4 {
+		t.Errorf("Expected every feature to be recorded, got %+v", assessment.Features)
+	}
+	if !history.since.Equal(now.Add(-10 * time.Minute)) {
+		t.Errorf("Expected transactions of the last 10 minutes to be counted, counted since %v", history.since)
+	}
+}
+
+func TestFeatureScorer_Features(t *testing.T) {
+	tests := []struct {
+		name    string
+		history *mockHistory
+		amount  int64
+		feature string
+		score   float64
+	}{
+		{"velocity at max count", &mockHistory{recent: 7}, 100, FeatureVelocity, 30},
+		{"velocity below max count", &mockHistory{recent: 2}, 100, FeatureVelocity, 12},
+		{"amount far above the mean", &mockHistory{amounts: []int64{1000, 1000, 1000}}, 10000, FeatureAmountDeviation, 30},
+		{"amount two deviations above the mean", &mockHistory{amounts: []int64{800, 1000, 1200}}, 1327, FeatureAmountDeviation, 15.02},
+		{"amount below the mean", &mockHistory{amounts: []int64{1000, 1000, 1000}}, 10, FeatureAmountDeviation, 0},
+		{"not enough history", &mockHistory{amounts: []int64{1000, 1000}}, 100000, FeatureAmountDeviation, 0},
+		{"new gateway", &mockHistory{gateways: map[int]bool{2: true}}, 100, FeatureNewGateway, 15},
+		{"known gateway", &mockHistory{gateways: map[int]bool{1: true}}, 100, FeatureNewGateway, 0},
+		{"other country", &mockHistory{country: 392}, 100, FeatureCountryMismatch, 25},
+		{"same country", &mockHistory{country: 840}, 100, FeatureCountryMismatch, 0},
+		{"unknown country", &mockHistory{}, 100, FeatureCountryMismatch, 0},
+	}
+	for _, tt := range tests {
+		assessment, err := newScorer(t, tt.history).Score(context.Background(), withdrawal(tt.amount))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if score := scores(assessment)[tt.feature]; score != tt.score {
+			t.Errorf("%s: expected %s to score %.2f, got %.2f", tt.name, tt.feature, tt.score, score)
+		}
+	}
+}
+
+func TestFeatureScorer_Thresholds(t *testing.T) {
+	// A burst of transactions on a new gateway from abroad, 30 + 15 + 25, goes to review.
+	history := &mockHistory{recent: 5, country: 392}
+	assessment, err := newScorer(t, history).Score(context.Background(), withdrawal(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assessment.Score != 70 || assessment.Outcome != OutcomeReview {
+		t.Errorf("Expected 70 to go to review, got %.2f %s", assessment.Score, assessment.Outcome)
+	}
+	if reason := assessment.Reason(); reason != "risk score 70.00 (velocity 30.00, new_gateway 15.00, country_mismatch 25.00)" {
+		t.Errorf("Unexpected reason %q", reason)
+	}
+
+	history.amounts = []int64{100, 100, 100}
+	assessment, _ = newScorer(t, history).Score(context.Background(), withdrawal(10000))
+	if assessment.Score != 100 || assessment.Outcome != OutcomeBlock {
+		t.Errorf("Expected 100 to be blocked, got %.2f %s", assessment.Score, assessment.Outcome)
+	}
+}
+
+func TestFeatureScorer_HistoryError(t *testing.T) {
+	history := &mockHistory{err: errors.New("connection refused")}
+	if _, err := newScorer(t, history).Score(context.Background(), withdrawal(100)); err == nil || !strings.HasPrefix(err.Error(), FeatureVelocity) {
+		t.Errorf("Expected the failing feature in the error, got %v", err)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := map[string]func(*Config){
+		"block below review":      func(c *Config) { c.Thresholds.Block = 40 },
+		"no review threshold":     func(c *Config) { c.Thresholds.Review = 0 },
+		"negative weight":         func(c *Config) { c.NewGateway.Weight = -1 },
+		"invalid window":          func(c *Config) { c.Velocity.Window = "soon" },
+		"no max count":            func(c *Config) { c.Velocity.MaxCount = 0 },
+		"min history above limit": func(c *Config) { c.AmountDeviation.MinHistory = 30 },
+		"no max deviation":        func(c *Config) { c.AmountDeviation.MaxDeviation = 0 },
+	}
+	for name, change := range tests {
+		cfg := DefaultConfig()
+		change(cfg)
+		if _, err := NewFeatureScorer(cfg, &mockHistory{}); err == nil {
+			t.Errorf("%s: expected the config to be rejected", name)
+		}
+	}
+}
+
+func TestLoadConfig_ShippedConfig(t *testing.T) {
+	cfg, err := LoadConfig("../../config/risk.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Expected the shipped config to be valid, got %v", err)
+	}
+
+	if cfg, err := LoadConfig(""); err != nil || cfg.Thresholds != DefaultConfig().Thresholds {
+		t.Errorf("Expected the defaults without a file, got %+v, %v", cfg, err)
+	}
+}
@@ -0,0 +1,280 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"payment-gateway/internal/models"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Reasons a gateway can't take a transaction that a fallback policy can act on. An unknown gateway is
+// always an error of the request and never falls back.
+const (
+	ReasonGatewayDisabled     = "gateway_disabled"
+	ReasonGatewayNotAvailable = "gateway_not_available"
+)
+
+// Config is the content of a routing file: where transactions go when their gateway can't take them, and
+// how the gateway is picked for transactions that don't ask for one.
+type Config struct {
+	// Fallback is the policy of merchants without one of their own, and of users without a merchant.
+	Fallback FallbackPolicy `yaml:"fallback" json:"fallback"`
+	// Merchants are the policies of single merchants, by the merchant id of the user's token.
+	Merchants map[string]MerchantConfig `yaml:"merchants" json:"merchants"`
+	// Smart picks the gateway of the transactions without a gateway_id, when it is enabled.
+	Smart SmartConfig `yaml:"smart" json:"smart"`
+}
+
+// SmartConfig scores the gateways of the country on their fees, their authorization success rate and their
+// p95 latency, and picks the best one. The weights say how much each of them counts.
+type SmartConfig struct {
+	Enabled bool    `yaml:"enabled" json:"enabled"`
+	Weights Weights `yaml:"weights" json:"weights"`
+	// Fees are the fee schedules by gateway name. A gateway without one scores nothing on cost.
+	Fees map[string]FeeSchedule `yaml:"fees" json:"fees"`
+	// Window is how far back the success rate and latency go, e.g. "1h".
+	Window string `yaml:"window" json:"window"`
+	// MinSamples is how many transaction outcomes a gateway needs within the window to be scored on its success
+	// rate and latency. Until then it gets full marks on them, so a new gateway gets the transactions to be measured on.
+	MinSamples int `yaml:"min_samples" json:"min_samples"`
+	// Countries override the weights and fees in single countries, by country id.
+	Countries map[int]CountryConfig `yaml:"countries" json:"countries"`
+}
+
+// Weights of the parts of a gateway's score, only their ratios matter.
+type Weights struct {
+	Cost        float64 `yaml:"cost" json:"cost"`
+	SuccessRate float64 `yaml:"success_rate" json:"success_rate"`
+	Latency     float64 `yaml:"latency" json:"latency"`
+}
+
+func (w Weights) total() float64 {
+	return w.Cost + w.SuccessRate + w.Latency
+}
+
+// CountryConfig overrides the weights of a country, and the fee schedules of the gateways it lists.
+type CountryConfig struct {
+	Weights *Weights               `yaml:"weights" json:"weights"`
+	Fees    map[string]FeeSchedule `yaml:"fees" json:"fees"`
+}
+
+// FeeSchedule is what a gateway charges for a transaction: a percentage of the amount plus a fixed fee.
+type FeeSchedule struct {
+	// Percent of the amount, e.g. 2.9.
+	Percent float64 `yaml:"percent" json:"percent"`
+	// Fixed fee per transaction in minor units, by currency. None in currencies it doesn't list.
+	Fixed map[string]int64 `yaml:"fixed" json:"fixed"`
+}
+
+// Fee is the fee of the amount in minor units of its currency, rounded to the nearest unit.
+func (f FeeSchedule) Fee(amount models.Money) int64 {
+	return int64(math.Round(float64(amount.Minor)*f.Percent/100)) + f.Fixed[amount.Currency]
+}
+
+func (f FeeSchedule) validate() error {
+	if f.Percent < 0 {
+		return fmt.Errorf("percent can't be negative")
+	}
+	for currency, fixed := range f.Fixed {
+		if fixed < 0 {
+			return fmt.Errorf("fixed fee in %s can't be negative", currency)
+		}
+	}
+	return nil
+}
+
+func (w Weights) validate() error {
+	if w.Cost < 0 || w.SuccessRate < 0 || w.Latency < 0 || w.total() <= 0 {
+		return fmt.Errorf("weights can't be negative and one of them has to be positive")
+	}
+	return nil
+}
+
+// weights returns the weights in the country.
+func (c *SmartConfig) weights(countryID int) Weights {
+	if country, ok := c.Countries[countryID]; ok && country.Weights != nil {
+		return *country.Weights
+	}
+	return c.Weights
+}
+
+// fees returns the fee schedule of the gateway in the country.
+func (c *SmartConfig) fees(countryID int, gateway string) (FeeSchedule, bool) {
+	if schedule, ok := c.Countries[countryID].Fees[gateway]; ok {
+		return schedule, true
+	}
+	schedule, ok := c.Fees[gateway]
+	return schedule, ok
+}
+
+func (c *SmartConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if err := c.Weights.validate(); err != nil {
+		return err
+	}
+	if window, err := time.ParseDuration(c.Window); err != nil || window <= 0 {
+		return fmt.Errorf("invalid window %q", c.Window)
+	}
+	if c.MinSamples < 0 {
+		return fmt.Errorf("min_samples can't be negative")
+	}
+	for gateway, schedule := range c.Fees {
+		if err := schedule.validate(); err != nil {
+			return fmt.Errorf("fees %s: %v", gateway, err)
+		}
+	}
+	for countryID, country := range c.Countries {
+		if country.Weights != nil {
+			if err := country.Weights.validate(); err != nil {
+				return fmt.Errorf("countries %d: %v", countryID, err)
+			}
+		}
+		for gateway, schedule := range country.Fees {
+			if err := schedule.validate(); err != nil {
+				return fmt.Errorf("countries %d: fees %s: %v", countryID, gateway, err)
+			}
+		}
+	}
+	return nil
+}
+
+// FeeGateways returns every gateway with a fee schedule.
+func (c *SmartConfig) FeeGateways() []string {
+	var names []string
+	for name := range c.Fees {
+		names = append(names, name)
+	}
+	for _, country := range c.Countries {
+		for name := range country.Fees {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// MerchantConfig is the routing of one merchant, what it leaves out is taken from the top of the file.
+type MerchantConfig struct {
+	Fallback *FallbackPolicy `yaml:"fallback" json:"fallback"`
+}
+
+// FallbackPolicy sends a transaction to another gateway of the country when the one the user asked for is
+// disabled or not available in the country. Without gateways the transaction fails with the reason.
+type FallbackPolicy struct {
+	// Gateways are tried in this order, by name. Only the enabled gateways of the country that settle the
+	// currency are taken.
+	Gateways []string `yaml:"gateways" json:"gateways"`
+	// On are the reasons to fall back for, all of them when empty.
+	On []string `yaml:"on" json:"on"`
+}
+
+// Allows is true when the policy falls back for the reason.
+func (p FallbackPolicy) Allows(reason string) bool {
+	if len(p.Gateways) == 0 {
+		return false
+	}
+	if len(p.On) == 0 {
+		return true
+	}
+	for _, on := range p.On {
+		if on == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// FallbackFor returns the fallback policy of the merchant.
+func (c *Config) FallbackFor(merchantID string) FallbackPolicy {
+	if merchant, ok := c.Merchants[merchantID]; ok && merchantID != "" && merchant.Fallback != nil {
+		return *merchant.Fallback
+	}
+	return c.Fallback
+}
+
+// DefaultConfig is used when no routing file is given: transactions never fall back.
+func DefaultConfig() *Config {
+	return &Config{}
+}
+
+// LoadConfig reads a routing file, as JSON when it ends in .json and as YAML otherwise.
+// Without a path the defaults are used. Unknown fields are errors, like in the compliance rules.
+func LoadConfig(path string) (*Config, error) {
+	if path == "" {
+		return DefaultConfig(), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routing config: %v", err)
+	}
+
+	cfg := &Config{}
+	if filepath.Ext(path) == ".json" {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(cfg)
+	} else {
+		err = yaml.UnmarshalStrict(data, cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse routing config %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks the config. The gateway names are checked against the gateways table by the caller.
+func (c *Config) Validate() error {
+	if err := c.Fallback.validate(); err != nil {
+		return fmt.Errorf("fallback: %v", err)
+	}
+	for merchantID, merchant := range c.Merchants {
+		if merchantID == "" {
+			return fmt.Errorf("merchants: empty merchant id")
+		}
+		if merchant.Fallback == nil {
+			continue
+		}
+		if err := merchant.Fallback.validate(); err != nil {
+			return fmt.Errorf("merchants %s: fallback: %v", merchantID, err)
+		}
+	}
+	if err := c.Smart.validate(); err != nil {
+		return fmt.Errorf("smart: %v", err)
+	}
+	return nil
+}
+
+// GatewayNames returns every gateway named in the config.
+func (c *Config) GatewayNames() []string {
+	names := append([]string(nil), c.Fallback.Gateways...)
+	for _, merchant := range c.Merchants {
+		if merchant.Fallback != nil {
+			names = append(names, merchant.Fallback.Gateways...)
+		}
+	}
+	return names
+}
+
+func (p FallbackPolicy) validate() error {
+	seen := make(map[string]bool)
+	for _, name := range p.Gateways {
+		if name == "" || seen[name] {
+			return fmt.Errorf("gateways have to be named once each, got %q", p.Gateways)
+		}
+		seen[name] = true
+	}
+	for _, on := range p.On {
+		if on != ReasonGatewayDisabled && on != ReasonGatewayNotAvailable {
+			return fmt.Errorf("unknown reason %q", on)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package routing
+
+import (
+	"testing"
+)
+
+func TestConfig_FallbackFor(t *testing.T) {
+	cfg := &Config{
+		Fallback: FallbackPolicy{Gateways: []string{"stripe"}, On: []string{ReasonGatewayNotAvailable}},
+		Merchants: map[string]MerchantConfig{
+			"shop-1": {Fallback: &FallbackPolicy{Gateways: []string{"paypal", "stripe"}}},
+			"shop-2": {},
+		},
+	}
+
+	tests := []struct {
+		merchant string
+		reason   string
+		allows   bool
+	}{
+		{"shop-1", ReasonGatewayDisabled, true},
+		{"shop-1", ReasonGatewayNotAvailable, true},
+		{"shop-2", ReasonGatewayDisabled, false},
+		{"shop-2", ReasonGatewayNotAvailable, true},
+		{"", ReasonGatewayNotAvailable, true},
+	}
+	for _, tt := range tests {
+		if got := cfg.FallbackFor(tt.merchant).Allows(tt.reason); got != tt.allows {
+			t.Errorf("%q on %s: expected %v, got %v", tt.merchant, tt.reason, tt.allows, got)
+		}
+	}
+	if got := cfg.FallbackFor("shop-1").Gateways; len(got) != 2 || got[0] != "paypal" {
+		t.Errorf("Expected the merchant's own gateways, got %v", got)
+	}
+	if DefaultConfig().FallbackFor("shop-1").Allows(ReasonGatewayDisabled) {
+		t.Error("Expected no fallback by default")
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := map[string]*Config{
+		"unknown reason":    {Fallback: FallbackPolicy{Gateways: []string{"stripe"}, On: []string{"gateway_slow"}}},
+		"gateway twice":     {Fallback: FallbackPolicy{Gateways: []string{"stripe", "stripe"}}},
+		"empty gateway":     {Merchants: map[string]MerchantConfig{"shop-1": {Fallback: &FallbackPolicy{Gateways: []string{""}}}}},
+		"empty merchant id": {Merchants: map[string]MerchantConfig{"": {}}},
+		"no weights":        {Smart: SmartConfig{Enabled: true, Window: "1h"}},
+		"invalid window":    {Smart: SmartConfig{Enabled: true, Weights: Weights{Cost: 1}, Window: "an hour"}},
+		"negative fee":      {Smart: SmartConfig{Enabled: true, Weights: Weights{Cost: 1}, Window: "1h", Fees: map[string]FeeSchedule{"stripe": {Percent: -1}}}},
+	}
+	for name, cfg := range tests {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s: expected the config to be rejected", name)
+		}
+	}
+}
+
+func TestLoadConfig_ShippedConfig(t *testing.T) {
+	cfg, err := LoadConfig("../../config/routing.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Expected the shipped config to be valid, got %v", err)
+	}
+
+	if cfg, err := LoadConfig(""); err != nil || len(cfg.GatewayNames()) != 0 {
+		t.Errorf("Expected the defaults without a file, got %+v, %v", cfg, err)
+	}
+}
@@ -0,0 +1,149 @@
+package routing
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"payment-gateway/internal/models"
+)
+
+// ErrNoCandidate is returned when no gateway of the country can take the transaction.
+var ErrNoCandidate = errors.New("no gateway of the country can take the transaction")
+
+// Candidate is a gateway that can take the transaction: enabled for the country, settling the currency
+// and supporting the operation.
+type Candidate struct {
+	GatewayID int
+	Name      string
+}
+
+// Score is how a candidate scored. Every part is between 0 and 1, the best candidate gets 1 on it.
+type Score struct {
+	GatewayID int    `json:"gateway_id"`
+	Name      string `json:"name"`
+	// Fee in minor units of the currency, none when the gateway has no fee schedule.
+	Fee         *int64  `json:"fee,omitempty"`
+	SuccessRate float64 `json:"success_rate"`
+	P95Ms       int64   `json:"p95_ms"`
+	// Samples are the transactions the success rate was measured on.
+	Samples int     `json:"samples"`
+	Cost    float64 `json:"cost"`
+	Success float64 `json:"success"`
+	Latency float64 `json:"latency"`
+	Total   float64 `json:"total"`
+}
+
+// Decision is the gateway the router picked for a transaction and the scores of every candidate.
+// It is stored with the transaction.
+type Decision struct {
+	ID            int64
+	TransactionID int
+	CountryID     int
+	GatewayID     int
+	Weights       Weights
+	Scores        []Score
+	CreatedAt     time.Time
+}
+
+// Score returns the score of the gateway that was picked.
+func (d *Decision) Score() Score {
+	for _, score := range d.Scores {
+		if score.GatewayID == d.GatewayID {
+			return score
+		}
+	}
+	return Score{}
+}
+
+// Router picks the gateway of the transactions that don't ask for one, see SmartConfig.
+type Router struct {
+	cfg   SmartConfig
+	stats *Stats
+	now   func() time.Time
+}
+
+// NewRouter builds the router of a validated config.
+func NewRouter(cfg SmartConfig) *Router {
+	window, _ := time.ParseDuration(cfg.Window)
+	return &Router{cfg: cfg, stats: NewStats(window), now: time.Now}
+}
+
+// Observe records the final outcome of a transaction of the gateway, ok when it went through.
+func (r *Router) Observe(gatewayID int, ok bool) {
+	r.stats.RecordOutcome(gatewayID, ok)
+}
+
+// ObserveLatency records how long a call to the gateway took to be answered.
+func (r *Router) ObserveLatency(gatewayID int, latency time.Duration) {
+	r.stats.RecordLatency(gatewayID, latency)
+}
+
+// Route scores the candidates and picks the one with the highest total, the lowest gateway id on a tie.
+func (r *Router) Route(countryID int, amount models.Money, candidates []Candidate) (*Decision, error) {
+	if len(candidates) == 0 {
+		return nil, ErrNoCandidate
+	}
+	candidates = append([]Candidate(nil), candidates...)
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].GatewayID < candidates[j].GatewayID })
+
+	scores := make([]Score, len(candidates))
+	var minFee *int64
+	var minP95 time.Duration
+	for i, candidate := range candidates {
+		score := Score{GatewayID: candidate.GatewayID, Name: candidate.Name}
+		if schedule, ok := r.cfg.fees(countryID, candidate.Name); ok {
+			fee := schedule.Fee(amount)
+			score.Fee = &fee
+			if minFee == nil || fee < *minFee {
+				minFee = &fee
+			}
+		}
+		snapshot := r.stats.Snapshot(candidate.GatewayID)
+		score.Samples, score.SuccessRate, score.P95Ms = snapshot.Samples, snapshot.SuccessRate, snapshot.P95.Milliseconds()
+		if r.measured(snapshot) && (minP95 == 0 || snapshot.P95 < minP95) {
+			minP95 = snapshot.P95
+		}
+		scores[i] = score
+	}
+
+	weights := r.cfg.weights(countryID)
+	best := 0
+	for i := range scores {
+		score := &scores[i]
+		// A gateway without a fee schedule can't be compared on cost.
+		if score.Fee != nil {
+			score.Cost = ratio(*minFee, *score.Fee)
+		}
+		// Until a gateway has been measured it gets full marks, so it gets the calls to be measured on.
+		score.Success, score.Latency = 1, 1
+		if r.measured(Snapshot{Samples: score.Samples}) {
+			score.Success = score.SuccessRate
+			score.Latency = ratio(minP95.Milliseconds(), score.P95Ms)
+		}
+		score.Total = (weights.Cost*score.Cost + weights.SuccessRate*score.Success + weights.Latency*score.Latency) / weights.total()
+		if score.Total > scores[best].Total {
+			best = i
+		}
+	}
+
+	return &Decision{
+		CountryID: countryID,
+		GatewayID: scores[best].GatewayID,
+		Weights:   weights,
+		Scores:    scores,
+		CreatedAt: r.now(),
+	}, nil
+}
+
+func (r *Router) measured(snapshot Snapshot) bool {
+	return snapshot.Samples > 0 && snapshot.Samples >= r.cfg.MinSamples
+}
+
+// ratio is best/value, 1 when the value is as good as it gets.
+func ratio(best int64, value int64) float64 {
+	if value <= best {
+		return 1
+	}
+	return float64(best) / float64(value)
+}
@@ -0,0 +1,132 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"payment-gateway/internal/models"
+)
+
+func smartConfig() SmartConfig {
+	return SmartConfig{
+		Enabled: true,
+		Weights: Weights{Cost: 1, SuccessRate: 1, Latency: 1},
+		Fees: map[string]FeeSchedule{
+			"stripe": {Percent: 2.9, Fixed: map[string]int64{"USD": 30}},
+			"paypal": {Percent: 3.5},
+		},
+		Window:     "1h",
+		MinSamples: 2,
+	}
+}
+
+var usd = models.Money{Minor: 10000, Currency: "USD"}
+
+func TestRouter_PicksCheapestUntilMeasured(t *testing.T) {
+	router := NewRouter(smartConfig())
+
+	decision, err := router.Route(840, usd, []Candidate{{GatewayID: 2, Name: "paypal"}, {GatewayID: 1, Name: "stripe"}, {GatewayID: 3, Name: "acme"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stripe charges 320, paypal 350 and acme has no fee schedule.
+	if decision.GatewayID != 1 || len(decision.Scores) != 3 {
+		t.Fatalf("Expected stripe out of 3 candidates, got %d out of %d", decision.GatewayID, len(decision.Scores))
+	}
+	if score := decision.Score(); *score.Fee != 320 || score.Cost != 1 || score.Success != 1 || score.Latency != 1 {
+		t.Errorf("Expected full marks for stripe, got %+v", score)
+	}
+	if acme := decision.Scores[2]; acme.Fee != nil || acme.Cost != 0 {
+		t.Errorf("Expected no cost score without a fee schedule, got %+v", acme)
+	}
+
+	if _, err := router.Route(840, usd, nil); err != ErrNoCandidate {
+		t.Errorf("Expected ErrNoCandidate, got %v", err)
+	}
+}
+
+func TestRouter_ScoresSuccessRateAndLatency(t *testing.T) {
+	router := NewRouter(smartConfig())
+	for i := 0; i < 4; i++ {
+		router.Observe(1, i%2 == 0)
+		router.ObserveLatency(1, 800*time.Millisecond)
+		router.Observe(2, true)
+		router.ObserveLatency(2, 200*time.Millisecond)
+	}
+	router.Observe(3, true)
+	router.ObserveLatency(3, time.Millisecond)
+
+	decision, err := router.Route(840, usd, []Candidate{{GatewayID: 1, Name: "stripe"}, {GatewayID: 2, Name: "paypal"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripe, paypal := decision.Scores[0], decision.Scores[1]
+	if stripe.Success != 0.5 || stripe.Latency != 0.25 || stripe.P95Ms != 800 {
+		t.Errorf("Expected half the calls and a quarter of the speed for stripe, got %+v", stripe)
+	}
+	if paypal.Success != 1 || paypal.Latency != 1 {
+		t.Errorf("Expected full marks for paypal, got %+v", paypal)
+	}
+	if decision.GatewayID != 2 {
+		t.Errorf("Expected paypal to win on success rate and latency, got %d", decision.GatewayID)
+	}
+}
+
+func TestRouter_CountryOverrides(t *testing.T) {
+	cfg := smartConfig()
+	cfg.Weights = Weights{Cost: 1}
+	cfg.Countries = map[int]CountryConfig{
+		826: {Weights: &Weights{SuccessRate: 1}},
+		392: {Fees: map[string]FeeSchedule{"paypal": {Percent: 1}}},
+	}
+	router := NewRouter(cfg)
+	router.Observe(1, false)
+	router.Observe(1, false)
+	candidates := []Candidate{{GatewayID: 1, Name: "stripe"}, {GatewayID: 2, Name: "paypal"}}
+
+	tests := []struct {
+		countryID int
+		gatewayID int
+	}{
+		{840, 1}, // only the cost counts, stripe is cheaper
+		{826, 2}, // only the success rate counts, stripe's calls failed
+		{392, 2}, // only the cost counts, paypal is cheaper in Japan
+	}
+	for _, tt := range tests {
+		decision, err := router.Route(tt.countryID, usd, candidates)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decision.GatewayID != tt.gatewayID {
+			t.Errorf("country %d: expected gateway %d, got %d (%+v)", tt.countryID, tt.gatewayID, decision.GatewayID, decision.Scores)
+		}
+	}
+}
+
+func TestStats_Window(t *testing.T) {
+	now := time.Now()
+	stats := NewStats(time.Hour)
+	stats.now = func() time.Time { return now }
+
+	stats.RecordOutcome(1, false)
+	stats.RecordLatency(1, 5*time.Second)
+	now = now.Add(2 * time.Hour)
+	for i := 1; i <= 20; i++ {
+		stats.RecordOutcome(1, i != 20)
+		stats.RecordLatency(1, time.Duration(i)*time.Millisecond)
+	}
+
+	snapshot := stats.Snapshot(1)
+	if snapshot.Samples != 20 || snapshot.SuccessRate != 0.95 || snapshot.P95 != 19*time.Millisecond {
+		t.Errorf("Expected the old outcome and call to be left out, got %+v", snapshot)
+	}
+
+	// Calls still waiting for their outcome have a latency, but no success rate yet.
+	stats.RecordLatency(2, time.Second)
+	if snapshot := stats.Snapshot(2); snapshot.Samples != 0 || snapshot.P95 != time.Second {
+		t.Errorf("Expected only the latency of the pending call, got %+v", snapshot)
+	}
+	if snapshot := stats.Snapshot(3); snapshot.Samples != 0 || snapshot.P95 != 0 {
+		t.Errorf("Expected nothing for a gateway without calls, got %+v", snapshot)
+	}
+}
@@ -0,0 +1,101 @@
+package routing
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxSamples bounds the outcomes and latencies kept per gateway, the oldest ones go first.
+const maxSamples = 1000
+
+// Stats keeps the outcome of the recent transactions of every gateway, and the latency of the recent calls to it,
+// as the service measured them. They are kept in memory, every instance measures what it saw itself.
+type Stats struct {
+	mu        sync.Mutex
+	window    time.Duration
+	outcomes  map[int][]sample
+	latencies map[int][]sample
+	now       func() time.Time
+}
+
+type sample struct {
+	at      time.Time
+	ok      bool
+	latency time.Duration
+}
+
+// Snapshot is what the transactions of a gateway and the calls to it within the window add up to.
+type Snapshot struct {
+	// Samples are the outcomes the success rate was measured on.
+	Samples     int
+	SuccessRate float64
+	P95         time.Duration
+}
+
+func NewStats(window time.Duration) *Stats {
+	return &Stats{window: window, outcomes: make(map[int][]sample), latencies: make(map[int][]sample), now: time.Now}
+}
+
+// RecordOutcome adds the final outcome of a transaction of the gateway, ok when it went through.
+func (s *Stats) RecordOutcome(gatewayID int, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record(s.outcomes, gatewayID, sample{at: s.now(), ok: ok})
+}
+
+// RecordLatency adds how long a call to the gateway took to be answered.
+func (s *Stats) RecordLatency(gatewayID int, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record(s.latencies, gatewayID, sample{at: s.now(), latency: latency})
+}
+
+// Snapshot returns the success rate and p95 latency of the gateway within the window.
+func (s *Stats) Snapshot(gatewayID int) Snapshot {
+	s.mu.Lock()
+	outcomes := s.prune(s.outcomes, gatewayID)
+	succeeded := 0
+	for _, sample := range outcomes {
+		if sample.ok {
+			succeeded++
+		}
+	}
+	calls := s.prune(s.latencies, gatewayID)
+	latencies := make([]time.Duration, len(calls))
+	for i, sample := range calls {
+		latencies[i] = sample.latency
+	}
+	s.mu.Unlock()
+
+	var snapshot Snapshot
+	if len(outcomes) > 0 {
+		snapshot.Samples = len(outcomes)
+		snapshot.SuccessRate = float64(succeeded) / float64(len(outcomes))
+	}
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		snapshot.P95 = latencies[int(math.Ceil(0.95*float64(len(latencies))))-1]
+	}
+	return snapshot
+}
+
+// record appends a sample of the gateway, within maxSamples. The caller holds the lock.
+func (s *Stats) record(samples map[int][]sample, gatewayID int, sample sample) {
+	kept := append(s.prune(samples, gatewayID), sample)
+	if len(kept) > maxSamples {
+		kept = kept[len(kept)-maxSamples:]
+	}
+	samples[gatewayID] = kept
+}
+
+// prune drops the samples of the gateway that fell out of the window. The caller holds the lock.
+func (s *Stats) prune(samples map[int][]sample, gatewayID int) []sample {
+	kept := samples[gatewayID]
+	since := s.now().Add(-s.window)
+	i := sort.Search(len(kept), func(i int) bool { return kept[i].at.After(since) })
+	kept = kept[i:]
+	samples[gatewayID] = kept
+	return kept
+}
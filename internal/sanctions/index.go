@@ -0,0 +1,217 @@
+package sanctions
+
+import (
+	"sort"
+
+	"payment-gateway/internal/compliance"
+)
+
+// indexedName is one name of an entry, the primary name or an alias.
+type indexedName struct {
+	entry  *Entry
+	text   string
+	tokens []string
+}
+
+// Index finds the entries whose names are close to a name. Names are compared token by token,
+// so the order of first and last name doesn't matter and small spelling differences cost little.
+type Index struct {
+	names []indexedName
+	// trigrams maps every trigram of every token to the names it appears in.
+	trigrams map[string][]int
+}
+
+func NewIndex(entries []*Entry) *Index {
+	index := &Index{trigrams: make(map[string][]int)}
+	for _, entry := range entries {
+		for _, name := range entry.Names {
+			tokens := normalize(name)
+			if len(tokens) == 0 {
+				continue
+			}
+			id := len(index.names)
+			index.names = append(index.names, indexedName{entry: entry, text: name, tokens: tokens})
+			for _, trigram := range trigramSet(tokens) {
+				index.trigrams[trigram] = append(index.trigrams[trigram], id)
+			}
+		}
+	}
+	return index
+}
+
+// Search returns the entries with a name scoring at least threshold against name, best first.
+// An entry is only returned once, with its best scoring name.
+func (ix *Index) Search(name string, threshold float64) []compliance.Match {
+	tokens := normalize(name)
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	// Only names sharing enough trigrams with the query are scored. A name this far off
+	// can't reach any threshold worth screening with.
+	query := trigramSet(tokens)
+	shared := make(map[int]int)
+	for _, trigram := range query {
+		for _, id := range ix.trigrams[trigram] {
+			shared[id]++
+		}
+	}
+	minShared := len(query) / 3
+	if minShared < 1 {
+		minShared = 1
+	}
+
+	best := make(map[*Entry]compliance.Match)
+	for id, count := range shared {
+		if count < minShared {
+			continue
+		}
+		candidate := ix.names[id]
+		score := similarity(tokens, candidate.tokens)
+		if score < threshold {
+			continue
+		}
+		if match, ok := best[candidate.entry]; !ok || score > match.Score {
+			best[candidate.entry] = compliance.Match{
+				List:  candidate.entry.List,
+				Ref:   candidate.entry.Ref,
+				Name:  candidate.text,
+				Score: score,
+			}
+		}
+	}
+
+	matches := make([]compliance.Match, 0, len(best))
+	for _, match := range best {
+		matches = append(matches, match)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].List+matches[i].Ref < matches[j].List+matches[j].Ref
+	})
+	return matches
+}
+
+// trigramSet returns the distinct trigrams of the tokens, padded so short tokens have some too.
+func trigramSet(tokens []string) []string {
+	seen := make(map[string]bool)
+	var trigrams []string
+	for _, token := range tokens {
+		padded := "$" + token + "$"
+		for i := 0; i+3 <= len(padded); i++ {
+			trigram := padded[i : i+3]
+			if !seen[trigram] {
+				seen[trigram] = true
+				trigrams = append(trigrams, trigram)
+			}
+		}
+	}
+	return trigrams
+}
+
+// similarity scores two tokenized names from 0 to 1. Every token is matched with its closest token
+// in the other name, and the scores are averaged over the tokens of both names, so an extra token
+// on either side lowers the score. Names written as one word on one side ("abdulrahman") and two
+// on the other ("abdul rahman") are also compared with the two words joined.
+func similarity(a, b []string) float64 {
+	var best float64
+	for _, va := range joinedVariants(a) {
+		for _, vb := range joinedVariants(b) {
+			if score := tokenSimilarity(va, vb); score > best {
+				best = score
+			}
+		}
+	}
+	return best
+}
+
+func tokenSimilarity(a, b []string) float64 {
+	var total float64
+	for _, token := range a {
+		total += closest(token, b)
+	}
+	for _, token := range b {
+		total += closest(token, a)
+	}
+	return total / float64(len(a)+len(b))
+}
+
+// joinedVariants returns the tokens, and the tokens with each pair of neighbours joined into one.
+func joinedVariants(tokens []string) [][]string {
+	variants := [][]string{tokens}
+	for i := 0; i+1 < len(tokens); i++ {
+		variant := make([]string, 0, len(tokens)-1)
+		variant = append(variant, tokens[:i]...)
+		variant = append(variant, tokens[i]+tokens[i+1])
+		variant = append(variant, tokens[i+2:]...)
+		variants = append(variants, variant)
+	}
+	return variants
+}
+
+func closest(token string, tokens []string) float64 {
+	var best float64
+	for _, other := range tokens {
+		if score := jaroWinkler(token, other); score > best {
+			best = score
+		}
+	}
+	return best
+}
+
+// jaroWinkler is the Jaro-Winkler similarity of two ASCII strings, which favours strings
+// sharing a prefix. Names differ more at the end than at the start.
+func jaroWinkler(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+
+	window := max(len(a), len(b))/2 - 1
+	if window < 0 {
+		window = 0
+	}
+	matchedA := make([]bool, len(a))
+	matchedB := make([]bool, len(b))
+	matches := 0
+	for i := range a {
+		for j := max(0, i-window); j < min(len(b), i+window+1); j++ {
+			if !matchedB[j] && a[i] == b[j] {
+				matchedA[i], matchedB[j] = true, true
+				matches++
+				break
+			}
+		}
+	}
+	if matches == 0 {
+		return 0
+	}
+
+	transpositions := 0
+	j := 0
+	for i := range a {
+		if !matchedA[i] {
+			continue
+		}
+		for !matchedB[j] {
+			j++
+		}
+		if a[i] != b[j] {
+			transpositions++
+		}
+		j++
+	}
+
+	m := float64(matches)
+	jaro := (m/float64(len(a)) + m/float64(len(b)) + (m-float64(transpositions)/2)/m) / 3
+
+	prefix := 0
+	for prefix < min(4, len(a), len(b)) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	return jaro + float64(prefix)*0.1*(1-jaro)
+}
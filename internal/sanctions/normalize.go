@@ -0,0 +1,47 @@
+package sanctions
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// transliterations are the letters that don't lose their accent by decomposing, and Cyrillic,
+// which the lists spell both ways.
+var transliterations = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'ø': "o", 'ł': "l", 'đ': "d", 'ð': "d", 'þ': "th", 'ı': "i",
+
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e", 'ж': "zh", 'з': "z",
+	'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o", 'п': "p", 'р': "r",
+	'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch",
+	'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya", 'і': "i", 'ї': "yi", 'є': "ye", 'ґ': "g",
+}
+
+// normalize turns a name into lowercase ASCII tokens: accents are dropped, Cyrillic is transliterated,
+// apostrophes are removed ("O'Brien" is "obrien") and any other punctuation separates tokens.
+func normalize(name string) []string {
+	// Decompose, so "é" becomes "e" followed by a combining accent we can drop.
+	stripped, _, err := transform.String(transform.Chain(norm.NFKD, runes.Remove(runes.In(unicode.Mn))), strings.ToLower(name))
+	if err != nil {
+		stripped = strings.ToLower(name)
+	}
+
+	var b strings.Builder
+	for _, r := range stripped {
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			b.WriteRune(r)
+		case r == '\'' || r == '’' || r == '`':
+		default:
+			if t, ok := transliterations[r]; ok {
+				b.WriteString(t)
+			} else {
+				b.WriteByte(' ')
+			}
+		}
+	}
+	return strings.Fields(b.String())
+}
@@ -0,0 +1,307 @@
+package sanctions
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ofacNull is how the OFAC CSV exports write an empty field.
+const ofacNull = "-0-"
+
+// LoadOFAC reads the OFAC SDN export, sdn.xml or sdn.csv. The CSV export keeps the aliases in a
+// separate file (alt.csv), aliasPath is optional and only used with it.
+func LoadOFAC(path string, aliasPath string) ([]*Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if !isCSV(path) {
+		return ParseOFACXML(file)
+	}
+
+	var aliases io.Reader
+	if aliasPath != "" {
+		aliasFile, err := os.Open(aliasPath)
+		if err != nil {
+			return nil, err
+		}
+		defer aliasFile.Close()
+		aliases = aliasFile
+	}
+	return ParseOFACCSV(file, aliases)
+}
+
+// LoadEU reads the EU consolidated list export, as XML or CSV.
+func LoadEU(path string) ([]*Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if isCSV(path) {
+		return ParseEUCSV(file)
+	}
+	return ParseEUXML(file)
+}
+
+func isCSV(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".csv")
+}
+
+// ParseOFACXML parses sdn.xml.
+func ParseOFACXML(r io.Reader) ([]*Entry, error) {
+	var list struct {
+		Entries []struct {
+			UID       string `xml:"uid"`
+			FirstName string `xml:"firstName"`
+			LastName  string `xml:"lastName"`
+			Type      string `xml:"sdnType"`
+			Aliases   []struct {
+				FirstName string `xml:"firstName"`
+				LastName  string `xml:"lastName"`
+			} `xml:"akaList>aka"`
+		} `xml:"sdnEntry"`
+	}
+	if err := xml.NewDecoder(r).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to parse OFAC SDN list: %v", err)
+	}
+
+	var entries []*Entry
+	for _, e := range list.Entries {
+		entryType, ok := ofacType(e.Type)
+		if !ok {
+			continue
+		}
+		entry := &Entry{List: ListOFAC, Ref: strings.TrimSpace(e.UID), Type: entryType}
+		entry.addName(fullName(e.FirstName, e.LastName))
+		for _, alias := range e.Aliases {
+			entry.addName(fullName(alias.FirstName, alias.LastName))
+		}
+		entries = appendEntry(entries, entry)
+	}
+	return entries, nil
+}
+
+// ParseOFACCSV parses sdn.csv, with the aliases of alt.csv when given. Neither has a header:
+// sdn.csv starts with ent_num, SDN_Name, SDN_Type and alt.csv with ent_num, alt_num, alt_type, alt_name.
+func ParseOFACCSV(sdn io.Reader, aliases io.Reader) ([]*Entry, error) {
+	var entries []*Entry
+	byRef := make(map[string]*Entry)
+	err := readCSV(sdn, ',', func(record []string) error {
+		if len(record) < 3 {
+			return nil
+		}
+		entryType, ok := ofacType(record[2])
+		if !ok {
+			return nil
+		}
+		entry := &Entry{List: ListOFAC, Ref: strings.TrimSpace(record[0]), Type: entryType}
+		entry.addName(ofacName(record[1]))
+		if entry.Ref == "" || len(entry.Names) == 0 {
+			return nil
+		}
+		entries = append(entries, entry)
+		byRef[entry.Ref] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse OFAC SDN list: %v", err)
+	}
+
+	if aliases != nil {
+		err = readCSV(aliases, ',', func(record []string) error {
+			if len(record) < 4 {
+				return nil
+			}
+			if entry, ok := byRef[strings.TrimSpace(record[0])]; ok {
+				entry.addName(ofacName(record[3]))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse OFAC alternate names: %v", err)
+		}
+	}
+	return entries, nil
+}
+
+// ofacType maps the SDN type to ours. Vessels and aircraft are left out.
+func ofacType(sdnType string) (string, bool) {
+	switch strings.ToLower(strings.TrimSpace(sdnType)) {
+	case "individual":
+		return TypeIndividual, true
+	case "entity", "", ofacNull:
+		// The CSV export leaves the type of entities empty.
+		return TypeEntity, true
+	default:
+		return "", false
+	}
+}
+
+// ofacName turns "DOE, John" into "John DOE".
+func ofacName(name string) string {
+	name = strings.TrimSpace(name)
+	if name == ofacNull {
+		return ""
+	}
+	if last, first, ok := strings.Cut(name, ", "); ok && !strings.Contains(first, ",") {
+		return fullName(first, last)
+	}
+	return name
+}
+
+// ParseEUXML parses the XML export of the EU consolidated list. The first name alias of an entity
+// is its primary name.
+func ParseEUXML(r io.Reader) ([]*Entry, error) {
+	var list struct {
+		Entities []struct {
+			LogicalID   string `xml:"logicalId,attr"`
+			SubjectType struct {
+				Code string `xml:"code,attr"`
+			} `xml:"subjectType"`
+			Aliases []struct {
+				WholeName string `xml:"wholeName,attr"`
+				FirstName string `xml:"firstName,attr"`
+				LastName  string `xml:"lastName,attr"`
+			} `xml:"nameAlias"`
+		} `xml:"sanctionEntity"`
+	}
+	if err := xml.NewDecoder(r).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to parse EU consolidated list: %v", err)
+	}
+
+	var entries []*Entry
+	for _, e := range list.Entities {
+		entry := &Entry{List: ListEU, Ref: strings.TrimSpace(e.LogicalID), Type: euType(e.SubjectType.Code)}
+		for _, alias := range e.Aliases {
+			name := alias.WholeName
+			if strings.TrimSpace(name) == "" {
+				name = fullName(alias.FirstName, alias.LastName)
+			}
+			entry.addName(name)
+		}
+		entries = appendEntry(entries, entry)
+	}
+	return entries, nil
+}
+
+// ParseEUCSV parses the CSV export of the EU consolidated list. It has a header and one row per
+// name alias (and address, identification, ...) of an entity, separated by semicolons.
+func ParseEUCSV(r io.Reader) ([]*Entry, error) {
+	var entries []*Entry
+	byRef := make(map[string]*Entry)
+	var columns map[string]int
+	err := readCSV(r, ';', func(record []string) error {
+		if columns == nil {
+			columns = make(map[string]int)
+			for i, name := range record {
+				columns[strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))] = i
+			}
+			for _, required := range []string{"Entity_LogicalId", "NameAlias_WholeName"} {
+				if _, ok := columns[required]; !ok {
+					return fmt.Errorf("missing column %s", required)
+				}
+			}
+			return nil
+		}
+
+		ref := strings.TrimSpace(field(record, columns, "Entity_LogicalId"))
+		if ref == "" {
+			return nil
+		}
+		entry, ok := byRef[ref]
+		if !ok {
+			subjectType := field(record, columns, "Entity_SubjectType")
+			if code := field(record, columns, "Entity_SubjectType_ClassificationCode"); code != "" {
+				subjectType = code
+			}
+			entry = &Entry{List: ListEU, Ref: ref, Type: euType(subjectType)}
+			byRef[ref] = entry
+			entries = append(entries, entry)
+		}
+		entry.addName(field(record, columns, "NameAlias_WholeName"))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse EU consolidated list: %v", err)
+	}
+
+	// Rows of an entity without a name carry its addresses and the like.
+	named := entries[:0]
+	for _, entry := range entries {
+		named = appendEntry(named, entry)
+	}
+	return named, nil
+}
+
+func euType(code string) string {
+	switch strings.ToLower(strings.TrimSpace(code)) {
+	case "person", "p":
+		return TypeIndividual
+	default:
+		return TypeEntity
+	}
+}
+
+func field(record []string, columns map[string]int, name string) string {
+	i, ok := columns[name]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return record[i]
+}
+
+// readCSV calls fn for every record. The exports aren't always strict about quotes and
+// field counts, so neither are we.
+func readCSV(r io.Reader, comma rune, fn func(record []string) error) error {
+	reader := csv.NewReader(r)
+	reader.Comma = comma
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
+
+func fullName(first, last string) string {
+	return strings.TrimSpace(strings.TrimSpace(first) + " " + strings.TrimSpace(last))
+}
+
+// addName adds a name to the entry, unless it is empty or already there.
+func (e *Entry) addName(name string) {
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" {
+		return
+	}
+	for _, existing := range e.Names {
+		if strings.EqualFold(existing, name) {
+			return
+		}
+	}
+	e.Names = append(e.Names, name)
+}
+
+func appendEntry(entries []*Entry, entry *Entry) []*Entry {
+	if entry.Ref == "" || len(entry.Names) == 0 {
+		return entries
+	}
+	return append(entries, entry)
+}
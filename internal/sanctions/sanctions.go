@@ -0,0 +1,161 @@
+package sanctions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"payment-gateway/internal/compliance"
+)
+
+// Lists we screen against.
+const (
+	ListOFAC = "OFAC SDN"
+	ListEU   = "EU consolidated"
+)
+
+// Types of entries. Vessels and aircraft are left out when a list is loaded, users are people.
+const (
+	TypeIndividual = "individual"
+	TypeEntity     = "entity"
+)
+
+// Entry is one sanctioned person or organisation.
+type Entry struct {
+	List string
+	// Ref is the id of the entry on its list, e.g. the uid of an OFAC entry.
+	Ref  string
+	Type string
+	// Names holds the primary name first, then the aliases.
+	Names []string
+}
+
+// ListInfo describes a stored list.
+type ListInfo struct {
+	Name string
+	// Source is the file the list was loaded from.
+	Source      string
+	Entries     int
+	RefreshedAt time.Time
+}
+
+// Store keeps the lists, so every instance screens against the same ones.
+type Store interface {
+	// Entries returns the entries of all lists.
+	Entries(ctx context.Context) ([]*Entry, error)
+	Lists(ctx context.Context) ([]*ListInfo, error)
+	// ReplaceList swaps all entries of a list for the new ones, at once.
+	ReplaceList(ctx context.Context, list string, source string, entries []*Entry) error
+}
+
+// UserStore is where the names users are screened by come from.
+type UserStore interface {
+	// ScreeningName returns the full name of the user, or the username when there is none.
+	ScreeningName(ctx context.Context, userID int) (string, error)
+}
+
+var ErrNotLoaded = errors.New("sanctions lists are not loaded")
+
+// Screener screens users against the stored lists. It keeps an index of the lists in memory
+// and rebuilds it when a list is refreshed.
+type Screener struct {
+	store Store
+	users UserStore
+
+	mu      sync.RWMutex
+	index   *Index
+	version string
+
+	// Interval is how often the screener checks for refreshed lists.
+	Interval time.Duration
+}
+
+func NewScreener(store Store, users UserStore) *Screener {
+	return &Screener{
+		store:    store,
+		users:    users,
+		Interval: time.Minute,
+	}
+}
+
+func (s *Screener) Screen(ctx context.Context, userID int, threshold float64) ([]compliance.Match, error) {
+	s.mu.RLock()
+	index := s.index
+	s.mu.RUnlock()
+	if index == nil {
+		return nil, ErrNotLoaded
+	}
+
+	name, err := s.users.ScreeningName(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user %d: %v", userID, err)
+	}
+	return index.Search(name, threshold), nil
+}
+
+// Load builds the index from the stored lists, unless they haven't changed since the last load.
+func (s *Screener) Load(ctx context.Context) error {
+	lists, err := s.store.Lists(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch sanctions lists: %v", err)
+	}
+	version := listsVersion(lists)
+
+	s.mu.RLock()
+	loaded := s.index != nil && s.version == version
+	s.mu.RUnlock()
+	if loaded {
+		return nil
+	}
+
+	entries, err := s.store.Entries(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch sanctions entries: %v", err)
+	}
+	index := NewIndex(entries)
+
+	s.mu.Lock()
+	s.index, s.version = index, version
+	s.mu.Unlock()
+
+	if len(lists) == 0 {
+		log.Println("no sanctions lists loaded, nobody matches until they are refreshed")
+	}
+	for _, list := range lists {
+		log.Printf("screening against %s: %d entries, refreshed %s", list.Name, list.Entries, list.RefreshedAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Run picks up refreshed lists until the context is cancelled. Until a reload succeeds,
+// the lists that were loaded before are used.
+func (s *Screener) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Load(ctx); err != nil {
+				log.Printf("sanctions screener failed to reload: %v", err)
+			}
+		}
+	}
+}
+
+// listsVersion changes whenever a list is refreshed.
+func listsVersion(lists []*ListInfo) string {
+	parts := make([]string, 0, len(lists))
+	for _, list := range lists {
+		parts = append(parts, fmt.Sprintf("%s@%d", list.Name, list.RefreshedAt.UnixNano()))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
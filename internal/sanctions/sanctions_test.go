@@ -0,0 +1,268 @@
+package sanctions
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := map[string][]string{
+		"John  DOE":                {"john", "doe"},
+		"José Müller-Lüdenscheidt": {"jose", "muller", "ludenscheidt"},
+		"O'Brien, Seán":            {"obrien", "sean"},
+		"Łukasz Øster Straße":      {"lukasz", "oster", "strasse"},
+		"Виктор Янукович":          {"viktor", "yanukovich"},
+		"!!!":                      {},
+	}
+	for name, want := range tests {
+		if got := normalize(name); !reflect.DeepEqual(got, want) {
+			t.Errorf("normalize(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestJaroWinkler(t *testing.T) {
+	if score := jaroWinkler("martha", "marhta"); score < 0.96 || score > 0.97 {
+		t.Errorf("Expected the textbook 0.961 for martha/marhta, got %.3f", score)
+	}
+	if score := jaroWinkler("abc", "xyz"); score != 0 {
+		t.Errorf("Expected 0 for nothing in common, got %.3f", score)
+	}
+}
+
+func testEntries() []*Entry {
+	return []*Entry{
+		{List: ListOFAC, Ref: "100", Type: TypeIndividual, Names: []string{"Viktor Fyodorovich YANUKOVYCH", "Viktor YANUKOVICH"}},
+		{List: ListOFAC, Ref: "200", Type: TypeIndividual, Names: []string{"Abdul Rahman AL-HADDAD"}},
+		{List: ListEU, Ref: "13", Type: TypeIndividual, Names: []string{"Saddam Hussein Al-Tikriti"}},
+		{List: ListEU, Ref: "14", Type: TypeEntity, Names: []string{"Acme Trading Company"}},
+	}
+}
+
+func TestIndex_Search(t *testing.T) {
+	index := NewIndex(testEntries())
+
+	tests := []struct {
+		name string
+		ref  string
+	}{
+		{"Viktor Yanukovych", "100"},
+		{"YANUKOVICH, Viktor", "100"},
+		{"Виктор Янукович", "100"},
+		{"Victor Janukovich", "100"},
+		{"Abdulrahman Al Haddad", "200"},
+		{"Saddam Husein al Tikriti", "13"},
+	}
+	for _, tt := range tests {
+		matches := index.Search(tt.name, 0.85)
+		if len(matches) == 0 || matches[0].Ref != tt.ref {
+			t.Errorf("Search(%q): expected entry %s first, got %+v", tt.name, tt.ref, matches)
+		}
+	}
+
+	for _, name := range []string{"John Smith", "Viktor Orban", "Hussein", "acme"} {
+		if matches := index.Search(name, 0.85); len(matches) != 0 {
+			t.Errorf("Search(%q): expected no match, got %+v", name, matches)
+		}
+	}
+}
+
+func TestIndex_SearchReturnsEachEntryOnce(t *testing.T) {
+	index := NewIndex(testEntries())
+	matches := index.Search("Viktor Yanukovich", 0.5)
+	count := 0
+	for _, match := range matches {
+		if match.Ref == "100" {
+			count++
+			if match.Name != "Viktor YANUKOVICH" || match.Score != 1 {
+				t.Errorf("Expected the exact alias to be the match, got %+v", match)
+			}
+		}
+	}
+	if count != 1 {
+		t.Errorf("Expected entry 100 once, got %d times", count)
+	}
+}
+
+func TestParseOFACXML(t *testing.T) {
+	export := `<?xml version="1.0" standalone="yes"?>
+<sdnList xmlns="http://tempuri.org/sdnList.xsd">
+  <publshInformation><Publish_Date>01/02/2024</Publish_Date><Record_Count>3</Record_Count></publshInformation>
+  <sdnEntry>
+    <uid>100</uid><firstName>Viktor Fyodorovich</firstName><lastName>YANUKOVYCH</lastName><sdnType>Individual</sdnType>
+    <akaList>
+      <aka><uid>1</uid><type>a.k.a.</type><category>strong</category><firstName>Viktor</firstName><lastName>YANUKOVICH</lastName></aka>
+    </akaList>
+  </sdnEntry>
+  <sdnEntry><uid>300</uid><lastName>AEROCARIBBEAN AIRLINES</lastName><sdnType>Entity</sdnType></sdnEntry>
+  <sdnEntry><uid>400</uid><lastName>SEA STAR</lastName><sdnType>Vessel</sdnType></sdnEntry>
+</sdnList>`
+
+	entries, err := ParseOFACXML(strings.NewReader(export))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Entry{
+		{List: ListOFAC, Ref: "100", Type: TypeIndividual, Names: []string{"Viktor Fyodorovich YANUKOVYCH", "Viktor YANUKOVICH"}},
+		{List: ListOFAC, Ref: "300", Type: TypeEntity, Names: []string{"AEROCARIBBEAN AIRLINES"}},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("Expected the vessel to be left out, got %+v", entries)
+	}
+}
+
+func TestParseOFACCSV(t *testing.T) {
+	sdn := `100,"YANUKOVYCH, Viktor Fyodorovich","individual","UKRAINE-EO13660",-0- ,-0- ,-0- ,-0- ,-0- ,-0- ,-0- ,"DOB 09 Jul 1950."
+300,"AEROCARIBBEAN AIRLINES",-0- ,"CUBA",-0- ,-0- ,-0- ,-0- ,-0- ,-0- ,-0- ,-0-
+400,"SEA STAR","vessel","IRAN",-0- ,-0- ,-0- ,-0- ,-0- ,-0- ,-0- ,-0-
+` + "\x1a"
+	alt := `100,1,"aka","YANUKOVICH, Viktor",-0-
+300,2,"aka","AERO-CARIBBEAN",-0-
+`
+
+	entries, err := ParseOFACCSV(strings.NewReader(sdn), strings.NewReader(alt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Entry{
+		{List: ListOFAC, Ref: "100", Type: TypeIndividual, Names: []string{"Viktor Fyodorovich YANUKOVYCH", "Viktor YANUKOVICH"}},
+		{List: ListOFAC, Ref: "300", Type: TypeEntity, Names: []string{"AEROCARIBBEAN AIRLINES", "AERO-CARIBBEAN"}},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("Unexpected entries %+v", entries)
+	}
+}
+
+func TestParseEUXML(t *testing.T) {
+	export := `<?xml version="1.0" encoding="UTF-8"?>
+<export xmlns="http://eu.europa.ec/fpi/fsd/export" generationDate="2024-01-02T10:00:00.000+01:00">
+  <sanctionEntity designationDetails="" unitedNationId="" euReferenceNumber="EU.27.28" logicalId="13">
+    <regulation regulationType="amendment" publicationDate="2003-07-08"/>
+    <subjectType code="person" classificationCode="P"/>
+    <nameAlias firstName="Saddam" middleName="" lastName="Hussein Al-Tikriti" wholeName="Saddam Hussein Al-Tikriti" strong="true" logicalId="17"/>
+    <nameAlias firstName="" lastName="" wholeName="Abu Ali" strong="false" logicalId="18"/>
+  </sanctionEntity>
+  <sanctionEntity logicalId="14">
+    <subjectType code="enterprise" classificationCode="E"/>
+    <nameAlias wholeName="Acme Trading Company" logicalId="19"/>
+  </sanctionEntity>
+</export>`
+
+	entries, err := ParseEUXML(strings.NewReader(export))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Entry{
+		{List: ListEU, Ref: "13", Type: TypeIndividual, Names: []string{"Saddam Hussein Al-Tikriti", "Abu Ali"}},
+		{List: ListEU, Ref: "14", Type: TypeEntity, Names: []string{"Acme Trading Company"}},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("Unexpected entries %+v", entries)
+	}
+}
+
+func TestParseEUCSV(t *testing.T) {
+	export := "\ufeffFileGenerationDate;Entity_LogicalId;Entity_SubjectType;Entity_SubjectType_ClassificationCode;NameAlias_WholeName;Address_City\n" +
+		"02/01/2024;13;person;P;Saddam Hussein Al-Tikriti;\n" +
+		"02/01/2024;13;person;P;Abu Ali;\n" +
+		"02/01/2024;13;person;P;;Baghdad\n" +
+		"02/01/2024;14;enterprise;E;Acme Trading Company;\n" +
+		"02/01/2024;15;enterprise;E;;Nowhere\n"
+
+	entries, err := ParseEUCSV(strings.NewReader(export))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Entry{
+		{List: ListEU, Ref: "13", Type: TypeIndividual, Names: []string{"Saddam Hussein Al-Tikriti", "Abu Ali"}},
+		{List: ListEU, Ref: "14", Type: TypeEntity, Names: []string{"Acme Trading Company"}},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("Unexpected entries %+v", entries)
+	}
+
+	if _, err := ParseEUCSV(strings.NewReader("Id;Name\n1;Someone\n")); err == nil {
+		t.Error("Expected an export without the expected columns to be rejected")
+	}
+}
+
+type memoryStore struct {
+	lists   map[string]*ListInfo
+	entries map[string][]*Entry
+	loads   int
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{lists: make(map[string]*ListInfo), entries: make(map[string][]*Entry)}
+}
+
+func (m *memoryStore) Entries(ctx context.Context) ([]*Entry, error) {
+	m.loads++
+	var entries []*Entry
+	for _, list := range m.entries {
+		entries = append(entries, list...)
+	}
+	return entries, nil
+}
+
+func (m *memoryStore) Lists(ctx context.Context) ([]*ListInfo, error) {
+	var lists []*ListInfo
+	for _, list := range m.lists {
+		lists = append(lists, list)
+	}
+	return lists, nil
+}
+
+func (m *memoryStore) ReplaceList(ctx context.Context, list string, source string, entries []*Entry) error {
+	m.lists[list] = &ListInfo{Name: list, Source: source, Entries: len(entries), RefreshedAt: time.Now()}
+	m.entries[list] = entries
+	return nil
+}
+
+type mockUsers map[int]string
+
+func (m mockUsers) ScreeningName(ctx context.Context, userID int) (string, error) {
+	return m[userID], nil
+}
+
+func TestScreener(t *testing.T) {
+	store := newMemoryStore()
+	screener := NewScreener(store, mockUsers{1: "Viktor Yanukovich", 2: "Jane Roe"})
+
+	if _, err := screener.Screen(context.Background(), 1, 0.85); !errors.Is(err, ErrNotLoaded) {
+		t.Fatalf("Expected screening to fail before the lists are loaded, got %v", err)
+	}
+
+	// Without lists nobody matches, but screening works.
+	if err := screener.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if matches, err := screener.Screen(context.Background(), 1, 0.85); err != nil || len(matches) != 0 {
+		t.Fatalf("Expected no matches without lists, got %+v, %v", matches, err)
+	}
+
+	store.ReplaceList(context.Background(), ListOFAC, "sdn.xml", testEntries()[:1])
+	if err := screener.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	matches, err := screener.Screen(context.Background(), 1, 0.85)
+	if err != nil || len(matches) != 1 || matches[0].List != ListOFAC || matches[0].Ref != "100" {
+		t.Errorf("Expected user 1 to match the refreshed list, got %+v, %v", matches, err)
+	}
+	if matches, _ := screener.Screen(context.Background(), 2, 0.85); len(matches) != 0 {
+		t.Errorf("Expected no match for user 2, got %+v", matches)
+	}
+
+	// Unchanged lists aren't loaded again.
+	loads := store.loads
+	if err := screener.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if store.loads != loads {
+		t.Errorf("Expected the entries not to be fetched again, fetched %d times", store.loads)
+	}
+}
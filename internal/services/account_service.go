@@ -1,19 +1,51 @@
 package services
 
+import (
+	"context"
+
+	"payment-gateway/db"
+	"payment-gateway/internal/ledger"
+	"payment-gateway/internal/models"
+)
+
 type AccountService interface {
-	GetBalance(userID int) (float64, error)
+	// GetBalance returns the amount the user can spend.
+	GetBalance(ctx context.Context, userID int, currency string) (models.Money, error)
+
+	// GetBalances returns the available balance and the amount held for withdrawals in flight.
+	GetBalances(ctx context.Context, userID int, currency string) (*models.Balance, error)
 }
 
 type AccountManager struct {
-	// Add any dependencies here, like db client, cache client, etc.
+	ledger ledger.Store
 }
 
 func NewAccountService() AccountService {
-	return &AccountManager{}
+	return &AccountManager{
+		ledger: db.NewLedgerStore(db.Db),
+	}
 }
 
-func (am *AccountManager) GetBalance(userID int) (float64, error) {
-	// Implement the actual balance fetching logic here
-	// This could involve database calls, cache checks, or even external API calls
-	return 5454.00, nil
+func (am *AccountManager) GetBalance(ctx context.Context, userID int, currency string) (models.Money, error) {
+	balance, err := am.GetBalances(ctx, userID, currency)
+	if err != nil {
+		return models.Money{}, err
+	}
+	return balance.Available, nil
+}
+
+func (am *AccountManager) GetBalances(ctx context.Context, userID int, currency string) (*models.Balance, error) {
+	available, err := models.NewMoney(0, currency)
+	if err != nil {
+		return nil, err
+	}
+	pending := available
+
+	if available.Minor, err = am.ledger.Balance(ctx, ledger.UserAvailable(userID, currency)); err != nil {
+		return nil, err
+	}
+	if pending.Minor, err = am.ledger.Balance(ctx, ledger.UserHeld(userID, currency)); err != nil {
+		return nil, err
+	}
+	return &models.Balance{Available: available, Pending: pending}, nil
 }
@@ -1,19 +1,47 @@
 package services
 
 import (
-	"payment-gateway/internal/models"
-	"time"
+	"context"
+	"errors"
+
+	"payment-gateway/db"
+	"payment-gateway/internal/compliance"
 )
 
 type ComplianceService interface {
-	CheckStatus(req *models.TransactionRequest) (string, error)
+	// Check runs the compliance rules for a transaction before it is created.
+	Check(ctx context.Context, req *compliance.Request) (*compliance.Decision, error)
+}
+
+var compliancePipeline compliance.Checker
+
+// InitCompliance sets up the compliance rules loaded at startup, screening users with the screener.
+func InitCompliance(cfg *compliance.Config, screener compliance.Screener) error {
+	pipeline, err := cfg.Build(compliance.Dependencies{
+		Activity: db.NewComplianceRepository(db.Db),
+		Screener: screener,
+	})
+	if err != nil {
+		return err
+	}
+	compliancePipeline = pipeline
+	return nil
+}
+
+type ComplianceManager struct {
+	checker compliance.Checker
 }
 
-type MyComplianceService struct {
+func NewComplianceService() ComplianceService {
+	return &ComplianceManager{
+		checker: compliancePipeline,
+	}
 }
 
-func (mcs *MyComplianceService) CheckStatus(req *models.TransactionRequest) (string, error) {
-	// All the complianceService logic goes here...
-	time.Sleep(2 * time.Second) // compliance check logic
-	return "approved", nil
+func (cm *ComplianceManager) Check(ctx context.Context, req *compliance.Request) (*compliance.Decision, error) {
+	if cm.checker == nil {
+		// Without rules nothing is let through, rather than everything.
+		return nil, errors.New("compliance rules are not loaded")
+	}
+	return cm.checker.Check(ctx, req)
 }
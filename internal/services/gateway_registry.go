@@ -0,0 +1,242 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"payment-gateway/db"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/retry"
+)
+
+// Capabilities says what a gateway adapter supports. Transactions it doesn't support are refused before
+// the adapter is called, and the rows of the gateways table are checked against it at startup.
+type Capabilities struct {
+	// Operations are the transaction types it can process, db.TypeDeposit, db.TypeWithdraw and db.TypeRefund.
+	Operations []string
+	// Currencies are the ISO 4217 codes it can settle, none means any.
+	Currencies []string
+	// DataFormats are the content types it exchanges with the gateway, one of them is the data_format_supported of its row.
+	DataFormats []string
+}
+
+// Reasons an adapter refuses a transaction, returned to clients with the error.
+const (
+	ReasonOperationNotSupported = "operation_not_supported"
+	ReasonCurrencyNotSupported  = "currency_not_supported"
+)
+
+// UnsupportedError says why an adapter can't process a transaction.
+type UnsupportedError struct {
+	// Reason is ReasonOperationNotSupported or ReasonCurrencyNotSupported.
+	Reason string
+	// Value is the operation or currency that isn't supported.
+	Value string
+}
+
+func (e *UnsupportedError) Error() string {
+	return e.Value + " is not supported"
+}
+
+// Supports returns an *UnsupportedError saying why the adapter can't process the operation in the currency, or nil.
+func (c Capabilities) Supports(operation string, currency string) error {
+	if !containsFold(c.Operations, operation) {
+		return &UnsupportedError{Reason: ReasonOperationNotSupported, Value: operation}
+	}
+	if len(c.Currencies) > 0 && !containsFold(c.Currencies, currency) {
+		return &UnsupportedError{Reason: ReasonCurrencyNotSupported, Value: currency}
+	}
+	return nil
+}
+
+// GatewayAdapter is an implementation of a gateway with its own type of config.
+type GatewayAdapter[C any] struct {
+	Capabilities Capabilities
+	// LoadConfig reads the config of the adapter, e.g. from the environment, when the gateways are set up.
+	LoadConfig func() (C, error)
+	// New builds the gateway from its config.
+	New func(cfg C) (PaymentGateway, error)
+}
+
+type registeredAdapter struct {
+	capabilities Capabilities
+	build        func() (PaymentGateway, error)
+}
+
+var (
+	adaptersMu      sync.RWMutex
+	gatewayAdapters = map[string]registeredAdapter{}
+	// gateways are the adapters built by InitGateways, by gateway name.
+	gateways map[string]PaymentGateway
+)
+
+// RegisterGateway adds or replaces the adapter of the gateway with the name of its row in the gateways
+// table. Adapters register themselves in an init function, so adding a gateway doesn't change this package's code.
+func RegisterGateway[C any](name string, adapter GatewayAdapter[C]) {
+	adaptersMu.Lock()
+	defer adaptersMu.Unlock()
+	gatewayAdapters[name] = registeredAdapter{
+		capabilities: adapter.Capabilities,
+		build: func() (PaymentGateway, error) {
+			cfg, err := adapter.LoadConfig()
+			if err != nil {
+				return nil, err
+			}
+			return adapter.New(cfg)
+		},
+	}
+}
+
+// GatewayCapabilities returns the capabilities of the adapter registered for the gateway.
+func GatewayCapabilities(name string) (Capabilities, bool) {
+	adaptersMu.RLock()
+	defer adaptersMu.RUnlock()
+	adapter, ok := gatewayAdapters[name]
+	return adapter.capabilities, ok
+}
+
+// InitGateways builds the adapter of every gateway in the gateways table. It fails when a gateway has no
+// registered adapter, or its row asks for a data format or currency the adapter doesn't support.
+func InitGateways(ctx context.Context, repo db.GatewayRepository) error {
+	rows, err := repo.ListGateways(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list gateways: %w", err)
+	}
+
+	adaptersMu.Lock()
+	defer adaptersMu.Unlock()
+	built := make(map[string]PaymentGateway, len(rows))
+	for _, row := range rows {
+		adapter, ok := gatewayAdapters[row.Name]
+		if !ok {
+			return fmt.Errorf("gateway %q (id %d) has no registered adapter", row.Name, row.ID)
+		}
+		if !containsFold(adapter.capabilities.DataFormats, row.DataFormatSupported) {
+			return fmt.Errorf("gateway %q uses %s, its adapter supports %s", row.Name, row.DataFormatSupported, strings.Join(adapter.capabilities.DataFormats, ", "))
+		}
+
+		currencies, err := repo.GetSupportedCurrencies(ctx, row.ID)
+		if err != nil {
+			return fmt.Errorf("failed to list the currencies of gateway %q: %w", row.Name, err)
+		}
+		for _, currency := range currencies {
+			if len(adapter.capabilities.Currencies) > 0 && !containsFold(adapter.capabilities.Currencies, currency) {
+				return fmt.Errorf("gateway %q settles %s, its adapter doesn't support it", row.Name, currency)
+			}
+		}
+
+		gateway, err := adapter.build()
+		if err != nil {
+			return fmt.Errorf("failed to set up gateway %q: %w", row.Name, err)
+		}
+		built[row.Name] = &checkedGateway{name: row.Name, capabilities: adapter.capabilities, gateway: gateway}
+	}
+
+	gateways = built
+	return nil
+}
+
+// getGatewayImplementation returns the adapter InitGateways built for the gateway.
+func getGatewayImplementation(gatewayName string) (PaymentGateway, bool) {
+	adaptersMu.RLock()
+	defer adaptersMu.RUnlock()
+	gateway, ok := gateways[gatewayName]
+	return gateway, ok
+}
+
+// getCallbackParser returns the callback parser of the gateway's adapter, ok is false when the gateway sends
+// models.PaymentCallback.
+func getCallbackParser(gatewayName string) (CallbackParser, bool) {
+	gateway, ok := getGatewayImplementation(gatewayName)
+	if !ok {
+		return nil, false
+	}
+	parser, ok := adapterOf(gateway).(CallbackParser)
+	return parser, ok
+}
+
+// adapterOf returns the adapter behind a gateway, to find the optional interfaces it implements.
+func adapterOf(gateway PaymentGateway) PaymentGateway {
+	if checked, ok := gateway.(*checkedGateway); ok {
+		return checked.gateway
+	}
+	return gateway
+}
+
+// checkedGateway refuses the transactions its adapter doesn't support before calling it.
+type checkedGateway struct {
+	name         string
+	capabilities Capabilities
+	gateway      PaymentGateway
+}
+
+func (g *checkedGateway) ProcessPayment(ctx context.Context, req *db.Transaction) (*GatewayResult, error) {
+	if err := g.check(req.Type, req.Amount.Currency); err != nil {
+		return nil, err
+	}
+	return g.gateway.ProcessPayment(ctx, req)
+}
+
+func (g *checkedGateway) Refund(ctx context.Context, refund *db.Transaction, parent *db.Transaction) (*GatewayResult, error) {
+	if err := g.check(db.TypeRefund, refund.Amount.Currency); err != nil {
+		return nil, err
+	}
+	return g.gateway.Refund(ctx, refund, parent)
+}
+
+func (g *checkedGateway) check(operation string, currency string) error {
+	if err := g.refusal(operation, currency); err != nil {
+		return retry.Permanent(err)
+	}
+	return nil
+}
+
+// refusal returns the error a transaction the adapter doesn't support is refused with, or nil.
+func (g *checkedGateway) refusal(operation string, currency string) error {
+	err := g.capabilities.Supports(operation, currency)
+	var unsupported *UnsupportedError
+	if !errors.As(err, &unsupported) {
+		return err
+	}
+	return models.NewServiceErrorWithReason(
+		models.ErrorCodeValidation,
+		unsupported.Reason,
+		fmt.Sprintf("Gateway %s can't process this transaction: %s.", g.name, unsupported),
+	)
+}
+
+// supports refuses the transactions the adapter of the gateway doesn't support, before anything is saved.
+// Gateways that aren't checked, like the ones of the tests, take everything.
+func supports(gateway PaymentGateway, operation string, currency string) error {
+	checked, ok := gateway.(*checkedGateway)
+	if !ok {
+		return nil
+	}
+	return checked.refusal(operation, currency)
+}
+
+// unavailableGateway stands in for a gateway that can't be resolved for a saved transaction, it fails the
+// transaction with the reason.
+type unavailableGateway struct {
+	err error
+}
+
+func (g *unavailableGateway) ProcessPayment(ctx context.Context, req *db.Transaction) (*GatewayResult, error) {
+	return nil, retry.Permanent(g.err)
+}
+
+func (g *unavailableGateway) Refund(ctx context.Context, refund *db.Transaction, parent *db.Transaction) (*GatewayResult, error) {
+	return nil, retry.Permanent(g.err)
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
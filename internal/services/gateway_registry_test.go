@@ -0,0 +1,118 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"payment-gateway/db"
+	"payment-gateway/internal/models"
+)
+
+type acmeConfig struct {
+	APIKey string
+}
+
+// registerAcme registers a test adapter and takes it out again, with the gateways built, when the test is done.
+func registerAcme(t *testing.T, capabilities Capabilities) *acmeConfig {
+	built := &acmeConfig{}
+	RegisterGateway("acme", GatewayAdapter[acmeConfig]{
+		Capabilities: capabilities,
+		LoadConfig:   func() (acmeConfig, error) { return acmeConfig{APIKey: "acme_key"}, nil },
+		New: func(cfg acmeConfig) (PaymentGateway, error) {
+			*built = cfg
+			return &mockPaymentGateway{}, nil
+		},
+	})
+	t.Cleanup(func() {
+		adaptersMu.Lock()
+		defer adaptersMu.Unlock()
+		delete(gatewayAdapters, "acme")
+		gateways = nil
+	})
+	return built
+}
+
+var acmeCapabilities = Capabilities{
+	Operations:  []string{db.TypeDeposit},
+	Currencies:  []string{"USD", "EUR"},
+	DataFormats: []string{"application/json"},
+}
+
+func TestInitGateways(t *testing.T) {
+	built := registerAcme(t, acmeCapabilities)
+	repo := &mockGatewayRepository{
+		gateways: []*db.Gateway{
+			{ID: 1, Name: "stripe", DataFormatSupported: "application/json"},
+			{ID: 2, Name: "acme", DataFormatSupported: "APPLICATION/JSON"},
+		},
+		currencies: map[int][]string{1: {"USD", "XOF"}, 2: {"USD"}},
+	}
+
+	if err := InitGateways(context.Background(), repo); err != nil {
+		t.Fatal(err)
+	}
+	if built.APIKey != "acme_key" {
+		t.Errorf("Expected the adapter to be built from its config, got %+v", built)
+	}
+	for _, name := range []string{"stripe", "acme"} {
+		if _, ok := getGatewayImplementation(name); !ok {
+			t.Errorf("Expected the %s adapter to be built", name)
+		}
+	}
+	if _, ok := getGatewayImplementation("paypal"); ok {
+		t.Error("Expected no adapter to be built for a gateway without a row")
+	}
+}
+
+func TestInitGateways_Fails(t *testing.T) {
+	registerAcme(t, acmeCapabilities)
+	tests := []struct {
+		name       string
+		gateway    *db.Gateway
+		currencies []string
+		want       string
+	}{
+		{"no adapter", &db.Gateway{ID: 3, Name: "revolut", DataFormatSupported: "application/json"}, nil, `gateway "revolut" (id 3) has no registered adapter`},
+		{"data format", &db.Gateway{ID: 2, Name: "acme", DataFormatSupported: "application/xml"}, nil, `gateway "acme" uses application/xml`},
+		{"currency", &db.Gateway{ID: 2, Name: "acme", DataFormatSupported: "application/json"}, []string{"USD", "GBP"}, `gateway "acme" settles GBP`},
+	}
+	for _, tt := range tests {
+		repo := &mockGatewayRepository{gateways: []*db.Gateway{tt.gateway}, currencies: map[int][]string{tt.gateway.ID: tt.currencies}}
+		err := InitGateways(context.Background(), repo)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected %q, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestCheckedGateway_RefusesUnsupportedTransactions(t *testing.T) {
+	service, mockGateway, mockRepo := setupTestService(t, true, 100000)
+	checked := &checkedGateway{name: "acme", capabilities: acmeCapabilities, gateway: mockGateway}
+	GetPaymentGateway = func(ctx context.Context, countryId int, gatewayId int) (PaymentGateway, error) {
+		return checked, nil
+	}
+
+	_, err := service.Withdraw(context.Background(), &models.TransactionRequest{Amount: 1000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1})
+	serviceErr, ok := err.(*models.ServiceError)
+	if !ok || serviceErr.Code != models.ErrorCodeValidation || serviceErr.Reason != ReasonOperationNotSupported {
+		t.Fatalf("Expected the withdrawal to be refused, got %v", err)
+	}
+	if mockGateway.calls != 0 {
+		t.Errorf("Expected the adapter not to be called, got %d calls", mockGateway.calls)
+	}
+	// Refused up front, nothing is saved or held.
+	if len(mockRepo.transactions) != 0 {
+		t.Errorf("Expected no transaction to be saved, got %d", len(mockRepo.transactions))
+	}
+
+	// A transaction saved before the adapter changed is refused when it gets to the gateway.
+	_, err = checked.ProcessPayment(context.Background(), &db.Transaction{Type: db.TypeDeposit, Amount: models.Money{Minor: 100, Currency: "JPY"}})
+	if !errors.As(err, &serviceErr) || serviceErr.Reason != ReasonCurrencyNotSupported {
+		t.Errorf("Expected the currency to be refused, got %v", err)
+	}
+	if _, err := checked.ProcessPayment(context.Background(), &db.Transaction{Type: db.TypeDeposit, Amount: models.Money{Minor: 100, Currency: "EUR"}}); err != nil {
+		t.Errorf("Expected a supported deposit to go through, got %v", err)
+	}
+}
@@ -2,83 +2,124 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
+
 	"payment-gateway/db"
-	"time"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/routing"
 )
 
 type GatewayResult struct {
 	// This is a unique id that is returned from the gateway.
 	GatewayTxnId string
-	//... other necessary response parameters
+	// ClientSecret lets the user confirm the payment with the gateway, e.g. the client_secret of a Stripe PaymentIntent.
+	// It is passed on to the client, it isn't saved with the transaction.
+	ClientSecret string
+	// ApprovalURL is where the user approves the payment with the gateway, e.g. the approve link of a PayPal order.
+	ApprovalURL string
 }
 
 type PaymentGateway interface {
 	// This request transaction can be converted based on what Payment processor takes in.
 	ProcessPayment(ctx context.Context, req *db.Transaction) (*GatewayResult, error)
+
+	// Refund gives back the amount of the refund from the parent transaction. The refund ID is
+	// stable across retries, so it should be used as the idempotency key with the processor.
+	Refund(ctx context.Context, refund *db.Transaction, parent *db.Transaction) (*GatewayResult, error)
+}
+
+// CallbackParser is implemented by gateways that send their callbacks in a format of their own, like the
+// webhook events of Stripe, instead of models.PaymentCallback. ParseCallback reads the gateway transaction ID,
+// status and error message from the raw body. It returns nil for a callback that doesn't change a transaction.
+type CallbackParser interface {
+	ParseCallback(body []byte) (*models.PaymentCallback, error)
+}
+
+// Capturer is implemented by gateways whose deposits are only authorized by the payer and have to be captured by
+// us, like PayPal orders. Capture is called once the deposit is authorized and returns the status the capture
+// moved it to, with the reason in ErrorMessage, or nil while the capture is pending.
+type Capturer interface {
+	Capture(ctx context.Context, trx *db.Transaction) (*models.PaymentCallback, error)
 }
 
-// Make GetPaymentGateway a variable so it can be mocked in tests
-var GetPaymentGateway = func(countryId int, gatewayId int) PaymentGateway {
-	repo := db.NewGatewayRepository(db.Db)
+// GetPaymentGateway returns the gateway of a transaction in the country. It never picks another gateway than
+// the one asked for: an unknown gateway, a disabled one or one that isn't enabled for the country is an error
+// with the unknown_gateway, gateway_disabled or gateway_not_available reason. Falling back to another gateway
+// is up to the merchant's policy, see resolveGateway. It is a variable so it can be mocked in tests.
+var GetPaymentGateway = func(ctx context.Context, countryId int, gatewayId int) (PaymentGateway, error) {
+	return resolvePaymentGateway(ctx, db.NewGatewayRepository(db.Db), countryId, gatewayId)
+}
 
-	// Get all available gateways for the country
-	gateways, err := repo.GetAvailableGateways(countryId)
+func resolvePaymentGateway(ctx context.Context, repo db.GatewayRepository, countryId int, gatewayId int) (PaymentGateway, error) {
+	gateway, err := repo.GetGateway(ctx, gatewayId)
 	if err != nil {
-		return &StripeGateway{}
+		return nil, err
 	}
-
-	for _, gateway := range gateways {
-		if gateway.ID == gatewayId {
-			return getGatewayImplementation(gateway.Name)
-		}
+	if gateway == nil {
+		return nil, models.NewServiceErrorWithReason(models.ErrorCodeValidation, reasonUnknownGateway, "Unknown gateway.")
 	}
-
-	if len(gateways) > 0 {
-		// Getting the default gateway.
-		return getGatewayImplementation(gateways[0].Name)
+	implementation, ok := getGatewayImplementation(gateway.Name)
+	if !gateway.Enabled || !ok {
+		// InitGateways refuses to start without an adapter for every gateway, so one is only missing for a
+		// gateway added to the table since. It can't take transactions before a restart, like a disabled one.
+		return nil, models.NewServiceErrorWithReason(models.ErrorCodeGatewayUnavailable, routing.ReasonGatewayDisabled,
+			fmt.Sprintf("Gateway %s is disabled.", gateway.Name))
 	}
 
-	// If no gateways available, fallback to Stripe.
-	// If we do not want to do this we can simply return error from here.
-	return &StripeGateway{}
+	available, err := availableGateways(ctx, repo, countryId)
+	if err != nil {
+		return nil, err
+	}
+	for _, candidate := range available {
+		if candidate.ID == gatewayId {
+			return implementation, nil
+		}
+	}
+	return nil, models.NewServiceErrorWithReason(models.ErrorCodeValidation, routing.ReasonGatewayNotAvailable,
+		fmt.Sprintf("Gateway %s is not available in this country.", gateway.Name))
 }
 
-func getGatewayImplementation(gatewayName string) PaymentGateway {
-	switch gatewayName {
-	case "stripe":
-		return &StripeGateway{}
-	case "paypal":
-		// return &PayPalGateway{}
-		return &PaypalGateway{} // Fallback to Stripe for now
-	default:
-		return &StripeGateway{} // Default to Stripe
+// gatewayOf returns the gateway of a saved transaction that is yet to be sent to it. A gateway disabled since
+// the transaction was saved fails it with the reason, the transaction stays with the gateway it was saved with.
+func gatewayOf(ctx context.Context, trx *db.Transaction) PaymentGateway {
+	gateway, err := GetPaymentGateway(ctx, trx.CountryID, trx.GatewayID)
+	if err != nil {
+		return &unavailableGateway{err: err}
 	}
+	return gateway
 }
 
-type StripeGateway struct{}
-
-func (stripe *StripeGateway) ProcessPayment(ctx context.Context, req *db.Transaction) (*GatewayResult, error) {
-	// process payment logic for stripe. This could be an api call with stripe
-	// related config.
-
-	time.Sleep(1 * time.Second) // simulating payment logic
-	randomId := "stripe_txn_" + time.Now().Format("20060102150405")
-	fmt.Println("Stripe payment processed with txn id: ", randomId)
-	return &GatewayResult{
-		GatewayTxnId: randomId,
-	}, nil
+// transactionGateway returns the gateway a saved transaction is with, to capture or refund it. Unlike
+// GetPaymentGateway it doesn't check that the gateway is enabled for the country: that only stops new
+// transactions, the ones already with the gateway are finished there.
+func (p *paymentService) transactionGateway(ctx context.Context, gatewayID int) (PaymentGateway, error) {
+	gateway, err := p.gateways.GetGateway(ctx, gatewayID)
+	if err != nil {
+		return nil, models.NewServiceError(models.ErrorCodeUnknown, "Failed to fetch gateway: "+err.Error())
+	}
+	if gateway == nil {
+		return nil, models.NewServiceErrorWithReason(models.ErrorCodeValidation, reasonUnknownGateway, "Unknown gateway.")
+	}
+	implementation, ok := getGatewayImplementation(gateway.Name)
+	if !ok {
+		// Only a gateway added to the table since the start has no adapter, see InitGateways.
+		return nil, models.NewServiceError(models.ErrorCodeGatewayUnavailable, fmt.Sprintf("Gateway %s has no adapter.", gateway.Name))
+	}
+	return implementation, nil
 }
 
-type PaypalGateway struct{}
+// reasonUnknownGateway is the reason of a gateway id that isn't in the gateways table.
+const reasonUnknownGateway = "unknown_gateway"
 
-func (stripe *PaypalGateway) ProcessPayment(ctx context.Context, req *db.Transaction) (*GatewayResult, error) {
-
-	// process payment logic for paypal. This could be an api call with paypal related config.
-	time.Sleep(1 * time.Second) // simulating payment logic
-	return &GatewayResult{
-		GatewayTxnId: "paypal_txn_id_322323",
-	}, nil
+// availableGateways returns the enabled gateways of the country, none when the country has none.
+func availableGateways(ctx context.Context, repo db.GatewayRepository, countryID int) ([]*db.Gateway, error) {
+	gateways, err := repo.GetAvailableGateways(ctx, countryID)
+	var serviceErr *models.ServiceError
+	if errors.As(err, &serviceErr) && serviceErr.Code == models.ErrorCodeNotFound {
+		return nil, nil
+	}
+	return gateways, err
 }
 
-// Can have more implementation of Gateway interface like Revolut etc.
+// More gateways, like Revolut, are added by registering an adapter for them, see RegisterGateway.
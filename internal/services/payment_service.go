@@ -3,104 +3,330 @@ package services
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"time"
 
 	"payment-gateway/db"
-	"payment-gateway/internal/kafka"
+	"payment-gateway/internal/cache"
+	"payment-gateway/internal/compliance"
+	"payment-gateway/internal/ledger"
+	"payment-gateway/internal/limits"
 	"payment-gateway/internal/models"
+	"payment-gateway/internal/retry"
+	"payment-gateway/internal/risk"
+	"payment-gateway/internal/routing"
 	"payment-gateway/internal/security"
-	"payment-gateway/internal/utils"
 )
 
 type PaymentService interface {
 	// This will deposit the amount to user account.
-	Deposit(req *models.TransactionRequest) (*models.PaymentResult, error)
+	Deposit(ctx context.Context, req *models.TransactionRequest) (*models.PaymentResult, error)
 
 	// This will will withdraw from user amount.
-	Withdraw(req *models.TransactionRequest) (*models.PaymentResult, error)
+	Withdraw(ctx context.Context, req *models.TransactionRequest) (*models.PaymentResult, error)
+
+	// This will refund a completed deposit, fully or partially.
+	Refund(ctx context.Context, req *models.RefundRequest) (*models.RefundResult, error)
 
 	// This function is for external payment gateway to confirm any transaction.
-	HandleCallback(callbackData *models.PaymentCallback) error
+	HandleCallback(ctx context.Context, callbackData *models.PaymentCallback) error
+
+	// This returns one of the user's transactions.
+	GetTransaction(ctx context.Context, userID int, transactionID int) (*models.Transaction, error)
+
+	// This returns a page of the user's transactions, newest first.
+	ListTransactions(ctx context.Context, query *models.TransactionQuery) (*models.TransactionPage, error)
+
+	// This returns every status change of one of the user's transactions.
+	GetTransactionEvents(ctx context.Context, userID int, transactionID int) (*models.TransactionTimeline, error)
 }
 
+// Every stage of a payment has its own deadline, within the deadline of the request. A client that goes
+// away cancels the stage that is running, except for saving what already happened, see detached.
+var (
+	// CheckTimeout bounds the checks before a transaction is saved: balance, limits, compliance and risk.
+	CheckTimeout = 5 * time.Second
+	// StoreTimeout bounds saving a transaction together with its effects.
+	StoreTimeout = 5 * time.Second
+	// GatewayTimeout bounds one call to the gateway.
+	GatewayTimeout = 20 * time.Second
+	// GatewayRetry is how a failed gateway call is retried. Gateways mark the errors that retrying
+	// won't fix, like a declined card, with retry.Permanent and those are returned at once.
+	GatewayRetry = retry.Policy{MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: 4 * time.Second}
+)
+
 type paymentService struct {
-	cs   ComplianceService
-	as   AccountService
-	repo db.TransactionRepository
+	cs        ComplianceService
+	as        AccountService
+	risk      RiskScorer
+	limits    limits.Checker
+	repo      db.TransactionRepository
+	countries db.CountryRepository
+	gateways  db.GatewayRepository
+	routing   *routing.Config
+	router    *routing.Router
 }
 
 func NewPaymentService() PaymentService {
+	return newPaymentService()
+}
+
+func newPaymentService() *paymentService {
 	return &paymentService{
-		cs:   &MyComplianceService{},
-		as:   NewAccountService(),
-		repo: db.NewTransactionRepository(db.Db),
+		cs:        NewComplianceService(),
+		as:        NewAccountService(),
+		risk:      NewRiskScorer(),
+		limits:    limits.NewEngine(db.NewLimitRepository(db.Db), cache.NewLimitRuleCache()),
+		repo:      db.NewTransactionRepository(db.Db),
+		countries: db.NewCountryRepository(db.Db),
+		gateways:  db.NewGatewayRepository(db.Db),
+		routing:   routingConfig,
+		router:    gatewayRouter,
 	}
 }
 
-func (p *paymentService) Deposit(req *models.TransactionRequest) (*models.PaymentResult, error) {
-	if _, err := p.cs.CheckStatus(req); err != nil {
-		return nil, models.NewServiceError(models.ErrorCodeValidation, err.Error())
+func (p *paymentService) Deposit(ctx context.Context, req *models.TransactionRequest) (*models.PaymentResult, error) {
+	checkCtx, cancel := context.WithTimeout(ctx, CheckTimeout)
+	defer cancel()
+
+	route, err := p.resolveGateway(checkCtx, req, db.TypeDeposit)
+	if err != nil {
+		return nil, err
+	}
+	// The checks are made for the gateway that moves the money.
+	req = route.route(req)
+
+	amount, err := p.validateCurrency(checkCtx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	limitReview, recheck, err := p.checkLimits(checkCtx, req, db.TypeDeposit, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	decision, err := p.checkCompliance(checkCtx, req, db.TypeDeposit, amount)
+	if err != nil {
+		return nil, err
+	}
+	if limitReview != nil {
+		decision.Add(*limitReview)
+	}
+
+	assessment, err := p.scoreRisk(checkCtx, req, db.TypeDeposit, amount)
+	if err != nil {
+		return nil, err
 	}
+	decision.Add(riskResult(assessment))
 
 	trx := &db.Transaction{
-		Amount:    req.Amount,
+		Amount:    amount,
 		Type:      db.TypeDeposit,
 		UserID:    req.UserID,
 		GatewayID: req.GatewayID,
 		CreatedAt: time.Now(),
 		CountryID: req.CountryID,
 	}
+	route.record(trx)
 
-	err := p.processTransaction(trx)
+	result, err := p.processTransaction(ctx, trx, route, decision, assessment, recheck)
 	if err != nil {
 		return nil, err
 	}
 
-	return &models.PaymentResult{
+	payment := &models.PaymentResult{
 		TransactionId: trx.ID,
-	}, nil
+		Status:        trx.Status,
+	}
+	if result != nil {
+		// The user confirms the payment with the gateway, e.g. a Stripe PaymentIntent with its client secret
+		// or a PayPal order on its approval page.
+		payment.ClientSecret = result.ClientSecret
+		payment.ApprovalURL = result.ApprovalURL
+	}
+	return payment, nil
 }
 
-func (p *paymentService) Withdraw(req *models.TransactionRequest) (*models.PaymentResult, error) {
-	// Get balance from account service
-	balance, err := p.as.GetBalance(req.UserID)
+func (p *paymentService) Withdraw(ctx context.Context, req *models.TransactionRequest) (*models.PaymentResult, error) {
+	checkCtx, cancel := context.WithTimeout(ctx, CheckTimeout)
+	defer cancel()
+
+	route, err := p.resolveGateway(checkCtx, req, db.TypeWithdraw)
+	if err != nil {
+		return nil, err
+	}
+	// The checks are made for the gateway that moves the money.
+	req = route.route(req)
+
+	amount, err := p.validateCurrency(checkCtx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get balance from account service. This only turns away withdrawals that can't be covered early,
+	// the hold placed when the transaction is saved is what guarantees the balance.
+	balance, err := p.as.GetBalance(checkCtx, req.UserID, amount.Currency)
 	if err != nil {
-		return nil, models.NewServiceError(models.ErrorCodeUnknown, "Failed to get account balance: "+err.Error())
+		return nil, stageError(checkCtx, "Failed to get account balance", err)
 	}
 
-	if err = p.validateBalance(balance, req); err != nil {
+	if err = p.validateBalance(balance, amount); err != nil {
+		return nil, err
+	}
+
+	limitReview, recheck, err := p.checkLimits(checkCtx, req, db.TypeWithdraw, amount)
+	if err != nil {
 		return nil, err
 	}
 
 	// Compliance check after balance validation
-	if sts, err := p.cs.CheckStatus(req); err != nil {
-		return nil, models.NewServiceError(models.ErrorCodeValidation, "Compliance check failed: "+sts)
+	decision, err := p.checkCompliance(checkCtx, req, db.TypeWithdraw, amount)
+	if err != nil {
+		return nil, err
+	}
+	if limitReview != nil {
+		decision.Add(*limitReview)
 	}
 
+	assessment, err := p.scoreRisk(checkCtx, req, db.TypeWithdraw, amount)
+	if err != nil {
+		return nil, err
+	}
+	decision.Add(riskResult(assessment))
+
 	trx := &db.Transaction{
-		Amount:    req.Amount,
+		Amount:    amount,
 		Type:      db.TypeWithdraw,
 		UserID:    req.UserID,
 		GatewayID: req.GatewayID,
 		CreatedAt: time.Now(),
 		CountryID: req.CountryID,
 	}
+	route.record(trx)
 
-	err = p.processTransaction(trx)
+	_, err = p.processTransaction(ctx, trx, route, decision, assessment, recheck)
 	if err != nil {
 		return nil, err
 	}
 
 	return &models.PaymentResult{
 		TransactionId: trx.ID,
+		Status:        trx.Status,
 	}, nil
 }
 
-func (p *paymentService) HandleCallback(callbackData *models.PaymentCallback) error {
+func (p *paymentService) Refund(ctx context.Context, req *models.RefundRequest) (*models.RefundResult, error) {
+	parent, err := p.repo.GetTransactionByID(ctx, req.TransactionID)
+	if err != nil {
+		return nil, models.NewServiceError(models.ErrorCodeUnknown, "Failed to fetch transaction: "+err.Error())
+	}
+	if parent == nil || parent.UserID != req.UserID {
+		// Users can only refund their own transactions.
+		return nil, models.NewServiceError(models.ErrorCodeNotFound, "Transaction not found")
+	}
+	if parent.Type != db.TypeDeposit {
+		return nil, models.NewServiceError(models.ErrorCodeValidation, "Only deposits can be refunded")
+	}
+	if parent.Status != db.StatusCompleted {
+		return nil, models.NewServiceError(models.ErrorCodeConflict, "Only completed transactions can be refunded")
+	}
+	if req.Currency != "" && req.Currency != parent.Amount.Currency {
+		return nil, models.NewServiceError(
+			models.ErrorCodeValidation,
+			fmt.Sprintf("refund has to be in %s, the currency of the transaction", parent.Amount.Currency),
+		)
+	}
+
+	amount := models.Money{Minor: req.Amount, Currency: parent.Amount.Currency}
+	if amount.IsZero() {
+		// A full refund gives back whatever hasn't been refunded yet.
+		refunded, err := p.repo.GetRefundedAmount(ctx, parent.ID)
+		if err != nil {
+			return nil, models.NewServiceError(models.ErrorCodeUnknown, "Failed to fetch refunds: "+err.Error())
+		}
+		amount.Minor = parent.Amount.Minor - refunded
+		if !amount.IsPositive() {
+			return nil, models.NewServiceError(models.ErrorCodeConflict, "Transaction has already been fully refunded")
+		}
+	}
+
+	// The deposit is refunded by its gateway, even when it was disabled since.
+	gt, err := p.transactionGateway(ctx, parent.GatewayID)
+	if err != nil {
+		return nil, err
+	}
+	if err := supports(gt, db.TypeRefund, amount.Currency); err != nil {
+		return nil, err
+	}
+
+	refund := &db.Transaction{
+		Amount:    amount,
+		Type:      db.TypeRefund,
+		Status:    db.StatusInitiated,
+		UserID:    parent.UserID,
+		GatewayID: parent.GatewayID,
+		CountryID: parent.CountryID,
+		ParentID:  parent.ID,
+		CreatedAt: time.Now(),
+	}
+
+	// The refund is saved before we call the gateway, that's what reserves the amount against
+	// concurrent refunds of the same transaction. It holds the amount from the user's balance
+	// too, the deposit may have been spent or withdrawn since.
+	record := initialTransition(refund, "refund requested")
+	effects := withLedger(&db.Effects{History: []*db.TransactionEvent{record}}, refund, record)
+	storeCtx, cancel := context.WithTimeout(ctx, StoreTimeout)
+	defer cancel()
+	if _, err := p.repo.CreateRefund(storeCtx, refund, effects); err != nil {
+		if errors.Is(err, db.ErrRefundExceedsAmount) {
+			return nil, models.NewServiceError(models.ErrorCodeValidation, "Refund amount exceeds the refundable amount of the transaction")
+		}
+		if errors.Is(err, ledger.ErrInsufficientFunds) {
+			return nil, models.NewServiceError(models.ErrorCodeInsufficientFunds, "Insufficient funds.")
+		}
+		return nil, models.NewServiceError(models.ErrorCodeUnknown, "Failed to save refund.")
+	}
+
+	_, err = p.callGateway(ctx, refund, EventRefundCreated, func(ctx context.Context) (*GatewayResult, error) {
+		return gt.Refund(ctx, refund, parent)
+	})
+	if err != nil {
+		// A failed refund no longer counts against the refundable amount.
+		return nil, err
+	}
+
+	return &models.RefundResult{
+		RefundID:      refund.ID,
+		TransactionID: parent.ID,
+		Amount:        refund.Amount,
+		Status:        refund.Status,
+	}, nil
+}
+
+func (p *paymentService) HandleCallback(ctx context.Context, callbackData *models.PaymentCallback) error {
+	ignored, err := p.parseCallback(ctx, callbackData)
+	if err != nil {
+		return err
+	}
+	if ignored {
+		// Gateways send events we have no use for, they are acknowledged so they aren't sent again.
+		return nil
+	}
+	if err := callbackData.Validate(); err != nil {
+		return models.NewServiceError(models.ErrorCodeValidation, err.Error())
+	}
+	return p.applyCallback(ctx, callbackData)
+}
+
+// applyCallback moves the transaction of the callback to the status of the callback.
+func (p *paymentService) applyCallback(ctx context.Context, callbackData *models.PaymentCallback) error {
 	// Fetch the original transaction
-	trx, err := p.repo.GetTransactionByGatewayTxnId(callbackData.GatewayTxnID)
+	// A gateway can only update its own transactions.
+	trx, err := p.repo.GetTransactionByGatewayTxnId(ctx, callbackData.GatewayID, callbackData.GatewayTxnID)
 	if err != nil {
 		return models.NewServiceError(models.ErrorCodeUnknown, "Failed to fetch transaction: "+err.Error())
 	}
@@ -109,86 +335,651 @@ func (p *paymentService) HandleCallback(callbackData *models.PaymentCallback) er
 	}
 
 	if transactionAlreadyProcessed(trx, callbackData) {
-		// Ignore the status update because we have already processed this transaction.
+		// Ignore the status update because we have already processed this transaction. What follows
+		// the status is only done once it is saved, so a gateway retrying after that failed gets it done now.
+		return p.followUp(ctx, trx)
+	}
+
+	// Update transaction status based on what we received in the callback, if the state machine allows it.
+	reason := callbackData.ErrorMessage
+	if reason == "" {
+		reason = "gateway callback"
+	}
+	record, err := transition(trx, callbackData.Status, reason, SourceCallback)
+	switch {
+	case errors.Is(err, ErrStaleTransition):
+		// Callbacks can arrive out of order. The transaction is already past this status,
+		// so the callback carries nothing new and is acknowledged without changing anything.
+		log.Printf("ignoring callback for transaction %d: %v", trx.ID, err)
 		return nil
+	case errors.Is(err, ErrUnknownStatus):
+		return models.NewServiceError(models.ErrorCodeValidation, err.Error())
+	case err != nil:
+		return models.NewServiceError(models.ErrorCodeConflict, err.Error())
 	}
+	record.Payload = callbackData.RawPayload
+	record.PayloadFormat = callbackData.PayloadFormat
 
-	// Update transaction status based on what we received in the callback.
-	trx.Status = callbackData.Status
-	if err := p.repo.Update(*trx); err != nil {
+	// The status update is published to kafka through the outbox, in the same db transaction.
+	eventType := EventTransactionUpdated
+	if trx.Type == db.TypeRefund {
+		eventType = EventRefundUpdated
+	}
+	effects := withLedger(&db.Effects{
+		Outbox:  []*db.OutboxEvent{newTransactionEvent(trx, eventType)},
+		History: []*db.TransactionEvent{record},
+	}, trx, record)
+	// The gateway sends the callback again when it doesn't get an answer, a cancelled update can be rolled back.
+	storeCtx, cancel := context.WithTimeout(ctx, StoreTimeout)
+	defer cancel()
+	err = p.repo.Update(storeCtx, *trx, record.FromStatus, effects)
+	if errors.Is(err, db.ErrStaleTransaction) {
+		// Another delivery of a callback changed the transaction after we read it. The gateway
+		// sends this one again and it is checked against the status that was saved.
+		return models.NewServiceError(models.ErrorCodeConflict, "Transaction was updated concurrently, try again.")
+	}
+	if err != nil {
 		return models.NewServiceError(models.ErrorCodeUnknown, "Failed to update transaction.")
 	}
+	p.observeOutcome(trx, record)
+
+	return p.followUp(ctx, trx)
+}
+
+// followUp does what a status saved from a callback leads to: a completed refund can complete the refund of
+// its deposit, and an authorized deposit is captured when its gateway leaves that to us.
+func (p *paymentService) followUp(ctx context.Context, trx *db.Transaction) error {
+	switch {
+	case trx.Type == db.TypeRefund && trx.Status == db.StatusCompleted:
+		return p.completeRefund(ctx, trx)
+	case trx.Type == db.TypeDeposit && trx.Status == db.StatusAuthorized:
+		return p.capture(ctx, trx)
+	}
+	return nil
+}
+
+// capture captures an authorized deposit when its gateway is a Capturer, and applies the outcome like a callback.
+// A capture that fails is tried again when the gateway sends the callback again.
+func (p *paymentService) capture(ctx context.Context, trx *db.Transaction) error {
+	// An approved deposit is captured by its gateway, even when it was disabled since. When the gateway can't
+	// be resolved the callback fails, so it is tried again.
+	gateway, err := p.transactionGateway(ctx, trx.GatewayID)
+	if err != nil {
+		return err
+	}
+	capturer, ok := adapterOf(gateway).(Capturer)
+	if !ok {
+		return nil
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, GatewayTimeout)
+	defer cancel()
+	outcome, err := capturer.Capture(callCtx, trx)
+	if err != nil {
+		var serviceErr *models.ServiceError
+		if errors.As(err, &serviceErr) {
+			return serviceErr
+		}
+		return models.NewServiceError(models.ErrorCodeGatewayError, "Payment gateway error.")
+	}
+	if outcome == nil || outcome.Status == trx.Status {
+		// The capture is pending, its outcome comes with a callback of its own.
+		return nil
+	}
+	outcome.GatewayTxnID = trx.GatewayTxnId
+	outcome.GatewayID = trx.GatewayID
+	return p.applyCallback(ctx, outcome)
+}
+
+// parseCallback fills the callback from its raw body when the gateway sends callbacks in a format of its own,
+// see CallbackParser. ignored is true for a callback that doesn't change a transaction.
+func (p *paymentService) parseCallback(ctx context.Context, callbackData *models.PaymentCallback) (ignored bool, err error) {
+	gateway, err := p.gateways.GetGateway(ctx, callbackData.GatewayID)
+	if err != nil {
+		return false, models.NewServiceError(models.ErrorCodeUnknown, "Failed to fetch gateway: "+err.Error())
+	}
+	if gateway == nil {
+		return false, nil
+	}
+	parser, ok := getCallbackParser(gateway.Name)
+	if !ok {
+		return false, nil
+	}
+
+	parsed, err := parser.ParseCallback(callbackData.RawPayload)
+	if err != nil {
+		return false, models.NewServiceError(models.ErrorCodeValidation, err.Error())
+	}
+	if parsed == nil {
+		return true, nil
+	}
+	callbackData.GatewayTxnID = parsed.GatewayTxnID
+	callbackData.Status = parsed.Status
+	callbackData.ErrorMessage = parsed.ErrorMessage
+	return false, nil
+}
+
+func (p *paymentService) GetTransaction(ctx context.Context, userID int, transactionID int) (*models.Transaction, error) {
+	trx, err := p.userTransaction(ctx, userID, transactionID)
+	if err != nil {
+		return nil, err
+	}
+	return toTransactionModel(trx), nil
+}
+
+func (p *paymentService) ListTransactions(ctx context.Context, query *models.TransactionQuery) (*models.TransactionPage, error) {
+	if query.Status != "" && !IsKnownStatus(query.Status) {
+		return nil, models.NewServiceError(models.ErrorCodeValidation, "invalid status")
+	}
+	switch query.Type {
+	case "", db.TypeDeposit, db.TypeWithdraw, db.TypeRefund:
+	default:
+		return nil, models.NewServiceError(models.ErrorCodeValidation, "invalid transaction type")
+	}
+
+	filter := db.TransactionFilter{
+		UserID:      query.UserID,
+		Status:      query.Status,
+		Type:        query.Type,
+		GatewayID:   query.GatewayID,
+		Currency:    query.Currency,
+		CreatedFrom: query.CreatedFrom,
+		CreatedTo:   query.CreatedTo,
+		// One more than asked for tells us whether there is a next page.
+		Limit: query.Limit + 1,
+	}
+	if query.Cursor != "" {
+		cursor, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return nil, models.NewServiceError(models.ErrorCodeValidation, err.Error())
+		}
+		filter.After = cursor
+	}
+
+	transactions, err := p.repo.ListTransactions(ctx, filter)
+	if err != nil {
+		return nil, models.NewServiceError(models.ErrorCodeUnknown, "Failed to fetch transactions: "+err.Error())
+	}
+
+	page := &models.TransactionPage{Transactions: make([]models.Transaction, 0, len(transactions))}
+	if len(transactions) > query.Limit {
+		transactions = transactions[:query.Limit]
+		page.NextCursor = encodeCursor(transactions[len(transactions)-1])
+	}
+	for _, trx := range transactions {
+		page.Transactions = append(page.Transactions, *toTransactionModel(trx))
+	}
+	return page, nil
+}
+
+func (p *paymentService) GetTransactionEvents(ctx context.Context, userID int, transactionID int) (*models.TransactionTimeline, error) {
+	trx, err := p.userTransaction(ctx, userID, transactionID)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := p.repo.GetEvents(ctx, trx.ID)
+	if err != nil {
+		return nil, models.NewServiceError(models.ErrorCodeUnknown, "Failed to fetch transaction events: "+err.Error())
+	}
+
+	timeline := &models.TransactionTimeline{
+		TransactionID: trx.ID,
+		Type:          trx.Type,
+		Status:        trx.Status,
+		Amount:        trx.Amount,
+		Events:        make([]models.TransactionEvent, 0, len(events)),
+	}
+	for _, event := range events {
+		timeline.Events = append(timeline.Events, models.TransactionEvent{
+			FromStatus:    event.FromStatus,
+			ToStatus:      event.ToStatus,
+			Reason:        event.Reason,
+			Source:        event.Source,
+			Payload:       string(event.Payload),
+			PayloadFormat: event.PayloadFormat,
+			CreatedAt:     event.CreatedAt,
+		})
+	}
+	return timeline, nil
+}
+
+// userTransaction returns the transaction if it belongs to the user. Other users' transactions
+// are reported as not found, so their ids can't be probed.
+func (p *paymentService) userTransaction(ctx context.Context, userID int, transactionID int) (*db.Transaction, error) {
+	trx, err := p.repo.GetTransactionByID(ctx, transactionID)
+	if err != nil {
+		return nil, models.NewServiceError(models.ErrorCodeUnknown, "Failed to fetch transaction: "+err.Error())
+	}
+	if trx == nil || trx.UserID != userID {
+		return nil, models.NewServiceError(models.ErrorCodeNotFound, "Transaction not found")
+	}
+	return trx, nil
+}
+
+func toTransactionModel(trx *db.Transaction) *models.Transaction {
+	return &models.Transaction{
+		ID:                 trx.ID,
+		Type:               trx.Type,
+		Status:             trx.Status,
+		Amount:             trx.Amount,
+		GatewayID:          trx.GatewayID,
+		RequestedGatewayID: trx.RequestedGatewayID,
+		CountryID:          trx.CountryID,
+		ParentID:           trx.ParentID,
+		CreatedAt:          trx.CreatedAt,
+	}
+}
+
+// completeRefund marks the parent as refunded once its refunds have all settled and add up to its amount.
+func (p *paymentService) completeRefund(ctx context.Context, refund *db.Transaction) error {
+	parent, err := p.repo.GetTransactionByID(ctx, refund.ParentID)
+	if err != nil || parent == nil {
+		return models.NewServiceError(models.ErrorCodeUnknown, "Failed to fetch refunded transaction.")
+	}
+	if parent.Status != db.StatusCompleted {
+		return nil
+	}
 
-	// Publish status update to Kafka
-	go SendToKafka(trx)
+	refunds, err := p.repo.GetRefunds(ctx, parent.ID)
+	if err != nil {
+		return models.NewServiceError(models.ErrorCodeUnknown, "Failed to fetch refunds.")
+	}
+	var refunded int64
+	for _, r := range refunds {
+		switch r.Status {
+		case db.StatusCompleted:
+			refunded += r.Amount.Minor
+		case db.StatusFailed:
+		default:
+			// Still waiting for the gateway, it may fail yet.
+			return nil
+		}
+	}
+	if refunded < parent.Amount.Minor {
+		return nil
+	}
 
+	record, err := transition(parent, db.StatusRefunded, "fully refunded", SourceCallback)
+	if err != nil {
+		return models.NewServiceError(models.ErrorCodeConflict, err.Error())
+	}
+	effects := withLedger(&db.Effects{
+		Outbox:  []*db.OutboxEvent{newTransactionEvent(parent, EventTransactionUpdated)},
+		History: []*db.TransactionEvent{record},
+	}, parent, record)
+	err = p.repo.Update(ctx, *parent, record.FromStatus, effects)
+	if errors.Is(err, db.ErrStaleTransaction) {
+		// The last two refunds completed at the same time and the other one got here first.
+		return nil
+	}
+	if err != nil {
+		return models.NewServiceError(models.ErrorCodeUnknown, "Failed to update transaction.")
+	}
 	return nil
 }
 
-func SendToKafka(trx *db.Transaction) {
-	jsonMsg, _ := json.Marshal(map[string]interface{}{
+const (
+	EventTransactionCreated = "transaction.created"
+	EventTransactionUpdated = "transaction.updated"
+	EventRefundCreated      = "refund.created"
+	EventRefundUpdated      = "refund.updated"
+)
+
+// newTransactionEvent builds the kafka event for other services of our system. It is stored in
+// the outbox together with the transaction and published by the outbox relay, so a broker outage
+// only delays the event instead of losing it.
+func newTransactionEvent(trx *db.Transaction, eventType string) *db.OutboxEvent {
+	message := map[string]interface{}{
 		"status": trx.Status,
 		"userId": security.MaskData([]byte(fmt.Sprint(trx.UserID))),
-		"amount": security.MaskData([]byte(fmt.Sprintf("%.2f", trx.Amount))),
-		"type":   trx.Type,
-	})
+		// Amount is sent in minor units of the currency, same as we store it.
+		"amount":   security.MaskData([]byte(strconv.FormatInt(trx.Amount.Minor, 10))),
+		"currency": trx.Amount.Currency,
+		"type":     trx.Type,
+	}
+	if trx.ParentID != 0 {
+		message["parentId"] = trx.ParentID
+	}
+	jsonMsg, _ := json.Marshal(message)
 
-	err := utils.PublishWithCircuitBreaker(func() error {
-		return kafka.PublishTransaction(context.Background(), fmt.Sprint(trx.ID), jsonMsg, "application/json")
-	})
-	if err != nil {
-		// Handling this error is critical because the transaction is already recorded but
-		// failed to publish to the topic for other services. In this case, we can apply couple of approaches.
-		// 1. Send it to different topic such as Dead Letter Queue (DLQ) for manual intervention.
-		// 2. Or, we save the failed event in database and try to send it again after some time
-		// using cronjob and clear it.
-		log.Printf("failed to publish callback to kafka: %v", err)
+	event := &db.OutboxEvent{
+		AggregateType: "transaction",
+		EventType:     eventType,
+		DataFormat:    "application/json",
+		Payload:       jsonMsg,
 	}
+	if trx.ID != 0 {
+		event.AggregateID = strconv.Itoa(trx.ID)
+	}
+	return event
 }
 
 func transactionAlreadyProcessed(trx *db.Transaction, callbackData *models.PaymentCallback) bool {
 	return trx.Status == callbackData.Status
 }
 
-func (p *paymentService) processTransaction(trx *db.Transaction) error {
-	gt := GetPaymentGateway(trx.CountryID, trx.GatewayID)
+func (p *paymentService) processTransaction(ctx context.Context, trx *db.Transaction, route *gatewayRoute, decision *compliance.Decision, assessment *risk.Assessment, recheck *limits.Recheck) (*GatewayResult, error) {
+	// The transaction is saved before we call the gateway, so there is a record of every payment we attempted
+	// even if we crash halfway. The routing decision, compliance decision and risk score are saved with it.
+	trx.Status = db.StatusInitiated
+	record := initialTransition(trx, trx.Type+" requested"+route.describe())
+	effects := &db.Effects{
+		History:    []*db.TransactionEvent{record},
+		Compliance: decision,
+		Risk:       assessment,
+		Routing:    route.routingDecision(),
+	}
+	if decision.Outcome != compliance.OutcomeReject {
+		// Withdrawals hold their amount here, checking the balance in the same database transaction.
+		// Withdrawals going to review keep the hold while they wait.
+		withLedger(effects, trx, record)
+		// The daily and weekly limits are checked again under a lock on the user, with the transactions
+		// of the user saved since they were checked.
+		if recheck != nil && decision.Outcome == compliance.OutcomeReview {
+			recheck = recheck.Rejecting()
+		}
+		effects.Limits = recheck
+	}
+	storeCtx, cancel := context.WithTimeout(ctx, StoreTimeout)
+	defer cancel()
+	savedTrx, err := p.repo.Create(storeCtx, trx, effects)
+	var violation *limits.Violation
+	if errors.As(err, &violation) && violation.NeedsReview() {
+		// Another transaction of the user took what was left of a limit that sends it to review.
+		decision.Add(limitReview(violation))
+		effects.Limits = recheck.Rejecting()
+		savedTrx, err = p.repo.Create(storeCtx, trx, effects)
+	}
+	if errors.As(err, &violation) {
+		return nil, limitError(violation)
+	}
+	if errors.Is(err, ledger.ErrInsufficientFunds) {
+		return nil, models.NewServiceError(models.ErrorCodeInsufficientFunds, "Insufficient funds.")
+	}
+	if err != nil {
+		return nil, models.NewServiceError(models.ErrorCodeUnknown, "Failed to save transaction.")
+	}
+	trx.ID = savedTrx.ID
+
+	switch decision.Outcome {
+	case compliance.OutcomeReject:
+		return nil, p.declineTransaction(ctx, trx, decision)
+	case compliance.OutcomeReview:
+		return nil, p.parkTransaction(ctx, trx, decision)
+	}
+
+	gt := gatewayOf(ctx, trx)
+	return p.callGateway(ctx, trx, EventTransactionCreated, func(ctx context.Context) (*GatewayResult, error) {
+		return gt.ProcessPayment(ctx, trx)
+	})
+}
+
+// declineTransaction fails a transaction the compliance rules rejected, without sending it to the gateway.
+// Nothing was held for it, so the ledger has nothing to give back.
+func (p *paymentService) declineTransaction(ctx context.Context, trx *db.Transaction, decision *compliance.Decision) error {
+	record, err := transition(trx, db.StatusFailed, "compliance "+decision.Outcome+": "+decision.Reasons(), SourceCompliance)
+	if err != nil {
+		return models.NewServiceError(models.ErrorCodeUnknown, err.Error())
+	}
+	effects := &db.Effects{
+		Outbox:  []*db.OutboxEvent{newTransactionEvent(trx, EventTransactionCreated)},
+		History: []*db.TransactionEvent{record},
+	}
+	// The transaction is saved already, it can't be left initiated because the client went away.
+	storeCtx, cancel := detached(ctx)
+	defer cancel()
+	if err := p.repo.Update(storeCtx, *trx, record.FromStatus, effects); err != nil {
+		return models.NewServiceError(models.ErrorCodeUnknown, "Failed to update transaction.")
+	}
+
+	// The reasons stay with us, telling the user which rule they hit would help them get around it.
+	return models.NewServiceErrorWithReason(models.ErrorCodeComplianceRejected, "compliance_rejected",
+		"Transaction was rejected by compliance checks.")
+}
 
-	err := utils.RetryOperation(func() error {
-		// Create a new background context for the critical section.
-		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+// parkTransaction moves a flagged transaction to review, where it waits for an operator instead of
+// going to the gateway. A withdrawal keeps its hold in the meantime, see ApproveReview and RejectReview.
+func (p *paymentService) parkTransaction(ctx context.Context, trx *db.Transaction, decision *compliance.Decision) error {
+	record, err := transition(trx, db.StatusReview, "compliance "+decision.Outcome+": "+decision.Reasons(), SourceCompliance)
+	if err != nil {
+		return models.NewServiceError(models.ErrorCodeUnknown, err.Error())
+	}
+	effects := &db.Effects{
+		Outbox:  []*db.OutboxEvent{newTransactionEvent(trx, EventTransactionCreated)},
+		History: []*db.TransactionEvent{record},
+	}
+	// The transaction is saved already, it can't be left initiated because the client went away.
+	storeCtx, cancel := detached(ctx)
+	defer cancel()
+	if err := p.repo.Update(storeCtx, *trx, record.FromStatus, effects); err != nil {
+		return models.NewServiceError(models.ErrorCodeUnknown, "Failed to update transaction.")
+	}
+	return nil
+}
+
+// callGateway sends an initiated transaction to the gateway and moves it to pending, or to failed when the
+// gateway doesn't take it. The created event is only published then, once we know the outcome.
+func (p *paymentService) callGateway(ctx context.Context, trx *db.Transaction, eventType string, call func(ctx context.Context) (*GatewayResult, error)) (*GatewayResult, error) {
+	var result *GatewayResult
+	err := retry.Do(ctx, GatewayRetry, func(ctx context.Context) error {
+		// Every attempt gets the whole gateway budget, a client that goes away cancels the call.
+		callCtx, cancel := context.WithTimeout(ctx, GatewayTimeout)
 		defer cancel()
-		result, err := gt.ProcessPayment(ctx, trx)
+		start := time.Now()
+		attempt, err := call(callCtx)
+		p.observeCall(ctx, trx.GatewayID, err, time.Since(start))
 		if err != nil {
 			return err
 		}
-		trx.Status = db.StatusPending
+		result = attempt
 		trx.GatewayTxnId = result.GatewayTxnId
 		return nil
-	}, 3)
-	if err != nil {
-		return models.NewServiceError(models.ErrorCodeGatewayError, "Payment gateway error.")
-	}
+	})
 
-	savedTrx, err := p.repo.Create(trx)
-	if err != nil {
-		return models.NewServiceError(models.ErrorCodeUnknown, "Failed to save transaction.")
+	to, reason := db.StatusPending, "accepted by gateway"
+	switch {
+	case err == nil:
+	case gatewayRefused(err):
+		to, reason = db.StatusFailed, "gateway error: "+err.Error()
+	default:
+		// The gateway may have taken the transaction before the call timed out or the client went away,
+		// so it isn't failed: it stays pending, a withdrawal keeps its hold, until the gateway tells.
+		reason = "gateway outcome unknown: " + err.Error()
+	}
+	record, trErr := transition(trx, to, reason, SourceGateway)
+	if trErr != nil {
+		return nil, models.NewServiceError(models.ErrorCodeUnknown, trErr.Error())
 	}
 
-	trx.ID = savedTrx.ID
+	effects := withLedger(&db.Effects{
+		Outbox:  []*db.OutboxEvent{newTransactionEvent(trx, eventType)},
+		History: []*db.TransactionEvent{record},
+	}, trx, record)
+	// What the gateway answered is saved even when the client is gone, or the transaction would stay initiated.
+	storeCtx, cancel := detached(ctx)
+	defer cancel()
+	if err := p.repo.Update(storeCtx, *trx, record.FromStatus, effects); err != nil {
+		return nil, models.NewServiceError(models.ErrorCodeUnknown, "Failed to update transaction.")
+	}
+	if reachedGateway(ctx, err) {
+		p.observeOutcome(trx, record)
+	}
 
-	go SendToKafka(trx)
+	if err != nil && !gatewayRefused(err) {
+		code := models.ErrorCodeGatewayError
+		if errors.Is(err, context.DeadlineExceeded) {
+			code = models.ErrorCodeTimeout
+		}
+		return nil, models.NewServiceErrorWithReason(code, ReasonOutcomeUnknown, "Payment gateway didn't answer, the transaction is pending until it does.")
+	}
+	if err != nil {
+		var serviceErr *models.ServiceError
+		if errors.As(err, &serviceErr) {
+			// The gateway told us why, e.g. a declined card.
+			return nil, serviceErr
+		}
+		return nil, models.NewServiceError(models.ErrorCodeGatewayError, "Payment gateway error.")
+	}
+	return result, nil
+}
 
-	return nil
+// ReasonOutcomeUnknown is the reason of the error of a call to the gateway that didn't tell whether
+// the gateway took the transaction.
+const ReasonOutcomeUnknown = "gateway_outcome_unknown"
+
+// gatewayRefused reports whether the gateway turned the transaction down for good: it returned an error
+// retrying won't fix, or declined it. Anything else, like a timeout or an error every retry ran into,
+// doesn't say whether the gateway took the transaction.
+func gatewayRefused(err error) bool {
+	var serviceErr *models.ServiceError
+	if errors.As(err, &serviceErr) && serviceErr.Code == models.ErrorCodePaymentDeclined {
+		return true
+	}
+	return !retry.Retryable(err)
 }
 
-func (p *paymentService) validateBalance(balance float64, req *models.TransactionRequest) error {
-	if balance < req.Amount {
+func (p *paymentService) validateBalance(balance models.Money, amount models.Money) error {
+	cmp, err := balance.Cmp(amount)
+	if err != nil {
+		return models.NewServiceError(models.ErrorCodeUnknown, "Failed to compare balance: "+err.Error())
+	}
+	if cmp < 0 {
 		return models.NewServiceError(
 			models.ErrorCodeInsufficientFunds,
 			"Insufficient funds.",
 		)
 	}
-	// It will consist of bunch of other validations like daily limit, weekly limit,
-	// minimum amount for withdrawal and so on.
 	return nil
 }
+
+// checkLimits checks the transaction against the configured limits, see the limits package.
+// A limit with the review action doesn't fail the check, it is returned as a compliance result
+// that sends the transaction to review. The daily and weekly limits are returned to be checked again
+// when the transaction is saved.
+func (p *paymentService) checkLimits(ctx context.Context, req *models.TransactionRequest, transactionType string, amount models.Money) (*compliance.Result, *limits.Recheck, error) {
+	recheck, err := p.limits.Check(ctx, &limits.Request{
+		UserID:          req.UserID,
+		CountryID:       req.CountryID,
+		GatewayID:       req.GatewayID,
+		TransactionType: transactionType,
+		Amount:          amount,
+	})
+	var violation *limits.Violation
+	if errors.As(err, &violation) {
+		if violation.NeedsReview() {
+			review := limitReview(violation)
+			return &review, recheck, nil
+		}
+		return nil, nil, limitError(violation)
+	}
+	if err != nil {
+		return nil, nil, stageError(ctx, "Failed to check limits", err)
+	}
+	return nil, recheck, nil
+}
+
+// limitReview is the compliance result of a limit with the review action.
+func limitReview(violation *limits.Violation) compliance.Result {
+	return compliance.Result{Rule: violation.Code, Outcome: compliance.OutcomeReview, Reason: violation.Error()}
+}
+
+func limitError(violation *limits.Violation) error {
+	return models.NewServiceErrorWithReason(models.ErrorCodeLimitExceeded, violation.Code, violation.Error())
+}
+
+// checkCompliance runs the compliance rules. When they can't be run the payment is refused, never let through unchecked.
+func (p *paymentService) checkCompliance(ctx context.Context, req *models.TransactionRequest, transactionType string, amount models.Money) (*compliance.Decision, error) {
+	decision, err := p.cs.Check(ctx, &compliance.Request{
+		UserID:          req.UserID,
+		CountryID:       req.CountryID,
+		GatewayID:       req.GatewayID,
+		TransactionType: transactionType,
+		Amount:          amount,
+	})
+	if err != nil {
+		return nil, stageError(ctx, "Failed to run compliance checks", err)
+	}
+	return decision, nil
+}
+
+// validateCurrency makes sure the request is in the currency of its country and that the
+// chosen gateway is able to settle it.
+func (p *paymentService) validateCurrency(ctx context.Context, req *models.TransactionRequest) (models.Money, error) {
+	amount, err := req.Money()
+	if err != nil {
+		return models.Money{}, models.NewServiceError(models.ErrorCodeValidation, "invalid currency code")
+	}
+
+	country, err := p.countries.GetCountry(ctx, req.CountryID)
+	if err != nil {
+		return models.Money{}, stageError(ctx, "Failed to fetch country", err)
+	}
+	if country == nil {
+		return models.Money{}, models.NewServiceError(models.ErrorCodeValidation, "invalid country id")
+	}
+	if country.Currency != amount.Currency {
+		return models.Money{}, models.NewServiceError(
+			models.ErrorCodeValidation,
+			fmt.Sprintf("currency %s is not accepted in %s", amount.Currency, country.Name),
+		)
+	}
+
+	currencies, err := p.gateways.GetSupportedCurrencies(ctx, req.GatewayID)
+	if err != nil {
+		return models.Money{}, stageError(ctx, "Failed to fetch supported currencies", err)
+	}
+	for _, currency := range currencies {
+		if currency == amount.Currency {
+			return amount, nil
+		}
+	}
+
+	return models.Money{}, models.NewServiceError(
+		models.ErrorCodeValidation,
+		fmt.Sprintf("gateway does not support currency %s", amount.Currency),
+	)
+}
+
+// scoreRisk scores the fraud risk of the transaction. Like the compliance rules, when it can't be scored the payment is refused.
+func (p *paymentService) scoreRisk(ctx context.Context, req *models.TransactionRequest, transactionType string, amount models.Money) (*risk.Assessment, error) {
+	assessment, err := p.risk.Score(ctx, &risk.Request{
+		UserID:          req.UserID,
+		CountryID:       req.CountryID,
+		GatewayID:       req.GatewayID,
+		TransactionType: transactionType,
+		Amount:          amount,
+	})
+	if err != nil {
+		return nil, stageError(ctx, "Failed to score risk", err)
+	}
+	return assessment, nil
+}
+
+// riskResult turns a risk score into a compliance result, so a risky transaction goes to review
+// or is declined the same way as one flagged by the compliance rules.
+func riskResult(assessment *risk.Assessment) compliance.Result {
+	result := compliance.Result{Rule: "risk_score", Outcome: compliance.OutcomeApprove}
+	switch assessment.Outcome {
+	case risk.OutcomeReview:
+		result.Outcome, result.Reason = compliance.OutcomeReview, assessment.Reason()
+	case risk.OutcomeBlock:
+		result.Outcome, result.Reason = compliance.OutcomeReject, assessment.Reason()
+	}
+	return result
+}
+
+// detached returns the context to save what already happened with, e.g. the answer of the gateway. It isn't
+// cancelled with the request, losing the write would leave the transaction in a state that is no longer true,
+// but it has a deadline of its own.
+func detached(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), StoreTimeout)
+}
+
+// stageError reports a failed stage of a payment, as a timeout when the stage ran out of time.
+func stageError(ctx context.Context, message string, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return models.NewServiceError(models.ErrorCodeTimeout, message+": timed out")
+	}
+	return models.NewServiceError(models.ErrorCodeUnknown, message+": "+err.Error())
+}
@@ -2,41 +2,119 @@ package services
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"payment-gateway/db"
+	"payment-gateway/internal/compliance"
+	"payment-gateway/internal/ledger"
+	"payment-gateway/internal/limits"
 	"payment-gateway/internal/models"
+	"payment-gateway/internal/retry"
+	"payment-gateway/internal/risk"
+	"payment-gateway/internal/routing"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 )
 
 // ----------- Mock Setup ------------------//
 type mockComplianceService struct {
-	shouldPass bool
+	outcome string
+	err     error
+	// hang makes the check wait until its context is done.
+	hang bool
 }
 
-func (m *mockComplianceService) CheckStatus(req *models.TransactionRequest) (string, error) {
-	if !m.shouldPass {
-		return "failed", errors.New("compliance check failed")
+func (m *mockComplianceService) Check(ctx context.Context, req *compliance.Request) (*compliance.Decision, error) {
+	if m.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
 	}
-	return "passed", nil
+	if m.err != nil {
+		return nil, m.err
+	}
+	decision := &compliance.Decision{Outcome: m.outcome}
+	if m.outcome != compliance.OutcomeApprove {
+		decision.Results = []compliance.Result{{Rule: "mock", Outcome: m.outcome, Reason: "flagged by mock"}}
+	}
+	return decision, nil
+}
+
+type mockRiskScorer struct {
+	outcome string
+	err     error
+}
+
+func (m *mockRiskScorer) Score(ctx context.Context, req *risk.Request) (*risk.Assessment, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	assessment := &risk.Assessment{Outcome: m.outcome}
+	if m.outcome != risk.OutcomeAllow {
+		assessment.Score = 90
+		assessment.Features = []risk.Feature{{Name: risk.FeatureVelocity, Value: 5, Score: 90}}
+	}
+	return assessment, nil
 }
 
 // Mock AccountService
 type mockAccountService struct {
-	balance float64
+	balance int64
 }
 
-func (m *mockAccountService) GetBalance(userID int) (float64, error) {
-	return m.balance, nil
+func (m *mockAccountService) GetBalance(ctx context.Context, userID int, currency string) (models.Money, error) {
+	return models.Money{Minor: m.balance, Currency: currency}, nil
+}
+
+func (m *mockAccountService) GetBalances(ctx context.Context, userID int, currency string) (*models.Balance, error) {
+	return &models.Balance{
+		Available: models.Money{Minor: m.balance, Currency: currency},
+		Pending:   models.Money{Currency: currency},
+	}, nil
 }
 
 // Mock PaymentGateway
 type mockPaymentGateway struct {
 	shouldFail    bool
 	shouldTimeout bool
+	// hang makes the gateway wait until the call is cancelled.
+	hang bool
+	// declines makes the gateway turn payments down for good.
+	declines bool
+	// slow makes the gateway take the payment but only answer once the call timed out.
+	slow  bool
+	taken int
+	calls int
+}
+
+func (m *mockPaymentGateway) Refund(ctx context.Context, refund *db.Transaction, parent *db.Transaction) (*GatewayResult, error) {
+	if m.declines {
+		return nil, retry.Permanent(errors.New("refund declined"))
+	}
+	if m.shouldFail {
+		return nil, errors.New("refund failed")
+	}
+	return &GatewayResult{
+		GatewayTxnId: fmt.Sprintf("mock_refund_%d", refund.ID),
+	}, nil
 }
 
 func (m *mockPaymentGateway) ProcessPayment(ctx context.Context, trx *db.Transaction) (*GatewayResult, error) {
+	m.calls++
+	if m.declines {
+		return nil, retry.Permanent(errors.New("card declined"))
+	}
+	if m.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if m.slow {
+		m.taken++
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
 	if m.shouldFail && m.shouldTimeout {
 		<-time.After(1 * time.Second)
 		return nil, errors.New("payment gateway error.hehe")
@@ -52,82 +130,375 @@ func (m *mockPaymentGateway) ProcessPayment(ctx context.Context, trx *db.Transac
 }
 
 type mockTransactionRepository struct {
-	transactions map[string]*db.Transaction
+	transactions map[int]*db.Transaction
+	outbox       []*db.OutboxEvent
+	history      []*db.TransactionEvent
+	decisions    []*compliance.Decision
+	assessments  []*risk.Assessment
+	routes       []*routing.Decision
+	reviews      []*db.ReviewDecision
+	ledger       *ledger.MemoryStore
 	lastID       int
 }
 
 func newMockRepository() *mockTransactionRepository {
 	return &mockTransactionRepository{
-		transactions: make(map[string]*db.Transaction),
+		transactions: make(map[int]*db.Transaction),
+		ledger:       ledger.NewMemoryStore(),
 		lastID:       0,
 	}
 }
 
-func (m *mockTransactionRepository) Create(tx *db.Transaction) (*db.Transaction, error) {
+func (m *mockTransactionRepository) Create(ctx context.Context, tx *db.Transaction, effects *db.Effects) (*db.Transaction, error) {
+	// Tests run one payment at a time, what the lock on the user guards against is done by racingLimits.
+	if effects != nil && effects.Limits != nil {
+		if err := effects.Limits.Check(ctx, &mockLimitStore{repo: m}); err != nil {
+			return nil, err
+		}
+	}
 	m.lastID++
 	tx.ID = m.lastID
-	m.transactions[tx.GatewayTxnId] = tx
+	if err := m.saveEffects(ctx, tx, effects); err != nil {
+		return nil, err
+	}
+	// The caller goes on changing its transaction, the saved one only changes with Update.
+	saved := *tx
+	m.transactions[tx.ID] = &saved
 	return tx, nil
 }
 
-func (m *mockTransactionRepository) Update(tx db.Transaction) error {
-	if _, exists := m.transactions[tx.GatewayTxnId]; !exists {
-		return errors.New("transaction not found")
+func (m *mockTransactionRepository) Update(ctx context.Context, tx db.Transaction, from string, effects *db.Effects) error {
+	saved, exists := m.transactions[tx.ID]
+	if !exists || saved.Status != from {
+		return db.ErrStaleTransaction
+	}
+	if err := m.saveEffects(ctx, &tx, effects); err != nil {
+		return err
+	}
+	m.transactions[tx.ID] = &tx
+	return nil
+}
+
+// saveEffects applies the ledger effects first, since they are the only ones that can fail.
+func (m *mockTransactionRepository) saveEffects(ctx context.Context, tx *db.Transaction, effects *db.Effects) error {
+	if effects == nil {
+		return nil
+	}
+	if decision := effects.Review; decision != nil {
+		for _, review := range m.reviews {
+			if review.TransactionID == tx.ID {
+				return db.ErrAlreadyReviewed
+			}
+		}
+	}
+	for _, entry := range effects.Journal {
+		if entry.TransactionID == 0 {
+			entry.TransactionID = tx.ID
+		}
+		if err := m.ledger.Post(ctx, entry); err != nil {
+			return err
+		}
+	}
+	for _, hold := range effects.Holds {
+		if hold.TransactionID == 0 {
+			hold.TransactionID = tx.ID
+		}
+		if err := m.ledger.PlaceHold(ctx, hold); err != nil {
+			return err
+		}
+	}
+	for _, settlement := range effects.Settlements {
+		if err := m.ledger.SettleHold(ctx, settlement); err != nil {
+			return err
+		}
+	}
+
+	if decision := effects.Compliance; decision != nil {
+		decision.TransactionID = tx.ID
+		m.decisions = append(m.decisions, decision)
+	}
+	if assessment := effects.Risk; assessment != nil {
+		assessment.TransactionID = tx.ID
+		m.assessments = append(m.assessments, assessment)
+	}
+	if decision := effects.Routing; decision != nil {
+		decision.TransactionID = tx.ID
+		m.routes = append(m.routes, decision)
+	}
+	if decision := effects.Review; decision != nil {
+		m.reviews = append(m.reviews, decision)
+	}
+	for _, event := range effects.Outbox {
+		if event.AggregateID == "" {
+			event.AggregateID = fmt.Sprint(tx.ID)
+		}
+		m.outbox = append(m.outbox, event)
+	}
+	for _, transition := range effects.History {
+		if transition.TransactionID == 0 {
+			transition.TransactionID = tx.ID
+		}
+		m.history = append(m.history, transition)
 	}
-	m.transactions[tx.GatewayTxnId] = &tx
 	return nil
 }
 
-func (m *mockTransactionRepository) GetTransactionByGatewayTxnId(gatewayTxnId string) (*db.Transaction, error) {
-	if tx, exists := m.transactions[gatewayTxnId]; exists {
-		return tx, nil
+// The getters return copies, like reading the row from the database would.
+func (m *mockTransactionRepository) GetTransactionByGatewayTxnId(ctx context.Context, gatewayID int, gatewayTxnId string) (*db.Transaction, error) {
+	for _, tx := range m.transactions {
+		if tx.GatewayID == gatewayID && tx.GatewayTxnId == gatewayTxnId {
+			saved := *tx
+			return &saved, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *mockTransactionRepository) GetTransactionByID(ctx context.Context, id int) (*db.Transaction, error) {
+	tx, ok := m.transactions[id]
+	if !ok {
+		return nil, nil
+	}
+	saved := *tx
+	return &saved, nil
+}
+
+func (m *mockTransactionRepository) ListTransactions(ctx context.Context, filter db.TransactionFilter) ([]*db.Transaction, error) {
+	var transactions []*db.Transaction
+	for _, tx := range m.transactions {
+		if tx.UserID != filter.UserID ||
+			(filter.Status != "" && tx.Status != filter.Status) ||
+			(filter.Type != "" && tx.Type != filter.Type) ||
+			(filter.GatewayID != 0 && tx.GatewayID != filter.GatewayID) ||
+			(filter.Currency != "" && tx.Amount.Currency != filter.Currency) ||
+			(!filter.CreatedFrom.IsZero() && tx.CreatedAt.Before(filter.CreatedFrom)) ||
+			(!filter.CreatedTo.IsZero() && !tx.CreatedAt.Before(filter.CreatedTo)) {
+			continue
+		}
+		if after := filter.After; after != nil &&
+			!(tx.CreatedAt.Before(after.CreatedAt) || (tx.CreatedAt.Equal(after.CreatedAt) && tx.ID < after.ID)) {
+			continue
+		}
+		transactions = append(transactions, tx)
+	}
+	sort.Slice(transactions, func(i, j int) bool {
+		if !transactions[i].CreatedAt.Equal(transactions[j].CreatedAt) {
+			return transactions[i].CreatedAt.After(transactions[j].CreatedAt)
+		}
+		return transactions[i].ID > transactions[j].ID
+	})
+	if len(transactions) > filter.Limit {
+		transactions = transactions[:filter.Limit]
+	}
+	return transactions, nil
+}
+
+func (m *mockTransactionRepository) GetRefundedAmount(ctx context.Context, parentID int) (int64, error) {
+	var refunded int64
+	for _, tx := range m.transactions {
+		if tx.ParentID == parentID && tx.Type == db.TypeRefund && tx.Status != db.StatusFailed {
+			refunded += tx.Amount.Minor
+		}
+	}
+	return refunded, nil
+}
+
+func (m *mockTransactionRepository) GetRefunds(ctx context.Context, parentID int) ([]*db.Transaction, error) {
+	var refunds []*db.Transaction
+	for _, tx := range m.transactions {
+		if tx.ParentID == parentID && tx.Type == db.TypeRefund {
+			refunds = append(refunds, tx)
+		}
+	}
+	return refunds, nil
+}
+
+func (m *mockTransactionRepository) GetEvents(ctx context.Context, transactionID int) ([]*db.TransactionEvent, error) {
+	var events []*db.TransactionEvent
+	for _, event := range m.history {
+		if event.TransactionID == transactionID {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (m *mockTransactionRepository) CreateRefund(ctx context.Context, refund *db.Transaction, effects *db.Effects) (*db.Transaction, error) {
+	refunded, _ := m.GetRefundedAmount(ctx, refund.ParentID)
+	if refunded+refund.Amount.Minor > m.transactions[refund.ParentID].Amount.Minor {
+		return nil, db.ErrRefundExceedsAmount
+	}
+	return m.Create(ctx, refund, effects)
+}
+
+func (m *mockTransactionRepository) ListReviewQueue(ctx context.Context, limit int) ([]*db.ReviewCase, error) {
+	var cases []*db.ReviewCase
+	for id := 1; id <= m.lastID && len(cases) < limit; id++ {
+		tx, ok := m.transactions[id]
+		if !ok || tx.Status != db.StatusReview {
+			continue
+		}
+		reviewCase := &db.ReviewCase{Transaction: tx}
+		for _, decision := range m.decisions {
+			if decision.TransactionID == id {
+				reviewCase.Compliance = decision
+			}
+		}
+		cases = append(cases, reviewCase)
+	}
+	return cases, nil
+}
+
+type mockLimitStore struct {
+	rules []*limits.Rule
+	tiers map[int]int
+	repo  *mockTransactionRepository
+}
+
+func (m *mockLimitStore) Rules(ctx context.Context) ([]*limits.Rule, error) {
+	return m.rules, nil
+}
+
+func (m *mockLimitStore) Usage(ctx context.Context, userID int, transactionType string, currency string, since time.Time) (int64, error) {
+	var used int64
+	for _, tx := range m.repo.transactions {
+		if tx.UserID == userID && tx.Type == transactionType && tx.Amount.Currency == currency &&
+			!tx.CreatedAt.Before(since) && tx.Status != db.StatusFailed && tx.Status != db.StatusReversed {
+			used += tx.Amount.Minor
+		}
+	}
+	return used, nil
+}
+
+func (m *mockLimitStore) KYCTier(ctx context.Context, userID int) (int, error) {
+	return m.tiers[userID], nil
+}
+
+type mockCountryRepository struct {
+	countries map[int]*db.Country
+	err       error
+}
+
+func (m *mockCountryRepository) GetCountry(ctx context.Context, countryID int) (*db.Country, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return m.countries[countryID], nil
+}
+
+type mockGatewayRepository struct {
+	gateways   []*db.Gateway
+	currencies map[int][]string
+	// available are the enabled gateways of every country.
+	available map[int][]*db.Gateway
+}
+
+func (m *mockGatewayRepository) GetAvailableGateways(ctx context.Context, countryID int) ([]*db.Gateway, error) {
+	return m.available[countryID], nil
+}
+
+func (m *mockGatewayRepository) GetGateway(ctx context.Context, gatewayID int) (*db.Gateway, error) {
+	for _, gateway := range m.gateways {
+		if gateway.ID == gatewayID {
+			return gateway, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *mockGatewayRepository) GetGatewayByName(ctx context.Context, name string) (*db.Gateway, error) {
+	for _, gateway := range m.gateways {
+		if gateway.Name == name {
+			return gateway, nil
+		}
 	}
 	return nil, nil
 }
 
+func (m *mockGatewayRepository) GetSupportedCurrencies(ctx context.Context, gatewayID int) ([]string, error) {
+	return m.currencies[gatewayID], nil
+}
+
+func (m *mockGatewayRepository) ListGateways(ctx context.Context) ([]*db.Gateway, error) {
+	return m.gateways, nil
+}
+
 // ---------------------------------------------- //
 
 // Test setup helper
-func setupTestService(t *testing.T, compliancePass bool, balance float64) (*paymentService, *mockPaymentGateway, *mockTransactionRepository) {
+func setupTestService(t *testing.T, compliancePass bool, balance int64) (*paymentService, *mockPaymentGateway, *mockTransactionRepository) {
 	mockGateway := &mockPaymentGateway{shouldFail: !compliancePass}
 	mockRepo := newMockRepository()
+	if balance > 0 {
+		// The mock account service reports the balance, the ledger has to agree for withdrawals to be held.
+		seedBalance(t, mockRepo, balance)
+	}
+
+	outcome := compliance.OutcomeApprove
+	if !compliancePass {
+		outcome = compliance.OutcomeReject
+	}
 
 	// Override the service creation
 	service := &paymentService{
-		cs:   &mockComplianceService{shouldPass: compliancePass},
-		as:   &mockAccountService{balance: balance},
-		repo: mockRepo,
+		cs:     &mockComplianceService{outcome: outcome},
+		as:     &mockAccountService{balance: balance},
+		risk:   &mockRiskScorer{outcome: risk.OutcomeAllow},
+		limits: limits.NewEngine(&mockLimitStore{repo: mockRepo}, nil),
+		repo:   mockRepo,
+		countries: &mockCountryRepository{countries: map[int]*db.Country{
+			840: {ID: 840, Name: "United States", Code: "US", Currency: "USD"},
+			392: {ID: 392, Name: "Japan", Code: "JP", Currency: "JPY"},
+		}},
+		gateways: &mockGatewayRepository{
+			gateways: []*db.Gateway{{ID: 1, Name: "mock", Enabled: true}},
+			currencies: map[int][]string{
+				1: {"EUR", "USD"},
+			},
+		},
 	}
 
 	// Store original gateway function
 	originalGateway := GetPaymentGateway
+	originalRetry := GatewayRetry
+	GatewayRetry = retry.Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
 
 	// Override gateway for testing
-	GetPaymentGateway = func(countryId int, gatewayId int) PaymentGateway {
-		return mockGateway
+	GetPaymentGateway = func(ctx context.Context, countryId int, gatewayId int) (PaymentGateway, error) {
+		return mockGateway, nil
 	}
 
+	// Saved transactions are captured and refunded by the adapter of their gateway.
+	adaptersMu.Lock()
+	originalAdapters := gateways
+	gateways = map[string]PaymentGateway{"mock": mockGateway}
+	adaptersMu.Unlock()
+
 	// Restore after test
 	t.Cleanup(func() {
 		GetPaymentGateway = originalGateway
+		GatewayRetry = originalRetry
+		adaptersMu.Lock()
+		defer adaptersMu.Unlock()
+		gateways = originalAdapters
 	})
 
 	return service, mockGateway, mockRepo
 }
 
 func TestDeposit_Success(t *testing.T) {
-	service, mockGateway, mockRepo := setupTestService(t, true, 1000)
+	service, mockGateway, mockRepo := setupTestService(t, true, 100000)
 	mockGateway.shouldFail = false
 
 	req := &models.TransactionRequest{
-		Amount:    100,
+		Amount:    10000,
 		Currency:  "USD",
 		GatewayID: 1,
 		CountryID: 840,
 		UserID:    1,
 	}
 
-	result, err := service.Deposit(req)
+	result, err := service.Deposit(context.Background(), req)
 	if err != nil {
 		t.Errorf("Expected successful deposit, got error: %v", err)
 	}
@@ -136,7 +507,7 @@ func TestDeposit_Success(t *testing.T) {
 	}
 
 	// Verify the saved transaction
-	savedTx, err := mockRepo.GetTransactionByGatewayTxnId("mock_txn_123")
+	savedTx, err := mockRepo.GetTransactionByGatewayTxnId(context.Background(), 1, "mock_txn_123")
 	if err != nil {
 		t.Errorf("Failed to fetch transaction: %v", err)
 	}
@@ -145,8 +516,8 @@ func TestDeposit_Success(t *testing.T) {
 	}
 
 	// Verify transaction details
-	if savedTx.Amount != req.Amount {
-		t.Errorf("Expected amount %v, got %v", req.Amount, savedTx.Amount)
+	if savedTx.Amount.Minor != req.Amount || savedTx.Amount.Currency != req.Currency {
+		t.Errorf("Expected amount %v %v, got %v", req.Amount, req.Currency, savedTx.Amount)
 	}
 	if savedTx.UserID != req.UserID {
 		t.Errorf("Expected userID %v, got %v", req.UserID, savedTx.UserID)
@@ -163,21 +534,35 @@ func TestDeposit_Success(t *testing.T) {
 	if savedTx.GatewayTxnId != "mock_txn_123" {
 		t.Errorf("Expected gatewayTxnId 'mock_txn_123', got %v", savedTx.GatewayTxnId)
 	}
+
+	// The event is stored in the outbox together with the transaction.
+	if len(mockRepo.outbox) != 1 {
+		t.Fatalf("Expected 1 outbox event, got %d", len(mockRepo.outbox))
+	}
+	event := mockRepo.outbox[0]
+	if event.EventType != EventTransactionCreated || event.AggregateID != fmt.Sprint(savedTx.ID) {
+		t.Errorf("Expected %s event for transaction %d, got %s for %s", EventTransactionCreated, savedTx.ID, event.EventType, event.AggregateID)
+	}
+	var payload map[string]interface{}
+	json.Unmarshal(event.Payload, &payload)
+	if payload["status"] != db.StatusPending || payload["currency"] != "USD" {
+		t.Errorf("Unexpected event payload: %s", event.Payload)
+	}
 }
 
 func TestDeposit_PaymentProcessingFailure(t *testing.T) {
-	service, mockGateway, _ := setupTestService(t, true, 1000)
-	mockGateway.shouldFail = true
+	service, mockGateway, _ := setupTestService(t, true, 100000)
+	mockGateway.declines = true
 
 	req := &models.TransactionRequest{
-		Amount:    100,
+		Amount:    10000,
 		Currency:  "USD",
 		GatewayID: 1,
 		CountryID: 840,
 		UserID:    1,
 	}
 
-	result, err := service.Deposit(req)
+	result, err := service.Deposit(context.Background(), req)
 	if err == nil {
 		t.Error("Expected error due to payment processing failure, got success")
 	}
@@ -190,62 +575,168 @@ func TestDeposit_PaymentProcessingFailure(t *testing.T) {
 }
 
 func TestDeposit_ComplianceFailure(t *testing.T) {
-	service, _, _ := setupTestService(t, false, 1000)
+	service, _, mockRepo := setupTestService(t, false, 100000)
 
 	req := &models.TransactionRequest{
-		Amount:    100,
+		Amount:    10000,
 		Currency:  "USD",
 		GatewayID: 1,
 		CountryID: 840,
 		UserID:    1,
 	}
 
-	_, err := service.Deposit(req)
-	if err == nil {
-		t.Error("Expected compliance check to fail, but got success")
+	_, err := service.Deposit(context.Background(), req)
+	assertComplianceError(t, err, "compliance_rejected")
+
+	// The rejected deposit is kept, failed, together with the decision.
+	trx := mockRepo.transactions[1]
+	if trx == nil || trx.Status != db.StatusFailed || trx.GatewayTxnId != "" {
+		t.Fatalf("Expected a failed transaction that never reached the gateway, got %+v", trx)
+	}
+	if len(mockRepo.decisions) != 1 || mockRepo.decisions[0].TransactionID != trx.ID || mockRepo.decisions[0].Outcome != compliance.OutcomeReject {
+		t.Errorf("Expected the reject decision to be saved with the transaction, got %+v", mockRepo.decisions)
+	}
+	last := mockRepo.history[len(mockRepo.history)-1]
+	if last.Source != SourceCompliance || last.Reason != "compliance reject: flagged by mock" {
+		t.Errorf("Expected the failure to be recorded with its reasons, got %+v", last)
+	}
+	if len(mockRepo.outbox) != 1 || mockRepo.outbox[0].EventType != EventTransactionCreated {
+		t.Errorf("Expected the failed transaction to be published, got %+v", mockRepo.outbox)
+	}
+}
+
+func TestDeposit_ComplianceCheckError(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	service.cs = &mockComplianceService{err: errors.New("rules unavailable")}
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	_, err := service.Deposit(context.Background(), req)
+	if models.GetStatusCode(err) != 500 {
+		t.Fatalf("Expected the deposit to be refused with 500, got %v", err)
 	}
-	if err != nil && err.Error() != "compliance check failed" {
-		t.Errorf("Expected compliance error, got: %v", err)
+	if len(mockRepo.transactions) != 0 {
+		t.Errorf("Expected no transaction to be saved, got %d", len(mockRepo.transactions))
+	}
+}
+
+func TestDeposit_CurrencyNotOfCountry(t *testing.T) {
+	service, _, _ := setupTestService(t, true, 100000)
+
+	req := &models.TransactionRequest{
+		Amount:    10000,
+		Currency:  "EUR",
+		GatewayID: 1,
+		CountryID: 840,
+		UserID:    1,
+	}
+
+	_, err := service.Deposit(context.Background(), req)
+	if err == nil || err.Error() != "currency EUR is not accepted in United States" {
+		t.Errorf("Expected currency error, got: %v", err)
+	}
+}
+
+func TestDeposit_CountryLookupFails(t *testing.T) {
+	service, _, _ := setupTestService(t, true, 100000)
+	service.countries.(*mockCountryRepository).err = errors.New("connection refused")
+
+	_, err := service.Deposit(context.Background(), &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1})
+	var serviceErr *models.ServiceError
+	if !errors.As(err, &serviceErr) || serviceErr.Code != models.ErrorCodeUnknown || serviceErr.Message != "Failed to fetch country: connection refused" {
+		t.Errorf("Expected a service error, got: %v", err)
+	}
+}
+
+func TestDeposit_GatewayDoesNotSupportCurrency(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+
+	req := &models.TransactionRequest{
+		Amount:    10000,
+		Currency:  "JPY",
+		GatewayID: 1,
+		CountryID: 392,
+		UserID:    1,
+	}
+
+	_, err := service.Deposit(context.Background(), req)
+	if err == nil || err.Error() != "gateway does not support currency JPY" {
+		t.Errorf("Expected gateway currency error, got: %v", err)
+	}
+	if len(mockRepo.transactions) != 0 {
+		t.Errorf("Expected no transaction to be saved, got %d", len(mockRepo.transactions))
 	}
 }
 
 func TestDeposit_PaymentProcessingTimeout(t *testing.T) {
-	service, pg, _ := setupTestService(t, true, 1000)
+	service, pg, _ := setupTestService(t, true, 100000)
 	pg.shouldFail = true
 	pg.shouldTimeout = true
 
 	req := &models.TransactionRequest{
-		Amount:    100,
+		Amount:    10000,
 		Currency:  "USD",
 		GatewayID: 1,
 		CountryID: 840,
 		UserID:    1,
 	}
-	res, err := service.Deposit(req)
+	res, err := service.Deposit(context.Background(), req)
 
 	if res != nil {
 		t.Errorf("Expected a nil response but received value")
 	}
 
-	if err != nil && err.Error() != "Payment gateway error." {
-		t.Errorf("Expected payment gateway error, got: %v", err)
+	if serviceErr, ok := err.(*models.ServiceError); !ok || serviceErr.Reason != ReasonOutcomeUnknown {
+		t.Errorf("Expected an unknown outcome, got: %v", err)
+	}
+
+}
+
+func TestDeposit_GatewayErrorIsRetried(t *testing.T) {
+	service, pg, mockRepo := setupTestService(t, true, 100000)
+	pg.shouldFail = true
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	if _, err := service.Deposit(context.Background(), req); err == nil {
+		t.Fatal("Expected payment gateway error, got success")
+	}
+	if pg.calls != 3 {
+		t.Errorf("Expected 3 attempts, got %d", pg.calls)
 	}
+	// Every attempt failed, but any of them may have reached the gateway.
+	if last := mockRepo.history[len(mockRepo.history)-1]; last.ToStatus != db.StatusPending || last.Reason != "gateway outcome unknown: gave up after 3 attempts: payment processing failed" {
+		t.Errorf("Expected the last gateway error in the timeline, got %+v", last)
+	}
+}
 
+func TestDeposit_GatewayDeclineIsNotRetried(t *testing.T) {
+	service, pg, mockRepo := setupTestService(t, true, 100000)
+	pg.declines = true
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	if _, err := service.Deposit(context.Background(), req); err == nil {
+		t.Fatal("Expected payment gateway error, got success")
+	}
+	if pg.calls != 1 {
+		t.Errorf("Expected a declined payment to be sent once, got %d attempts", pg.calls)
+	}
+	if status := mockRepo.transactions[1].Status; status != db.StatusFailed {
+		t.Errorf("Expected the deposit to be failed, got %s", status)
+	}
 }
 
 func TestWithdraw_Success(t *testing.T) {
-	service, mockGateway, mockRepo := setupTestService(t, true, 1000)
+	service, mockGateway, mockRepo := setupTestService(t, true, 100000)
 	mockGateway.shouldFail = false
 
 	req := &models.TransactionRequest{
-		Amount:    100,
+		Amount:    10000,
 		Currency:  "USD",
 		GatewayID: 1,
 		CountryID: 840,
 		UserID:    1,
 	}
 
-	result, err := service.Withdraw(req)
+	result, err := service.Withdraw(context.Background(), req)
 	if err != nil {
 		t.Errorf("Expected successful withdrawal, got error: %v", err)
 	}
@@ -254,7 +745,7 @@ func TestWithdraw_Success(t *testing.T) {
 	}
 
 	// Verify the saved transaction
-	savedTx, err := mockRepo.GetTransactionByGatewayTxnId("mock_txn_123")
+	savedTx, err := mockRepo.GetTransactionByGatewayTxnId(context.Background(), 1, "mock_txn_123")
 	if err != nil {
 		t.Errorf("Failed to fetch transaction: %v", err)
 	}
@@ -263,8 +754,8 @@ func TestWithdraw_Success(t *testing.T) {
 	}
 
 	// Verify transaction details
-	if savedTx.Amount != req.Amount {
-		t.Errorf("Expected amount %v, got %v", req.Amount, savedTx.Amount)
+	if savedTx.Amount.Minor != req.Amount || savedTx.Amount.Currency != req.Currency {
+		t.Errorf("Expected amount %v %v, got %v", req.Amount, req.Currency, savedTx.Amount)
 	}
 	if savedTx.UserID != req.UserID {
 		t.Errorf("Expected userID %v, got %v", req.UserID, savedTx.UserID)
@@ -285,18 +776,18 @@ func TestWithdraw_Success(t *testing.T) {
 }
 
 func TestWithdraw_PaymentProcessingFailure(t *testing.T) {
-	service, mockGateway, _ := setupTestService(t, true, 1000)
-	mockGateway.shouldFail = true
+	service, mockGateway, _ := setupTestService(t, true, 100000)
+	mockGateway.declines = true
 
 	req := &models.TransactionRequest{
-		Amount:    100,
+		Amount:    10000,
 		Currency:  "USD",
 		GatewayID: 1,
 		CountryID: 840,
 		UserID:    1,
 	}
 
-	result, err := service.Withdraw(req)
+	result, err := service.Withdraw(context.Background(), req)
 	if err == nil {
 		t.Error("Expected error due to payment processing failure, got success")
 	}
@@ -312,17 +803,17 @@ func TestWithdraw_PaymentProcessingFailure(t *testing.T) {
 //----------------------------------------  Withdraw Test ----------------------------------------------------//
 
 func TestWithdraw_InsufficientFunds(t *testing.T) {
-	service, _, _ := setupTestService(t, true, 50)
+	service, _, _ := setupTestService(t, true, 5000)
 
 	req := &models.TransactionRequest{
-		Amount:    100,
+		Amount:    10000,
 		Currency:  "USD",
 		GatewayID: 1,
 		CountryID: 840,
 		UserID:    1,
 	}
 
-	_, err := service.Withdraw(req)
+	_, err := service.Withdraw(context.Background(), req)
 	if err == nil {
 		t.Error("Expected insufficient funds error, but got success")
 	}
@@ -332,37 +823,230 @@ func TestWithdraw_InsufficientFunds(t *testing.T) {
 }
 
 func TestWithdraw_ComplianceFailure(t *testing.T) {
-	service, _, _ := setupTestService(t, false, 1000)
+	service, _, mockRepo := setupTestService(t, false, 100000)
+	useLedger(service, mockRepo)
 
 	req := &models.TransactionRequest{
-		Amount:    100,
+		Amount:    10000,
 		Currency:  "USD",
 		GatewayID: 1,
 		CountryID: 840,
 		UserID:    1,
 	}
 
-	_, err := service.Withdraw(req)
-	if err == nil {
-		t.Error("Expected compliance check to fail, but got success")
+	_, err := service.Withdraw(context.Background(), req)
+	assertComplianceError(t, err, "compliance_rejected")
+
+	// Nothing was held, so nothing had to be given back.
+	assertBalances(t, service, 100000, 0)
+	if mockRepo.ledger.Hold(1) != nil {
+		t.Error("Expected no hold for a rejected withdrawal")
+	}
+}
+
+func TestWithdraw_ComplianceReview(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	useLedger(service, mockRepo)
+	service.cs = &mockComplianceService{outcome: compliance.OutcomeReview}
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	result, err := service.Withdraw(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Expected the withdrawal to be parked, got error: %v", err)
+	}
+	if result.Status != db.StatusReview {
+		t.Errorf("Expected status review in the result, got %q", result.Status)
+	}
+
+	if trx := mockRepo.transactions[1]; trx == nil || trx.Status != db.StatusReview || trx.GatewayTxnId != "" {
+		t.Fatalf("Expected the withdrawal to wait in review without going to the gateway, got %+v", trx)
+	}
+	if len(mockRepo.decisions) != 1 || mockRepo.decisions[0].Outcome != compliance.OutcomeReview {
+		t.Errorf("Expected the review decision to be saved, got %+v", mockRepo.decisions)
+	}
+	// The amount stays held while the withdrawal waits.
+	assertBalances(t, service, 90000, 10000)
+
+	last := mockRepo.history[len(mockRepo.history)-1]
+	if last.ToStatus != db.StatusReview || last.Source != SourceCompliance {
+		t.Errorf("Expected the move to review to be recorded, got %+v", last)
+	}
+	if len(mockRepo.outbox) != 1 || mockRepo.outbox[0].EventType != EventTransactionCreated {
+		t.Errorf("Expected one created event, got %+v", mockRepo.outbox)
+	}
+}
+
+func TestDeposit_ComplianceApprovalIsSaved(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	result, err := service.Deposit(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Expected deposit to succeed, got %v", err)
+	}
+	if len(mockRepo.decisions) != 1 || mockRepo.decisions[0].TransactionID != result.TransactionId || !mockRepo.decisions[0].Approved() {
+		t.Errorf("Expected the approval to be saved with the transaction, got %+v", mockRepo.decisions)
+	}
+}
+
+func TestDeposit_RiskScoreIsSaved(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	result, err := service.Deposit(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Expected deposit to succeed, got %v", err)
+	}
+	if len(mockRepo.assessments) != 1 || mockRepo.assessments[0].TransactionID != result.TransactionId {
+		t.Errorf("Expected the risk score to be saved with the transaction, got %+v", mockRepo.assessments)
+	}
+	results := mockRepo.decisions[0].Results
+	if len(results) == 0 || results[len(results)-1].Rule != "risk_score" || !mockRepo.decisions[0].Approved() {
+		t.Errorf("Expected the allowed score in the approved decision, got %+v", mockRepo.decisions[0])
+	}
+}
+
+func TestWithdraw_RiskReview(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	useLedger(service, mockRepo)
+	service.risk = &mockRiskScorer{outcome: risk.OutcomeReview}
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	result, err := service.Withdraw(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Expected the withdrawal to be parked, got error: %v", err)
+	}
+	if result.Status != db.StatusReview {
+		t.Errorf("Expected status review in the result, got %q", result.Status)
+	}
+	if decision := mockRepo.decisions[0]; decision.Outcome != compliance.OutcomeReview || decision.Reasons() != "risk score 90.00 (velocity 90.00)" {
+		t.Errorf("Expected the risk score to send the withdrawal to review, got %+v", decision)
+	}
+	assertBalances(t, service, 90000, 10000)
+}
+
+func TestDeposit_RiskBlock(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	service.risk = &mockRiskScorer{outcome: risk.OutcomeBlock}
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	_, err := service.Deposit(context.Background(), req)
+	assertComplianceError(t, err, "compliance_rejected")
+
+	if trx := mockRepo.transactions[1]; trx == nil || trx.Status != db.StatusFailed || trx.GatewayTxnId != "" {
+		t.Fatalf("Expected the deposit to fail without going to the gateway, got %+v", trx)
+	}
+	if len(mockRepo.assessments) != 1 || mockRepo.assessments[0].Outcome != risk.OutcomeBlock {
+		t.Errorf("Expected the blocking score to be saved, got %+v", mockRepo.assessments)
+	}
+	if last := mockRepo.history[len(mockRepo.history)-1]; last.Reason != "compliance reject: risk score 90.00 (velocity 90.00)" {
+		t.Errorf("Expected the score in the timeline, got %q", last.Reason)
+	}
+}
+
+func TestDeposit_RiskScoringError(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	service.risk = &mockRiskScorer{err: errors.New("history unavailable")}
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	_, err := service.Deposit(context.Background(), req)
+	if models.GetStatusCode(err) != 500 {
+		t.Fatalf("Expected the deposit to be refused with 500, got %v", err)
+	}
+	if len(mockRepo.transactions) != 0 {
+		t.Errorf("Expected no transaction to be saved, got %d", len(mockRepo.transactions))
+	}
+}
+
+func TestDeposit_ChecksTimeOut(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	service.cs = &mockComplianceService{hang: true}
+	originalTimeout := CheckTimeout
+	CheckTimeout = 10 * time.Millisecond
+	t.Cleanup(func() { CheckTimeout = originalTimeout })
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	_, err := service.Deposit(context.Background(), req)
+	if models.GetStatusCode(err) != 504 {
+		t.Fatalf("Expected the deposit to time out with 504, got %v", err)
+	}
+	if len(mockRepo.transactions) != 0 {
+		t.Errorf("Expected no transaction to be saved, got %d", len(mockRepo.transactions))
+	}
+}
+
+func TestWithdraw_ClientGoneDuringGatewayCall(t *testing.T) {
+	service, mockGateway, mockRepo := setupTestService(t, true, 15000)
+	useLedger(service, mockRepo)
+	mockGateway.hang = true
+
+	// The client goes away while the gateway is called. The gateway may still pay out, so the withdrawal
+	// is saved as pending and keeps its hold.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := service.Withdraw(ctx, &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1})
+	if serviceErr, ok := err.(*models.ServiceError); !ok || serviceErr.Code != models.ErrorCodeTimeout || serviceErr.Reason != ReasonOutcomeUnknown {
+		t.Fatalf("Expected an unknown outcome, got %v", err)
+	}
+	if status := mockRepo.transactions[1].Status; status != db.StatusPending {
+		t.Errorf("Expected the withdrawal to be pending, got %s", status)
+	}
+	assertBalances(t, service, 5000, 10000)
+}
+
+func TestWithdraw_GatewayTimesOutAfterThePayout(t *testing.T) {
+	service, mockGateway, mockRepo := setupTestService(t, true, 15000)
+	useLedger(service, mockRepo)
+	mockGateway.slow = true
+	originalTimeout := GatewayTimeout
+	GatewayTimeout = 10 * time.Millisecond
+	t.Cleanup(func() { GatewayTimeout = originalTimeout })
+
+	_, err := service.Withdraw(context.Background(), &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1})
+	if serviceErr, ok := err.(*models.ServiceError); !ok || serviceErr.Code != models.ErrorCodeTimeout || serviceErr.Reason != ReasonOutcomeUnknown {
+		t.Fatalf("Expected an unknown outcome, got %v", err)
+	}
+	if mockGateway.taken == 0 {
+		t.Fatal("Expected the gateway to take the payout")
+	}
+	// The money may be gone already, it isn't given back to the user.
+	if status := mockRepo.transactions[1].Status; status != db.StatusPending {
+		t.Errorf("Expected the withdrawal to stay pending, got %s", status)
+	}
+	assertBalances(t, service, 5000, 10000)
+	if hold := mockRepo.ledger.Hold(1); hold == nil || hold.Status != ledger.HoldActive {
+		t.Errorf("Expected the hold to be kept, got %+v", hold)
+	}
+	var message map[string]interface{}
+	json.Unmarshal(mockRepo.outbox[len(mockRepo.outbox)-1].Payload, &message)
+	if message["status"] != db.StatusPending {
+		t.Errorf("Expected the event of a pending withdrawal, got %v", message)
+	}
+}
+
+func assertComplianceError(t *testing.T, err error, reason string) {
+	t.Helper()
+	serviceErr, ok := err.(*models.ServiceError)
+	if !ok {
+		t.Fatalf("Expected a compliance error, got %v", err)
 	}
-	if err != nil && err.Error() != "Compliance check failed: failed" {
-		t.Errorf("Expected compliance error, got: %v", err)
+	if serviceErr.Code != models.ErrorCodeComplianceRejected || serviceErr.Reason != reason {
+		t.Errorf("Expected compliance error %q, got %+v", reason, serviceErr)
 	}
 }
 
 func TestHandleCallback_Success(t *testing.T) {
-	service, _, mockRepo := setupTestService(t, true, 1000)
+	service, _, mockRepo := setupTestService(t, true, 100000)
 
 	tx := &db.Transaction{
-		Amount:       100,
+		Amount:       models.Money{Minor: 10000, Currency: "USD"},
 		Type:         "deposit",
 		UserID:       1,
 		GatewayID:    1,
 		Status:       "pending",
 		GatewayTxnId: "txn123",
 	}
-	mockRepo.Create(tx)
+	mockRepo.Create(context.Background(), tx, nil)
 
 	callback := &models.PaymentCallback{
 		GatewayTxnID: "txn123",
@@ -370,12 +1054,12 @@ func TestHandleCallback_Success(t *testing.T) {
 		GatewayID:    1,
 	}
 
-	err := service.HandleCallback(callback)
+	err := service.HandleCallback(context.Background(), callback)
 	if err != nil {
 		t.Errorf("Expected successful callback handling, got error: %v", err)
 	}
 
-	updatedTx, err := mockRepo.GetTransactionByGatewayTxnId("txn123")
+	updatedTx, err := mockRepo.GetTransactionByGatewayTxnId(context.Background(), 1, "txn123")
 	if err != nil {
 		t.Errorf("Failed to fetch updated transaction: %v", err)
 	}
@@ -385,20 +1069,23 @@ func TestHandleCallback_Success(t *testing.T) {
 	if updatedTx.Status != db.StatusCompleted {
 		t.Errorf("Expected transaction status to be 'failed', got '%s'", updatedTx.Status)
 	}
+	if len(mockRepo.outbox) != 1 || mockRepo.outbox[0].EventType != EventTransactionUpdated {
+		t.Errorf("Expected a %s outbox event, got %v", EventTransactionUpdated, mockRepo.outbox)
+	}
 
 }
 func TestHandleCallback_Failed(t *testing.T) {
-	service, _, mockRepo := setupTestService(t, true, 1000)
+	service, _, mockRepo := setupTestService(t, true, 100000)
 
 	tx := &db.Transaction{
-		Amount:       100,
+		Amount:       models.Money{Minor: 10000, Currency: "USD"},
 		Type:         "deposit",
 		UserID:       1,
 		GatewayID:    1,
 		Status:       "pending",
 		GatewayTxnId: "txn123",
 	}
-	mockRepo.Create(tx)
+	mockRepo.Create(context.Background(), tx, nil)
 
 	callback := &models.PaymentCallback{
 		GatewayTxnID: "txn123",
@@ -406,12 +1093,12 @@ func TestHandleCallback_Failed(t *testing.T) {
 		GatewayID:    1,
 	}
 
-	err := service.HandleCallback(callback)
+	err := service.HandleCallback(context.Background(), callback)
 	if err != nil {
 		t.Errorf("Expected successful callback handling, got error: %v", err)
 	}
 
-	updatedTx, err := mockRepo.GetTransactionByGatewayTxnId("txn123")
+	updatedTx, err := mockRepo.GetTransactionByGatewayTxnId(context.Background(), 1, "txn123")
 	if err != nil {
 		t.Errorf("Failed to fetch updated transaction: %v", err)
 	}
@@ -424,7 +1111,7 @@ func TestHandleCallback_Failed(t *testing.T) {
 }
 
 func TestHandleCallback_InvalidTransaction(t *testing.T) {
-	service, _, _ := setupTestService(t, true, 1000)
+	service, _, _ := setupTestService(t, true, 100000)
 
 	mockCallback := &models.PaymentCallback{
 		GatewayTxnID: "invalid_txn",
@@ -432,7 +1119,7 @@ func TestHandleCallback_InvalidTransaction(t *testing.T) {
 		GatewayID:    1,
 	}
 
-	err := service.HandleCallback(mockCallback)
+	err := service.HandleCallback(context.Background(), mockCallback)
 	if err == nil {
 		t.Error("Expected error for invalid transaction, but got success")
 	}
@@ -440,3 +1127,1127 @@ func TestHandleCallback_InvalidTransaction(t *testing.T) {
 		t.Errorf("Expected 'Transaction not found' error, got: %v", err)
 	}
 }
+
+func TestHandleCallback_OtherGatewaysTransaction(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+
+	tx := &db.Transaction{
+		Amount:       models.Money{Minor: 10000, Currency: "USD"},
+		Type:         "deposit",
+		UserID:       1,
+		GatewayID:    1,
+		Status:       "pending",
+		GatewayTxnId: "txn123",
+	}
+	mockRepo.Create(context.Background(), tx, nil)
+
+	callback := &models.PaymentCallback{
+		GatewayTxnID: "txn123",
+		Status:       "completed",
+		GatewayID:    2,
+	}
+
+	err := service.HandleCallback(context.Background(), callback)
+	if err == nil || err.Error() != "Transaction not found" {
+		t.Errorf("Expected 'Transaction not found' error, got: %v", err)
+	}
+	if tx.Status != db.StatusPending {
+		t.Errorf("Expected transaction status to stay 'pending', got '%s'", tx.Status)
+	}
+}
+
+func TestHandleCallback_SameIdAtTwoGateways(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+
+	// Two gateways can hand out the same id, the callback updates the transaction of its own.
+	for _, gatewayID := range []int{1, 2} {
+		mockRepo.Create(context.Background(), &db.Transaction{
+			Amount:       models.Money{Minor: 10000, Currency: "USD"},
+			Type:         db.TypeDeposit,
+			UserID:       1,
+			GatewayID:    gatewayID,
+			Status:       db.StatusPending,
+			GatewayTxnId: "txn123",
+		}, nil)
+	}
+
+	err := service.HandleCallback(context.Background(), &models.PaymentCallback{GatewayTxnID: "txn123", Status: db.StatusCompleted, GatewayID: 2})
+	if err != nil {
+		t.Fatalf("Expected successful callback handling, got error: %v", err)
+	}
+	if mockRepo.transactions[1].Status != db.StatusPending || mockRepo.transactions[2].Status != db.StatusCompleted {
+		t.Errorf("Expected only the transaction of gateway 2 to complete, got %s and %s", mockRepo.transactions[1].Status, mockRepo.transactions[2].Status)
+	}
+}
+
+//----------------------------------------  State Machine Test ----------------------------------------------------//
+
+func createTransactionWithStatus(mockRepo *mockTransactionRepository, status string) *db.Transaction {
+	tx := &db.Transaction{
+		Amount:       models.Money{Minor: 10000, Currency: "USD"},
+		Type:         db.TypeDeposit,
+		UserID:       1,
+		GatewayID:    1,
+		Status:       status,
+		GatewayTxnId: "txn123",
+	}
+	mockRepo.Create(context.Background(), tx, nil)
+	return tx
+}
+
+func TestDeposit_RecordsTransitions(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+
+	result, err := service.Deposit(context.Background(), &models.TransactionRequest{
+		Amount:    10000,
+		Currency:  "USD",
+		GatewayID: 1,
+		CountryID: 840,
+		UserID:    1,
+	})
+	if err != nil {
+		t.Fatalf("Expected successful deposit, got error: %v", err)
+	}
+
+	if len(mockRepo.history) != 2 {
+		t.Fatalf("Expected 2 transitions, got %d", len(mockRepo.history))
+	}
+	created, accepted := mockRepo.history[0], mockRepo.history[1]
+	if created.TransactionID != result.TransactionId || created.FromStatus != "" || created.ToStatus != db.StatusInitiated {
+		t.Errorf("Expected the transaction to be created as initiated, got %+v", created)
+	}
+	if accepted.FromStatus != db.StatusInitiated || accepted.ToStatus != db.StatusPending || accepted.Source != SourceGateway {
+		t.Errorf("Expected the gateway to move it to pending, got %+v", accepted)
+	}
+}
+
+func TestDeposit_GatewayFailureMarksTransactionFailed(t *testing.T) {
+	service, mockGateway, mockRepo := setupTestService(t, true, 100000)
+	mockGateway.declines = true
+
+	_, err := service.Deposit(context.Background(), &models.TransactionRequest{
+		Amount:    10000,
+		Currency:  "USD",
+		GatewayID: 1,
+		CountryID: 840,
+		UserID:    1,
+	})
+	if err == nil {
+		t.Fatal("Expected error due to payment processing failure, got success")
+	}
+
+	if len(mockRepo.transactions) != 1 || mockRepo.transactions[1].Status != db.StatusFailed {
+		t.Fatalf("Expected the attempt to be saved as failed, got %v", mockRepo.transactions)
+	}
+	last := mockRepo.history[len(mockRepo.history)-1]
+	if last.ToStatus != db.StatusFailed || !strings.HasPrefix(last.Reason, "gateway error: ") {
+		t.Errorf("Expected the failure reason to be recorded, got %+v", last)
+	}
+}
+
+// staleRepository returns the transaction as it was before it last changed, like a read that
+// raced with another delivery of the same callback.
+type staleRepository struct {
+	*mockTransactionRepository
+	snapshot db.Transaction
+}
+
+func (r *staleRepository) GetTransactionByGatewayTxnId(ctx context.Context, gatewayID int, gatewayTxnId string) (*db.Transaction, error) {
+	snapshot := r.snapshot
+	return &snapshot, nil
+}
+
+func TestHandleCallback_ConcurrentDeliveryIsCreditedOnce(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 0)
+	useLedger(service, mockRepo)
+	tx := createTransactionWithStatus(mockRepo, db.StatusPending)
+	service.repo = &staleRepository{mockTransactionRepository: mockRepo, snapshot: *tx}
+
+	callback := &models.PaymentCallback{GatewayTxnID: "txn123", Status: db.StatusCompleted, GatewayID: 1}
+	if err := service.HandleCallback(context.Background(), callback); err != nil {
+		t.Fatalf("Expected successful callback handling, got error: %v", err)
+	}
+	// The second delivery read the transaction while it was still pending.
+	err := service.HandleCallback(context.Background(), callback)
+	if serviceErr, ok := err.(*models.ServiceError); !ok || serviceErr.Code != models.ErrorCodeConflict {
+		t.Errorf("Expected conflict error, got: %v", err)
+	}
+
+	assertBalances(t, service, 10000, 0)
+	if len(mockRepo.history) != 1 || len(mockRepo.outbox) != 1 {
+		t.Errorf("Expected the change to be recorded once, got %d transitions and %d events", len(mockRepo.history), len(mockRepo.outbox))
+	}
+}
+
+func TestHandleCallback_UnknownStatus(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	tx := createTransactionWithStatus(mockRepo, db.StatusPending)
+
+	err := service.HandleCallback(context.Background(), &models.PaymentCallback{GatewayTxnID: "txn123", Status: "banana", GatewayID: 1})
+
+	if serviceErr, ok := err.(*models.ServiceError); !ok || serviceErr.Code != models.ErrorCodeValidation {
+		t.Errorf("Expected validation error, got: %v", err)
+	}
+	if mockRepo.transactions[tx.ID].Status != db.StatusPending {
+		t.Errorf("Expected status to stay pending, got %s", mockRepo.transactions[tx.ID].Status)
+	}
+}
+
+func TestHandleCallback_OutOfOrderCallbackIsIgnored(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	tx := createTransactionWithStatus(mockRepo, db.StatusCompleted)
+
+	for _, status := range []string{db.StatusPending, db.StatusAuthorized} {
+		err := service.HandleCallback(context.Background(), &models.PaymentCallback{GatewayTxnID: "txn123", Status: status, GatewayID: 1})
+		if err != nil {
+			t.Errorf("Expected stale %s callback to be acknowledged, got error: %v", status, err)
+		}
+	}
+
+	if mockRepo.transactions[tx.ID].Status != db.StatusCompleted {
+		t.Errorf("Expected status to stay completed, got %s", mockRepo.transactions[tx.ID].Status)
+	}
+	if len(mockRepo.outbox) != 0 || len(mockRepo.history) != 0 {
+		t.Errorf("Expected nothing to be recorded, got %d events and %d transitions", len(mockRepo.outbox), len(mockRepo.history))
+	}
+}
+
+func TestHandleCallback_TerminalStatus(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	tx := createTransactionWithStatus(mockRepo, db.StatusFailed)
+
+	err := service.HandleCallback(context.Background(), &models.PaymentCallback{GatewayTxnID: "txn123", Status: db.StatusCompleted, GatewayID: 1})
+
+	if serviceErr, ok := err.(*models.ServiceError); !ok || serviceErr.Code != models.ErrorCodeConflict {
+		t.Errorf("Expected conflict error, got: %v", err)
+	}
+	if mockRepo.transactions[tx.ID].Status != db.StatusFailed {
+		t.Errorf("Expected status to stay failed, got %s", mockRepo.transactions[tx.ID].Status)
+	}
+}
+
+func TestHandleCallback_StatusOfAnotherType(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 25000)
+	useLedger(service, mockRepo)
+	if _, err := service.Withdraw(context.Background(), &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}); err != nil {
+		t.Fatalf("Expected successful withdrawal, got error: %v", err)
+	}
+
+	// Withdrawals can't be refunded, the hold would never be settled.
+	err := service.HandleCallback(context.Background(), &models.PaymentCallback{GatewayTxnID: "mock_txn_123", Status: db.StatusRefunded, GatewayID: 1})
+	if serviceErr, ok := err.(*models.ServiceError); !ok || serviceErr.Code != models.ErrorCodeConflict {
+		t.Errorf("Expected conflict error, got: %v", err)
+	}
+	if status := mockRepo.transactions[1].Status; status != db.StatusPending {
+		t.Errorf("Expected status to stay pending, got %s", status)
+	}
+	assertBalances(t, service, 15000, 10000)
+}
+
+func TestHandleCallback_RecordsReason(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	tx := createTransactionWithStatus(mockRepo, db.StatusAuthorized)
+
+	err := service.HandleCallback(context.Background(), &models.PaymentCallback{
+		GatewayTxnID: "txn123",
+		Status:       db.StatusReversed,
+		ErrorMessage: "authorization voided",
+		GatewayID:    1,
+	})
+	if err != nil {
+		t.Fatalf("Expected successful callback handling, got error: %v", err)
+	}
+
+	if len(mockRepo.history) != 1 {
+		t.Fatalf("Expected 1 transition, got %d", len(mockRepo.history))
+	}
+	record := mockRepo.history[0]
+	if record.TransactionID != tx.ID || record.FromStatus != db.StatusAuthorized || record.ToStatus != db.StatusReversed ||
+		record.Reason != "authorization voided" || record.Source != SourceCallback || record.CreatedAt.IsZero() {
+		t.Errorf("Unexpected transition record: %+v", record)
+	}
+}
+
+func TestGetTransactionEvents(t *testing.T) {
+	service, _, _ := setupTestService(t, true, 100000)
+
+	result, err := service.Deposit(context.Background(), &models.TransactionRequest{
+		Amount:    10000,
+		Currency:  "USD",
+		GatewayID: 1,
+		CountryID: 840,
+		UserID:    1,
+	})
+	if err != nil {
+		t.Fatalf("Expected successful deposit, got error: %v", err)
+	}
+
+	payload := []byte(`<callback><gateway_txn_id>mock_txn_123</gateway_txn_id><status>completed</status></callback>`)
+	err = service.HandleCallback(context.Background(), &models.PaymentCallback{
+		GatewayTxnID:  "mock_txn_123",
+		Status:        db.StatusCompleted,
+		GatewayID:     1,
+		RawPayload:    payload,
+		PayloadFormat: "application/xml",
+	})
+	if err != nil {
+		t.Fatalf("Expected successful callback handling, got error: %v", err)
+	}
+
+	timeline, err := service.GetTransactionEvents(context.Background(), 1, result.TransactionId)
+	if err != nil {
+		t.Fatalf("Expected the events, got error: %v", err)
+	}
+	if timeline.Status != db.StatusCompleted || len(timeline.Events) != 3 {
+		t.Fatalf("Expected 3 events of a completed transaction, got %+v", timeline)
+	}
+	var statuses []string
+	for _, event := range timeline.Events {
+		statuses = append(statuses, event.ToStatus)
+	}
+	if fmt.Sprint(statuses) != fmt.Sprint([]string{db.StatusInitiated, db.StatusPending, db.StatusCompleted}) {
+		t.Errorf("Unexpected status history %v", statuses)
+	}
+	last := timeline.Events[2]
+	if last.Source != SourceCallback || last.Payload != string(payload) || last.PayloadFormat != "application/xml" {
+		t.Errorf("Expected the raw callback to be kept, got %+v", last)
+	}
+	if _, err := service.GetTransactionEvents(context.Background(), 2, result.TransactionId); err == nil || err.Error() != "Transaction not found" {
+		t.Errorf("Expected 'Transaction not found' for another user, got: %v", err)
+	}
+}
+
+//----------------------------------------  Ledger Test ----------------------------------------------------//
+
+// useLedger makes the service read balances from the mock repository's ledger.
+func useLedger(service *paymentService, mockRepo *mockTransactionRepository) {
+	service.as = &AccountManager{ledger: mockRepo.ledger}
+}
+
+func seedBalance(t *testing.T, mockRepo *mockTransactionRepository, balance int64) {
+	entry := ledger.Transfer(ledger.KindDeposit, 0, ledger.GatewayClearing(1, "USD"), ledger.UserAvailable(1, "USD"), balance)
+	if err := mockRepo.ledger.Post(context.Background(), entry); err != nil {
+		t.Fatalf("Failed to seed the ledger: %v", err)
+	}
+}
+
+func assertBalances(t *testing.T, service *paymentService, available int64, pending int64) {
+	t.Helper()
+	balance, err := service.as.GetBalances(context.Background(), 1, "USD")
+	if err != nil {
+		t.Fatalf("Failed to get balances: %v", err)
+	}
+	if balance.Available.Minor != available || balance.Pending.Minor != pending {
+		t.Errorf("Expected available %d and pending %d, got %+v", available, pending, balance)
+	}
+}
+
+func TestDeposit_CreditsLedgerOnCompletion(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 0)
+	useLedger(service, mockRepo)
+
+	_, err := service.Deposit(context.Background(), &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1})
+	if err != nil {
+		t.Fatalf("Expected successful deposit, got error: %v", err)
+	}
+	// Nothing is credited before the gateway confirms the deposit.
+	assertBalances(t, service, 0, 0)
+
+	err = service.HandleCallback(context.Background(), &models.PaymentCallback{GatewayTxnID: "mock_txn_123", Status: db.StatusCompleted, GatewayID: 1})
+	if err != nil {
+		t.Fatalf("Expected successful callback handling, got error: %v", err)
+	}
+	assertBalances(t, service, 10000, 0)
+
+	clearing, _ := mockRepo.ledger.Balance(context.Background(), ledger.GatewayClearing(1, "USD"))
+	if clearing != -10000 {
+		t.Errorf("Expected the gateway clearing account at -10000, got %d", clearing)
+	}
+}
+
+func TestWithdraw_HoldIsDebitedOnCompletion(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 25000)
+	useLedger(service, mockRepo)
+
+	_, err := service.Withdraw(context.Background(), &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1})
+	if err != nil {
+		t.Fatalf("Expected successful withdrawal, got error: %v", err)
+	}
+	assertBalances(t, service, 15000, 10000)
+
+	err = service.HandleCallback(context.Background(), &models.PaymentCallback{GatewayTxnID: "mock_txn_123", Status: db.StatusCompleted, GatewayID: 1})
+	if err != nil {
+		t.Fatalf("Expected successful callback handling, got error: %v", err)
+	}
+	assertBalances(t, service, 15000, 0)
+
+	var kinds []string
+	for _, entry := range mockRepo.ledger.Entries() {
+		kinds = append(kinds, entry.Kind)
+	}
+	if fmt.Sprint(kinds) != fmt.Sprint([]string{ledger.KindDeposit, ledger.KindHold, ledger.KindWithdrawal}) {
+		t.Errorf("Unexpected journal %v", kinds)
+	}
+}
+
+func TestWithdraw_HoldIsReleasedOnFailure(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 25000)
+	useLedger(service, mockRepo)
+
+	_, err := service.Withdraw(context.Background(), &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1})
+	if err != nil {
+		t.Fatalf("Expected successful withdrawal, got error: %v", err)
+	}
+
+	err = service.HandleCallback(context.Background(), &models.PaymentCallback{GatewayTxnID: "mock_txn_123", Status: db.StatusFailed, GatewayID: 1})
+	if err != nil {
+		t.Fatalf("Expected successful callback handling, got error: %v", err)
+	}
+	assertBalances(t, service, 25000, 0)
+}
+
+func TestWithdraw_InsufficientLedgerBalance(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 5000)
+	useLedger(service, mockRepo)
+
+	_, err := service.Withdraw(context.Background(), &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1})
+	if err == nil || err.Error() != "Insufficient funds." {
+		t.Errorf("Expected insufficient funds error, got: %v", err)
+	}
+	assertBalances(t, service, 5000, 0)
+}
+
+func TestWithdraw_HoldGuardsStaleBalance(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 15000)
+	// The balance read before the hold is out of date, e.g. because another withdrawal was placed in between.
+	service.as = &mockAccountService{balance: 100000}
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	if _, err := service.Withdraw(context.Background(), req); err != nil {
+		t.Fatalf("Expected the first withdrawal to succeed, got error: %v", err)
+	}
+	if _, err := service.Withdraw(context.Background(), req); err == nil || err.Error() != "Insufficient funds." {
+		t.Errorf("Expected insufficient funds error, got: %v", err)
+	}
+	if len(mockRepo.transactions) != 1 {
+		t.Errorf("Expected only the first withdrawal to be saved, got %d transactions", len(mockRepo.transactions))
+	}
+
+	useLedger(service, mockRepo)
+	assertBalances(t, service, 5000, 10000)
+}
+
+func TestWithdraw_GatewayFailureReleasesHold(t *testing.T) {
+	service, mockGateway, mockRepo := setupTestService(t, true, 15000)
+	useLedger(service, mockRepo)
+	mockGateway.declines = true
+
+	_, err := service.Withdraw(context.Background(), &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1})
+	if err == nil {
+		t.Fatal("Expected payment gateway error, got success")
+	}
+	assertBalances(t, service, 15000, 0)
+	if hold := mockRepo.ledger.Hold(1); hold == nil || hold.Status != ledger.HoldReleased {
+		t.Errorf("Expected the hold to be released, got %+v", hold)
+	}
+}
+
+//----------------------------------------  Limits Test ----------------------------------------------------//
+
+func useLimits(service *paymentService, mockRepo *mockTransactionRepository, rules ...*limits.Rule) *mockLimitStore {
+	store := &mockLimitStore{rules: rules, tiers: map[int]int{}, repo: mockRepo}
+	service.limits = limits.NewEngine(store, nil)
+	return store
+}
+
+func TestWithdraw_DailyLimit(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	useLimits(service, mockRepo, &limits.Rule{
+		ID: 1, Kind: limits.KindDailyAmount, TransactionType: db.TypeWithdraw, Currency: "USD", Amount: 15000, Enabled: true,
+	})
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	if _, err := service.Withdraw(context.Background(), req); err != nil {
+		t.Fatalf("Expected the first withdrawal to succeed, got error: %v", err)
+	}
+
+	_, err := service.Withdraw(context.Background(), req)
+	var serviceErr *models.ServiceError
+	if !errors.As(err, &serviceErr) || serviceErr.Code != models.ErrorCodeLimitExceeded || serviceErr.Reason != limits.CodeDailyLimitExceeded {
+		t.Fatalf("Expected the daily limit to be exceeded, got: %v", err)
+	}
+	if models.GetStatusCode(err) != 422 {
+		t.Errorf("Expected status 422, got %d", models.GetStatusCode(err))
+	}
+
+	// Failed withdrawals don't count.
+	for _, tx := range mockRepo.transactions {
+		tx.Status = db.StatusFailed
+	}
+	if _, err := service.Withdraw(context.Background(), req); err != nil {
+		t.Errorf("Expected the withdrawal to succeed once the first one failed, got error: %v", err)
+	}
+}
+
+// racingLimits saves a withdrawal of the user right after the limits were checked, like one of their requests
+// handled at the same time by another instance.
+type racingLimits struct {
+	limits.Checker
+	repo   *mockTransactionRepository
+	amount int64
+}
+
+func (r *racingLimits) Check(ctx context.Context, req *limits.Request) (*limits.Recheck, error) {
+	recheck, err := r.Checker.Check(ctx, req)
+	r.repo.Create(ctx, &db.Transaction{
+		Amount: models.Money{Minor: r.amount, Currency: "USD"}, Type: db.TypeWithdraw, UserID: req.UserID,
+		GatewayID: 1, Status: db.StatusPending, CreatedAt: time.Now(),
+	}, nil)
+	return recheck, err
+}
+
+func TestWithdraw_DailyLimitRecheckedWhenSaved(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	useLedger(service, mockRepo)
+	useLimits(service, mockRepo, &limits.Rule{
+		ID: 1, Kind: limits.KindDailyAmount, TransactionType: db.TypeWithdraw, Currency: "USD", Amount: 15000, Enabled: true,
+	})
+	service.limits = &racingLimits{Checker: service.limits, repo: mockRepo, amount: 10000}
+
+	_, err := service.Withdraw(context.Background(), &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1})
+	var serviceErr *models.ServiceError
+	if !errors.As(err, &serviceErr) || serviceErr.Code != models.ErrorCodeLimitExceeded || serviceErr.Reason != limits.CodeDailyLimitExceeded {
+		t.Fatalf("Expected the daily limit to be exceeded once the other withdrawal was saved, got: %v", err)
+	}
+	if len(mockRepo.transactions) != 1 {
+		t.Errorf("Expected only the other withdrawal to be saved, got %d transactions", len(mockRepo.transactions))
+	}
+	assertBalances(t, service, 100000, 0)
+}
+
+func TestWithdraw_ReviewLimitRecheckedWhenSaved(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	useLedger(service, mockRepo)
+	useLimits(service, mockRepo, &limits.Rule{
+		ID: 1, Kind: limits.KindDailyAmount, TransactionType: db.TypeWithdraw, Currency: "USD", Amount: 15000,
+		Action: limits.ActionReview, Enabled: true,
+	})
+	service.limits = &racingLimits{Checker: service.limits, repo: mockRepo, amount: 10000}
+
+	result, err := service.Withdraw(context.Background(), &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1})
+	if err != nil || result.Status != db.StatusReview {
+		t.Fatalf("Expected the withdrawal to be parked once the other withdrawal was saved, got %+v, %v", result, err)
+	}
+	if decision := mockRepo.decisions[len(mockRepo.decisions)-1]; decision.Reasons() != "daily withdraw limit of 150.00 USD exceeded, 100.00 USD already used" {
+		t.Errorf("Expected the limit to be the reason for the review, got %q", decision.Reasons())
+	}
+	// The amount stays held while the withdrawal waits.
+	assertBalances(t, service, 90000, 10000)
+}
+
+func kycTier(tier int) *int {
+	return &tier
+}
+
+func TestWithdraw_LimitScopes(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     limits.Rule
+		tier     int
+		disabled bool
+		reason   string
+	}{
+		{"minimum", limits.Rule{Kind: limits.KindMinAmount, Amount: 20000}, 0, false, limits.CodeBelowMinimum},
+		{"maximum", limits.Rule{Kind: limits.KindMaxAmount, Amount: 5000}, 0, false, limits.CodeAboveMaximum},
+		{"other user", limits.Rule{Kind: limits.KindMaxAmount, Amount: 5000, UserID: 2}, 0, false, ""},
+		{"user's country", limits.Rule{Kind: limits.KindMaxAmount, Amount: 5000, CountryID: 840}, 0, false, limits.CodeAboveMaximum},
+		{"other gateway", limits.Rule{Kind: limits.KindMaxAmount, Amount: 5000, GatewayID: 2}, 0, false, ""},
+		{"other currency", limits.Rule{Kind: limits.KindMaxAmount, Amount: 5000, Currency: "EUR"}, 0, false, ""},
+		{"deposits only", limits.Rule{Kind: limits.KindMaxAmount, Amount: 5000, TransactionType: db.TypeDeposit}, 0, false, ""},
+		{"user's tier", limits.Rule{Kind: limits.KindMaxAmount, Amount: 5000, KYCTier: kycTier(1)}, 1, false, limits.CodeAboveMaximum},
+		{"other tier", limits.Rule{Kind: limits.KindMaxAmount, Amount: 5000, KYCTier: kycTier(2)}, 1, false, ""},
+		{"unverified", limits.Rule{Kind: limits.KindMaxAmount, Amount: 5000, KYCTier: kycTier(0)}, 0, false, limits.CodeAboveMaximum},
+		{"unverified only", limits.Rule{Kind: limits.KindMaxAmount, Amount: 5000, KYCTier: kycTier(0)}, 1, false, ""},
+		{"every tier", limits.Rule{Kind: limits.KindMaxAmount, Amount: 5000}, 2, false, limits.CodeAboveMaximum},
+		{"disabled", limits.Rule{Kind: limits.KindMaxAmount, Amount: 5000}, 0, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, _, mockRepo := setupTestService(t, true, 100000)
+			rule := tt.rule
+			if rule.Currency == "" {
+				rule.Currency = "USD"
+			}
+			if rule.TransactionType == "" {
+				rule.TransactionType = db.TypeWithdraw
+			}
+			rule.Enabled = !tt.disabled
+			store := useLimits(service, mockRepo, &rule)
+			store.tiers[1] = tt.tier
+
+			_, err := service.Withdraw(context.Background(), &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1})
+			if tt.reason == "" {
+				if err != nil {
+					t.Errorf("Expected the rule not to apply, got error: %v", err)
+				}
+				return
+			}
+			var serviceErr *models.ServiceError
+			if !errors.As(err, &serviceErr) || serviceErr.Reason != tt.reason {
+				t.Errorf("Expected %s, got: %v", tt.reason, err)
+			}
+		})
+	}
+}
+
+//----------------------------------------  Transaction Listing Test ----------------------------------------------------//
+
+// createTransactions creates n deposits of user 1, a minute apart, the last one the newest.
+func createTransactions(mockRepo *mockTransactionRepository, n int) []*db.Transaction {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var transactions []*db.Transaction
+	for i := 0; i < n; i++ {
+		tx := &db.Transaction{
+			Amount:    models.Money{Minor: int64(1000 * (i + 1)), Currency: "USD"},
+			Type:      db.TypeDeposit,
+			Status:    db.StatusCompleted,
+			UserID:    1,
+			GatewayID: 1,
+			CountryID: 840,
+			CreatedAt: start.Add(time.Duration(i) * time.Minute),
+		}
+		mockRepo.Create(context.Background(), tx, nil)
+		transactions = append(transactions, tx)
+	}
+	return transactions
+}
+
+func TestGetTransaction(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	tx := createCompletedDeposit(mockRepo)
+
+	transaction, err := service.GetTransaction(context.Background(), 1, tx.ID)
+	if err != nil {
+		t.Fatalf("Expected the transaction, got error: %v", err)
+	}
+	if transaction.ID != tx.ID || transaction.Status != db.StatusCompleted || transaction.Amount != tx.Amount {
+		t.Errorf("Unexpected transaction %+v", transaction)
+	}
+
+	if _, err := service.GetTransaction(context.Background(), 2, tx.ID); err == nil || err.Error() != "Transaction not found" {
+		t.Errorf("Expected 'Transaction not found' for another user, got: %v", err)
+	}
+	if _, err := service.GetTransaction(context.Background(), 1, 999); err == nil || err.Error() != "Transaction not found" {
+		t.Errorf("Expected 'Transaction not found' for an unknown transaction, got: %v", err)
+	}
+}
+
+func TestListTransactions_Pagination(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	created := createTransactions(mockRepo, 5)
+	// Same created_at as the newest one, the id breaks the tie.
+	tie := &db.Transaction{Type: db.TypeDeposit, Status: db.StatusPending, UserID: 1, CreatedAt: created[4].CreatedAt,
+		Amount: models.Money{Minor: 500, Currency: "USD"}}
+	mockRepo.Create(context.Background(), tie, nil)
+	// Other users' transactions are never listed.
+	mockRepo.Create(context.Background(), &db.Transaction{Type: db.TypeDeposit, UserID: 2, CreatedAt: created[4].CreatedAt}, nil)
+
+	var ids []int
+	query := &models.TransactionQuery{UserID: 1, Limit: 2}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("Expected the listing to end after 3 pages")
+		}
+		page, err := service.ListTransactions(context.Background(), query)
+		if err != nil {
+			t.Fatalf("Expected a page, got error: %v", err)
+		}
+		for _, tx := range page.Transactions {
+			ids = append(ids, tx.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+
+	expected := []int{tie.ID, created[4].ID, created[3].ID, created[2].ID, created[1].ID, created[0].ID}
+	if fmt.Sprint(ids) != fmt.Sprint(expected) {
+		t.Errorf("Expected transactions %v newest first, got %v", expected, ids)
+	}
+}
+
+func TestListTransactions_Filters(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	created := createTransactions(mockRepo, 4)
+	mockRepo.transactions[created[1].ID].Status = db.StatusFailed
+	mockRepo.transactions[created[2].ID].Amount.Currency = "EUR"
+
+	page, err := service.ListTransactions(context.Background(), &models.TransactionQuery{UserID: 1, Status: db.StatusFailed, Limit: 10})
+	if err != nil || len(page.Transactions) != 1 || page.Transactions[0].ID != created[1].ID {
+		t.Errorf("Expected only the failed transaction, got %+v, %v", page, err)
+	}
+
+	page, err = service.ListTransactions(context.Background(), &models.TransactionQuery{
+		UserID:      1,
+		Currency:    "USD",
+		CreatedFrom: created[1].CreatedAt,
+		CreatedTo:   created[3].CreatedAt,
+		Limit:       10,
+	})
+	if err != nil || len(page.Transactions) != 1 || page.Transactions[0].ID != created[1].ID {
+		t.Errorf("Expected only the USD transaction created in range, got %+v, %v", page, err)
+	}
+	if page.NextCursor != "" {
+		t.Errorf("Expected no next page, got cursor %q", page.NextCursor)
+	}
+}
+
+func TestListTransactions_InvalidQuery(t *testing.T) {
+	service, _, _ := setupTestService(t, true, 100000)
+
+	tests := []struct {
+		name  string
+		query models.TransactionQuery
+	}{
+		{"unknown status", models.TransactionQuery{UserID: 1, Status: "done", Limit: 10}},
+		{"unknown type", models.TransactionQuery{UserID: 1, Type: "transfer", Limit: 10}},
+		{"malformed cursor", models.TransactionQuery{UserID: 1, Cursor: "not a cursor", Limit: 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := service.ListTransactions(context.Background(), &tt.query)
+			var serviceErr *models.ServiceError
+			if !errors.As(err, &serviceErr) || serviceErr.Code != models.ErrorCodeValidation {
+				t.Errorf("Expected a validation error, got: %v", err)
+			}
+		})
+	}
+}
+
+//----------------------------------------  Refund Test ----------------------------------------------------//
+
+func createCompletedDeposit(mockRepo *mockTransactionRepository) *db.Transaction {
+	tx := &db.Transaction{
+		Amount:       models.Money{Minor: 10000, Currency: "USD"},
+		Type:         db.TypeDeposit,
+		UserID:       1,
+		GatewayID:    1,
+		CountryID:    840,
+		Status:       db.StatusCompleted,
+		GatewayTxnId: "txn123",
+	}
+	mockRepo.Create(context.Background(), tx, nil)
+	return tx
+}
+
+func TestRefund_PartialRefunds(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	parent := createCompletedDeposit(mockRepo)
+
+	result, err := service.Refund(context.Background(), &models.RefundRequest{TransactionID: parent.ID, UserID: 1, Amount: 4000})
+	if err != nil {
+		t.Fatalf("Expected successful refund, got error: %v", err)
+	}
+	if result.TransactionID != parent.ID || result.Amount.Minor != 4000 || result.Amount.Currency != "USD" {
+		t.Errorf("Expected a refund of 40.00 USD of transaction %d, got %+v", parent.ID, result)
+	}
+
+	refund := mockRepo.transactions[result.RefundID]
+	if refund.Type != db.TypeRefund || refund.ParentID != parent.ID || refund.Status != db.StatusPending {
+		t.Errorf("Expected a pending refund linked to the parent, got %+v", refund)
+	}
+	if refund.GatewayTxnId != fmt.Sprintf("mock_refund_%d", refund.ID) {
+		t.Errorf("Expected the gateway refund id to be saved, got %q", refund.GatewayTxnId)
+	}
+	if len(mockRepo.outbox) != 1 || mockRepo.outbox[0].EventType != EventRefundCreated {
+		t.Fatalf("Expected a %s outbox event, got %v", EventRefundCreated, mockRepo.outbox)
+	}
+	var message map[string]interface{}
+	json.Unmarshal(mockRepo.outbox[0].Payload, &message)
+	if message["parentId"] != float64(parent.ID) {
+		t.Errorf("Expected the event to reference the parent, got %v", message)
+	}
+
+	// The remaining 60.00 can still be refunded, but not a cent more.
+	if _, err := service.Refund(context.Background(), &models.RefundRequest{TransactionID: parent.ID, UserID: 1, Amount: 6001}); err == nil {
+		t.Error("Expected refund above the remaining amount to fail")
+	} else if serviceErr, ok := err.(*models.ServiceError); !ok || serviceErr.Code != models.ErrorCodeValidation {
+		t.Errorf("Expected validation error, got: %v", err)
+	}
+	if _, err := service.Refund(context.Background(), &models.RefundRequest{TransactionID: parent.ID, UserID: 1, Amount: 6000}); err != nil {
+		t.Errorf("Expected refund of the remaining amount to succeed, got: %v", err)
+	}
+}
+
+func TestRefund_FullRefund(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	parent := createCompletedDeposit(mockRepo)
+
+	if _, err := service.Refund(context.Background(), &models.RefundRequest{TransactionID: parent.ID, UserID: 1, Amount: 2500}); err != nil {
+		t.Fatalf("Expected successful refund, got error: %v", err)
+	}
+
+	result, err := service.Refund(context.Background(), &models.RefundRequest{TransactionID: parent.ID, UserID: 1})
+	if err != nil {
+		t.Fatalf("Expected successful refund, got error: %v", err)
+	}
+	if result.Amount.Minor != 7500 {
+		t.Errorf("Expected the remaining 7500 to be refunded, got %d", result.Amount.Minor)
+	}
+
+	_, err = service.Refund(context.Background(), &models.RefundRequest{TransactionID: parent.ID, UserID: 1})
+	if serviceErr, ok := err.(*models.ServiceError); !ok || serviceErr.Code != models.ErrorCodeConflict {
+		t.Errorf("Expected conflict for a fully refunded transaction, got: %v", err)
+	}
+}
+
+func TestRefund_GatewayDisabledSinceTheDeposit(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	parent := createCompletedDeposit(mockRepo)
+	repo := service.gateways.(*mockGatewayRepository)
+	repo.gateways[0].Enabled = false
+	GetPaymentGateway = func(ctx context.Context, countryId int, gatewayId int) (PaymentGateway, error) {
+		return resolvePaymentGateway(ctx, repo, countryId, gatewayId)
+	}
+
+	// New transactions can't go to the gateway any more, the deposits it already has are refunded there.
+	if _, err := service.Deposit(context.Background(), &models.TransactionRequest{Amount: 1000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}); models.GetStatusCode(err) != 503 {
+		t.Errorf("Expected the disabled gateway to refuse a deposit, got: %v", err)
+	}
+	result, err := service.Refund(context.Background(), &models.RefundRequest{TransactionID: parent.ID, UserID: 1})
+	if err != nil {
+		t.Fatalf("Expected successful refund, got error: %v", err)
+	}
+	if refund := mockRepo.transactions[result.RefundID]; result.Status != db.StatusPending || refund.GatewayTxnId != fmt.Sprintf("mock_refund_%d", refund.ID) {
+		t.Errorf("Expected the refund to be sent to the gateway, got %+v", refund)
+	}
+}
+
+func TestRefund_GatewayFailureReleasesAmount(t *testing.T) {
+	service, mockGateway, mockRepo := setupTestService(t, true, 100000)
+	parent := createCompletedDeposit(mockRepo)
+	mockGateway.declines = true
+
+	_, err := service.Refund(context.Background(), &models.RefundRequest{TransactionID: parent.ID, UserID: 1})
+	if serviceErr, ok := err.(*models.ServiceError); !ok || serviceErr.Code != models.ErrorCodeGatewayError {
+		t.Fatalf("Expected gateway error, got: %v", err)
+	}
+
+	refunded, _ := mockRepo.GetRefundedAmount(context.Background(), parent.ID)
+	if refunded != 0 {
+		t.Errorf("Expected the failed refund not to count, got %d refunded", refunded)
+	}
+	if len(mockRepo.outbox) != 1 || mockRepo.outbox[0].EventType != EventRefundCreated {
+		t.Fatalf("Expected a %s outbox event, got %v", EventRefundCreated, mockRepo.outbox)
+	}
+	var message map[string]interface{}
+	json.Unmarshal(mockRepo.outbox[0].Payload, &message)
+	if message["status"] != db.StatusFailed {
+		t.Errorf("Expected the event of a failed refund, got %v", message)
+	}
+}
+
+func TestRefund_HoldsAmountUntilSettled(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	useLedger(service, mockRepo)
+	parent := createCompletedDeposit(mockRepo)
+
+	result, err := service.Refund(context.Background(), &models.RefundRequest{TransactionID: parent.ID, UserID: 1, Amount: 4000})
+	if err != nil {
+		t.Fatalf("Expected successful refund, got error: %v", err)
+	}
+	assertBalances(t, service, 96000, 4000)
+
+	refund := mockRepo.transactions[result.RefundID]
+	err = service.HandleCallback(context.Background(), &models.PaymentCallback{GatewayTxnID: refund.GatewayTxnId, Status: db.StatusCompleted, GatewayID: 1})
+	if err != nil {
+		t.Fatalf("Expected successful callback handling, got error: %v", err)
+	}
+	assertBalances(t, service, 96000, 0)
+	entries := mockRepo.ledger.Entries()
+	if last := entries[len(entries)-1]; last.Kind != ledger.KindRefund || last.TransactionID != refund.ID {
+		t.Errorf("Expected the hold to be captured as a refund, got %+v", last)
+	}
+}
+
+func TestRefund_AfterWithdrawingTheDeposit(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 10000)
+	useLedger(service, mockRepo)
+	parent := createCompletedDeposit(mockRepo)
+	if _, err := service.Withdraw(context.Background(), &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}); err != nil {
+		t.Fatalf("Expected successful withdrawal, got error: %v", err)
+	}
+
+	_, err := service.Refund(context.Background(), &models.RefundRequest{TransactionID: parent.ID, UserID: 1})
+	if err == nil || err.Error() != "Insufficient funds." {
+		t.Errorf("Expected insufficient funds error, got: %v", err)
+	}
+	if refunded, _ := mockRepo.GetRefundedAmount(context.Background(), parent.ID); refunded != 0 {
+		t.Errorf("Expected no refund to be saved, got %d refunded", refunded)
+	}
+	assertBalances(t, service, 0, 10000)
+}
+
+func TestRefund_OtherUsersTransaction(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	parent := createCompletedDeposit(mockRepo)
+
+	_, err := service.Refund(context.Background(), &models.RefundRequest{TransactionID: parent.ID, UserID: 2})
+	if err == nil || err.Error() != "Transaction not found" {
+		t.Errorf("Expected 'Transaction not found' error, got: %v", err)
+	}
+}
+
+func TestRefund_PendingTransaction(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	parent := createCompletedDeposit(mockRepo)
+	mockRepo.transactions[parent.ID].Status = db.StatusPending
+
+	_, err := service.Refund(context.Background(), &models.RefundRequest{TransactionID: parent.ID, UserID: 1})
+	if serviceErr, ok := err.(*models.ServiceError); !ok || serviceErr.Code != models.ErrorCodeConflict {
+		t.Errorf("Expected conflict for a pending transaction, got: %v", err)
+	}
+}
+
+func TestRefund_CurrencyMismatch(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	parent := createCompletedDeposit(mockRepo)
+
+	_, err := service.Refund(context.Background(), &models.RefundRequest{TransactionID: parent.ID, UserID: 1, Amount: 100, Currency: "EUR"})
+	if serviceErr, ok := err.(*models.ServiceError); !ok || serviceErr.Code != models.ErrorCodeValidation {
+		t.Errorf("Expected validation error, got: %v", err)
+	}
+}
+
+func TestHandleCallback_Refund(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	parent := createCompletedDeposit(mockRepo)
+
+	result, err := service.Refund(context.Background(), &models.RefundRequest{TransactionID: parent.ID, UserID: 1})
+	if err != nil {
+		t.Fatalf("Expected successful refund, got error: %v", err)
+	}
+	refund := mockRepo.transactions[result.RefundID]
+
+	err = service.HandleCallback(context.Background(), &models.PaymentCallback{
+		GatewayTxnID: refund.GatewayTxnId,
+		Status:       db.StatusCompleted,
+		GatewayID:    1,
+	})
+	if err != nil {
+		t.Fatalf("Expected successful callback handling, got error: %v", err)
+	}
+
+	if mockRepo.transactions[refund.ID].Status != db.StatusCompleted {
+		t.Errorf("Expected refund to be completed, got %s", mockRepo.transactions[refund.ID].Status)
+	}
+	// A completed full refund also moves the deposit to refunded.
+	if mockRepo.transactions[parent.ID].Status != db.StatusRefunded {
+		t.Errorf("Expected the deposit to be refunded, got %s", mockRepo.transactions[parent.ID].Status)
+	}
+
+	var eventTypes []string
+	for _, event := range mockRepo.outbox {
+		eventTypes = append(eventTypes, event.EventType)
+	}
+	expected := fmt.Sprint([]string{EventRefundCreated, EventRefundUpdated, EventTransactionUpdated})
+	if fmt.Sprint(eventTypes) != expected {
+		t.Errorf("Expected outbox events %s, got %v", expected, eventTypes)
+	}
+}
+
+// failingRefundsRepository fails to list refunds while failing is set.
+type failingRefundsRepository struct {
+	*mockTransactionRepository
+	failing bool
+}
+
+func (r *failingRefundsRepository) GetRefunds(ctx context.Context, parentID int) ([]*db.Transaction, error) {
+	if r.failing {
+		return nil, errors.New("connection reset")
+	}
+	return r.mockTransactionRepository.GetRefunds(ctx, parentID)
+}
+
+func TestHandleCallback_RetriedRefundMarksDepositRefunded(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	parent := createCompletedDeposit(mockRepo)
+	result, err := service.Refund(context.Background(), &models.RefundRequest{TransactionID: parent.ID, UserID: 1})
+	if err != nil {
+		t.Fatalf("Expected successful refund, got error: %v", err)
+	}
+	refund := mockRepo.transactions[result.RefundID]
+
+	repo := &failingRefundsRepository{mockTransactionRepository: mockRepo, failing: true}
+	service.repo = repo
+	callback := &models.PaymentCallback{GatewayTxnID: refund.GatewayTxnId, Status: db.StatusCompleted, GatewayID: 1}
+	if err := service.HandleCallback(context.Background(), callback); err == nil {
+		t.Fatal("Expected an error so the gateway sends the callback again")
+	}
+	if mockRepo.transactions[refund.ID].Status != db.StatusCompleted || mockRepo.transactions[parent.ID].Status != db.StatusCompleted {
+		t.Fatalf("Expected only the refund to be completed, got refund %s and deposit %s",
+			mockRepo.transactions[refund.ID].Status, mockRepo.transactions[parent.ID].Status)
+	}
+
+	// The gateway retries, the refund is already completed.
+	repo.failing = false
+	if err := service.HandleCallback(context.Background(), callback); err != nil {
+		t.Fatalf("Expected successful callback handling, got error: %v", err)
+	}
+	if mockRepo.transactions[parent.ID].Status != db.StatusRefunded {
+		t.Errorf("Expected the deposit to be refunded, got %s", mockRepo.transactions[parent.ID].Status)
+	}
+}
+
+func TestHandleCallback_PartialRefundKeepsDepositCompleted(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	parent := createCompletedDeposit(mockRepo)
+
+	result, _ := service.Refund(context.Background(), &models.RefundRequest{TransactionID: parent.ID, UserID: 1, Amount: 5000})
+	refund := mockRepo.transactions[result.RefundID]
+
+	err := service.HandleCallback(context.Background(), &models.PaymentCallback{
+		GatewayTxnID: refund.GatewayTxnId,
+		Status:       db.StatusCompleted,
+		GatewayID:    1,
+	})
+	if err != nil {
+		t.Fatalf("Expected successful callback handling, got error: %v", err)
+	}
+	if mockRepo.transactions[parent.ID].Status != db.StatusCompleted {
+		t.Errorf("Expected the deposit to stay completed, got %s", mockRepo.transactions[parent.ID].Status)
+	}
+}
+
+//----------------------------------------  Review Test ----------------------------------------------------//
+
+// parkWithdrawal creates a withdrawal of 100.00 USD that the compliance checks sent to review.
+func parkWithdrawal(t *testing.T, service *paymentService) int {
+	t.Helper()
+	cs := service.cs
+	service.cs = &mockComplianceService{outcome: compliance.OutcomeReview}
+	defer func() { service.cs = cs }()
+
+	result, err := service.Withdraw(context.Background(), &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1})
+	if err != nil || result.Status != db.StatusReview {
+		t.Fatalf("Expected the withdrawal to be parked, got %+v, %v", result, err)
+	}
+	return result.TransactionId
+}
+
+func TestApproveReview_SendsTransactionToGateway(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	useLedger(service, mockRepo)
+	id := parkWithdrawal(t, service)
+
+	result, err := service.ApproveReview(context.Background(), &models.ReviewRequest{TransactionID: id, ReviewerID: 7, Reason: "known customer"})
+	if err != nil {
+		t.Fatalf("Expected the approval to succeed, got error: %v", err)
+	}
+	if result.Status != db.StatusPending || mockRepo.transactions[id].GatewayTxnId != "mock_txn_123" {
+		t.Errorf("Expected the withdrawal to be pending at the gateway, got %+v", mockRepo.transactions[id])
+	}
+	if len(mockRepo.reviews) != 1 || mockRepo.reviews[0].ReviewerID != 7 || mockRepo.reviews[0].Action != db.ReviewApprove {
+		t.Errorf("Expected the approval of reviewer 7 to be audited, got %+v", mockRepo.reviews)
+	}
+	last := mockRepo.outbox[len(mockRepo.outbox)-1]
+	if last.EventType != EventTransactionUpdated || !strings.Contains(string(last.Payload), `"status":"pending"`) {
+		t.Errorf("Expected an updated event for the pending withdrawal, got %s %s", last.EventType, last.Payload)
+	}
+	// The hold placed when the withdrawal was parked carries on.
+	assertBalances(t, service, 90000, 10000)
+
+	// The second operator is too late.
+	if _, err := service.ApproveReview(context.Background(), &models.ReviewRequest{TransactionID: id, ReviewerID: 8}); models.GetStatusCode(err) != 409 {
+		t.Errorf("Expected 409 for a transaction that isn't in review anymore, got: %v", err)
+	}
+}
+
+func TestApproveReview_AlreadyReviewed(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	id := parkWithdrawal(t, service)
+	// Another operator's decision was saved in the meantime.
+	mockRepo.reviews = append(mockRepo.reviews, &db.ReviewDecision{TransactionID: id, ReviewerID: 8, Action: db.ReviewApprove})
+
+	_, err := service.ApproveReview(context.Background(), &models.ReviewRequest{TransactionID: id, ReviewerID: 7})
+	if err == nil || err.Error() != "Transaction has already been reviewed" {
+		t.Errorf("Expected the approval to be refused, got: %v", err)
+	}
+	if mockRepo.transactions[id].GatewayTxnId != "" {
+		t.Error("Expected the withdrawal not to be sent to the gateway twice")
+	}
+}
+
+func TestApproveReview_ExpiredHold(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	id := parkWithdrawal(t, service)
+	mockRepo.transactions[id].CreatedAt = time.Now().Add(-WithdrawalHoldTTL - time.Minute)
+
+	if _, err := service.ApproveReview(context.Background(), &models.ReviewRequest{TransactionID: id, ReviewerID: 7}); models.GetStatusCode(err) != 409 {
+		t.Errorf("Expected 409 once the hold has expired, got: %v", err)
+	}
+	if _, err := service.RejectReview(context.Background(), &models.ReviewRequest{TransactionID: id, ReviewerID: 7, Reason: "too late"}); err != nil {
+		t.Errorf("Expected the withdrawal to be rejectable, got: %v", err)
+	}
+}
+
+func TestRejectReview_ReleasesHold(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	useLedger(service, mockRepo)
+	id := parkWithdrawal(t, service)
+
+	result, err := service.RejectReview(context.Background(), &models.ReviewRequest{TransactionID: id, ReviewerID: 7, Reason: "unverified source of funds"})
+	if err != nil {
+		t.Fatalf("Expected the rejection to succeed, got error: %v", err)
+	}
+	if result.Status != db.StatusFailed || mockRepo.transactions[id].GatewayTxnId != "" {
+		t.Errorf("Expected the withdrawal to fail without going to the gateway, got %+v", mockRepo.transactions[id])
+	}
+	assertBalances(t, service, 100000, 0)
+
+	last := mockRepo.history[len(mockRepo.history)-1]
+	if last.Source != SourceReview || last.Reason != "rejected by reviewer 7: unverified source of funds" {
+		t.Errorf("Expected the rejection to be recorded, got %+v", last)
+	}
+	event := mockRepo.outbox[len(mockRepo.outbox)-1]
+	if event.EventType != EventTransactionUpdated || !strings.Contains(string(event.Payload), `"status":"failed"`) {
+		t.Errorf("Expected a failed event, got %s %s", event.EventType, event.Payload)
+	}
+	if len(mockRepo.reviews) != 1 || mockRepo.reviews[0].Action != db.ReviewReject || mockRepo.reviews[0].Reason != "unverified source of funds" {
+		t.Errorf("Expected the rejection to be audited, got %+v", mockRepo.reviews)
+	}
+}
+
+func TestRejectReview_NotInReview(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	trx := createTransactionWithStatus(mockRepo, db.StatusPending)
+
+	if _, err := service.RejectReview(context.Background(), &models.ReviewRequest{TransactionID: trx.ID, ReviewerID: 7, Reason: "no"}); models.GetStatusCode(err) != 409 {
+		t.Errorf("Expected 409 for a pending transaction, got: %v", err)
+	}
+	if _, err := service.RejectReview(context.Background(), &models.ReviewRequest{TransactionID: 999, ReviewerID: 7, Reason: "no"}); models.GetStatusCode(err) != 404 {
+		t.Errorf("Expected 404 for an unknown transaction, got: %v", err)
+	}
+}
+
+func TestWithdraw_LimitWithReviewAction(t *testing.T) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	useLimits(service, mockRepo, &limits.Rule{
+		ID: 1, Kind: limits.KindMaxAmount, TransactionType: db.TypeWithdraw, Currency: "USD", Amount: 5000,
+		Action: limits.ActionReview, Enabled: true,
+	})
+
+	result, err := service.Withdraw(context.Background(), &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1})
+	if err != nil || result.Status != db.StatusReview {
+		t.Fatalf("Expected the withdrawal to be parked by the limit, got %+v, %v", result, err)
+	}
+
+	queue, err := service.ListReviewQueue(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue.Items) != 1 || len(queue.Items[0].Flags) != 1 || queue.Items[0].Flags[0].Rule != limits.CodeAboveMaximum {
+		t.Errorf("Expected the limit to be listed as the reason for the review, got %+v", queue.Items)
+	}
+}
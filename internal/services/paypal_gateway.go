@@ -0,0 +1,262 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"payment-gateway/db"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/paypal"
+	"payment-gateway/internal/retry"
+)
+
+func init() {
+	RegisterGateway("paypal", GatewayAdapter[paypal.Config]{
+		Capabilities: Capabilities{
+			Operations: []string{db.TypeDeposit, db.TypeWithdraw, db.TypeRefund},
+			// The currencies PayPal can hold balances in and pay out.
+			Currencies: []string{
+				"AUD", "BRL", "CAD", "CHF", "CNY", "CZK", "DKK", "EUR", "GBP", "HKD", "HUF", "ILS", "JPY",
+				"MXN", "MYR", "NOK", "NZD", "PHP", "PLN", "SEK", "SGD", "THB", "TWD", "USD",
+			},
+			DataFormats: []string{"application/json"},
+		},
+		LoadConfig: func() (paypal.Config, error) { return paypal.LoadConfig(), nil },
+		New:        newPaypalGateway,
+	})
+}
+
+// PaypalGateway takes deposits as orders the user approves on PayPal and sends withdrawals as payouts
+// to the PayPal account of the user's email. Their outcome comes back through the callback as a webhook
+// event. An approved order is authorized and captured right away, see Capture.
+type PaypalGateway struct {
+	client *paypal.Client
+	users  db.UserRepository
+}
+
+func newPaypalGateway(cfg paypal.Config) (PaymentGateway, error) {
+	if cfg.ClientID == "" || cfg.ClientSecret == "" {
+		log.Println("PAYPAL_CLIENT_ID or PAYPAL_CLIENT_SECRET is not set, PayPal will turn every payment down")
+	}
+	return &PaypalGateway{client: paypal.NewClient(cfg), users: db.NewUserRepository(db.Db)}, nil
+}
+
+// paypalStatuses maps the statuses of PayPal orders, captures, refunds and payouts to the ones of our transactions.
+var paypalStatuses = map[string]string{
+	// orders
+	"CREATED":               db.StatusPending,
+	"SAVED":                 db.StatusPending,
+	"PAYER_ACTION_REQUIRED": db.StatusPending,
+	"APPROVED":              db.StatusAuthorized,
+	"VOIDED":                db.StatusFailed,
+	// captures and refunds
+	"PENDING":   db.StatusPending,
+	"COMPLETED": db.StatusCompleted,
+	"DECLINED":  db.StatusFailed,
+	"FAILED":    db.StatusFailed,
+	"CANCELLED": db.StatusFailed,
+	"REFUNDED":  db.StatusRefunded,
+	// payout batches and items
+	"PROCESSING": db.StatusPending,
+	"UNCLAIMED":  db.StatusPending,
+	"ONHOLD":     db.StatusPending,
+	"SUCCESS":    db.StatusCompleted,
+	"DENIED":     db.StatusFailed,
+	"CANCELED":   db.StatusFailed,
+	"BLOCKED":    db.StatusFailed,
+	"RETURNED":   db.StatusFailed,
+	"REVERSED":   db.StatusReversed,
+}
+
+// paypalStatus returns the status of our transactions for a PayPal status, ok is false for one we don't know.
+func paypalStatus(status string) (string, bool) {
+	mapped, ok := paypalStatuses[strings.ToUpper(status)]
+	return mapped, ok
+}
+
+func (p *PaypalGateway) ProcessPayment(ctx context.Context, req *db.Transaction) (*GatewayResult, error) {
+	if p.client == nil {
+		return nil, retry.Permanent(errors.New("paypal is not set up"))
+	}
+
+	// The request id is stable across retries, PayPal answers a retry with what it did the first time.
+	requestID := fmt.Sprintf("%s-%d", req.Type, req.ID)
+	amount := paypal.Amount{CurrencyCode: req.Amount.Currency, Value: req.Amount.Decimal()}
+	var id, status, approvalURL string
+	switch req.Type {
+	case db.TypeDeposit:
+		order, err := p.client.CreateOrder(ctx, &paypal.OrderParams{
+			ReferenceID: requestID,
+			CustomID:    strconv.Itoa(req.ID),
+			Amount:      amount,
+		}, requestID)
+		if err != nil {
+			return nil, paypalError(err)
+		}
+		id, status, approvalURL = order.ID, order.Status, order.ApproveURL()
+	case db.TypeWithdraw:
+		receiver, err := p.users.GetUserEmail(ctx, req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		batch, err := p.client.CreatePayout(ctx, &paypal.PayoutParams{
+			SenderBatchID: requestID,
+			Receiver:      receiver,
+			Amount:        amount,
+			Note:          "Withdrawal " + strconv.Itoa(req.ID),
+		}, requestID)
+		if err != nil {
+			return nil, paypalError(err)
+		}
+		id, status = batch.BatchHeader.PayoutBatchID, batch.BatchHeader.BatchStatus
+	default:
+		return nil, retry.Permanent(fmt.Errorf("paypal can't process a %s", req.Type))
+	}
+
+	if err := paypalRejected(status); err != nil {
+		return nil, err
+	}
+	return &GatewayResult{GatewayTxnId: id, ApprovalURL: approvalURL}, nil
+}
+
+// Capture captures the order of a deposit the payer approved. The request id is stable, so a capture tried
+// again, e.g. for a webhook PayPal sends again, gets the answer of the first one.
+func (p *PaypalGateway) Capture(ctx context.Context, trx *db.Transaction) (*models.PaymentCallback, error) {
+	if p.client == nil {
+		return nil, retry.Permanent(errors.New("paypal is not set up"))
+	}
+
+	order, err := p.client.CaptureOrder(ctx, trx.GatewayTxnId, fmt.Sprintf("capture-%d", trx.ID))
+	var paypalErr *paypal.Error
+	switch {
+	case errors.As(err, &paypalErr) && paypalErr.Issue() == "ORDER_ALREADY_CAPTURED":
+		// Captured before, the events of the capture tell how it went.
+		return nil, nil
+	case errors.As(err, &paypalErr) && paypalErr.HTTPStatus == http.StatusUnprocessableEntity:
+		// The payer's funding source was turned down, e.g. INSTRUMENT_DECLINED.
+		return &models.PaymentCallback{Status: db.StatusFailed, ErrorMessage: paypalErr.Error()}, nil
+	case err != nil:
+		return nil, paypalError(err)
+	}
+
+	capture, err := paypal.CaptureOf(order)
+	if err != nil {
+		return nil, err
+	}
+	status, ok := paypalStatus(capture.Status)
+	if !ok || status == db.StatusPending {
+		// The money isn't taken yet, e.g. for an eCheck. PAYMENT.CAPTURE.COMPLETED or DENIED follows.
+		return nil, nil
+	}
+	return &models.PaymentCallback{Status: status}, nil
+}
+
+// ParseCallback reads the webhook event of PayPal and maps the status of its resource with paypalStatuses.
+// Deposits are known by their order, so the events of a capture are matched by the capture's order. Events
+// about other resources or statuses we don't track are acknowledged without changing anything.
+func (p *PaypalGateway) ParseCallback(body []byte) (*models.PaymentCallback, error) {
+	event, err := paypal.ParseEvent(body)
+	if err != nil {
+		return nil, err
+	}
+
+	resource := event.Resource
+	id, status := resource.ID, resource.Status
+	switch event.ResourceType {
+	case paypal.ResourceOrder, paypal.ResourceRefund:
+	case paypal.ResourceCapture:
+		id = resource.SupplementaryData.RelatedIDs.OrderID
+		if strings.HasSuffix(status, "REFUNDED") {
+			// The refunds have events of their own, the deposit is refunded once they complete.
+			id = ""
+		}
+	case paypal.ResourcePayouts:
+		id, status = "", ""
+		if resource.BatchHeader != nil {
+			id, status = resource.BatchHeader.PayoutBatchID, resource.BatchHeader.BatchStatus
+		}
+	default:
+		id = ""
+	}
+
+	mapped, ok := paypalStatus(status)
+	if id == "" || !ok {
+		log.Printf("ignoring paypal event %s (%s) of %s %s in status %s", event.ID, event.EventType, event.ResourceType, id, status)
+		return nil, nil
+	}
+	callback := &models.PaymentCallback{GatewayTxnID: id, Status: mapped}
+	if mapped == db.StatusFailed {
+		callback.ErrorMessage = resource.StatusDetails.Reason
+		if callback.ErrorMessage == "" {
+			callback.ErrorMessage = event.Summary
+		}
+	}
+	return callback, nil
+}
+
+// Refund refunds the capture of the parent's order, the order itself can't be refunded.
+func (p *PaypalGateway) Refund(ctx context.Context, refund *db.Transaction, parent *db.Transaction) (*GatewayResult, error) {
+	if p.client == nil {
+		return nil, retry.Permanent(errors.New("paypal is not set up"))
+	}
+
+	order, err := p.client.GetOrder(ctx, parent.GatewayTxnId)
+	if err != nil {
+		return nil, paypalError(err)
+	}
+	capture, err := paypal.CaptureOf(order)
+	if err != nil {
+		return nil, retry.Permanent(err)
+	}
+
+	amount := paypal.Amount{CurrencyCode: refund.Amount.Currency, Value: refund.Amount.Decimal()}
+	result, err := p.client.RefundCapture(ctx, capture.ID, amount, fmt.Sprintf("refund-%d", refund.ID))
+	if err != nil {
+		return nil, paypalError(err)
+	}
+	if err := paypalRejected(result.Status); err != nil {
+		return nil, err
+	}
+	return &GatewayResult{GatewayTxnId: result.ID}, nil
+}
+
+// paypalRejected returns an error when PayPal accepted the request, but turned the payment down right away.
+func paypalRejected(status string) error {
+	if mapped, _ := paypalStatus(status); mapped == db.StatusFailed {
+		return retry.Permanent(models.NewServiceErrorWithReason(models.ErrorCodePaymentDeclined, strings.ToLower(status), "Payment declined by PayPal."))
+	}
+	return nil
+}
+
+// paypalError maps an error of the PayPal API to one of our errors. The PayPal error stays wrapped,
+// it tells the retry whether the request can be tried again.
+func paypalError(err error) error {
+	var paypalErr *paypal.Error
+	if !errors.As(err, &paypalErr) {
+		// PayPal couldn't be reached, the request is retried.
+		return err
+	}
+
+	var serviceErr *models.ServiceError
+	switch {
+	case paypalErr.Retryable():
+		// Only left when every attempt failed, e.g. PayPal being down.
+		serviceErr = models.NewServiceError(models.ErrorCodeGatewayError, "Payment gateway error.")
+	case paypalErr.HTTPStatus == http.StatusUnprocessableEntity:
+		// The request was fine, the payment wasn't, e.g. INSTRUMENT_DECLINED or PAYER_CANNOT_PAY.
+		serviceErr = models.NewServiceErrorWithReason(models.ErrorCodePaymentDeclined, strings.ToLower(paypalErr.Issue()), "Payment declined: "+paypalErr.Message)
+	case paypalErr.HTTPStatus == http.StatusBadRequest:
+		serviceErr = models.NewServiceErrorWithReason(models.ErrorCodeValidation, strings.ToLower(paypalErr.Issue()), "Payment rejected by the gateway: "+paypalErr.Message)
+	case paypalErr.HTTPStatus == http.StatusConflict:
+		serviceErr = models.NewServiceError(models.ErrorCodeConflict, "Payment conflicts with an earlier request to the gateway.")
+	default:
+		// Errors of our credentials are nothing the client can act on.
+		serviceErr = models.NewServiceError(models.ErrorCodeGatewayError, "Payment gateway error.")
+	}
+	return fmt.Errorf("%w: %w", serviceErr, paypalErr)
+}
@@ -0,0 +1,295 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"payment-gateway/db"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/paypal"
+	"payment-gateway/internal/paypal/paypaltest"
+)
+
+type mockUserRepository struct{}
+
+func (m *mockUserRepository) GetUserEmail(ctx context.Context, userID int) (string, error) {
+	return fmt.Sprintf("user%d@example.com", userID), nil
+}
+
+func newTestPaypalGateway(t *testing.T) (*PaypalGateway, *paypaltest.Server) {
+	server := paypaltest.NewServer()
+	t.Cleanup(server.Close)
+	client := paypal.NewClient(paypal.Config{BaseURL: server.URL, ClientID: paypaltest.ClientID, ClientSecret: paypaltest.ClientSecret})
+	return &PaypalGateway{client: client, users: &mockUserRepository{}}, server
+}
+
+func setupPaypal(t *testing.T) (*paymentService, *mockTransactionRepository, *paypaltest.Server) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	gateway, server := newTestPaypalGateway(t)
+	GetPaymentGateway = func(ctx context.Context, countryId int, gatewayId int) (PaymentGateway, error) {
+		return gateway, nil
+	}
+
+	// Callbacks of gateway 1 are parsed by the adapter built for it.
+	service.gateways.(*mockGatewayRepository).gateways = []*db.Gateway{{ID: 1, Name: "paypal", Enabled: true}}
+	adaptersMu.Lock()
+	original := gateways
+	gateways = map[string]PaymentGateway{"paypal": &checkedGateway{name: "paypal", gateway: gateway}}
+	adaptersMu.Unlock()
+	t.Cleanup(func() {
+		adaptersMu.Lock()
+		defer adaptersMu.Unlock()
+		gateways = original
+	})
+	return service, mockRepo, server
+}
+
+// paypalEvent is a webhook event of PayPal about the resource.
+func paypalEvent(eventType string, resourceType string, resource string) *models.PaymentCallback {
+	body := fmt.Sprintf(`{"id": "WH-1", "event_type": %q, "resource_type": %q, "summary": "PayPal event", "resource": %s}`, eventType, resourceType, resource)
+	return &models.PaymentCallback{GatewayID: 1, RawPayload: []byte(body)}
+}
+
+func TestPaypalGateway_Deposit(t *testing.T) {
+	service, mockRepo, server := setupPaypal(t)
+
+	req := &models.TransactionRequest{Amount: 10050, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	result, err := service.Deposit(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trx := mockRepo.transactions[1]
+	if trx.Status != db.StatusPending || trx.GatewayTxnId != "ORDER-1" {
+		t.Errorf("Expected a pending deposit with the order, got %s %q", trx.Status, trx.GatewayTxnId)
+	}
+	if result.ApprovalURL != "https://www.sandbox.paypal.com/checkoutnow?token=ORDER-1" {
+		t.Errorf("Expected the approve link of the order, got %q", result.ApprovalURL)
+	}
+	sent := server.Requests()[0]
+	unit := sent.Body["purchase_units"].([]interface{})[0].(map[string]interface{})
+	if sent.RequestID != "deposit-1" || unit["amount"].(map[string]interface{})["value"] != "100.50" {
+		t.Errorf("Unexpected request %+v", sent)
+	}
+}
+
+func TestPaypalGateway_Withdraw(t *testing.T) {
+	service, mockRepo, server := setupPaypal(t)
+	useLedger(service, mockRepo)
+	seedBalance(t, mockRepo, 15000)
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	if _, err := service.Withdraw(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if trx := mockRepo.transactions[1]; trx.GatewayTxnId != "BATCH-1" {
+		t.Errorf("Expected the payout batch, got %q", trx.GatewayTxnId)
+	}
+	item := server.Requests()[0].Body["items"].([]interface{})[0].(map[string]interface{})
+	if item["receiver"] != "user1@example.com" {
+		t.Errorf("Expected the payout to go to the user's email, got %v", item["receiver"])
+	}
+}
+
+func TestPaypalGateway_Declined(t *testing.T) {
+	service, mockRepo, server := setupPaypal(t)
+	server.Fail(paypaltest.Failure{Status: http.StatusUnprocessableEntity, Name: "UNPROCESSABLE_ENTITY", Issue: "INSTRUMENT_DECLINED", Message: "The instrument presented was declined."})
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	_, err := service.Deposit(context.Background(), req)
+	serviceErr, ok := err.(*models.ServiceError)
+	if !ok || serviceErr.Code != models.ErrorCodePaymentDeclined || serviceErr.Reason != "instrument_declined" {
+		t.Fatalf("Expected the decline to be returned, got %v", err)
+	}
+	if len(server.Requests()) != 1 {
+		t.Errorf("Expected a decline not to be retried, got %d requests", len(server.Requests()))
+	}
+	if status := mockRepo.transactions[1].Status; status != db.StatusFailed {
+		t.Errorf("Expected the deposit to be failed, got %s", status)
+	}
+}
+
+func TestPaypalGateway_RefundsTheCapture(t *testing.T) {
+	gateway, server := newTestPaypalGateway(t)
+	deposit := &db.Transaction{ID: 1, Type: db.TypeDeposit, Amount: models.Money{Minor: 10000, Currency: "USD"}}
+	result, err := gateway.ProcessPayment(context.Background(), deposit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deposit.GatewayTxnId = result.GatewayTxnId
+
+	refund := &db.Transaction{ID: 2, Type: db.TypeRefund, Amount: models.Money{Minor: 2500, Currency: "USD"}}
+	if _, err := gateway.Refund(context.Background(), refund, deposit); err == nil {
+		t.Error("Expected an order without capture not to be refunded")
+	}
+
+	captureID := server.CaptureOrder(deposit.GatewayTxnId)
+	result, err = gateway.Refund(context.Background(), refund, deposit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := server.Requests()
+	sent := requests[len(requests)-1]
+	if sent.Path != "/v2/payments/captures/"+captureID+"/refund" || sent.RequestID != "refund-2" || result.GatewayTxnId == "" {
+		t.Errorf("Unexpected refund %+v for request %+v", result, sent)
+	}
+}
+
+func TestPaypalGateway_ApprovedOrderIsCaptured(t *testing.T) {
+	service, mockRepo, server := setupPaypal(t)
+	useLedger(service, mockRepo)
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	if _, err := service.Deposit(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	server.ApproveOrder("ORDER-1")
+	approved := paypalEvent("CHECKOUT.ORDER.APPROVED", "checkout-order", `{"id": "ORDER-1", "status": "APPROVED"}`)
+	if err := service.HandleCallback(context.Background(), approved); err != nil {
+		t.Fatalf("Expected successful callback handling, got error: %v", err)
+	}
+
+	requests := server.Requests()
+	if sent := requests[len(requests)-1]; sent.Path != "/v2/checkout/orders/ORDER-1/capture" || sent.RequestID != "capture-1" {
+		t.Errorf("Expected the order to be captured, got %+v", sent)
+	}
+	var statuses []string
+	for _, record := range mockRepo.history {
+		statuses = append(statuses, record.ToStatus)
+	}
+	if fmt.Sprint(statuses) != "[initiated pending authorized completed]" {
+		t.Errorf("Expected the deposit to be authorized and then completed, got %v", statuses)
+	}
+	assertBalances(t, service, 110000, 0)
+
+	// The capture's own event comes after, it changes nothing.
+	completed := paypalEvent("PAYMENT.CAPTURE.COMPLETED", "capture", `{"id": "CAPTURE-2", "status": "COMPLETED",
+		"supplementary_data": {"related_ids": {"order_id": "ORDER-1"}}}`)
+	if err := service.HandleCallback(context.Background(), completed); err != nil {
+		t.Fatalf("Expected successful callback handling, got error: %v", err)
+	}
+	if len(mockRepo.history) != 4 {
+		t.Errorf("Expected no more transitions, got %d", len(mockRepo.history))
+	}
+}
+
+func TestPaypalGateway_CapturedAfterTheGatewayIsDisabled(t *testing.T) {
+	service, mockRepo, server := setupPaypal(t)
+	useLedger(service, mockRepo)
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	if _, err := service.Deposit(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	repo := service.gateways.(*mockGatewayRepository)
+	repo.gateways[0].Enabled = false
+	GetPaymentGateway = func(ctx context.Context, countryId int, gatewayId int) (PaymentGateway, error) {
+		return resolvePaymentGateway(ctx, repo, countryId, gatewayId)
+	}
+
+	// The payer approved the order before the gateway was disabled, it is still captured.
+	server.ApproveOrder("ORDER-1")
+	approved := paypalEvent("CHECKOUT.ORDER.APPROVED", "checkout-order", `{"id": "ORDER-1", "status": "APPROVED"}`)
+	if err := service.HandleCallback(context.Background(), approved); err != nil {
+		t.Fatalf("Expected successful callback handling, got error: %v", err)
+	}
+	if trx := mockRepo.transactions[1]; trx.Status != db.StatusCompleted {
+		t.Errorf("Expected the deposit to be captured, got %s", trx.Status)
+	}
+	assertBalances(t, service, 110000, 0)
+}
+
+func TestPaypalGateway_CaptureIsRetriedWithTheCallback(t *testing.T) {
+	service, mockRepo, server := setupPaypal(t)
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	if _, err := service.Deposit(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	server.ApproveOrder("ORDER-1")
+	server.Fail(paypaltest.Failure{Status: http.StatusServiceUnavailable, Name: "SERVICE_UNAVAILABLE"})
+	approved := paypalEvent("CHECKOUT.ORDER.APPROVED", "checkout-order", `{"id": "ORDER-1", "status": "APPROVED"}`)
+	if err := service.HandleCallback(context.Background(), approved); err == nil {
+		t.Fatal("Expected an error so PayPal sends the event again")
+	}
+	if status := mockRepo.transactions[1].Status; status != db.StatusAuthorized {
+		t.Fatalf("Expected the deposit to be authorized, got %s", status)
+	}
+
+	if err := service.HandleCallback(context.Background(), approved); err != nil {
+		t.Fatalf("Expected successful callback handling, got error: %v", err)
+	}
+	if status := mockRepo.transactions[1].Status; status != db.StatusCompleted {
+		t.Errorf("Expected the deposit to be completed, got %s", status)
+	}
+}
+
+func TestPaypalGateway_DeclinedCaptureFailsDeposit(t *testing.T) {
+	service, mockRepo, server := setupPaypal(t)
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	if _, err := service.Deposit(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	server.ApproveOrder("ORDER-1")
+	server.Fail(paypaltest.Failure{Status: http.StatusUnprocessableEntity, Name: "UNPROCESSABLE_ENTITY", Issue: "INSTRUMENT_DECLINED", Message: "The instrument presented was declined."})
+	approved := paypalEvent("CHECKOUT.ORDER.APPROVED", "checkout-order", `{"id": "ORDER-1", "status": "APPROVED"}`)
+	if err := service.HandleCallback(context.Background(), approved); err != nil {
+		t.Fatalf("Expected successful callback handling, got error: %v", err)
+	}
+	if status := mockRepo.transactions[1].Status; status != db.StatusFailed {
+		t.Errorf("Expected the deposit to be failed, got %s", status)
+	}
+}
+
+func TestPaypalGateway_PayoutEvents(t *testing.T) {
+	service, mockRepo, _ := setupPaypal(t)
+	useLedger(service, mockRepo)
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	if _, err := service.Withdraw(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	// Events of the payout items are left to the batch.
+	item := paypalEvent("PAYMENT.PAYOUTS-ITEM.SUCCEEDED", "payouts_item", `{"payout_item_id": "ITEM-1", "transaction_status": "SUCCESS"}`)
+	if err := service.HandleCallback(context.Background(), item); err != nil {
+		t.Fatalf("Expected the event to be acknowledged, got error: %v", err)
+	}
+	if status := mockRepo.transactions[1].Status; status != db.StatusPending {
+		t.Fatalf("Expected the withdrawal to stay pending, got %s", status)
+	}
+
+	batch := paypalEvent("PAYMENT.PAYOUTSBATCH.SUCCESS", "payouts", `{"batch_header": {"payout_batch_id": "BATCH-1", "batch_status": "SUCCESS"}}`)
+	if err := service.HandleCallback(context.Background(), batch); err != nil {
+		t.Fatalf("Expected successful callback handling, got error: %v", err)
+	}
+	if status := mockRepo.transactions[1].Status; status != db.StatusCompleted {
+		t.Errorf("Expected the withdrawal to be completed, got %s", status)
+	}
+	assertBalances(t, service, 90000, 0)
+}
+
+func TestPaypalStatus(t *testing.T) {
+	tests := map[string]string{
+		"CREATED":   db.StatusPending,
+		"APPROVED":  db.StatusAuthorized,
+		"COMPLETED": db.StatusCompleted,
+		"VOIDED":    db.StatusFailed,
+		"SUCCESS":   db.StatusCompleted,
+		"denied":    db.StatusFailed,
+		"REVERSED":  db.StatusReversed,
+	}
+	for status, expected := range tests {
+		if got, ok := paypalStatus(status); !ok || got != expected {
+			t.Errorf("Expected %s to be %s, got %q", status, expected, got)
+		}
+	}
+	if _, ok := paypalStatus("SOMETHING_NEW"); ok {
+		t.Error("Expected an unknown status not to be mapped")
+	}
+}
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"payment-gateway/db"
+	"payment-gateway/internal/compliance"
+	"payment-gateway/internal/models"
+)
+
+type ReviewService interface {
+	// This returns the transactions waiting for an operator, oldest first.
+	ListReviewQueue(ctx context.Context, limit int) (*models.ReviewQueue, error)
+
+	// This sends a transaction in review to its gateway, as if it had passed the checks.
+	ApproveReview(ctx context.Context, req *models.ReviewRequest) (*models.ReviewResult, error)
+
+	// This fails a transaction in review, giving back what was held for it.
+	RejectReview(ctx context.Context, req *models.ReviewRequest) (*models.ReviewResult, error)
+}
+
+// Reviews are part of the payment flow, the review service is the payment service seen by operators.
+func NewReviewService() ReviewService {
+	return newPaymentService()
+}
+
+func (p *paymentService) ListReviewQueue(ctx context.Context, limit int) (*models.ReviewQueue, error) {
+	cases, err := p.repo.ListReviewQueue(ctx, limit)
+	if err != nil {
+		return nil, models.NewServiceError(models.ErrorCodeUnknown, "Failed to fetch review queue: "+err.Error())
+	}
+
+	queue := &models.ReviewQueue{Items: make([]models.ReviewItem, 0, len(cases))}
+	for _, reviewCase := range cases {
+		item := models.ReviewItem{
+			Transaction: *toTransactionModel(reviewCase.Transaction),
+			UserID:      reviewCase.Transaction.UserID,
+			Flags:       []models.ReviewFlag{},
+		}
+		if reviewCase.Compliance != nil {
+			for _, result := range reviewCase.Compliance.Results {
+				if result.Outcome != compliance.OutcomeApprove {
+					item.Flags = append(item.Flags, models.ReviewFlag{Rule: result.Rule, Reason: result.Reason})
+				}
+			}
+		}
+		queue.Items = append(queue.Items, item)
+	}
+	return queue, nil
+}
+
+func (p *paymentService) ApproveReview(ctx context.Context, req *models.ReviewRequest) (*models.ReviewResult, error) {
+	trx, err := p.transactionInReview(ctx, req.TransactionID)
+	if err != nil {
+		return nil, err
+	}
+	if trx.Type == db.TypeWithdraw && time.Since(trx.CreatedAt) > WithdrawalHoldTTL {
+		// The hold sweeper has given the amount back to the user, nothing guarantees the balance anymore.
+		return nil, models.NewServiceError(models.ErrorCodeConflict, "The hold of this withdrawal has expired, it can only be rejected")
+	}
+
+	// The decision is saved before the gateway is called. Only one decision can be saved per
+	// transaction, so a transaction approved by two operators at once is still only sent once.
+	decision := &db.ReviewDecision{
+		TransactionID: trx.ID,
+		ReviewerID:    req.ReviewerID,
+		Action:        db.ReviewApprove,
+		Reason:        req.Reason,
+		CreatedAt:     time.Now(),
+	}
+	if err := p.repo.Update(ctx, *trx, db.StatusReview, &db.Effects{Review: decision}); err != nil {
+		return nil, reviewSaveError(err)
+	}
+
+	gt := gatewayOf(ctx, trx)
+	_, err = p.callGateway(ctx, trx, EventTransactionUpdated, func(ctx context.Context) (*GatewayResult, error) {
+		return gt.ProcessPayment(ctx, trx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.ReviewResult{TransactionID: trx.ID, Action: db.ReviewApprove, Status: trx.Status}, nil
+}
+
+func (p *paymentService) RejectReview(ctx context.Context, req *models.ReviewRequest) (*models.ReviewResult, error) {
+	if strings.TrimSpace(req.Reason) == "" {
+		return nil, models.NewServiceError(models.ErrorCodeValidation, "A reason is required to reject a transaction")
+	}
+	trx, err := p.transactionInReview(ctx, req.TransactionID)
+	if err != nil {
+		return nil, err
+	}
+
+	reason := fmt.Sprintf("rejected by reviewer %d: %s", req.ReviewerID, req.Reason)
+	record, err := transition(trx, db.StatusFailed, reason, SourceReview)
+	if err != nil {
+		return nil, models.NewServiceError(models.ErrorCodeUnknown, err.Error())
+	}
+
+	// Failing a withdrawal releases its hold.
+	effects := withLedger(&db.Effects{
+		Outbox:  []*db.OutboxEvent{newTransactionEvent(trx, EventTransactionUpdated)},
+		History: []*db.TransactionEvent{record},
+		Review: &db.ReviewDecision{
+			TransactionID: trx.ID,
+			ReviewerID:    req.ReviewerID,
+			Action:        db.ReviewReject,
+			Reason:        req.Reason,
+			CreatedAt:     record.CreatedAt,
+		},
+	}, trx, record)
+	if err := p.repo.Update(ctx, *trx, record.FromStatus, effects); err != nil {
+		return nil, reviewSaveError(err)
+	}
+
+	return &models.ReviewResult{TransactionID: trx.ID, Action: db.ReviewReject, Status: trx.Status}, nil
+}
+
+func (p *paymentService) transactionInReview(ctx context.Context, transactionID int) (*db.Transaction, error) {
+	trx, err := p.repo.GetTransactionByID(ctx, transactionID)
+	if err != nil {
+		return nil, models.NewServiceError(models.ErrorCodeUnknown, "Failed to fetch transaction: "+err.Error())
+	}
+	if trx == nil {
+		return nil, models.NewServiceError(models.ErrorCodeNotFound, "Transaction not found")
+	}
+	if trx.Status != db.StatusReview {
+		return nil, models.NewServiceError(models.ErrorCodeConflict, "Transaction is not waiting for a review")
+	}
+	return trx, nil
+}
+
+func reviewSaveError(err error) error {
+	if errors.Is(err, db.ErrAlreadyReviewed) || errors.Is(err, db.ErrStaleTransaction) {
+		return models.NewServiceError(models.ErrorCodeConflict, "Transaction has already been reviewed")
+	}
+	return models.NewServiceError(models.ErrorCodeUnknown, "Failed to save review decision.")
+}
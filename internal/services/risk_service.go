@@ -0,0 +1,44 @@
+package services
+
+import (
+	"context"
+	"errors"
+
+	"payment-gateway/db"
+	"payment-gateway/internal/risk"
+)
+
+type RiskScorer interface {
+	// Score scores the fraud risk of a transaction before it is sent to the gateway.
+	Score(ctx context.Context, req *risk.Request) (*risk.Assessment, error)
+}
+
+var riskScorer risk.Scorer
+
+// InitRisk sets up the risk scoring loaded at startup, reading the user's history from the database.
+func InitRisk(cfg *risk.Config) error {
+	scorer, err := risk.NewFeatureScorer(cfg, db.NewRiskRepository(db.Db))
+	if err != nil {
+		return err
+	}
+	riskScorer = scorer
+	return nil
+}
+
+type RiskManager struct {
+	scorer risk.Scorer
+}
+
+func NewRiskScorer() RiskScorer {
+	return &RiskManager{
+		scorer: riskScorer,
+	}
+}
+
+func (rm *RiskManager) Score(ctx context.Context, req *risk.Request) (*risk.Assessment, error) {
+	if rm.scorer == nil {
+		// Like the compliance rules, nothing is let through unscored.
+		return nil, errors.New("risk scoring is not set up")
+	}
+	return rm.scorer.Score(ctx, req)
+}
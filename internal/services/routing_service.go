@@ -0,0 +1,248 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"payment-gateway/db"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/routing"
+)
+
+// Reasons a transaction without a gateway_id can't be routed.
+const (
+	reasonGatewayRequired = "gateway_required"
+	reasonNoGateway       = "no_gateway_available"
+)
+
+var (
+	routingConfig = routing.DefaultConfig()
+	// gatewayRouter picks the gateway of the transactions that don't ask for one, nil when smart routing is off.
+	gatewayRouter *routing.Router
+)
+
+// InitRouting sets up the routing loaded at startup. Every gateway its fallback policies and fee schedules
+// name has to be in the gateways table.
+func InitRouting(ctx context.Context, cfg *routing.Config, repo db.GatewayRepository) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	gateways, err := repo.ListGateways(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list gateways: %w", err)
+	}
+	known := make(map[string]bool, len(gateways))
+	for _, gateway := range gateways {
+		known[gateway.Name] = true
+	}
+	for _, name := range cfg.GatewayNames() {
+		if !known[name] {
+			return fmt.Errorf("fallback gateway %q is not in the gateways table", name)
+		}
+	}
+
+	var router *routing.Router
+	if cfg.Smart.Enabled {
+		for _, name := range cfg.Smart.FeeGateways() {
+			if !known[name] {
+				return fmt.Errorf("fee schedule of gateway %q, which is not in the gateways table", name)
+			}
+		}
+		router = routing.NewRouter(cfg.Smart)
+	}
+	routingConfig, gatewayRouter = cfg, router
+	return nil
+}
+
+// gatewayRoute is the gateway a transaction goes to when it isn't the one asked for: either a fallback policy
+// sent it to another gateway, or the transaction didn't ask for one and the router picked it.
+type gatewayRoute struct {
+	requestedGatewayID int
+	gatewayID          int
+	fallbackReason     string
+	decision           *routing.Decision
+}
+
+// resolveGateway checks that the gateway asked for can take the transaction. When it can't, and the fallback
+// policy of the user's merchant allows it for the reason, the first gateway of the policy that is enabled for
+// the country and settles the currency takes it instead. Without a fallback the error of the gateway is returned.
+// A transaction that doesn't ask for a gateway is routed, see pickGateway.
+func (p *paymentService) resolveGateway(ctx context.Context, req *models.TransactionRequest, transactionType string) (*gatewayRoute, error) {
+	if req.GatewayID == 0 {
+		return p.pickGateway(ctx, req, transactionType)
+	}
+	amount, err := req.Money()
+	if err != nil {
+		return nil, models.NewServiceError(models.ErrorCodeValidation, "invalid currency code")
+	}
+	gateway, resolveErr := GetPaymentGateway(ctx, req.CountryID, req.GatewayID)
+	if resolveErr == nil {
+		// Refused before the transaction is saved, like the candidates of smart routing.
+		return nil, supports(gateway, transactionType, amount.Currency)
+	}
+	var serviceErr *models.ServiceError
+	if !errors.As(resolveErr, &serviceErr) || p.routing == nil {
+		return nil, resolveErr
+	}
+	policy := p.routing.FallbackFor(req.MerchantID)
+	if !policy.Allows(serviceErr.Reason) {
+		return nil, resolveErr
+	}
+
+	available, err := availableGateways(ctx, p.gateways, req.CountryID)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range policy.Gateways {
+		for _, candidate := range available {
+			if candidate.Name != name || candidate.ID == req.GatewayID {
+				continue
+			}
+			settles, err := p.settles(ctx, candidate.ID, amount.Currency)
+			if err != nil {
+				return nil, err
+			}
+			if !settles {
+				continue
+			}
+			if gateway, err := GetPaymentGateway(ctx, req.CountryID, candidate.ID); err != nil || supports(gateway, transactionType, amount.Currency) != nil {
+				continue
+			}
+			return &gatewayRoute{requestedGatewayID: req.GatewayID, gatewayID: candidate.ID, fallbackReason: serviceErr.Reason}, nil
+		}
+	}
+	return nil, resolveErr
+}
+
+// pickGateway routes a transaction that doesn't ask for a gateway. The candidates are the gateways of the
+// country that settle the currency and whose adapter supports the operation, the router scores them.
+func (p *paymentService) pickGateway(ctx context.Context, req *models.TransactionRequest, transactionType string) (*gatewayRoute, error) {
+	if p.router == nil {
+		// Without smart routing the gateway has to be asked for, like before there was any.
+		return nil, models.NewServiceErrorWithReason(models.ErrorCodeValidation, reasonGatewayRequired, "invalid gateway id")
+	}
+	amount, err := req.Money()
+	if err != nil {
+		return nil, models.NewServiceError(models.ErrorCodeValidation, "invalid currency code")
+	}
+	available, err := availableGateways(ctx, p.gateways, req.CountryID)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []routing.Candidate
+	for _, gateway := range available {
+		capabilities, ok := GatewayCapabilities(gateway.Name)
+		if !ok || capabilities.Supports(transactionType, amount.Currency) != nil {
+			continue
+		}
+		settles, err := p.settles(ctx, gateway.ID, amount.Currency)
+		if err != nil {
+			return nil, err
+		}
+		if !settles {
+			continue
+		}
+		if _, err := GetPaymentGateway(ctx, req.CountryID, gateway.ID); err != nil {
+			continue
+		}
+		candidates = append(candidates, routing.Candidate{GatewayID: gateway.ID, Name: gateway.Name})
+	}
+
+	decision, err := p.router.Route(req.CountryID, amount, candidates)
+	if errors.Is(err, routing.ErrNoCandidate) {
+		return nil, models.NewServiceErrorWithReason(models.ErrorCodeGatewayUnavailable, reasonNoGateway, "No gateway of the country can take this transaction.")
+	}
+	if err != nil {
+		return nil, models.NewServiceError(models.ErrorCodeUnknown, "Failed to route transaction: "+err.Error())
+	}
+	return &gatewayRoute{gatewayID: decision.GatewayID, decision: decision}, nil
+}
+
+// settles is true when the gateway settles the currency.
+func (p *paymentService) settles(ctx context.Context, gatewayID int, currency string) (bool, error) {
+	currencies, err := p.gateways.GetSupportedCurrencies(ctx, gatewayID)
+	if err != nil {
+		return false, err
+	}
+	for _, supported := range currencies {
+		if supported == currency {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// route returns the request sent to the gateway of the route, so the checks are made for the gateway that moves the money.
+func (r *gatewayRoute) route(req *models.TransactionRequest) *models.TransactionRequest {
+	if r == nil {
+		return req
+	}
+	routed := *req
+	routed.GatewayID = r.gatewayID
+	return &routed
+}
+
+// record saves on the transaction which gateway was asked for and why another one took it.
+func (r *gatewayRoute) record(trx *db.Transaction) {
+	if r == nil || r.fallbackReason == "" {
+		return
+	}
+	trx.RequestedGatewayID = r.requestedGatewayID
+	trx.FallbackReason = r.fallbackReason
+}
+
+// routingDecision is the decision of the router, stored with the transaction. None for a fallback.
+func (r *gatewayRoute) routingDecision() *routing.Decision {
+	if r == nil {
+		return nil
+	}
+	return r.decision
+}
+
+// describe tells in the timeline how the transaction got to its gateway.
+func (r *gatewayRoute) describe() string {
+	switch {
+	case r == nil:
+		return ""
+	case r.decision != nil:
+		return fmt.Sprintf(", routed to gateway %d with a score of %.2f out of %d candidates", r.gatewayID, r.decision.Score().Total, len(r.decision.Scores))
+	default:
+		return fmt.Sprintf(", sent to gateway %d instead of %d (%s)", r.gatewayID, r.requestedGatewayID, r.fallbackReason)
+	}
+}
+
+// reachedGateway tells whether a gateway call says something about the gateway. Calls the client cancelled, and
+// transactions refused before they got to the gateway, don't.
+func reachedGateway(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var serviceErr *models.ServiceError
+	return !errors.As(err, &serviceErr) || (serviceErr.Code != models.ErrorCodeValidation && serviceErr.Code != models.ErrorCodeGatewayUnavailable)
+}
+
+// observeCall feeds the latency of a gateway call to the router.
+func (p *paymentService) observeCall(ctx context.Context, gatewayID int, err error, latency time.Duration) {
+	if p.router == nil || !reachedGateway(ctx, err) {
+		return
+	}
+	p.router.ObserveLatency(gatewayID, latency)
+}
+
+// observeOutcome feeds the final outcome of a transaction to the router: it went through once the gateway
+// authorized or completed it, and didn't when the gateway declined it right away or failed it later on.
+// The gateway accepting the call only says the transaction is pending.
+func (p *paymentService) observeOutcome(trx *db.Transaction, record *db.TransactionEvent) {
+	if p.router == nil {
+		return
+	}
+	switch {
+	case (record.FromStatus == db.StatusInitiated || record.FromStatus == db.StatusPending) && record.ToStatus == db.StatusFailed:
+		p.router.Observe(trx.GatewayID, false)
+	case record.FromStatus == db.StatusPending && (record.ToStatus == db.StatusAuthorized || record.ToStatus == db.StatusCompleted):
+		p.router.Observe(trx.GatewayID, true)
+	}
+}
@@ -0,0 +1,259 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"payment-gateway/db"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/routing"
+)
+
+// routingGateways has stripe disabled, paypal enabled in the US and acme enabled but only in Japan.
+func routingGateways() *mockGatewayRepository {
+	stripe := &db.Gateway{ID: 1, Name: "stripe", Enabled: false}
+	paypal := &db.Gateway{ID: 2, Name: "paypal", Enabled: true}
+	acme := &db.Gateway{ID: 3, Name: "acme", Enabled: true}
+	return &mockGatewayRepository{
+		gateways:   []*db.Gateway{stripe, paypal, acme},
+		currencies: map[int][]string{1: {"USD"}, 2: {"EUR", "USD"}, 3: {"JPY", "USD"}},
+		available:  map[int][]*db.Gateway{840: {paypal}, 392: {acme}},
+	}
+}
+
+// setupRouting resolves the gateways from repo, every adapter is the mock gateway.
+func setupRouting(t *testing.T, repo *mockGatewayRepository, cfg *routing.Config) (*paymentService, *mockTransactionRepository) {
+	service, mockGateway, mockRepo := setupTestService(t, true, 100000)
+	service.gateways = repo
+	service.routing = cfg
+
+	adaptersMu.Lock()
+	original := gateways
+	gateways = map[string]PaymentGateway{"stripe": mockGateway, "paypal": mockGateway, "acme": mockGateway}
+	adaptersMu.Unlock()
+	t.Cleanup(func() {
+		adaptersMu.Lock()
+		defer adaptersMu.Unlock()
+		gateways = original
+	})
+	GetPaymentGateway = func(ctx context.Context, countryId int, gatewayId int) (PaymentGateway, error) {
+		return resolvePaymentGateway(ctx, repo, countryId, gatewayId)
+	}
+	return service, mockRepo
+}
+
+func TestResolvePaymentGateway(t *testing.T) {
+	setupRouting(t, routingGateways(), nil)
+
+	tests := []struct {
+		name      string
+		countryID int
+		gatewayID int
+		code      models.ErrorCode
+		reason    string
+	}{
+		{"unknown", 840, 9, models.ErrorCodeValidation, reasonUnknownGateway},
+		{"disabled", 840, 1, models.ErrorCodeGatewayUnavailable, routing.ReasonGatewayDisabled},
+		{"not in the country", 840, 3, models.ErrorCodeValidation, routing.ReasonGatewayNotAvailable},
+		{"country without gateways", 250, 2, models.ErrorCodeValidation, routing.ReasonGatewayNotAvailable},
+	}
+	for _, tt := range tests {
+		_, err := GetPaymentGateway(context.Background(), tt.countryID, tt.gatewayID)
+		serviceErr, ok := err.(*models.ServiceError)
+		if !ok || serviceErr.Code != tt.code || serviceErr.Reason != tt.reason {
+			t.Errorf("%s: expected %s, got %v", tt.name, tt.reason, err)
+		}
+	}
+
+	if gateway, err := GetPaymentGateway(context.Background(), 840, 2); gateway == nil || err != nil {
+		t.Errorf("Expected paypal in the US, got %v", err)
+	}
+}
+
+func TestDeposit_DisabledGatewayDoesNotFallBack(t *testing.T) {
+	service, mockRepo := setupRouting(t, routingGateways(), routing.DefaultConfig())
+
+	_, err := service.Deposit(context.Background(), &models.TransactionRequest{Amount: 1000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1, MerchantID: "shop-1"})
+	serviceErr, ok := err.(*models.ServiceError)
+	if !ok || serviceErr.Code != models.ErrorCodeGatewayUnavailable || serviceErr.Reason != routing.ReasonGatewayDisabled {
+		t.Fatalf("Expected the disabled gateway to be reported, got %v", err)
+	}
+	if len(mockRepo.transactions) != 0 {
+		t.Errorf("Expected no transaction to be saved, got %d", len(mockRepo.transactions))
+	}
+}
+
+func TestDeposit_FallsBackForMerchant(t *testing.T) {
+	cfg := &routing.Config{Merchants: map[string]routing.MerchantConfig{
+		"shop-1": {Fallback: &routing.FallbackPolicy{Gateways: []string{"acme", "paypal"}}},
+	}}
+	service, mockRepo := setupRouting(t, routingGateways(), cfg)
+
+	result, err := service.Deposit(context.Background(), &models.TransactionRequest{Amount: 1000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1, MerchantID: "shop-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// acme comes first in the policy, but it isn't available in the US.
+	trx := mockRepo.transactions[result.TransactionId]
+	if trx.GatewayID != 2 || trx.RequestedGatewayID != 1 || trx.FallbackReason != routing.ReasonGatewayDisabled {
+		t.Errorf("Expected the deposit to go to paypal instead of stripe, got gateway %d for %d (%s)", trx.GatewayID, trx.RequestedGatewayID, trx.FallbackReason)
+	}
+	if reason := mockRepo.history[0].Reason; !strings.Contains(reason, "sent to gateway 2 instead of 1 (gateway_disabled)") {
+		t.Errorf("Expected the fallback in the timeline, got %q", reason)
+	}
+
+	// Other merchants keep the default policy, without a fallback.
+	_, err = service.Deposit(context.Background(), &models.TransactionRequest{Amount: 1000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1, MerchantID: "shop-2"})
+	if serviceErr, ok := err.(*models.ServiceError); !ok || serviceErr.Reason != routing.ReasonGatewayDisabled {
+		t.Errorf("Expected no fallback for another merchant, got %v", err)
+	}
+}
+
+func TestDeposit_FallbackOnlyForItsReasons(t *testing.T) {
+	cfg := &routing.Config{Fallback: routing.FallbackPolicy{Gateways: []string{"paypal"}, On: []string{routing.ReasonGatewayDisabled}}}
+	service, _ := setupRouting(t, routingGateways(), cfg)
+
+	_, err := service.Deposit(context.Background(), &models.TransactionRequest{Amount: 1000, Currency: "USD", GatewayID: 3, CountryID: 840, UserID: 1})
+	if serviceErr, ok := err.(*models.ServiceError); !ok || serviceErr.Reason != routing.ReasonGatewayNotAvailable {
+		t.Errorf("Expected no fallback for a gateway not available in the country, got %v", err)
+	}
+
+	_, err = service.Deposit(context.Background(), &models.TransactionRequest{Amount: 1000, Currency: "USD", GatewayID: 9, CountryID: 840, UserID: 1})
+	if serviceErr, ok := err.(*models.ServiceError); !ok || serviceErr.Reason != reasonUnknownGateway {
+		t.Errorf("Expected an unknown gateway never to fall back, got %v", err)
+	}
+}
+
+func TestInitRouting_UnknownGateway(t *testing.T) {
+	cfg := &routing.Config{Fallback: routing.FallbackPolicy{Gateways: []string{"revolut"}}}
+	if err := InitRouting(context.Background(), cfg, routingGateways()); err == nil || !strings.Contains(err.Error(), `"revolut"`) {
+		t.Errorf("Expected a fallback to a gateway that doesn't exist to be refused, got %v", err)
+	}
+
+	cfg = &routing.Config{Smart: routing.SmartConfig{
+		Enabled: true,
+		Weights: routing.Weights{Cost: 1},
+		Fees:    map[string]routing.FeeSchedule{"revolut": {Percent: 1}},
+		Window:  "1h",
+	}}
+	if err := InitRouting(context.Background(), cfg, routingGateways()); err == nil || !strings.Contains(err.Error(), `"revolut"`) {
+		t.Errorf("Expected a fee schedule of a gateway that doesn't exist to be refused, got %v", err)
+	}
+}
+
+func TestDeposit_SmartRouting(t *testing.T) {
+	stripe := &db.Gateway{ID: 1, Name: "stripe", Enabled: true}
+	paypal := &db.Gateway{ID: 2, Name: "paypal", Enabled: true}
+	repo := &mockGatewayRepository{
+		gateways:   []*db.Gateway{stripe, paypal},
+		currencies: map[int][]string{1: {"USD"}, 2: {"USD"}},
+		available:  map[int][]*db.Gateway{840: {stripe, paypal}},
+	}
+	cfg := routing.SmartConfig{
+		Enabled: true,
+		Weights: routing.Weights{Cost: 1, SuccessRate: 1},
+		Fees: map[string]routing.FeeSchedule{
+			"stripe": {Percent: 2.9, Fixed: map[string]int64{"USD": 30}},
+			"paypal": {Percent: 3.5},
+		},
+		Window:     "1h",
+		MinSamples: 1,
+	}
+	service, mockRepo := setupRouting(t, repo, routing.DefaultConfig())
+	service.router = routing.NewRouter(cfg)
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", CountryID: 840, UserID: 1}
+
+	// Nothing is measured yet, stripe is cheaper.
+	result, err := service.Deposit(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trx := mockRepo.transactions[result.TransactionId]; trx.GatewayID != 1 || trx.RequestedGatewayID != 0 {
+		t.Errorf("Expected the deposit to be routed to stripe, got gateway %d", trx.GatewayID)
+	}
+	if len(mockRepo.routes) != 1 || mockRepo.routes[0].TransactionID != result.TransactionId || len(mockRepo.routes[0].Scores) != 2 {
+		t.Fatalf("Expected the routing decision to be saved with the transaction, got %+v", mockRepo.routes)
+	}
+	if reason := mockRepo.history[0].Reason; !strings.Contains(reason, "routed to gateway 1 with a score of 1.00 out of 2 candidates") {
+		t.Errorf("Expected the routing in the timeline, got %q", reason)
+	}
+
+	// The gateway accepting the call doesn't tell whether the deposit goes through, stripe isn't measured yet.
+	first := mockRepo.transactions[result.TransactionId]
+	result, err = service.Deposit(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stripe := mockRepo.routes[1].Scores[0]; mockRepo.transactions[result.TransactionId].GatewayID != 1 || stripe.Samples != 0 {
+		t.Errorf("Expected the deposit to be routed to stripe before any outcome, got %+v", mockRepo.routes[1].Scores)
+	}
+
+	// The deposit failing brings stripe's success rate down, paypal hasn't been measured and keeps full marks.
+	callback := &models.PaymentCallback{GatewayTxnID: first.GatewayTxnId, GatewayID: 1, Status: db.StatusFailed}
+	if err := service.HandleCallback(context.Background(), callback); err != nil {
+		t.Fatal(err)
+	}
+	result, err = service.Deposit(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trx := mockRepo.transactions[result.TransactionId]; trx.GatewayID != 2 {
+		t.Errorf("Expected the deposit to be routed to paypal, got gateway %d (%+v)", trx.GatewayID, mockRepo.routes[2].Scores)
+	}
+	if stripe := mockRepo.routes[2].Scores[0]; stripe.Samples != 1 || stripe.SuccessRate != 0 {
+		t.Errorf("Expected the failed deposit to be scored, got %+v", stripe)
+	}
+}
+
+func TestDeposit_SmartRoutingScoresDeclines(t *testing.T) {
+	stripe := &db.Gateway{ID: 1, Name: "stripe", Enabled: true}
+	paypal := &db.Gateway{ID: 2, Name: "paypal", Enabled: true}
+	repo := &mockGatewayRepository{
+		gateways:   []*db.Gateway{stripe, paypal},
+		currencies: map[int][]string{1: {"USD"}, 2: {"USD"}},
+		available:  map[int][]*db.Gateway{840: {stripe, paypal}},
+	}
+	service, mockRepo := setupRouting(t, repo, routing.DefaultConfig())
+	service.router = routing.NewRouter(routing.SmartConfig{
+		Enabled:    true,
+		Weights:    routing.Weights{SuccessRate: 1},
+		Window:     "1h",
+		MinSamples: 1,
+	})
+	mockGateway := gateways["stripe"].(*mockPaymentGateway)
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", CountryID: 840, UserID: 1}
+
+	// A deposit the gateway declines right away is failed without a callback.
+	mockGateway.declines = true
+	if _, err := service.Deposit(context.Background(), req); err == nil {
+		t.Fatal("Expected the deposit to be declined")
+	}
+	mockGateway.declines = false
+	result, err := service.Deposit(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trx := mockRepo.transactions[result.TransactionId]; trx.GatewayID != 2 {
+		t.Errorf("Expected the deposit to be routed to paypal, got gateway %d (%+v)", trx.GatewayID, mockRepo.routes[1].Scores)
+	}
+}
+
+func TestDeposit_WithoutGatewayNeedsSmartRouting(t *testing.T) {
+	service, mockRepo := setupRouting(t, routingGateways(), routing.DefaultConfig())
+
+	_, err := service.Deposit(context.Background(), &models.TransactionRequest{Amount: 1000, Currency: "USD", CountryID: 840, UserID: 1})
+	if serviceErr, ok := err.(*models.ServiceError); !ok || serviceErr.Code != models.ErrorCodeValidation || serviceErr.Reason != reasonGatewayRequired {
+		t.Errorf("Expected a gateway to be required, got %v", err)
+	}
+
+	// Japan's only gateway has no registered adapter.
+	service.router = routing.NewRouter(routing.SmartConfig{Enabled: true, Weights: routing.Weights{Cost: 1}, Window: "1h"})
+	_, err = service.Deposit(context.Background(), &models.TransactionRequest{Amount: 1000, Currency: "USD", CountryID: 392, UserID: 1})
+	if serviceErr, ok := err.(*models.ServiceError); !ok || serviceErr.Code != models.ErrorCodeGatewayUnavailable || serviceErr.Reason != reasonNoGateway {
+		t.Errorf("Expected no gateway to be found, got %v", err)
+	}
+	if len(mockRepo.transactions) != 0 {
+		t.Errorf("Expected no transaction to be saved, got %d", len(mockRepo.transactions))
+	}
+}
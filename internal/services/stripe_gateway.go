@@ -0,0 +1,159 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"payment-gateway/db"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/retry"
+	"payment-gateway/internal/stripe"
+)
+
+func init() {
+	RegisterGateway("stripe", GatewayAdapter[stripe.Config]{
+		Capabilities: Capabilities{
+			// No withdrawals: a Payout goes to the bank account of our own Stripe account, users have no payout
+			// destination with Stripe (a Connect account) to send their money to.
+			Operations: []string{db.TypeDeposit, db.TypeRefund},
+			// Stripe settles about every currency, gateway_currencies says which ones our account takes.
+			DataFormats: []string{"application/json"},
+		},
+		LoadConfig: func() (stripe.Config, error) { return stripe.LoadConfig(), nil },
+		New:        newStripeGateway,
+	})
+}
+
+// StripeGateway takes deposits as PaymentIntents and refunds them. Their outcome comes back through
+// the callback as a webhook event, so a transaction Stripe accepted is pending until then.
+type StripeGateway struct {
+	client *stripe.Client
+}
+
+func newStripeGateway(cfg stripe.Config) (PaymentGateway, error) {
+	if cfg.APIKey == "" {
+		log.Println("STRIPE_API_KEY is not set, Stripe will turn every payment down")
+	}
+	return &StripeGateway{client: stripe.NewClient(cfg)}, nil
+}
+
+func (s *StripeGateway) ProcessPayment(ctx context.Context, req *db.Transaction) (*GatewayResult, error) {
+	if s.client == nil {
+		return nil, retry.Permanent(errors.New("stripe is not set up"))
+	}
+
+	// The key is stable across retries, Stripe answers a retry with what it did the first time.
+	key := fmt.Sprintf("%s-%d", req.Type, req.ID)
+	switch req.Type {
+	case db.TypeDeposit:
+		intent, err := s.client.CreatePaymentIntent(ctx, &stripe.PaymentIntentParams{
+			Amount:   req.Amount.Minor,
+			Currency: req.Amount.Currency,
+			Metadata: stripeMetadata(req),
+		}, key)
+		if err != nil {
+			return nil, stripeError(err)
+		}
+		// The intent waits for the user to confirm it with a payment method, that is what the client secret is for.
+		return &GatewayResult{GatewayTxnId: intent.ID, ClientSecret: intent.ClientSecret}, nil
+	default:
+		return nil, retry.Permanent(fmt.Errorf("stripe can't process a %s", req.Type))
+	}
+}
+
+func (s *StripeGateway) Refund(ctx context.Context, refund *db.Transaction, parent *db.Transaction) (*GatewayResult, error) {
+	if s.client == nil {
+		return nil, retry.Permanent(errors.New("stripe is not set up"))
+	}
+
+	result, err := s.client.CreateRefund(ctx, &stripe.RefundParams{
+		PaymentIntent: parent.GatewayTxnId,
+		Amount:        refund.Amount.Minor,
+		Metadata:      stripeMetadata(refund),
+	}, fmt.Sprintf("refund-%d", refund.ID))
+	if err != nil {
+		return nil, stripeError(err)
+	}
+	return &GatewayResult{GatewayTxnId: result.ID}, nil
+}
+
+// stripeStatuses maps the statuses of Stripe PaymentIntents and Refunds to the ones of our transactions.
+// Statuses that wait for someone, like requires_payment_method, are left out: a PaymentIntent whose payment
+// failed stays open for the user to try another payment method, the deposit only fails once it is canceled.
+var stripeStatuses = map[string]map[string]string{
+	stripe.ObjectPaymentIntent: {
+		"processing":       db.StatusPending,
+		"requires_capture": db.StatusAuthorized,
+		"succeeded":        db.StatusCompleted,
+		"canceled":         db.StatusFailed,
+	},
+	stripe.ObjectRefund: {
+		"pending":         db.StatusPending,
+		"requires_action": db.StatusPending,
+		"succeeded":       db.StatusCompleted,
+		"failed":          db.StatusFailed,
+		"canceled":        db.StatusFailed,
+	},
+}
+
+// ParseCallback reads the webhook event of Stripe. The status comes from the object of the event, as it is after
+// the event, so events about other objects or statuses we don't track are acknowledged without changing anything.
+func (s *StripeGateway) ParseCallback(body []byte) (*models.PaymentCallback, error) {
+	event, err := stripe.ParseEvent(body)
+	if err != nil {
+		return nil, err
+	}
+	object := event.Data.Object
+	status, ok := stripeStatuses[object.Object][object.Status]
+	if !ok {
+		log.Printf("ignoring stripe event %s (%s) of %s %s in status %s", event.ID, event.Type, object.Object, object.ID, object.Status)
+		return nil, nil
+	}
+	return &models.PaymentCallback{
+		GatewayTxnID: object.ID,
+		Status:       status,
+		ErrorMessage: object.Failure(),
+	}, nil
+}
+
+// stripeMetadata links the Stripe object back to our transaction, for whoever looks at it in the dashboard.
+func stripeMetadata(trx *db.Transaction) map[string]string {
+	return map[string]string{
+		"transaction_id": strconv.Itoa(trx.ID),
+		"user_id":        strconv.Itoa(trx.UserID),
+	}
+}
+
+// stripeError maps an error of the Stripe API to one of our errors. The Stripe error stays wrapped,
+// it tells the retry whether the request can be tried again.
+func stripeError(err error) error {
+	var stripeErr *stripe.Error
+	if !errors.As(err, &stripeErr) {
+		// Stripe couldn't be reached, the request is retried.
+		return err
+	}
+
+	var serviceErr *models.ServiceError
+	switch {
+	case stripeErr.Retryable():
+		// Only left when every attempt failed, e.g. Stripe being down.
+		serviceErr = models.NewServiceError(models.ErrorCodeGatewayError, "Payment gateway error.")
+	case stripeErr.Type == stripe.ErrorTypeCard:
+		reason := stripeErr.DeclineCode
+		if reason == "" {
+			reason = stripeErr.Code
+		}
+		serviceErr = models.NewServiceErrorWithReason(models.ErrorCodePaymentDeclined, reason, "Payment declined: "+stripeErr.Message)
+	case stripeErr.Type == stripe.ErrorTypeInvalidRequest:
+		serviceErr = models.NewServiceErrorWithReason(models.ErrorCodeValidation, stripeErr.Code, "Payment rejected by the gateway: "+stripeErr.Message)
+	case stripeErr.Type == stripe.ErrorTypeIdempotency:
+		serviceErr = models.NewServiceError(models.ErrorCodeConflict, "Payment conflicts with an earlier request to the gateway.")
+	default:
+		// Errors of our credentials are nothing the client can act on.
+		serviceErr = models.NewServiceError(models.ErrorCodeGatewayError, "Payment gateway error.")
+	}
+	return fmt.Errorf("%w: %w", serviceErr, stripeErr)
+}
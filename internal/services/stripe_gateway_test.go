@@ -0,0 +1,170 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"payment-gateway/db"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/stripe"
+	"payment-gateway/internal/stripe/stripetest"
+)
+
+func setupStripe(t *testing.T) (*paymentService, *mockTransactionRepository, *stripetest.Server) {
+	service, _, mockRepo := setupTestService(t, true, 100000)
+	server := stripetest.NewServer()
+	t.Cleanup(server.Close)
+
+	gateway := &StripeGateway{client: stripe.NewClient(stripe.Config{BaseURL: server.URL, APIKey: stripetest.APIKey})}
+	GetPaymentGateway = func(ctx context.Context, countryId int, gatewayId int) (PaymentGateway, error) {
+		return gateway, nil
+	}
+
+	// Callbacks of gateway 1 are parsed by the adapter built for it.
+	service.gateways.(*mockGatewayRepository).gateways = []*db.Gateway{{ID: 1, Name: "stripe", Enabled: true}}
+	adaptersMu.Lock()
+	original := gateways
+	gateways = map[string]PaymentGateway{"stripe": &checkedGateway{name: "stripe", capabilities: gatewayAdapters["stripe"].capabilities, gateway: gateway}}
+	adaptersMu.Unlock()
+	t.Cleanup(func() {
+		adaptersMu.Lock()
+		defer adaptersMu.Unlock()
+		gateways = original
+	})
+	return service, mockRepo, server
+}
+
+// stripeEvent is a webhook event of Stripe about the object.
+func stripeEvent(eventType string, object string) []byte {
+	return []byte(fmt.Sprintf(`{"id": "evt_1", "object": "event", "type": %q, "data": {"object": %s}}`, eventType, object))
+}
+
+func TestStripeGateway_Deposit(t *testing.T) {
+	service, mockRepo, server := setupStripe(t)
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	result, err := service.Deposit(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trx := mockRepo.transactions[1]
+	if trx.Status != db.StatusPending || trx.GatewayTxnId != "pi_stub_1" {
+		t.Errorf("Expected a pending deposit with the payment intent, got %s %q", trx.Status, trx.GatewayTxnId)
+	}
+	if result.ClientSecret != "pi_stub_1_secret_stub" {
+		t.Errorf("Expected the client secret of the payment intent, got %q", result.ClientSecret)
+	}
+	if sent := server.Requests()[0]; sent.IdempotencyKey != "deposit-1" || sent.Form.Get("amount") != "10000" {
+		t.Errorf("Unexpected request %+v", sent)
+	}
+}
+
+func TestStripeGateway_WebhookCompletesDeposit(t *testing.T) {
+	service, mockRepo, _ := setupStripe(t)
+	useLedger(service, mockRepo)
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	if _, err := service.Deposit(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed attempt leaves the intent open for another card, the deposit stays pending.
+	failed := stripeEvent("payment_intent.payment_failed", `{"id": "pi_stub_1", "object": "payment_intent", "status": "requires_payment_method",
+		"last_payment_error": {"type": "card_error", "code": "card_declined", "message": "Your card was declined."}}`)
+	if err := service.HandleCallback(context.Background(), &models.PaymentCallback{GatewayID: 1, RawPayload: failed}); err != nil {
+		t.Fatalf("Expected the event to be acknowledged, got error: %v", err)
+	}
+	if status := mockRepo.transactions[1].Status; status != db.StatusPending {
+		t.Fatalf("Expected the deposit to stay pending, got %s", status)
+	}
+
+	succeeded := stripeEvent("payment_intent.succeeded", `{"id": "pi_stub_1", "object": "payment_intent", "status": "succeeded"}`)
+	if err := service.HandleCallback(context.Background(), &models.PaymentCallback{GatewayID: 1, RawPayload: succeeded}); err != nil {
+		t.Fatalf("Expected successful callback handling, got error: %v", err)
+	}
+	if status := mockRepo.transactions[1].Status; status != db.StatusCompleted {
+		t.Errorf("Expected the deposit to be completed, got %s", status)
+	}
+	assertBalances(t, service, 110000, 0)
+}
+
+func TestStripeGateway_RefusesWithdrawals(t *testing.T) {
+	service, mockRepo, server := setupStripe(t)
+	checked, _ := getGatewayImplementation("stripe")
+	GetPaymentGateway = func(ctx context.Context, countryId int, gatewayId int) (PaymentGateway, error) {
+		return checked, nil
+	}
+
+	// Users have no payout destination with Stripe, a payout would go to our own bank account.
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	_, err := service.Withdraw(context.Background(), req)
+	if serviceErr, ok := err.(*models.ServiceError); !ok || serviceErr.Reason != ReasonOperationNotSupported {
+		t.Fatalf("Expected the withdrawal to be refused, got %v", err)
+	}
+	if len(mockRepo.transactions) != 0 || len(server.Requests()) != 0 {
+		t.Errorf("Expected nothing to be saved or sent to Stripe, got %d transactions and %d requests", len(mockRepo.transactions), len(server.Requests()))
+	}
+}
+
+func TestStripeGateway_WebhookNotAnEvent(t *testing.T) {
+	service, _, _ := setupStripe(t)
+
+	err := service.HandleCallback(context.Background(), &models.PaymentCallback{GatewayID: 1, RawPayload: []byte(`{"gateway_txn_id": "pi_stub_1", "status": "completed"}`)})
+	if serviceErr, ok := err.(*models.ServiceError); !ok || serviceErr.Code != models.ErrorCodeValidation {
+		t.Errorf("Expected validation error, got: %v", err)
+	}
+}
+
+func TestStripeGateway_DeclinedCard(t *testing.T) {
+	service, mockRepo, server := setupStripe(t)
+	server.Fail(stripetest.Failure{Status: http.StatusPaymentRequired, Type: stripe.ErrorTypeCard, Code: "card_declined", DeclineCode: "insufficient_funds", Message: "Your card has insufficient funds."})
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	_, err := service.Deposit(context.Background(), req)
+	serviceErr, ok := err.(*models.ServiceError)
+	if !ok || serviceErr.Code != models.ErrorCodePaymentDeclined || serviceErr.Reason != "insufficient_funds" {
+		t.Fatalf("Expected the decline to be returned, got %v", err)
+	}
+	if len(server.Requests()) != 1 {
+		t.Errorf("Expected a declined card not to be retried, got %d requests", len(server.Requests()))
+	}
+	if status := mockRepo.transactions[1].Status; status != db.StatusFailed {
+		t.Errorf("Expected the deposit to be failed, got %s", status)
+	}
+}
+
+func TestStripeGateway_RetriesWithSameIdempotencyKey(t *testing.T) {
+	service, mockRepo, server := setupStripe(t)
+	server.Fail(stripetest.Failure{Status: http.StatusInternalServerError, Type: stripe.ErrorTypeAPI})
+
+	req := &models.TransactionRequest{Amount: 10000, Currency: "USD", GatewayID: 1, CountryID: 840, UserID: 1}
+	if _, err := service.Deposit(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	requests := server.Requests()
+	if len(requests) != 2 || requests[0].IdempotencyKey != "deposit-1" || requests[1].IdempotencyKey != "deposit-1" {
+		t.Errorf("Expected the payment intent to be retried with the same key, got %+v", requests)
+	}
+	if trx := mockRepo.transactions[1]; trx.GatewayTxnId != "pi_stub_1" {
+		t.Errorf("Expected the payment intent of the retry, got %q", trx.GatewayTxnId)
+	}
+}
+
+func TestStripeGateway_Refund(t *testing.T) {
+	server := stripetest.NewServer()
+	defer server.Close()
+	gateway := &StripeGateway{client: stripe.NewClient(stripe.Config{BaseURL: server.URL, APIKey: stripetest.APIKey})}
+
+	parent := &db.Transaction{ID: 4, GatewayTxnId: "pi_stub_9", Type: db.TypeDeposit}
+	refund := &db.Transaction{ID: 5, Type: db.TypeRefund, Amount: models.Money{Minor: 2500, Currency: "USD"}}
+	result, err := gateway.Refund(context.Background(), refund, parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := server.Requests()[0]
+	if result.GatewayTxnId != "re_stub_1" || sent.IdempotencyKey != "refund-5" || sent.Form.Get("payment_intent") != "pi_stub_9" {
+		t.Errorf("Unexpected refund %+v for request %+v", result, sent)
+	}
+}
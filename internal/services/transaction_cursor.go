@@ -0,0 +1,38 @@
+package services
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"payment-gateway/db"
+)
+
+// encodeCursor turns the position of the last transaction of a page into an opaque cursor,
+// so clients can't rely on what's inside.
+func encodeCursor(trx *db.Transaction) string {
+	raw := strconv.FormatInt(trx.CreatedAt.UnixMicro(), 10) + ":" + strconv.Itoa(trx.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(cursor string) (*db.TransactionCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	micros, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil || id <= 0 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &db.TransactionCursor{CreatedAt: time.UnixMicro(micros).UTC(), ID: id}, nil
+}
@@ -0,0 +1,61 @@
+package services
+
+import (
+	"time"
+
+	"payment-gateway/db"
+	"payment-gateway/internal/ledger"
+)
+
+// WithdrawalHoldTTL is how long the amount of a withdrawal or refund stays held. Those that haven't
+// settled by then give the amount back to the user, see ledger.HoldSweeper.
+var WithdrawalHoldTTL = 72 * time.Hour
+
+// withLedger adds the ledger effects of a status change of the transaction to effects.
+//
+//	deposit:          completed                -> credit the user
+//	withdraw, refund: initiated                -> hold the amount
+//	                  completed                -> capture the hold
+//	                  failed, reversed         -> release the hold
+//	any:              completed -> reversed    -> undo the completed entry
+//
+// A refund gives back money the user may have spent or withdrawn since, so it is held like a withdrawal.
+func withLedger(effects *db.Effects, trx *db.Transaction, change *db.TransactionEvent) *db.Effects {
+	currency := trx.Amount.Currency
+	available := ledger.UserAvailable(trx.UserID, currency)
+	clearing := ledger.GatewayClearing(trx.GatewayID, currency)
+	amount := trx.Amount.Minor
+	reversed := change.FromStatus == db.StatusCompleted && change.ToStatus == db.StatusReversed
+
+	switch trx.Type {
+	case db.TypeDeposit:
+		switch {
+		case change.ToStatus == db.StatusCompleted:
+			effects.Journal = append(effects.Journal, ledger.Transfer(ledger.KindDeposit, trx.ID, clearing, available, amount))
+		case reversed:
+			effects.Journal = append(effects.Journal, ledger.Transfer(ledger.KindReversal, trx.ID, available, clearing, amount))
+		}
+	case db.TypeWithdraw, db.TypeRefund:
+		kind := ledger.KindWithdrawal
+		if trx.Type == db.TypeRefund {
+			kind = ledger.KindRefund
+		}
+		switch {
+		case change.FromStatus == "" && change.ToStatus == db.StatusInitiated:
+			effects.Holds = append(effects.Holds, &ledger.Hold{
+				TransactionID: trx.ID,
+				UserID:        trx.UserID,
+				Currency:      currency,
+				Amount:        amount,
+				ExpiresAt:     time.Now().Add(WithdrawalHoldTTL),
+			})
+		case change.ToStatus == db.StatusCompleted:
+			effects.Settlements = append(effects.Settlements, &ledger.Settlement{TransactionID: trx.ID, Capture: true, Counterparty: clearing, Kind: kind})
+		case reversed:
+			effects.Journal = append(effects.Journal, ledger.Transfer(ledger.KindReversal, trx.ID, clearing, available, amount))
+		case change.ToStatus == db.StatusFailed || change.ToStatus == db.StatusReversed:
+			effects.Settlements = append(effects.Settlements, &ledger.Settlement{TransactionID: trx.ID})
+		}
+	}
+	return effects
+}
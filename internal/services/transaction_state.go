@@ -0,0 +1,157 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"payment-gateway/db"
+)
+
+// Sources of a status change, stored with every transition.
+const (
+	SourceAPI        = "api"
+	SourceGateway    = "gateway"
+	SourceCallback   = "callback"
+	SourceReconciler = "reconciler"
+	SourceCompliance = "compliance"
+	SourceReview     = "review"
+)
+
+var (
+	ErrUnknownStatus     = errors.New("unknown transaction status")
+	ErrInvalidTransition = errors.New("invalid status transition")
+	// ErrStaleTransition means the transaction has already moved past the requested status,
+	// e.g. an "authorized" callback that arrives after the "completed" one.
+	ErrStaleTransition = errors.New("stale status transition")
+)
+
+// transactionTransitions lists, for every type of transaction, the statuses it can move to from each status.
+// Only these moves are allowed, a status can only be skipped where the skip is listed.
+//
+//	initiated ---------> pending -> authorized -> completed -> refunded
+//	    |    \            ^  |           |             |
+//	    |     +-> review -+  |           |             |
+//	    |           |        |           |             |
+//	    +-----------+--------+-----------+-> failed    +-> reversed
+//	                                     +-> reversed
+//
+// pending -> completed skips authorized, for gateways that capture the payment at once.
+// review holds transactions flagged by the compliance checks or a limit until an operator
+// approves them, which sends them to the gateway, or rejects them.
+// Only deposits can be refunded. Refunds themselves go straight to the gateway, they are
+// never reviewed or authorized separately.
+// failed, refunded and reversed are terminal.
+var transactionTransitions = map[string]map[string][]string{
+	db.TypeDeposit: {
+		db.StatusInitiated:  {db.StatusPending, db.StatusReview, db.StatusFailed},
+		db.StatusReview:     {db.StatusPending, db.StatusFailed},
+		db.StatusPending:    {db.StatusAuthorized, db.StatusCompleted, db.StatusFailed},
+		db.StatusAuthorized: {db.StatusCompleted, db.StatusFailed, db.StatusReversed},
+		db.StatusCompleted:  {db.StatusRefunded, db.StatusReversed},
+		db.StatusFailed:     {},
+		db.StatusRefunded:   {},
+		db.StatusReversed:   {},
+	},
+	db.TypeWithdraw: {
+		db.StatusInitiated:  {db.StatusPending, db.StatusReview, db.StatusFailed},
+		db.StatusReview:     {db.StatusPending, db.StatusFailed},
+		db.StatusPending:    {db.StatusAuthorized, db.StatusCompleted, db.StatusFailed},
+		db.StatusAuthorized: {db.StatusCompleted, db.StatusFailed, db.StatusReversed},
+		db.StatusCompleted:  {db.StatusReversed},
+		db.StatusFailed:     {},
+		db.StatusReversed:   {},
+	},
+	db.TypeRefund: {
+		db.StatusInitiated: {db.StatusPending, db.StatusFailed},
+		db.StatusPending:   {db.StatusCompleted, db.StatusFailed},
+		db.StatusCompleted: {db.StatusReversed},
+		db.StatusFailed:    {},
+		db.StatusReversed:  {},
+	},
+}
+
+// IsKnownStatus reports whether transactions of any type can be in this status.
+func IsKnownStatus(status string) bool {
+	for _, transitions := range transactionTransitions {
+		if _, ok := transitions[status]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTerminalStatus reports whether a transaction in this status can't change anymore.
+func IsTerminalStatus(status string) bool {
+	if !IsKnownStatus(status) {
+		return false
+	}
+	for _, transitions := range transactionTransitions {
+		if len(transitions[status]) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validateTransition checks that a transaction of the given type can move from one status to another.
+func validateTransition(transactionType, from, to string) error {
+	if !IsKnownStatus(to) {
+		return fmt.Errorf("%w %q", ErrUnknownStatus, to)
+	}
+	if !IsKnownStatus(from) {
+		return fmt.Errorf("%w %q", ErrUnknownStatus, from)
+	}
+	transitions, ok := transactionTransitions[transactionType]
+	if !ok {
+		return fmt.Errorf("%w: unknown transaction type %q", ErrInvalidTransition, transactionType)
+	}
+	if slices.Contains(transitions[from], to) {
+		return nil
+	}
+	if canReach(transitions, to, from) {
+		return fmt.Errorf("%w: transaction is already %s", ErrStaleTransition, from)
+	}
+	return fmt.Errorf("%w from %s to %s of a %s", ErrInvalidTransition, from, to, transactionType)
+}
+
+// canReach reports whether to can be reached from from in one or more transitions. It only tells
+// whether a transaction has already moved past a status, a transition has to be listed itself.
+func canReach(transitions map[string][]string, from, to string) bool {
+	for _, next := range transitions[from] {
+		if next == to || canReach(transitions, next, to) {
+			return true
+		}
+	}
+	return false
+}
+
+// transition moves the transaction to a new status and returns the record of the change,
+// to be saved together with the transaction.
+func transition(trx *db.Transaction, to, reason, source string) (*db.TransactionEvent, error) {
+	if err := validateTransition(trx.Type, trx.Status, to); err != nil {
+		return nil, err
+	}
+
+	record := &db.TransactionEvent{
+		TransactionID: trx.ID,
+		FromStatus:    trx.Status,
+		ToStatus:      to,
+		Reason:        reason,
+		Source:        source,
+		CreatedAt:     time.Now(),
+	}
+	trx.Status = to
+	return record, nil
+}
+
+// initialTransition is the record of the status a new transaction is created with.
+func initialTransition(trx *db.Transaction, reason string) *db.TransactionEvent {
+	return &db.TransactionEvent{
+		ToStatus:  trx.Status,
+		Reason:    reason,
+		Source:    SourceAPI,
+		CreatedAt: time.Now(),
+	}
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"payment-gateway/db"
+)
+
+func TestValidateTransition(t *testing.T) {
+	tests := []struct {
+		transactionType, from, to string
+		expected                  error
+	}{
+		{db.TypeDeposit, db.StatusInitiated, db.StatusPending, nil},
+		{db.TypeDeposit, db.StatusInitiated, db.StatusFailed, nil},
+		{db.TypeDeposit, db.StatusPending, db.StatusAuthorized, nil},
+		{db.TypeDeposit, db.StatusAuthorized, db.StatusCompleted, nil},
+		{db.TypeDeposit, db.StatusAuthorized, db.StatusReversed, nil},
+		{db.TypeDeposit, db.StatusCompleted, db.StatusRefunded, nil},
+		{db.TypeDeposit, db.StatusCompleted, db.StatusReversed, nil},
+		{db.TypeWithdraw, db.StatusReview, db.StatusPending, nil},
+		{db.TypeWithdraw, db.StatusCompleted, db.StatusReversed, nil},
+		{db.TypeRefund, db.StatusPending, db.StatusCompleted, nil},
+		// The gateway captured at once, authorized is the one status that can be skipped.
+		{db.TypeDeposit, db.StatusPending, db.StatusCompleted, nil},
+
+		{db.TypeDeposit, db.StatusCompleted, db.StatusPending, ErrStaleTransition},
+		{db.TypeDeposit, db.StatusCompleted, db.StatusAuthorized, ErrStaleTransition},
+		{db.TypeDeposit, db.StatusRefunded, db.StatusCompleted, ErrStaleTransition},
+
+		// Statuses can't be skipped otherwise.
+		{db.TypeDeposit, db.StatusInitiated, db.StatusCompleted, ErrInvalidTransition},
+		{db.TypeDeposit, db.StatusPending, db.StatusRefunded, ErrInvalidTransition},
+		{db.TypeDeposit, db.StatusInitiated, db.StatusReversed, ErrInvalidTransition},
+		// Nor can a transaction take a status of another type.
+		{db.TypeWithdraw, db.StatusPending, db.StatusRefunded, ErrInvalidTransition},
+		{db.TypeWithdraw, db.StatusCompleted, db.StatusRefunded, ErrInvalidTransition},
+		{db.TypeRefund, db.StatusInitiated, db.StatusReview, ErrInvalidTransition},
+		{db.TypeRefund, db.StatusPending, db.StatusAuthorized, ErrInvalidTransition},
+		{"transfer", db.StatusInitiated, db.StatusPending, ErrInvalidTransition},
+
+		{db.TypeDeposit, db.StatusFailed, db.StatusCompleted, ErrInvalidTransition},
+		{db.TypeDeposit, db.StatusReversed, db.StatusRefunded, ErrInvalidTransition},
+		{db.TypeDeposit, db.StatusPending, db.StatusRefunded + "x", ErrUnknownStatus},
+		{db.TypeDeposit, db.StatusPending, "banana", ErrUnknownStatus},
+	}
+
+	for _, test := range tests {
+		err := validateTransition(test.transactionType, test.from, test.to)
+		if test.expected == nil && err != nil {
+			t.Errorf("Expected %s %s -> %s to be allowed, got: %v", test.transactionType, test.from, test.to, err)
+		}
+		if test.expected != nil && !errors.Is(err, test.expected) {
+			t.Errorf("Expected %s %s -> %s to fail with %v, got: %v", test.transactionType, test.from, test.to, test.expected, err)
+		}
+	}
+}
+
+func TestIsTerminalStatus(t *testing.T) {
+	for _, transitions := range transactionTransitions {
+		for status := range transitions {
+			terminal := status == db.StatusFailed || status == db.StatusRefunded || status == db.StatusReversed
+			if IsTerminalStatus(status) != terminal {
+				t.Errorf("Expected IsTerminalStatus(%s) to be %v", status, terminal)
+			}
+		}
+	}
+	if IsTerminalStatus("banana") {
+		t.Error("Expected an unknown status not to be terminal")
+	}
+}
@@ -0,0 +1,60 @@
+package stripe
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Kinds of the objects an event can be about, the object field of the object.
+const (
+	ObjectPaymentIntent = "payment_intent"
+	ObjectPayout        = "payout"
+	ObjectRefund        = "refund"
+)
+
+// Event is a webhook event. Stripe sends the object the event is about, as it is after the event, in data.object.
+type Event struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object EventObject `json:"object"`
+	} `json:"data"`
+}
+
+// EventObject is the part of the PaymentIntent, Payout or Refund of an event we use.
+type EventObject struct {
+	ID string `json:"id"`
+	// Object is the kind of the object, e.g. ObjectPaymentIntent.
+	Object string `json:"object"`
+	Status string `json:"status"`
+	// Why the last payment attempt of a PaymentIntent failed.
+	LastPaymentError *Error `json:"last_payment_error"`
+	// Why a payout failed.
+	FailureMessage string `json:"failure_message"`
+	// Why a refund failed.
+	FailureReason string `json:"failure_reason"`
+}
+
+// ParseEvent decodes the body of a webhook. It doesn't check the Stripe-Signature header, that is done before.
+func ParseEvent(body []byte) (*Event, error) {
+	event := &Event{}
+	if err := json.Unmarshal(body, event); err != nil {
+		return nil, fmt.Errorf("failed to decode stripe event: %v", err)
+	}
+	if event.Type == "" || event.Data.Object.ID == "" {
+		return nil, errors.New("not a stripe event")
+	}
+	return event, nil
+}
+
+// Failure returns why the object failed, if Stripe said so.
+func (o *EventObject) Failure() string {
+	switch {
+	case o.LastPaymentError != nil:
+		return o.LastPaymentError.Message
+	case o.FailureMessage != "":
+		return o.FailureMessage
+	}
+	return o.FailureReason
+}
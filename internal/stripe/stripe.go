@@ -0,0 +1,254 @@
+package stripe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultBaseURL = "https://api.stripe.com"
+	// DefaultVersion is the API version the client was written against, it is sent with every request
+	// so a change of the account's default version doesn't change the responses under us.
+	DefaultVersion = "2024-06-20"
+)
+
+// Types of the errors returned by Stripe.
+const (
+	ErrorTypeAPI            = "api_error"
+	ErrorTypeCard           = "card_error"
+	ErrorTypeIdempotency    = "idempotency_error"
+	ErrorTypeInvalidRequest = "invalid_request_error"
+	ErrorTypeAuthentication = "authentication_error"
+	ErrorTypePermission     = "permission_error"
+	ErrorTypeRateLimit      = "rate_limit_error"
+)
+
+// Config is where and as who the client talks to Stripe.
+type Config struct {
+	BaseURL string
+	APIKey  string
+	// Version is sent in the Stripe-Version header.
+	Version    string
+	HTTPClient *http.Client
+}
+
+// LoadConfig reads the Stripe configuration from the environment.
+func LoadConfig() Config {
+	return Config{
+		BaseURL: os.Getenv("STRIPE_API_BASE_URL"),
+		APIKey:  os.Getenv("STRIPE_API_KEY"),
+		Version: os.Getenv("STRIPE_API_VERSION"),
+	}
+}
+
+// Client calls the PaymentIntents, Payouts and Refunds endpoints of the Stripe API.
+type Client struct {
+	baseURL string
+	apiKey  string
+	version string
+	http    *http.Client
+}
+
+func NewClient(cfg Config) *Client {
+	c := &Client{
+		baseURL: strings.TrimSuffix(cfg.BaseURL, "/"),
+		apiKey:  cfg.APIKey,
+		version: cfg.Version,
+		http:    cfg.HTTPClient,
+	}
+	if c.baseURL == "" {
+		c.baseURL = DefaultBaseURL
+	}
+	if c.version == "" {
+		c.version = DefaultVersion
+	}
+	if c.http == nil {
+		// The caller's context bounds every request, this only catches a context without a deadline.
+		c.http = &http.Client{Timeout: time.Minute}
+	}
+	return c
+}
+
+// PaymentIntent is the part of a Stripe PaymentIntent we use.
+type PaymentIntent struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+	// ClientSecret is what the user's browser or app confirms the payment with, using Stripe.js or a mobile SDK.
+	ClientSecret string `json:"client_secret"`
+}
+
+// Payout is the part of a Stripe Payout we use.
+type Payout struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// Refund is the part of a Stripe Refund we use.
+type Refund struct {
+	ID            string `json:"id"`
+	Status        string `json:"status"`
+	Amount        int64  `json:"amount"`
+	Currency      string `json:"currency"`
+	PaymentIntent string `json:"payment_intent"`
+}
+
+// Params of a request. Amounts are in the smallest unit of the currency, like models.Money.
+type PaymentIntentParams struct {
+	Amount   int64
+	Currency string
+	Metadata map[string]string
+}
+
+type PayoutParams struct {
+	Amount   int64
+	Currency string
+	Metadata map[string]string
+}
+
+type RefundParams struct {
+	PaymentIntent string
+	Amount        int64
+	Metadata      map[string]string
+}
+
+// CreatePaymentIntent creates a payment the user then confirms with Stripe, using the client secret of the
+// intent. Its outcome comes back as a webhook.
+func (c *Client) CreatePaymentIntent(ctx context.Context, params *PaymentIntentParams, idempotencyKey string) (*PaymentIntent, error) {
+	form := url.Values{}
+	form.Set("amount", strconv.FormatInt(params.Amount, 10))
+	form.Set("currency", strings.ToLower(params.Currency))
+	form.Set("automatic_payment_methods[enabled]", "true")
+	setMetadata(form, params.Metadata)
+
+	intent := &PaymentIntent{}
+	if err := c.post(ctx, "/v1/payment_intents", form, idempotencyKey, intent); err != nil {
+		return nil, err
+	}
+	return intent, nil
+}
+
+// CreatePayout sends money from the Stripe balance out to a bank account.
+func (c *Client) CreatePayout(ctx context.Context, params *PayoutParams, idempotencyKey string) (*Payout, error) {
+	form := url.Values{}
+	form.Set("amount", strconv.FormatInt(params.Amount, 10))
+	form.Set("currency", strings.ToLower(params.Currency))
+	setMetadata(form, params.Metadata)
+
+	payout := &Payout{}
+	if err := c.post(ctx, "/v1/payouts", form, idempotencyKey, payout); err != nil {
+		return nil, err
+	}
+	return payout, nil
+}
+
+// CreateRefund gives back part or all of a PaymentIntent.
+func (c *Client) CreateRefund(ctx context.Context, params *RefundParams, idempotencyKey string) (*Refund, error) {
+	form := url.Values{}
+	form.Set("payment_intent", params.PaymentIntent)
+	form.Set("amount", strconv.FormatInt(params.Amount, 10))
+	setMetadata(form, params.Metadata)
+
+	refund := &Refund{}
+	if err := c.post(ctx, "/v1/refunds", form, idempotencyKey, refund); err != nil {
+		return nil, err
+	}
+	return refund, nil
+}
+
+func setMetadata(form url.Values, metadata map[string]string) {
+	for key, value := range metadata {
+		form.Set("metadata["+key+"]", value)
+	}
+}
+
+// post sends a form encoded request, like every write to the Stripe API, and decodes the response into out.
+// The idempotency key makes Stripe answer a retried request with the result of the first one.
+func (c *Client) post(ctx context.Context, path string, form url.Values, idempotencyKey string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Stripe-Version", c.version)
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return parseError(resp, body)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to decode stripe response: %v", err)
+	}
+	return nil
+}
+
+// Error is an error response of the Stripe API.
+type Error struct {
+	HTTPStatus  int    `json:"-"`
+	RequestID   string `json:"-"`
+	Type        string `json:"type"`
+	Code        string `json:"code"`
+	DeclineCode string `json:"decline_code"`
+	Message     string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("stripe %s (%s): %s", e.Type, e.Code, e.Message)
+	}
+	return fmt.Sprintf("stripe %s: %s", e.Type, e.Message)
+}
+
+// Retryable follows Stripe's advice: errors on their side, rate limits and lock timeouts can be retried
+// with the same idempotency key, everything else will fail the same way again.
+func (e *Error) Retryable() bool {
+	switch {
+	case e.Type == ErrorTypeAPI, e.Type == ErrorTypeRateLimit:
+		return true
+	case e.HTTPStatus == http.StatusTooManyRequests, e.HTTPStatus >= 500:
+		return true
+	case e.Code == "lock_timeout":
+		return true
+	}
+	return false
+}
+
+func parseError(resp *http.Response, body []byte) error {
+	var envelope struct {
+		Error *Error `json:"error"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil || envelope.Error == nil {
+		// Not an answer of the API, e.g. a proxy in between. Only worth retrying when it is on their side.
+		envelope.Error = &Error{Type: ErrorTypeInvalidRequest, Message: http.StatusText(resp.StatusCode)}
+		if resp.StatusCode >= 500 {
+			envelope.Error.Type = ErrorTypeAPI
+		}
+	}
+	envelope.Error.HTTPStatus = resp.StatusCode
+	envelope.Error.RequestID = resp.Header.Get("Request-Id")
+	return envelope.Error
+}
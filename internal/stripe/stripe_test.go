@@ -0,0 +1,123 @@
+package stripe
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"payment-gateway/internal/stripe/stripetest"
+)
+
+func newTestClient(t *testing.T) (*Client, *stripetest.Server) {
+	server := stripetest.NewServer()
+	t.Cleanup(server.Close)
+	return NewClient(Config{BaseURL: server.URL, APIKey: stripetest.APIKey}), server
+}
+
+func TestClient_CreatePaymentIntent(t *testing.T) {
+	client, server := newTestClient(t)
+
+	params := &PaymentIntentParams{Amount: 1050, Currency: "USD", Metadata: map[string]string{"transaction_id": "7"}}
+	intent, err := client.CreatePaymentIntent(context.Background(), params, "deposit-7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if intent.ID == "" || intent.ClientSecret == "" || intent.Amount != 1050 || intent.Currency != "usd" {
+		t.Errorf("Unexpected payment intent %+v", intent)
+	}
+
+	req := server.Requests()[0]
+	if req.Path != "/v1/payment_intents" || req.IdempotencyKey != "deposit-7" || req.Version != DefaultVersion {
+		t.Errorf("Unexpected request %+v", req)
+	}
+	if req.Form.Get("metadata[transaction_id]") != "7" || req.Form.Get("currency") != "usd" {
+		t.Errorf("Unexpected form %v", req.Form)
+	}
+}
+
+func TestClient_IdempotentRetry(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	params := &PayoutParams{Amount: 500, Currency: "EUR"}
+	first, err := client.CreatePayout(context.Background(), params, "withdraw-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := client.CreatePayout(context.Background(), params, "withdraw-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != second.ID {
+		t.Errorf("Expected the retry to get the same payout, got %s and %s", first.ID, second.ID)
+	}
+
+	params.Amount = 600
+	_, err = client.CreatePayout(context.Background(), params, "withdraw-3")
+	var stripeErr *Error
+	if !errors.As(err, &stripeErr) || stripeErr.Type != ErrorTypeIdempotency {
+		t.Errorf("Expected an idempotency error for other parameters, got %v", err)
+	}
+}
+
+func TestClient_Errors(t *testing.T) {
+	tests := []struct {
+		name      string
+		failure   stripetest.Failure
+		retryable bool
+	}{
+		{"declined card", stripetest.Failure{Status: http.StatusPaymentRequired, Type: ErrorTypeCard, Code: "card_declined", DeclineCode: "insufficient_funds"}, false},
+		{"invalid request", stripetest.Failure{Status: http.StatusBadRequest, Type: ErrorTypeInvalidRequest, Code: "amount_too_small"}, false},
+		{"stripe is down", stripetest.Failure{Status: http.StatusInternalServerError, Type: ErrorTypeAPI}, true},
+		{"rate limited", stripetest.Failure{Status: http.StatusTooManyRequests, Type: ErrorTypeRateLimit, Code: "rate_limit"}, true},
+		{"lock timeout", stripetest.Failure{Status: http.StatusConflict, Type: ErrorTypeInvalidRequest, Code: "lock_timeout"}, true},
+	}
+	for _, tt := range tests {
+		client, server := newTestClient(t)
+		server.Fail(tt.failure)
+
+		_, err := client.CreatePaymentIntent(context.Background(), &PaymentIntentParams{Amount: 100, Currency: "usd"}, "")
+		var stripeErr *Error
+		if !errors.As(err, &stripeErr) {
+			t.Fatalf("%s: expected a stripe error, got %v", tt.name, err)
+		}
+		if stripeErr.Type != tt.failure.Type || stripeErr.Code != tt.failure.Code || stripeErr.HTTPStatus != tt.failure.Status {
+			t.Errorf("%s: unexpected error %+v", tt.name, stripeErr)
+		}
+		if stripeErr.Retryable() != tt.retryable {
+			t.Errorf("%s: expected retryable to be %v", tt.name, tt.retryable)
+		}
+	}
+}
+
+func TestClient_InvalidAPIKey(t *testing.T) {
+	client, _ := newTestClient(t)
+	client.apiKey = "sk_test_wrong"
+
+	_, err := client.CreateRefund(context.Background(), &RefundParams{PaymentIntent: "pi_1", Amount: 100}, "refund-1")
+	var stripeErr *Error
+	if !errors.As(err, &stripeErr) || stripeErr.Type != ErrorTypeAuthentication || stripeErr.Retryable() {
+		t.Errorf("Expected a final authentication error, got %v", err)
+	}
+}
+
+func TestParseEvent(t *testing.T) {
+	body := `{"id": "evt_1", "object": "event", "type": "payment_intent.payment_failed", "data": {"object": {
+		"id": "pi_1", "object": "payment_intent", "status": "requires_payment_method",
+		"last_payment_error": {"type": "card_error", "code": "card_declined", "message": "Your card was declined."}}}}`
+	event, err := ParseEvent([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	object := event.Data.Object
+	if event.Type != "payment_intent.payment_failed" || object.ID != "pi_1" || object.Object != ObjectPaymentIntent || object.Status != "requires_payment_method" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	if object.Failure() != "Your card was declined." {
+		t.Errorf("Expected the message of the payment error, got %q", object.Failure())
+	}
+
+	if _, err := ParseEvent([]byte(`{"gateway_txn_id": "pi_1", "status": "completed"}`)); err == nil {
+		t.Error("Expected a body without an event to be rejected")
+	}
+}
@@ -0,0 +1,162 @@
+package stripetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+// APIKey is the key the stub accepts.
+const APIKey = "sk_test_stub"
+
+// Request is a request the stub received.
+type Request struct {
+	Path           string
+	IdempotencyKey string
+	Version        string
+	Form           url.Values
+}
+
+// Failure is an error the stub answers the next request with.
+type Failure struct {
+	Status      int
+	Type        string
+	Code        string
+	DeclineCode string
+	Message     string
+}
+
+// Server is a local stand-in for the Stripe API, answering PaymentIntents, Payouts and Refunds like Stripe does:
+// form encoded requests, a bearer API key and idempotency keys that replay the first answer.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []Request
+	failures []Failure
+	// responses by idempotency key, with the form they were created from
+	responses map[string]storedResponse
+	lastID    int
+}
+
+type storedResponse struct {
+	form   string
+	status int
+	body   []byte
+}
+
+func NewServer() *Server {
+	s := &Server{responses: make(map[string]storedResponse)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/payment_intents", s.handle("pi", "requires_payment_method"))
+	mux.HandleFunc("/v1/payouts", s.handle("po", "pending"))
+	mux.HandleFunc("/v1/refunds", s.handle("re", "pending"))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Fail makes the stub answer the next requests with the failures, one each, in order.
+func (s *Server) Fail(failures ...Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, failures...)
+}
+
+// Requests returns the requests received so far, replays included.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+func (s *Server) handle(prefix string, status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, Failure{Status: http.StatusMethodNotAllowed, Type: "invalid_request_error", Message: "only POST is supported by the stub"})
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+APIKey {
+			writeError(w, Failure{Status: http.StatusUnauthorized, Type: "authentication_error", Message: "Invalid API Key provided"})
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			writeError(w, Failure{Status: http.StatusBadRequest, Type: "invalid_request_error", Message: err.Error()})
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		key := r.Header.Get("Idempotency-Key")
+		s.requests = append(s.requests, Request{Path: r.URL.Path, IdempotencyKey: key, Version: r.Header.Get("Stripe-Version"), Form: r.PostForm})
+
+		form := r.PostForm.Encode()
+		if stored, ok := s.responses[key]; ok && key != "" {
+			if stored.form != form {
+				writeError(w, Failure{Status: http.StatusBadRequest, Type: "idempotency_error", Message: "Keys for idempotent requests can only be used with the same parameters they were first used with."})
+				return
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			writeJSON(w, stored.status, stored.body)
+			return
+		}
+
+		if len(s.failures) > 0 {
+			failure := s.failures[0]
+			s.failures = s.failures[1:]
+			writeError(w, failure)
+			return
+		}
+
+		amount, err := strconv.ParseInt(r.PostForm.Get("amount"), 10, 64)
+		if err != nil || amount <= 0 {
+			writeError(w, Failure{Status: http.StatusBadRequest, Type: "invalid_request_error", Code: "parameter_invalid_integer", Message: "Invalid positive integer"})
+			return
+		}
+
+		s.lastID++
+		object := map[string]interface{}{
+			"id":       fmt.Sprintf("%s_stub_%d", prefix, s.lastID),
+			"status":   status,
+			"amount":   amount,
+			"currency": r.PostForm.Get("currency"),
+		}
+		if intent := r.PostForm.Get("payment_intent"); intent != "" {
+			object["payment_intent"] = intent
+		}
+		if prefix == "pi" {
+			object["client_secret"] = object["id"].(string) + "_secret_stub"
+		}
+		body, _ := json.Marshal(object)
+		if key != "" {
+			s.responses[key] = storedResponse{form: form, status: http.StatusOK, body: body}
+		}
+		writeJSON(w, http.StatusOK, body)
+	}
+}
+
+func writeError(w http.ResponseWriter, failure Failure) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]string{
+			"type":         failure.Type,
+			"code":         failure.Code,
+			"decline_code": failure.DeclineCode,
+			"message":      failure.Message,
+		},
+	})
+	status := failure.Status
+	if status == 0 {
+		status = http.StatusPaymentRequired
+	}
+	writeJSON(w, status, body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Request-Id", "req_stub")
+	w.WriteHeader(status)
+	w.Write(body)
+}
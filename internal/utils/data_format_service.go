@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"payment-gateway/internal/models"
+	"strings"
 )
 
 // decodes the incoming request based on content type
@@ -26,6 +27,38 @@ func DecodeRequest(r *http.Request, request *models.TransactionRequest) error {
 }
 
 func DecodeCallbackRequest(r *http.Request, request *models.PaymentCallback) error {
+	// Gateways like Stripe and PayPal send "application/json; charset=utf-8".
+	contentType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	contentType = strings.TrimSpace(contentType)
+
+	switch contentType {
+	case "application/json":
+		return json.NewDecoder(r.Body).Decode(request)
+	case "text/xml":
+		return xml.NewDecoder(r.Body).Decode(request)
+	case "application/xml":
+		return xml.NewDecoder(r.Body).Decode(request)
+	default:
+		return fmt.Errorf("unsupported content type")
+	}
+}
+
+func DecodeRefundRequest(r *http.Request, request *models.RefundRequest) error {
+	contentType := r.Header.Get("Content-Type")
+
+	switch contentType {
+	case "application/json":
+		return json.NewDecoder(r.Body).Decode(request)
+	case "text/xml":
+		return xml.NewDecoder(r.Body).Decode(request)
+	case "application/xml":
+		return xml.NewDecoder(r.Body).Decode(request)
+	default:
+		return fmt.Errorf("unsupported content type")
+	}
+}
+
+func DecodeReviewRequest(r *http.Request, request *models.ReviewRequest) error {
 	contentType := r.Header.Get("Content-Type")
 
 	switch contentType {
@@ -51,9 +84,33 @@ func EncodeResponse(contentType string, data interface{}) ([]byte, error) {
 	}
 }
 
+// ResponseContentType picks the format of the response. A supported type in the Accept header wins,
+// then the format of the request body, and JSON when neither says anything, e.g. for GET requests.
+func ResponseContentType(r *http.Request) string {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(accepted, ";", 2)[0])
+		if isSupportedContentType(mediaType) {
+			return mediaType
+		}
+	}
+	if contentType := r.Header.Get("Content-Type"); isSupportedContentType(contentType) {
+		return contentType
+	}
+	return "application/json"
+}
+
+func isSupportedContentType(contentType string) bool {
+	switch contentType {
+	case "application/json", "text/xml", "application/xml":
+		return true
+	default:
+		return false
+	}
+}
+
 // WriteResponse writes a response to the http.ResponseWriter
 func WriteResponse(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
-	contentType := r.Header.Get("Content-Type")
+	contentType := ResponseContentType(r)
 
 	w.Header().Set("Content-Type", contentType)
 	w.WriteHeader(status)
@@ -68,3 +125,13 @@ func WriteResponse(w http.ResponseWriter, r *http.Request, status int, data inte
 		log.Printf("Error writing response: %v", err)
 	}
 }
+
+// WriteEncodedResponse writes an already encoded body, e.g. a stored response that is replayed.
+func WriteEncodedResponse(w http.ResponseWriter, contentType string, status int, body []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+
+	if _, err := w.Write(body); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
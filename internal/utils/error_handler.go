@@ -9,10 +9,14 @@ import (
 func HandleError(err error) models.APIError {
 	statusCode := models.GetStatusCode(err)
 
-	return models.APIError{
+	apiErr := models.APIError{
 		StatusCode: statusCode,
 		Error:      err.Error(),
 	}
+	if serviceErr, ok := err.(*models.ServiceError); ok {
+		apiErr.Code = serviceErr.Reason
+	}
+	return apiErr
 }
 
 // WriteErrorResponse writes an error response to the http.ResponseWriter
@@ -1,7 +1,6 @@
 package utils
 
 import (
-	"fmt"
 	"time"
 
 	"github.com/sony/gobreaker"
@@ -22,14 +21,3 @@ func PublishWithCircuitBreaker(operation func() error) error {
 	})
 	return err
 }
-
-// Retry operation with exponential backoff
-func RetryOperation(operation func() error, maxRetries int) error {
-	for i := 0; i < maxRetries; i++ {
-		if err := operation(); err == nil {
-			return nil
-		}
-		time.Sleep(time.Duration(2^i) * time.Second)
-	}
-	return fmt.Errorf("operation failed after %d attempts", maxRetries)
-}